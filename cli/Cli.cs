@@ -64,4 +64,30 @@ internal static class Cli
         return table;
 
     }
+
+    public static Table CreateImportResultsTable(IEnumerable<ImportResult> results)
+    {
+        Table table = new();
+
+        table.AsciiBorder();
+
+        table.AddColumn("Source Title")
+            .AddColumn("Status")
+            .AddColumn("ID")
+            .AddColumn("Title")
+            .AddColumn("Messages")
+            .AddColumn("Error");
+
+        foreach (var result in results)
+        {
+            table.AddRow(
+                Markup.Escape(result.SourceTitle),
+                result.Status.ToString(),
+                result.ConversationId == 0 ? "" : result.ConversationId.ToString(),
+                Markup.Escape(result.Title),
+                result.MessageCount.ToString(),
+                Markup.Escape(result.Error));
+        }
+        return table;
+    }
 }
\ No newline at end of file
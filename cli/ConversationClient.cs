@@ -78,7 +78,7 @@ internal class ConversationClient : IDisposable
         };
         var requestBytes = request.ToByteArray();
         var token = ConfigurationManager.EnsureToken();
-        var requestMessage = new HttpRequestMessage(HttpMethod.Post, $"/conversations/{conversationId}/messages")
+        var requestMessage = new HttpRequestMessage(HttpMethod.Post, $"/conversations/{conversationId}/messages?reply=false")
         {
             Content = new ByteArrayContent(requestBytes)
             {
@@ -93,6 +93,31 @@ internal class ConversationClient : IDisposable
         return Message.Parser.ParseFrom(responseStream);
     }
 
+    public async Task<ImportConversationsResponse> Import(byte[] data, ImportConversationsRequest.Types.Format format, ImportConversationsRequest.Types.ConflictPolicy onConflict)
+    {
+        ImportConversationsRequest request = new()
+        {
+            Data = ByteString.CopyFrom(data),
+            Format = format,
+            OnConflict = onConflict
+        };
+        var requestBytes = request.ToByteArray();
+        var token = ConfigurationManager.EnsureToken();
+        var requestMessage = new HttpRequestMessage(HttpMethod.Post, "/conversations/import")
+        {
+            Content = new ByteArrayContent(requestBytes)
+            {
+                Headers = { ContentType = new MediaTypeHeaderValue("application/protobuf") }
+            },
+            Headers = { Authorization = new("Bearer", token) }
+        };
+        var response = await _httpClient.SendAsync(requestMessage);
+        response.EnsureSuccessStatusCode();
+
+        var responseStream = await response.Content.ReadAsStreamAsync();
+        return ImportConversationsResponse.Parser.ParseFrom(responseStream);
+    }
+
     public async Task<Conversation> Get(string id)
     {
         var request = new HttpRequestMessage(HttpMethod.Get, $"/conversations/{id}");
@@ -27,6 +27,13 @@ var tokenOption = new Option<string>("--token", "Sets the OpenAI API token.");
 
 var messageArgument = new Argument<string>("message", "The message to send to the chat.");
 
+var fileArgument = new Argument<FileInfo>("file", "The file to import conversations from.");
+
+var formatOption = new Option<ImportConversationsRequest.Types.Format>("--format", () => ImportConversationsRequest.Types.Format.Unspecified, "The format of the file. Detected from its contents when not set.");
+formatOption.AddAlias("-f");
+
+var skipExistingOption = new Option<bool>("--skip-existing", "Skip conversations whose title is already taken instead of importing them under a new title.");
+
 Command chatCommand = new("chat", "Chat with an AI.");
 chatCommand.AddArgument(idArgument);
 chatCommand.AddOption(noInteractiveOption);
@@ -50,11 +57,18 @@ Command listChatCommand = new("list", "List all chats available on the server.")
 listChatCommand.AddAlias("ls");
 listChatCommand.SetHandler(ListChatHandler);
 
+Command importCommand = new("import", "Imports conversations from a ChatGPT data export, a JSON export or a Markdown transcript.");
+importCommand.AddArgument(fileArgument);
+importCommand.AddOption(formatOption);
+importCommand.AddOption(skipExistingOption);
+importCommand.SetHandler(ImportHandler, fileArgument, formatOption, skipExistingOption);
+
 rootCommand.AddGlobalOption(tokenOption);
 rootCommand.AddCommand(chatCommand);
 chatCommand.AddCommand(listChatCommand);
 chatCommand.AddCommand(messagesCommand);
 chatCommand.AddCommand(newChatCommand);
+chatCommand.AddCommand(importCommand);
 messagesCommand.AddCommand(listMessagesCommand);
 
 var builder = new CommandLineBuilder(rootCommand);
@@ -165,6 +179,16 @@ async Task NewChatHandler(string? title)
     AnsiConsole.Write(Cli.CreateConversationTable([conversation]));
 }
 
+async Task ImportHandler(FileInfo file, ImportConversationsRequest.Types.Format format, bool skipExisting)
+{
+    var data = await File.ReadAllBytesAsync(file.FullName);
+    var onConflict = skipExisting ? ImportConversationsRequest.Types.ConflictPolicy.Skip : ImportConversationsRequest.Types.ConflictPolicy.Rename;
+    var response = await client.Import(data, format, onConflict);
+    var imported = response.Results.Count(r => r.Status is ImportResult.Types.Status.Created or ImportResult.Types.Status.Renamed);
+    AnsiConsole.MarkupLine("Imported [bold]{0}[/] of {1} conversations.", imported, response.Results.Count);
+    AnsiConsole.Write(Cli.CreateImportResultsTable(response.Results));
+}
+
 async Task CheckToken(InvocationContext context, Func<InvocationContext, Task> next)
 {
     if (context.ParseResult.HasOption(tokenOption))
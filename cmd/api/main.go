@@ -1,42 +1,185 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	labstack "github.com/labstack/echo/v4/middleware"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/timsexperiments/chat-cli/internal/backup"
+	"github.com/timsexperiments/chat-cli/internal/config"
 	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/encryption"
 	"github.com/timsexperiments/chat-cli/internal/handlers"
 	"github.com/timsexperiments/chat-cli/internal/middleware"
+	"github.com/timsexperiments/chat-cli/internal/retention"
+	"github.com/timsexperiments/chat-cli/internal/webhooks"
+	"golang.org/x/net/http2"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			restore(os.Args[2:])
+			return
+		case "rotate-keys":
+			rotateKeys(os.Args[2:])
+			return
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command %q. Run without arguments to start the server, or use: restore, rotate-keys\n", os.Args[1])
+			os.Exit(2)
+		}
+	}
+	serve()
+}
+
+func serve() {
 	e := echo.New()
+	e.Use(labstack.RequestID())
 	e.Use(labstack.Logger())
 
 	e.HTTPErrorHandler = handlers.ErrorHandler
 
-	dbPath := "data/chat.db"
-	if _, err := os.Stat(dbPath); err != nil {
-		os.MkdirAll("data", os.ModePerm)
-		file, err := os.Create(dbPath)
-		if err != nil {
-			panic(fmt.Errorf("unable to create database file: %w", err))
-		}
-		file.Close()
-	}
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := database.Open(config.GetConfig())
 	if err != nil {
-		e.Logger.Fatal(fmt.Errorf("unable to open database: %w", err))
+		e.Logger.Fatal(err)
 	}
 	defer db.Close()
-	sqlite := database.CreateDB(db)
+	keys, err := loadKeyring()
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+	sqlite := database.CreateDB(db, keys)
+	if _, _, err := sqlite.PurgeTrash(time.Now().Add(-config.GetConfig().TrashRetention)); err != nil {
+		e.Logger.Error(fmt.Errorf("unable to purge trash: %w", err))
+	}
+	if _, err := sqlite.RecoverOrphanedMessages(); err != nil {
+		e.Logger.Error(err)
+	}
 	e.Use(middleware.ContextDB(sqlite))
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backups := backup.NewService(sqlite, config.GetConfig().BackupDir, config.GetConfig().BackupKeep)
+	if interval := config.GetConfig().BackupInterval; interval > 0 {
+		go backups.Schedule(ctx, interval, e.Logger)
+	}
+	action, err := retention.ParseAction(config.GetConfig().RetentionAction)
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+	worker := retention.NewWorker(sqlite, config.GetConfig().RetentionMaxAge, action, config.GetConfig().RetentionBatchSize, config.GetConfig().TrashRetention, config.GetConfig().RetentionFullVacuum)
+	if interval := config.GetConfig().RetentionInterval; interval > 0 {
+		go worker.Schedule(ctx, interval, e.Logger)
+	}
+	webhookWorker := webhooks.NewWorker(sqlite, config.GetConfig().WebhookTimeout, config.GetConfig().WebhookMaxAttempts)
+	if interval := config.GetConfig().WebhookInterval; interval > 0 {
+		go webhookWorker.Schedule(ctx, interval, e.Logger)
+	}
+
 	handlers.RegisterConversationsHandlers(e)
+	handlers.RegisterTrashHandlers(e)
+	handlers.RegisterTagHandlers(e)
+	handlers.RegisterFolderHandlers(e)
+	handlers.RegisterPinHandlers(e)
+	handlers.RegisterAdminHandlers(e, backups, worker, webhookWorker)
+	handlers.RegisterChatService(e)
+	handlers.RegisterOpenAIHandlers(e)
+
+	// HTTP/2 is accepted without TLS so that gRPC clients can reach
+	// ChatService, while HTTP/1.1 clients keep working as before.
+	e.Logger.Fatal(e.StartH2CServer(":8080", &http2.Server{}))
+}
+
+// restore replaces the database with a backup. It must be run while the server
+// is stopped.
+func restore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	target := flags.String("db", database.DatabaseFile(config.GetConfig().DatabaseDSN), "the database file to replace")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: restore [-db path] <backup file>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *target == "" {
+		fmt.Fprintln(os.Stderr, "an in-memory database cannot be restored. Pass the database file to replace with -db")
+		os.Exit(1)
+	}
+	previous, err := backup.Restore(flags.Arg(0), *target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("restored %s from %s\n", *target, flags.Arg(0))
+	if previous != "" {
+		fmt.Printf("the previous database was kept at %s\n", previous)
+	}
+}
 
-	e.Logger.Fatal(e.Start(":8080"))
+func rotateKeys(args []string) {
+	flags := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	target := flags.String("db", config.GetConfig().DatabaseDSN, "the database to re-encrypt")
+	batchSize := flags.Int("batch", 500, "the number of rows to re-encrypt per transaction")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: rotate-keys [-db path] [-batch n]")
+		fmt.Fprintln(flags.Output(), "Re-encrypts every message body and conversation context that is not encrypted with the active key.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 || *batchSize < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	keys, err := loadKeyring()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if keys == nil {
+		fmt.Fprintln(os.Stderr, "no encryption key is configured. Set ENCRYPTION_KEY or ENCRYPTION_KEY_FILE")
+		os.Exit(1)
+	}
+	path := database.DatabaseFile(*target)
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "an in-memory database cannot be re-encrypted")
+		os.Exit(1)
+	}
+	if _, err := os.Stat(path); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	cfg := *config.GetConfig()
+	cfg.DatabaseDSN = *target
+	db, err := database.Open(&cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	rotation, err := database.CreateDB(db, keys).RotateKeys(*batchSize)
+	fmt.Printf(
+		"re-encrypted %d messages, %d conversation contexts, %d webhook secrets and %d webhook payloads with key %q\n",
+		rotation.Messages, rotation.Conversations, rotation.WebhookSecrets, rotation.WebhookPayloads, keys.ActiveKeyId())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func loadKeyring() (*encryption.Keyring, error) {
+	cfg := config.GetConfig()
+	keys, err := encryption.Load(cfg.EncryptionKey, cfg.EncryptionKeyId, cfg.EncryptionKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load encryption keys: %w", err)
+	}
+	return keys, nil
 }
@@ -0,0 +1,216 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/proto/admin"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	filePrefix = "chat-"
+	fileSuffix = ".db"
+	timeLayout = "20060102-150405.000"
+)
+
+// Service takes verified backups of the database into a directory and keeps
+// only the most recent ones.
+type Service struct {
+	db   *database.DB
+	dir  string
+	keep int
+	// mutex keeps scheduled and on demand backups from running at once.
+	mutex sync.Mutex
+}
+
+func NewService(db *database.DB, dir string, keep int) *Service {
+	return &Service{db: db, dir: dir, keep: keep}
+}
+
+// Backup takes a snapshot of the database, checks its integrity and removes
+// backups beyond the number to keep. A snapshot that fails its check is
+// deleted rather than kept.
+func (s *Service) Backup(ctx context.Context) (*admin.Backup, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.MkdirAll(s.dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("unable to create backup directory: %w", err)
+	}
+	createdAt := time.Now().UTC()
+	name := filePrefix + createdAt.Format(timeLayout) + fileSuffix
+	path := filepath.Join(s.dir, name)
+	if err := s.db.Backup(ctx, path); err != nil {
+		return nil, fmt.Errorf("unable to back up database: %w", err)
+	}
+	version, err := database.VerifyDatabaseFile(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("backup %s failed verification: %w", name, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read backup %s: %w", name, err)
+	}
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	return &admin.Backup{
+		Name:          name,
+		SizeBytes:     info.Size(),
+		CreatedAt:     timestamppb.New(createdAt),
+		SchemaVersion: int32(version),
+	}, nil
+}
+
+// List lists the backups in the backup directory, newest first.
+func (s *Service) List() ([]*admin.Backup, error) {
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return []*admin.Backup{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read backup directory: %w", err)
+	}
+	backups := []*admin.Backup{}
+	for _, entry := range entries {
+		createdAt, ok := parseName(entry.Name())
+		if !ok || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read backup %s: %w", entry.Name(), err)
+		}
+		backups = append(backups, &admin.Backup{
+			Name:      entry.Name(),
+			SizeBytes: info.Size(),
+			CreatedAt: timestamppb.New(createdAt),
+		})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.AsTime().After(backups[j].CreatedAt.AsTime())
+	})
+	return backups, nil
+}
+
+// Schedule takes a backup every interval until ctx is done.
+func (s *Service) Schedule(ctx context.Context, interval time.Duration, logger echo.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			backup, err := s.Backup(ctx)
+			if err != nil {
+				logger.Error(fmt.Errorf("scheduled backup failed: %w", err))
+				continue
+			}
+			logger.Infof("scheduled backup %s written (%d bytes)", backup.Name, backup.SizeBytes)
+		}
+	}
+}
+
+func (s *Service) rotate() error {
+	backups, err := s.List()
+	if err != nil {
+		return err
+	}
+	for i := s.keep; i < len(backups); i++ {
+		if err := os.Remove(filepath.Join(s.dir, backups[i].Name)); err != nil {
+			return fmt.Errorf("unable to remove old backup %s: %w", backups[i].Name, err)
+		}
+	}
+	return nil
+}
+
+func parseName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileSuffix) {
+		return time.Time{}, false
+	}
+	createdAt, err := time.Parse(timeLayout, strings.TrimSuffix(strings.TrimPrefix(name, filePrefix), fileSuffix))
+	return createdAt, err == nil
+}
+
+// The suffixes of the journal files SQLite keeps next to a database file.
+var journalSuffixes = []string{"-wal", "-shm", "-journal"}
+
+// Restore replaces the database at dbPath with the backup at backupPath. The
+// backup is checked before anything is touched, and the current database is
+// kept next to dbPath as a .pre-restore file, along with its journal files.
+// The server must not be running while a restore happens.
+func Restore(backupPath, dbPath string) (string, error) {
+	if _, err := database.VerifyDatabaseFile(backupPath); err != nil {
+		return "", fmt.Errorf("refusing to restore %s: %w", backupPath, err)
+	}
+
+	var previous string
+	if _, err := os.Stat(dbPath); err == nil {
+		// Changes that are still in the write-ahead log are moved into the
+		// database file first, so that the copy holds all of them.
+		if err := database.CheckpointDatabaseFile(dbPath); err != nil {
+			return "", fmt.Errorf("unable to keep current database: %w", err)
+		}
+		previous = fmt.Sprintf("%s.pre-restore-%s", dbPath, time.Now().UTC().Format(timeLayout))
+		if err := copyFile(dbPath, previous); err != nil {
+			return "", fmt.Errorf("unable to keep current database: %w", err)
+		}
+		for _, suffix := range journalSuffixes {
+			if _, err := os.Stat(dbPath + suffix); err != nil {
+				continue
+			}
+			if err := copyFile(dbPath+suffix, previous+suffix); err != nil {
+				return "", fmt.Errorf("unable to keep current database: %w", err)
+			}
+		}
+	}
+
+	tmpPath := dbPath + ".restore"
+	if err := copyFile(backupPath, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("unable to copy backup: %w", err)
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("unable to replace database: %w", err)
+	}
+	// Journal files belong to the database that was replaced, and were kept
+	// with its copy.
+	for _, suffix := range journalSuffixes {
+		os.Remove(dbPath + suffix)
+	}
+	return previous, nil
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dest, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dest, src); err != nil {
+		dest.Close()
+		return err
+	}
+	if err := dest.Sync(); err != nil {
+		dest.Close()
+		return err
+	}
+	return dest.Close()
+}
@@ -0,0 +1,129 @@
+package backup
+
+import (
+	"database/sql"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// createDatabase creates a chat database at path with the given number of
+// conversations, and returns the open connection to it.
+func createDatabase(t *testing.T, path string, conversations int, wal bool) *sql.DB {
+	t.Helper()
+	dsn := "file:" + path
+	if wal {
+		dsn += "?_journal_mode=wal"
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	statements := []string{
+		"PRAGMA wal_autocheckpoint = 0",
+		"CREATE TABLE conversations (id INTEGER PRIMARY KEY, title TEXT)",
+		"CREATE TABLE messages (id INTEGER PRIMARY KEY, body TEXT)",
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < conversations; i++ {
+		if _, err := db.Exec("INSERT INTO conversations (title) VALUES ('c')"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func countConversations(t *testing.T, path string) int {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM conversations").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func copyTestFile(t *testing.T, from, to string) {
+	t.Helper()
+	src, err := os.Open(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dest, err := os.Create(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	if _, err := io.Copy(dest, src); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreKeepsChangesStillInTheWriteAheadLog(t *testing.T) {
+	dir := t.TempDir()
+	backupPath := filepath.Join(dir, "backup.db")
+	createDatabase(t, backupPath, 1, false).Close()
+
+	// The database is copied while its changes are only in the log, as
+	// they are after the server stopped without checkpointing.
+	livePath := filepath.Join(dir, "live.db")
+	live := createDatabase(t, livePath, 3, true)
+	dbPath := filepath.Join(dir, "chat.db")
+	copyTestFile(t, livePath, dbPath)
+	copyTestFile(t, livePath+"-wal", dbPath+"-wal")
+	live.Close()
+
+	previous, err := Restore(backupPath, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := countConversations(t, previous); got != 3 {
+		t.Fatalf("expected the kept database to have 3 conversations, got %d", got)
+	}
+	if got := countConversations(t, dbPath); got != 1 {
+		t.Fatalf("expected the restored database to have 1 conversation, got %d", got)
+	}
+	if _, err := os.Stat(dbPath + "-wal"); !os.IsNotExist(err) {
+		t.Fatalf("expected the log of the replaced database to be removed, got %v", err)
+	}
+}
+
+func TestRestoreRefusesInvalidBackups(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "chat.db")
+	createDatabase(t, dbPath, 2, false).Close()
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{"not a database", "hello"},
+		{"empty", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backupPath := filepath.Join(dir, "backup.db")
+			if err := os.WriteFile(backupPath, []byte(test.contents), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Restore(backupPath, dbPath); err == nil {
+				t.Fatal("expected the restore to be refused")
+			}
+			if got := countConversations(t, dbPath); got != 2 {
+				t.Fatalf("expected the database to be left alone, got %d conversations", got)
+			}
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 
 	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
 )
 
 type ChatRequest struct {
@@ -41,11 +42,14 @@ type ChatResponse struct {
 	} `json:"choices"`
 }
 
-func MakeChatRequest(messages []ChatMessage, temperature float64, token string) (*ChatResponse, error) {
-	url := "https://api.openai.com/v1/chat/completions"
+func MakeChatRequest(messages []ChatMessage, model string, temperature float64, token string) (*ChatResponse, error) {
+	url := config.GetConfig().OpenAiBaseURL + "/chat/completions"
 
+	if model == "" {
+		model = Model(nil)
+	}
 	chatRequest := ChatRequest{
-		Model:       config.GetConfig().OpenAiModel,
+		Model:       model,
 		Messages:    messages,
 		Temperature: temperature,
 	}
@@ -86,3 +90,12 @@ func MakeChatRequest(messages []ChatMessage, temperature float64, token string)
 
 	return &chatResponse, nil
 }
+
+// Model returns the model that is asked for replies with the given settings,
+// which is the server default when they do not name one.
+func Model(settings *chat.ConversationSettings) string {
+	if model := settings.GetModel(); model != "" {
+		return model
+	}
+	return config.GetConfig().OpenAiModel
+}
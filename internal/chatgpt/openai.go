@@ -8,9 +8,17 @@ import (
 	"github.com/timsexperiments/chat-cli/internal/proto/chat"
 )
 
-func SendMessage(message, token string, messages []*chat.Message) (responseMessage, context, completionId string, err error) {
+const defaultTemperature = 0.3
+
+// The range of sampling temperatures the model accepts.
+const (
+	MinTemperature = 0.0
+	MaxTemperature = 2.0
+)
+
+func SendMessage(message, token string, messages []*chat.Message, settings *chat.ConversationSettings) (responseMessage, context, completionId string, tokens int, err error) {
 	if message == "" || token == "" {
-		return "", "", "", fmt.Errorf("message and token must be provided")
+		return "", "", "", 0, fmt.Errorf("message and token must be provided")
 	}
 
 	contextMessage := ChatMessage{
@@ -19,13 +27,17 @@ func SendMessage(message, token string, messages []*chat.Message) (responseMessa
 	}
 
 	requestMessages := append(messagesToChatMessages(messages), contextMessage)
-	response, err := MakeChatRequest(requestMessages, 0.3, token)
+	temperature := defaultTemperature
+	if settings != nil && settings.Temperature != nil {
+		temperature = settings.GetTemperature()
+	}
+	response, err := MakeChatRequest(requestMessages, Model(settings), temperature, token)
 	if err != nil {
-		return "", "", "", fmt.Errorf("unable to make chat request: %w", err)
+		return "", "", "", 0, fmt.Errorf("unable to make chat request: %w", err)
 	}
 
 	if len(response.Choices) == 0 {
-		return "", "", "", fmt.Errorf("no choices returned")
+		return "", "", "", 0, fmt.Errorf("no choices returned")
 	}
 
 	messageParts := strings.Split(response.Choices[0].Message.Content, "\n\n")
@@ -34,7 +46,7 @@ func SendMessage(message, token string, messages []*chat.Message) (responseMessa
 		log.Default().Println("Expected at least 2 parts in the response, a response and a context, only found 1 part. Both context and message will be the full message content.")
 	}
 
-	return strings.Join(messageParts[0:len(messageParts)-1], "\n\n"), messageParts[len(messageParts)-1], response.ID, nil
+	return strings.Join(messageParts[0:len(messageParts)-1], "\n\n"), messageParts[len(messageParts)-1], response.ID, response.Usage.TotalTokens, nil
 }
 
 type messages = []*chat.Message
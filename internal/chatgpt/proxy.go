@@ -0,0 +1,36 @@
+package chatgpt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/timsexperiments/chat-cli/internal/config"
+)
+
+// The request headers passed on to the provider by Forward, besides
+// Authorization.
+var forwardedHeaders = []string{"Content-Type", "Accept", "OpenAI-Organization", "OpenAI-Project"}
+
+// Forward sends a request to path under the configured base URL of the
+// provider, e.g. "/chat/completions", authorized with token, and returns the
+// response as it is. The caller closes its body.
+func Forward(ctx context.Context, method, path, token string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, config.GetConfig().OpenAiBaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	for _, name := range forwardedHeaders {
+		if value := header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %v", err)
+	}
+	return resp, nil
+}
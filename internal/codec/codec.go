@@ -0,0 +1,103 @@
+// Package codec encodes and decodes the protobuf messages of the API as
+// binary protobuf or as JSON, depending on the media type a client asked for.
+package codec
+
+import (
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// The media types messages can be encoded as.
+const (
+	Protobuf = "application/protobuf"
+	JSON     = "application/json"
+)
+
+// JSON is written with the field names from the .proto files, so that it does
+// not change with the JSON names protoc derives.
+var (
+	jsonMarshal   = protojson.MarshalOptions{UseProtoNames: true}
+	jsonUnmarshal = protojson.UnmarshalOptions{}
+)
+
+// MediaType returns the media type named by a Content-Type header, and
+// whether it is one messages can be encoded as. An empty header is taken to
+// be protobuf, which is what clients sent before JSON was supported.
+func MediaType(contentType string) (string, bool) {
+	if contentType == "" {
+		return Protobuf, true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+	switch mediaType {
+	case Protobuf, "application/x-protobuf":
+		return Protobuf, true
+	case JSON:
+		return JSON, true
+	}
+	return mediaType, false
+}
+
+// Negotiate picks the media type to send a response as from an Accept header,
+// preferring whichever supported type is given the highest quality. It returns
+// fallback when the header does not name a supported type, or only accepts
+// anything.
+func Negotiate(accept, fallback string) string {
+	best, bestQuality := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if value, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		candidate, ok := MediaType(mediaType)
+		if !ok {
+			if mediaType != "*/*" && mediaType != "application/*" {
+				continue
+			}
+			candidate = fallback
+		}
+		if quality > bestQuality {
+			best, bestQuality = candidate, quality
+		}
+	}
+	if best == "" {
+		return fallback
+	}
+	return best
+}
+
+// Marshal encodes message as mediaType, which must be Protobuf or JSON.
+func Marshal(mediaType string, message proto.Message) ([]byte, error) {
+	switch mediaType {
+	case Protobuf:
+		return proto.Marshal(message)
+	case JSON:
+		return jsonMarshal.Marshal(message)
+	}
+	return nil, fmt.Errorf("unsupported media type %s", mediaType)
+}
+
+// Unmarshal decodes data encoded as mediaType into message. JSON may use
+// either the field names from the .proto files or their JSON names.
+func Unmarshal(mediaType string, data []byte, message proto.Message) error {
+	switch mediaType {
+	case Protobuf:
+		return proto.Unmarshal(data, message)
+	case JSON:
+		return jsonUnmarshal.Unmarshal(data, message)
+	}
+	return fmt.Errorf("unsupported media type %s", mediaType)
+}
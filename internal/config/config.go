@@ -1,12 +1,101 @@
 package config
 
 import (
+	"fmt"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type Config struct {
 	OpenAiModel string
+	// The base URL of the OpenAI compatible API that replies are asked for,
+	// e.g. to go through a gateway or use another provider.
+	OpenAiBaseURL string
+	// The SQLite database to use: a file path, a file: URI, or :memory: for a
+	// database that only lives as long as the server, which is meant for
+	// tests.
+	DatabaseDSN string
+	// The SQLite journal mode of file databases, e.g. wal or delete.
+	DatabaseJournalMode string
+	// How long a connection waits for another one to release its lock on the
+	// database before giving up with "database is locked".
+	DatabaseBusyTimeout time.Duration
+	// Whether foreign keys are enforced. Deleting conversations and messages
+	// relies on them to remove what belongs to them.
+	DatabaseForeignKeys bool
+	// The most connections open to the database at once.
+	DatabaseMaxOpenConns int
+	// The most idle connections kept open to the database.
+	DatabaseMaxIdleConns int
+	// How long a connection is reused before it is closed. Connections are
+	// reused forever when zero.
+	DatabaseConnMaxLifetime time.Duration
+	// How long conversations and messages stay in the trash before they are
+	// permanently deleted.
+	TrashRetention time.Duration
+	// How long the response to a request sent with an Idempotency-Key header
+	// is kept and sent again when the request is retried with the same key.
+	IdempotencyWindow time.Duration
+	// The bearer token required by the admin API. The admin API is disabled
+	// when it is empty.
+	AdminToken string
+	// Where database backups are written.
+	BackupDir string
+	// How often a backup is taken. Scheduled backups are disabled when zero.
+	BackupInterval time.Duration
+	// How many backups to keep.
+	BackupKeep int
+	// How long messages are kept before the retention worker removes them.
+	// Messages are kept forever when zero, unless a retention policy says
+	// otherwise.
+	RetentionMaxAge time.Duration
+	// What the retention worker does with expired messages, purge or redact.
+	RetentionAction string
+	// How often the retention worker runs. The worker is disabled when zero.
+	RetentionInterval time.Duration
+	// How many messages the retention worker removes per transaction.
+	RetentionBatchSize int
+	// Whether the retention worker rebuilds the whole database with VACUUM
+	// after removing rows, when the database is not set up for incremental
+	// vacuums. A full vacuum locks the database until it is done, and needs as
+	// much free disk space as the database takes up.
+	RetentionFullVacuum bool
+	// How often due webhook deliveries are sent. Webhook deliveries are
+	// disabled when zero, and events are queued until they are enabled.
+	WebhookInterval time.Duration
+	// How long a webhook has to answer a delivery before the attempt fails.
+	WebhookTimeout time.Duration
+	// How many times a delivery is attempted before it is moved to the dead
+	// letters.
+	WebhookMaxAttempts int
+	// How often conversation WebSockets are pinged to keep them open and to
+	// find out whether the client is still there.
+	WebSocketPingInterval time.Duration
+	// How long a conversation WebSocket may go without hearing from the
+	// client, e.g. a pong, before it is closed.
+	WebSocketPongTimeout time.Duration
+	// How long writing an event to a conversation WebSocket may take before
+	// the connection is closed.
+	WebSocketWriteTimeout time.Duration
+	// How many of the latest events of a conversation are kept for clients
+	// that resume their session after reconnecting.
+	WebSocketEventBuffer int
+	// How long after it disconnected a client may still resume its session.
+	WebSocketResumeWindow time.Duration
+	// A base64 encoded 32 byte key that message bodies and conversation
+	// contexts are encrypted with.
+	EncryptionKey string
+	// The id stored with values encrypted with EncryptionKey.
+	EncryptionKeyId string
+	// A file of "<id>:<base64 key>" lines to use instead of EncryptionKey. The
+	// first key encrypts new values, the others are kept for reading values
+	// that have not been rotated yet.
+	EncryptionKeyFile string
 }
 
 var (
@@ -16,7 +105,37 @@ var (
 
 func initConfig() {
 	cfg = &Config{
-		OpenAiModel: getEnv("OPEN_API_KEY", "gpt-3.5-turbo"),
+		OpenAiModel:             getEnv("OPEN_API_KEY", "gpt-3.5-turbo"),
+		OpenAiBaseURL:           strings.TrimSuffix(getEnv("OPENAI_BASE_URL", "https://api.openai.com/v1"), "/"),
+		DatabaseDSN:             getEnv("DATABASE_DSN", "data/chat.db"),
+		DatabaseJournalMode:     strings.ToLower(getEnv("DATABASE_JOURNAL_MODE", "wal")),
+		DatabaseBusyTimeout:     getDurationEnv("DATABASE_BUSY_TIMEOUT", 5*time.Second),
+		DatabaseForeignKeys:     getBoolEnv("DATABASE_FOREIGN_KEYS", true),
+		DatabaseMaxOpenConns:    getIntEnv("DATABASE_MAX_OPEN_CONNS", 8),
+		DatabaseMaxIdleConns:    getIntEnv("DATABASE_MAX_IDLE_CONNS", 2),
+		DatabaseConnMaxLifetime: getDurationEnv("DATABASE_CONN_MAX_LIFETIME", 0),
+		TrashRetention:          getDurationEnv("TRASH_RETENTION", 30*24*time.Hour),
+		IdempotencyWindow:       getDurationEnv("IDEMPOTENCY_WINDOW", 24*time.Hour),
+		AdminToken:              getEnv("ADMIN_TOKEN", ""),
+		BackupDir:               getEnv("BACKUP_DIR", "data/backups"),
+		BackupInterval:          getDurationEnv("BACKUP_INTERVAL", 24*time.Hour),
+		BackupKeep:              getIntEnv("BACKUP_KEEP", 7),
+		RetentionMaxAge:         getDurationEnv("RETENTION_MAX_AGE", 0),
+		RetentionAction:         getEnv("RETENTION_ACTION", "purge"),
+		RetentionInterval:       getDurationEnv("RETENTION_INTERVAL", time.Hour),
+		RetentionBatchSize:      getIntEnv("RETENTION_BATCH_SIZE", 500),
+		RetentionFullVacuum:     getBoolEnv("RETENTION_FULL_VACUUM", false),
+		WebhookInterval:         getDurationEnv("WEBHOOK_INTERVAL", 5*time.Second),
+		WebhookTimeout:          getDurationEnv("WEBHOOK_TIMEOUT", 10*time.Second),
+		WebhookMaxAttempts:      getIntEnv("WEBHOOK_MAX_ATTEMPTS", 8),
+		WebSocketPingInterval:   getDurationEnv("WEBSOCKET_PING_INTERVAL", 30*time.Second),
+		WebSocketPongTimeout:    getDurationEnv("WEBSOCKET_PONG_TIMEOUT", time.Minute),
+		WebSocketWriteTimeout:   getDurationEnv("WEBSOCKET_WRITE_TIMEOUT", 10*time.Second),
+		WebSocketEventBuffer:    getIntEnv("WEBSOCKET_EVENT_BUFFER", 256),
+		WebSocketResumeWindow:   getDurationEnv("WEBSOCKET_RESUME_WINDOW", 2*time.Minute),
+		EncryptionKey:           getEnv("ENCRYPTION_KEY", ""),
+		EncryptionKeyId:         getEnv("ENCRYPTION_KEY_ID", "primary"),
+		EncryptionKeyFile:       getEnv("ENCRYPTION_KEY_FILE", ""),
 	}
 
 	validateConfig(cfg)
@@ -34,6 +153,116 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+func getDurationEnv(key string, fallback time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		panic(fmt.Errorf("invalid duration for %s [%s]: %w", key, value, err))
+	}
+	return duration
+}
+
+func getBoolEnv(key string, fallback bool) bool {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		panic(fmt.Errorf("invalid boolean for %s [%s]: %w", key, value, err))
+	}
+	return enabled
+}
+
+func getIntEnv(key string, fallback int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		panic(fmt.Errorf("invalid integer for %s [%s]: %w", key, value, err))
+	}
+	return number
+}
+
+// The journal modes SQLite supports.
+var journalModes = []string{"delete", "truncate", "persist", "memory", "wal", "off"}
+
 func validateConfig(cfg *Config) {
-	// Currently no validations are needed
+	if baseURL, err := url.Parse(cfg.OpenAiBaseURL); err != nil || (baseURL.Scheme != "http" && baseURL.Scheme != "https") || baseURL.Host == "" {
+		panic(fmt.Errorf("OPENAI_BASE_URL must be an http or https URL, got %s", cfg.OpenAiBaseURL))
+	}
+	if cfg.DatabaseDSN == "" {
+		panic(fmt.Errorf("DATABASE_DSN must not be empty"))
+	}
+	if !slices.Contains(journalModes, cfg.DatabaseJournalMode) {
+		panic(fmt.Errorf("DATABASE_JOURNAL_MODE must be one of %s, got %s", strings.Join(journalModes, ", "), cfg.DatabaseJournalMode))
+	}
+	if cfg.DatabaseBusyTimeout < 0 {
+		panic(fmt.Errorf("DATABASE_BUSY_TIMEOUT must not be negative, got %s", cfg.DatabaseBusyTimeout))
+	}
+	if cfg.DatabaseMaxOpenConns < 1 {
+		panic(fmt.Errorf("DATABASE_MAX_OPEN_CONNS must be at least 1, got %d", cfg.DatabaseMaxOpenConns))
+	}
+	if cfg.DatabaseMaxIdleConns < 0 || cfg.DatabaseMaxIdleConns > cfg.DatabaseMaxOpenConns {
+		panic(fmt.Errorf("DATABASE_MAX_IDLE_CONNS must be from 0 to DATABASE_MAX_OPEN_CONNS (%d), got %d", cfg.DatabaseMaxOpenConns, cfg.DatabaseMaxIdleConns))
+	}
+	if cfg.DatabaseConnMaxLifetime < 0 {
+		panic(fmt.Errorf("DATABASE_CONN_MAX_LIFETIME must not be negative, got %s", cfg.DatabaseConnMaxLifetime))
+	}
+	if cfg.TrashRetention <= 0 {
+		panic(fmt.Errorf("TRASH_RETENTION must be positive, got %s", cfg.TrashRetention))
+	}
+	if cfg.IdempotencyWindow <= 0 {
+		panic(fmt.Errorf("IDEMPOTENCY_WINDOW must be positive, got %s", cfg.IdempotencyWindow))
+	}
+	if cfg.BackupInterval < 0 {
+		panic(fmt.Errorf("BACKUP_INTERVAL must not be negative, got %s", cfg.BackupInterval))
+	}
+	if cfg.BackupKeep < 1 {
+		panic(fmt.Errorf("BACKUP_KEEP must be at least 1, got %d", cfg.BackupKeep))
+	}
+	if cfg.RetentionMaxAge < 0 {
+		panic(fmt.Errorf("RETENTION_MAX_AGE must not be negative, got %s", cfg.RetentionMaxAge))
+	}
+	if cfg.RetentionAction != "purge" && cfg.RetentionAction != "redact" {
+		panic(fmt.Errorf("RETENTION_ACTION must be purge or redact, got %s", cfg.RetentionAction))
+	}
+	if cfg.RetentionInterval < 0 {
+		panic(fmt.Errorf("RETENTION_INTERVAL must not be negative, got %s", cfg.RetentionInterval))
+	}
+	if cfg.RetentionBatchSize < 1 {
+		panic(fmt.Errorf("RETENTION_BATCH_SIZE must be at least 1, got %d", cfg.RetentionBatchSize))
+	}
+	if cfg.WebhookInterval < 0 {
+		panic(fmt.Errorf("WEBHOOK_INTERVAL must not be negative, got %s", cfg.WebhookInterval))
+	}
+	if cfg.WebhookTimeout <= 0 {
+		panic(fmt.Errorf("WEBHOOK_TIMEOUT must be positive, got %s", cfg.WebhookTimeout))
+	}
+	if cfg.WebhookMaxAttempts < 1 {
+		panic(fmt.Errorf("WEBHOOK_MAX_ATTEMPTS must be at least 1, got %d", cfg.WebhookMaxAttempts))
+	}
+	if cfg.WebSocketPingInterval <= 0 {
+		panic(fmt.Errorf("WEBSOCKET_PING_INTERVAL must be positive, got %s", cfg.WebSocketPingInterval))
+	}
+	if cfg.WebSocketPongTimeout <= cfg.WebSocketPingInterval {
+		panic(fmt.Errorf("WEBSOCKET_PONG_TIMEOUT must be longer than WEBSOCKET_PING_INTERVAL (%s), got %s", cfg.WebSocketPingInterval, cfg.WebSocketPongTimeout))
+	}
+	if cfg.WebSocketWriteTimeout <= 0 {
+		panic(fmt.Errorf("WEBSOCKET_WRITE_TIMEOUT must be positive, got %s", cfg.WebSocketWriteTimeout))
+	}
+	if cfg.WebSocketEventBuffer < 0 {
+		panic(fmt.Errorf("WEBSOCKET_EVENT_BUFFER must not be negative, got %d", cfg.WebSocketEventBuffer))
+	}
+	if cfg.WebSocketResumeWindow < 0 {
+		panic(fmt.Errorf("WEBSOCKET_RESUME_WINDOW must not be negative, got %s", cfg.WebSocketResumeWindow))
+	}
+	if cfg.EncryptionKey != "" && cfg.EncryptionKeyFile != "" {
+		panic(fmt.Errorf("only one of ENCRYPTION_KEY and ENCRYPTION_KEY_FILE may be set"))
+	}
 }
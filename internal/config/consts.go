@@ -7,12 +7,125 @@ const (
 )
 
 const (
-	INIT_QUERY                      = "init"
-	CREATE_CONVERSATION_QUERY       = "create_conversation"
-	GET_CONVERSATION_QUERY          = "get_conversation"
-	GET_CONVERSATION_BY_TITLE_QUERY = "get_conversation_by_title"
-	LIST_CONVERSATIONS_QUERY        = "list_conversations"
-	CREATE_MESSAGE_QUERY            = "create_message"
-	GET_MESSAGE_QUERY               = "get_message"
-	UPDATE_CONVERSATION_QUERY       = "update_conversation"
+	INIT_QUERY                         = "init"
+	CREATE_CONVERSATION_QUERY          = "create_conversation"
+	GET_CONVERSATION_QUERY             = "get_conversation"
+	EXPORT_CONVERSATIONS_QUERY         = "export_conversations"
+	GET_CONVERSATION_BY_TITLE_QUERY    = "get_conversation_by_title"
+	LIST_CONVERSATIONS_QUERY           = "list_conversations"
+	CREATE_MESSAGE_QUERY               = "create_message"
+	GET_MESSAGE_QUERY                  = "get_message"
+	UPDATE_CONVERSATION_QUERY          = "update_conversation"
+	DELETE_CONVERSATION_QUERY          = "delete_conversation"
+	RESTORE_CONVERSATION_QUERY         = "restore_conversation"
+	PURGE_CONVERSATION_QUERY           = "purge_conversation"
+	ARCHIVE_CONVERSATION_QUERY         = "archive_conversation"
+	DELETE_MESSAGE_QUERY               = "delete_message"
+	RESTORE_MESSAGE_QUERY              = "restore_message"
+	PURGE_MESSAGE_QUERY                = "purge_message"
+	LIST_DELETED_CONVERSATIONS_QUERY   = "list_deleted_conversations"
+	LIST_DELETED_MESSAGES_QUERY        = "list_deleted_messages"
+	PURGE_TRASH_MESSAGES_QUERY         = "purge_trash_messages"
+	PURGE_TRASH_CONVERSATIONS_QUERY    = "purge_trash_conversations"
+	CREATE_TAG_QUERY                   = "create_tag"
+	ENSURE_TAG_QUERY                   = "ensure_tag"
+	GET_TAG_QUERY                      = "get_tag"
+	LIST_TAGS_QUERY                    = "list_tags"
+	RENAME_TAG_QUERY                   = "rename_tag"
+	DELETE_TAG_QUERY                   = "delete_tag"
+	ADD_CONVERSATION_TAG_QUERY         = "add_conversation_tag"
+	REMOVE_CONVERSATION_TAG_QUERY      = "remove_conversation_tag"
+	CLEAR_CONVERSATION_TAGS_QUERY      = "clear_conversation_tags"
+	GET_CONVERSATION_TAGS_QUERY        = "get_conversation_tags"
+	LIST_CONVERSATION_TAGS_QUERY       = "list_conversation_tags"
+	CREATE_FOLDER_QUERY                = "create_folder"
+	GET_FOLDER_QUERY                   = "get_folder"
+	LIST_FOLDERS_QUERY                 = "list_folders"
+	UPDATE_FOLDER_QUERY                = "update_folder"
+	DELETE_FOLDER_QUERY                = "delete_folder"
+	GET_FOLDER_ANCESTORS_QUERY         = "get_folder_ancestors"
+	PIN_MESSAGE_QUERY                  = "pin_message"
+	GET_PIN_QUERY                      = "get_pin"
+	GET_MESSAGE_PIN_QUERY              = "get_message_pin"
+	UNPIN_MESSAGE_QUERY                = "unpin_message"
+	LIST_PINS_QUERY                    = "list_pins"
+	LIST_CONTEXT_PINS_QUERY            = "list_context_pins"
+	LIST_EXPIRED_MESSAGES_QUERY        = "list_expired_messages"
+	REDACT_MESSAGES_QUERY              = "redact_messages"
+	PURGE_MESSAGES_QUERY               = "purge_messages"
+	CLEAR_CONVERSATION_CONTEXTS_QUERY  = "clear_conversation_contexts"
+	CREATE_RETENTION_AUDIT_QUERY       = "create_retention_audit"
+	LIST_RETENTION_AUDIT_QUERY         = "list_retention_audit"
+	SET_RETENTION_POLICY_QUERY         = "set_retention_policy"
+	GET_RETENTION_POLICY_QUERY         = "get_retention_policy"
+	FIND_RETENTION_POLICY_QUERY        = "find_retention_policy"
+	LIST_RETENTION_POLICIES_QUERY      = "list_retention_policies"
+	DELETE_RETENTION_POLICY_QUERY      = "delete_retention_policy"
+	LIST_MESSAGES_TO_ROTATE_QUERY      = "list_messages_to_rotate"
+	LIST_CONTEXTS_TO_ROTATE_QUERY      = "list_contexts_to_rotate"
+	LIST_SECRETS_TO_ROTATE_QUERY       = "list_secrets_to_rotate"
+	LIST_PAYLOADS_TO_ROTATE_QUERY      = "list_payloads_to_rotate"
+	UPDATE_MESSAGE_BODY_QUERY          = "update_message_body"
+	UPDATE_CONVERSATION_CONTEXT_QUERY  = "update_conversation_context"
+	TOUCH_CONVERSATION_QUERY           = "touch_conversation"
+	GET_CONVERSATION_VERSION_QUERY     = "get_conversation_version"
+	GET_CONVERSATION_METADATA_QUERY    = "get_conversation_metadata"
+	CREATE_AUDIT_EVENT_QUERY           = "create_audit_event"
+	LIST_AUDIT_EVENTS_QUERY            = "list_audit_events"
+	SET_FEEDBACK_QUERY                 = "set_feedback"
+	GET_FEEDBACK_QUERY                 = "get_feedback"
+	DELETE_FEEDBACK_QUERY              = "delete_feedback"
+	FEEDBACK_REPORT_QUERY              = "feedback_report"
+	FEEDBACK_REPORT_CATEGORIES_QUERY   = "feedback_report_categories"
+	LIST_FEEDBACK_EXAMPLES_QUERY       = "list_feedback_examples"
+	IMPORT_CONVERSATION_QUERY          = "import_conversation"
+	IMPORT_MESSAGE_QUERY               = "import_message"
+	UPDATE_MESSAGE_STATUS_QUERY        = "update_message_status"
+	FAIL_PENDING_MESSAGES_QUERY        = "fail_pending_messages"
+	UPDATE_CONVERSATION_METADATA_QUERY = "update_conversation_metadata"
+	CLAIM_IDEMPOTENCY_KEY_QUERY        = "claim_idempotency_key"
+	GET_IDEMPOTENCY_KEY_QUERY          = "get_idempotency_key"
+	COMPLETE_IDEMPOTENCY_KEY_QUERY     = "complete_idempotency_key"
+	RELEASE_IDEMPOTENCY_KEY_QUERY      = "release_idempotency_key"
+	PURGE_IDEMPOTENCY_KEYS_QUERY       = "purge_idempotency_keys"
+	CREATE_WEBHOOK_QUERY               = "create_webhook"
+	GET_WEBHOOK_QUERY                  = "get_webhook"
+	LIST_WEBHOOKS_QUERY                = "list_webhooks"
+	UPDATE_WEBHOOK_QUERY               = "update_webhook"
+	UPDATE_WEBHOOK_SECRET_QUERY        = "update_webhook_secret"
+	ROTATE_WEBHOOK_SECRET_QUERY        = "rotate_webhook_secret"
+	DELETE_WEBHOOK_QUERY               = "delete_webhook"
+	ENQUEUE_WEBHOOK_DELIVERIES_QUERY   = "enqueue_webhook_deliveries"
+	UPDATE_WEBHOOK_PAYLOAD_QUERY       = "update_webhook_payload"
+	LIST_DUE_WEBHOOK_DELIVERIES_QUERY  = "list_due_webhook_deliveries"
+	CREATE_WEBHOOK_ATTEMPT_QUERY       = "create_webhook_attempt"
+	COMPLETE_WEBHOOK_DELIVERY_QUERY    = "complete_webhook_delivery"
+	RETRY_WEBHOOK_DELIVERY_QUERY       = "retry_webhook_delivery"
+	FAIL_WEBHOOK_DELIVERY_QUERY        = "fail_webhook_delivery"
+	CREATE_WEBHOOK_DEAD_LETTER_QUERY   = "create_webhook_dead_letter"
+	LIST_WEBHOOK_DELIVERIES_QUERY      = "list_webhook_deliveries"
+	GET_WEBHOOK_DELIVERY_QUERY         = "get_webhook_delivery"
+	LIST_WEBHOOK_ATTEMPTS_QUERY        = "list_webhook_attempts"
+	LIST_WEBHOOK_DEAD_LETTERS_QUERY    = "list_webhook_dead_letters"
+	GET_WEBHOOK_DEAD_LETTER_QUERY      = "get_webhook_dead_letter"
+	DELETE_WEBHOOK_DEAD_LETTER_QUERY   = "delete_webhook_dead_letter"
+	REQUEUE_WEBHOOK_DELIVERY_QUERY     = "requeue_webhook_delivery"
 )
+
+// Migrations applied on top of the init query, in order. The index of a
+// migration plus one is the schema version it produces.
+var MIGRATIONS = []string{
+	"migrate_001_trash",
+	"migrate_002_settings",
+	"migrate_003_message_status",
+	"migrate_004_tags_folders",
+	"migrate_005_pins",
+	"migrate_006_retention",
+	"migrate_007_encryption",
+	"migrate_008_listing",
+	"migrate_009_versions",
+	"migrate_010_audit",
+	"migrate_011_feedback",
+	"migrate_012_idempotency",
+	"migrate_013_webhooks",
+}
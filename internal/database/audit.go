@@ -0,0 +1,296 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/proto/admin"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// SystemActor is who changes are recorded against when they are made by the
+// server on its own, like the retention worker, rather than for a request.
+const SystemActor = "system"
+
+// The kinds of things recorded as the target of audit events.
+const (
+	auditConversation    = "conversation"
+	auditMessage         = "message"
+	auditTag             = "tag"
+	auditFolder          = "folder"
+	auditRetentionPolicy = "retention_policy"
+	auditTrash           = "trash"
+	auditEncryptionKeys  = "encryption_keys"
+	auditWebhook         = "webhook"
+)
+
+// Actor is who the changes made through a DB are recorded against in the
+// audit log.
+type Actor struct {
+	// Who is making the changes, e.g. "admin". SystemActor is used when it
+	// is empty.
+	Name string
+	// The identifier of the request the changes are made for.
+	RequestId string
+	// The IP address of the client that sent the request.
+	ClientIp string
+}
+
+// AuditFilter narrows down the events returned by ListAuditEvents. Fields
+// that are not set match every event.
+type AuditFilter struct {
+	Actor      string
+	Action     string
+	TargetType string
+	TargetId   int64
+	RequestId  string
+	// Only include events at or after this time, when set.
+	After time.Time
+	// Only include events before this time, when set.
+	Before time.Time
+}
+
+// As returns a DB that records every change made through it against actor.
+func (db *DB) As(actor Actor) *DB {
+	scoped := *db
+	scoped.actor = actor
+	return &scoped
+}
+
+// Actor returns who the changes made through db are recorded against.
+func (db *DB) Actor() Actor {
+	return db.actor
+}
+
+// AuditExport records that the conversations with the given ids were
+// exported.
+func (db *DB) AuditExport(conversationIds ...int64) error {
+	return db.WithTx(func(tx *DB) error {
+		for _, id := range conversationIds {
+			if err := tx.audit("conversation.export", auditConversation, id, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListAuditEvents lists the audit events that match the filter, newest first
+// or oldest first. At most limit events are returned, or all of them when
+// limit is 0, after skipping the first offset.
+func (db *DB) ListAuditEvents(filter AuditFilter, oldestFirst bool, limit, offset int) ([]*admin.AuditEvent, error) {
+	if limit == 0 {
+		limit = -1
+	}
+	rows, err := db.Query(
+		config.LIST_AUDIT_EVENTS_QUERY,
+		filter.Actor,
+		filter.Action,
+		filter.TargetType,
+		filter.TargetId,
+		filter.RequestId,
+		optionalTime(filter.After),
+		optionalTime(filter.Before),
+		oldestFirst,
+		limit,
+		offset)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list audit events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []*admin.AuditEvent{}
+	for rows.Next() {
+		var id int64
+		var actor, action, targetType string
+		var targetId *int64
+		var requestId, clientIp, changes *string
+		var createdAt time.Time
+		if err := rows.Scan(&id, &actor, &action, &targetType, &targetId, &requestId, &clientIp, &changes, &createdAt); err != nil {
+			return nil, fmt.Errorf("unable to build audit event: %w", err)
+		}
+		event := &admin.AuditEvent{
+			Id:         id,
+			Actor:      actor,
+			Action:     action,
+			TargetType: targetType,
+			CreatedAt:  timestamppb.New(createdAt),
+		}
+		if targetId != nil {
+			event.TargetId = *targetId
+		}
+		if requestId != nil {
+			event.RequestId = *requestId
+		}
+		if clientIp != nil {
+			event.ClientIp = *clientIp
+		}
+		if changes != nil {
+			decoded := auditChanges{}
+			if err := json.Unmarshal([]byte(*changes), &decoded); err != nil {
+				return nil, fmt.Errorf("unable to parse changes of audit event %d: %w", id, err)
+			}
+			for _, change := range decoded {
+				event.Changes = append(event.Changes, &admin.AuditChange{
+					Field:  change.Field,
+					Before: string(change.Before),
+					After:  string(change.After),
+				})
+			}
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// audit records a change made through db in the audit log. It is meant to
+// run in the same transaction as the change, so that a change is never stored
+// without its audit event or the other way around.
+func (db *DB) audit(action, targetType string, targetId int64, changes auditChanges) error {
+	actor := db.actor.Name
+	if actor == "" {
+		actor = SystemActor
+	}
+	var encoded *string
+	if len(changes) > 0 {
+		data, err := json.Marshal(changes)
+		if err != nil {
+			return fmt.Errorf("unable to encode changes of audit event %s: %w", action, err)
+		}
+		changesJson := string(data)
+		encoded = &changesJson
+	}
+	_, err := db.Exec(
+		config.CREATE_AUDIT_EVENT_QUERY,
+		actor,
+		action,
+		targetType,
+		nullableId(targetId),
+		nullableString(db.actor.RequestId),
+		nullableString(db.actor.ClientIp),
+		encoded)
+	if err != nil {
+		return fmt.Errorf("unable to record audit event %s: %w", action, err)
+	}
+	return nil
+}
+
+// auditChange is a field changed by an audited change. A missing before or
+// after means the field did not exist on that side of the change, and both
+// are missing for content fields, which are only recorded as changed.
+type auditChange struct {
+	Field  string          `json:"field"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+type auditChanges []auditChange
+
+// set records field going from before to after, unless it stayed the same. A
+// nil before or after means the field did not exist on that side.
+func (c *auditChanges) set(field string, before, after any) {
+	change := auditChange{Field: field, Before: auditValue(before), After: auditValue(after)}
+	if bytes.Equal(change.Before, change.After) {
+		return
+	}
+	*c = append(*c, change)
+}
+
+// content records that field changed without recording its values.
+func (c *auditChanges) content(field string, changed bool) {
+	if changed {
+		*c = append(*c, auditChange{Field: field})
+	}
+}
+
+func auditValue(value any) json.RawMessage {
+	if value == nil {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		// Only plain values are recorded, which always encode.
+		panic(fmt.Errorf("unable to encode audit value: %w", err))
+	}
+	return data
+}
+
+// fields records every field going from before to after, where either side
+// may be nil when the thing did not exist before or after the change.
+func (c *auditChanges) fields(names []string, before, after map[string]any) {
+	for _, name := range names {
+		var beforeValue, afterValue any
+		if before != nil {
+			beforeValue = before[name]
+		}
+		if after != nil {
+			afterValue = after[name]
+		}
+		c.set(name, beforeValue, afterValue)
+	}
+}
+
+// The conversation fields recorded in the audit log, in the order they are
+// recorded.
+var conversationAuditFields = []string{"title", "archived", "deleted", "model", "temperature", "folder_id", "tags"}
+
+// conversationChanges returns the changes between two versions of a
+// conversation, either of which may be nil when the conversation was created
+// or purged. The context and completion id are recorded as changed without
+// their values, since they hold the content of the conversation.
+func conversationChanges(before, after *chat.Conversation) auditChanges {
+	changes := auditChanges{}
+	changes.fields(conversationAuditFields, conversationAuditValues(before), conversationAuditValues(after))
+	if before != nil && after != nil {
+		changes.content("context", before.Context != after.Context)
+		changes.content("completion_id", before.CompletionId != after.CompletionId)
+	}
+	return changes
+}
+
+func conversationAuditValues(conversation *chat.Conversation) map[string]any {
+	if conversation == nil {
+		return nil
+	}
+	var temperature *float64
+	if settings := conversation.GetSettings(); settings != nil {
+		temperature = settings.Temperature
+	}
+	return map[string]any{
+		"title":       conversation.Title,
+		"archived":    conversation.Archived,
+		"deleted":     conversation.DeletedAt != nil,
+		"model":       conversation.GetSettings().GetModel(),
+		"temperature": temperature,
+		"folder_id":   nullableId(conversation.FolderId),
+		"tags":        append([]string{}, conversation.Tags...),
+	}
+}
+
+// conversationMetadata returns the stored fields of the conversation with the
+// given id, in the trash or not, without its messages. It returns nil if there
+// is no such conversation.
+func (db *DB) conversationMetadata(id int64) (*chat.Conversation, error) {
+	rows, err := db.Query(config.GET_CONVERSATION_METADATA_QUERY, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get conversation %d: %w", id, err)
+	}
+	defer rows.Close()
+	conversations, err := db.conversationsFromRows(rows)
+	if err != nil || len(conversations) == 0 {
+		return nil, err
+	}
+	return db.conversationWithTags(conversations[0], nil)
+}
+
+// nullableString stores an empty string as NULL.
+func nullableString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/timsexperiments/chat-cli/internal/config"
+)
+
+// How long to wait before retrying a backup step when the database is busy.
+const backupRetryDelay = 50 * time.Millisecond
+
+// Backup writes a consistent snapshot of the database to path using SQLite's
+// online backup API, so the server can keep serving while it runs. The
+// snapshot is written to a temporary file next to path and renamed into place
+// once complete, so path never holds a partial backup.
+func (db *DB) Backup(ctx context.Context, path string) error {
+	tmpPath := path + ".tmp"
+	os.Remove(tmpPath)
+	if err := db.backupTo(ctx, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("unable to move backup into place: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) backupTo(ctx context.Context, path string) error {
+	dest, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return fmt.Errorf("unable to open backup file: %w", err)
+	}
+	defer dest.Close()
+
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to connect to backup file: %w", err)
+	}
+	defer destConn.Close()
+
+	srcConn, err := db.sql.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to connect to database: %w", err)
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destDriverConn any) error {
+		return srcConn.Raw(func(srcDriverConn any) error {
+			destSqlite, ok := destDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("backup file is not a sqlite connection")
+			}
+			srcSqlite, ok := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("database is not a sqlite connection")
+			}
+			backup, err := destSqlite.Backup("main", srcSqlite, "main")
+			if err != nil {
+				return fmt.Errorf("unable to start backup: %w", err)
+			}
+			for {
+				// Copying every page in one step holds the read lock for the
+				// whole copy, which is what keeps the snapshot consistent.
+				done, err := backup.Step(-1)
+				if err != nil {
+					backup.Close()
+					return fmt.Errorf("unable to copy database: %w", err)
+				}
+				if done {
+					break
+				}
+				select {
+				case <-ctx.Done():
+					backup.Close()
+					return ctx.Err()
+				case <-time.After(backupRetryDelay):
+				}
+			}
+			if err := backup.Finish(); err != nil {
+				return fmt.Errorf("unable to finish backup: %w", err)
+			}
+			return nil
+		})
+	})
+}
+
+// CheckpointDatabaseFile moves every change in the write-ahead log of the
+// database file at path into the file itself and empties the log, so that the
+// file alone holds the whole database. It fails if another connection, e.g. a
+// running server, keeps the log from being checkpointed completely.
+func CheckpointDatabaseFile(path string) error {
+	conn, err := sql.Open("sqlite3", "file:"+path)
+	if err != nil {
+		return fmt.Errorf("unable to open database file: %w", err)
+	}
+	defer conn.Close()
+
+	var busy, logFrames, checkpointed int
+	if err := conn.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logFrames, &checkpointed); err != nil {
+		return fmt.Errorf("unable to checkpoint database: %w", err)
+	}
+	if busy != 0 {
+		return fmt.Errorf("unable to checkpoint database: it is in use")
+	}
+	return nil
+}
+
+// VerifyDatabaseFile runs SQLite's integrity check against the database file
+// at path and returns the schema version it is migrated to. It fails if the
+// file is corrupt or was written by a newer version of the server than this
+// one.
+func VerifyDatabaseFile(path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, fmt.Errorf("unable to read database file: %w", err)
+	}
+	conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, fmt.Errorf("unable to open database file: %w", err)
+	}
+	defer conn.Close()
+
+	var result string
+	if err := conn.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return 0, fmt.Errorf("unable to check database integrity: %w", err)
+	}
+	if result != "ok" {
+		return 0, fmt.Errorf("database failed integrity check: %s", result)
+	}
+	var tables int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name IN ('conversations', 'messages')").Scan(&tables); err != nil {
+		return 0, fmt.Errorf("unable to read database schema: %w", err)
+	}
+	if tables != 2 {
+		return 0, fmt.Errorf("file is not a chat database")
+	}
+	var version int
+	if err := conn.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("unable to read schema version: %w", err)
+	}
+	if version > len(config.MIGRATIONS) {
+		return version, fmt.Errorf("database schema version %d is newer than the latest supported version %d", version, len(config.MIGRATIONS))
+	}
+	return version, nil
+}
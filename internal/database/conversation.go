@@ -2,7 +2,10 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/timsexperiments/chat-cli/internal/config"
@@ -10,23 +13,110 @@ import (
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-func (db *DB) CreateConversation(title string) (*chat.Conversation, error) {
-	result, err := db.Exec(config.CREATE_CONVERSATION_QUERY, title)
-	if err != nil {
-		return nil, fmt.Errorf("unable to create conversation: %w", err)
-	}
-	rowsAffected, err := result.RowsAffected()
+// The most characters of the last message shown when listing conversations.
+const previewLength = 120
+
+// ConversationFilter narrows down the conversations returned by
+// ListConversations.
+type ConversationFilter struct {
+	// Include archived conversations.
+	IncludeArchived bool
+	// Only include conversations that have every one of these tags.
+	Tags []string
+	// Only include conversations filed directly in this folder, when set.
+	FolderId int64
+	// Only include conversations whose title contains this, ignoring case.
+	Title string
+	// Only include conversations created at or after this time, when set.
+	CreatedAfter time.Time
+	// Only include conversations created before this time, when set.
+	CreatedBefore time.Time
+}
+
+// ConversationSort is what ListConversations orders conversations by. Ties
+// are broken by creation time and then id.
+type ConversationSort string
+
+const (
+	SortByCreated      ConversationSort = "created"
+	SortByLastActivity ConversationSort = "last_activity"
+	SortByTitle        ConversationSort = "title"
+)
+
+// ConversationOrder is the order ListConversations returns conversations in.
+type ConversationOrder struct {
+	Sort       ConversationSort
+	Descending bool
+}
+
+// CreateConversation creates a conversation filed in the given folder, 0 for
+// none, with the named tags.
+func (db *DB) CreateConversation(title string, folderId int64, tags []string) (*chat.Conversation, error) {
+	var conversation *chat.Conversation
+	err := db.WithTx(func(tx *DB) error {
+		result, err := tx.Exec(config.CREATE_CONVERSATION_QUERY, title, nullableId(folderId))
+		if isUniqueViolation(err, "conversations.title") {
+			return fmt.Errorf("unable to create conversation %q: %w", title, ErrDuplicateTitle)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to create conversation: %w", err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("unable to get rows affected: %w", err)
+		}
+		if rowsAffected != 1 {
+			return fmt.Errorf("expected 1 row to be affected, got %d", rowsAffected)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("unable to get last insert ID: %w", err)
+		}
+		if err := tx.SetConversationTags(id, tags); err != nil {
+			return err
+		}
+		if conversation, err = tx.GetConversation(int(id)); err != nil {
+			return err
+		}
+		if err := tx.emitWebhookEvent(WebhookConversationCreated, conversation, nil); err != nil {
+			return err
+		}
+		return tx.audit("conversation.create", auditConversation, id, conversationChanges(nil, conversation))
+	})
 	if err != nil {
-		return nil, fmt.Errorf("unable to get rows affected: %w", err)
-	}
-	if rowsAffected != 1 {
-		return nil, fmt.Errorf("expected 1 row to be affected, got %d", rowsAffected)
+		return nil, err
 	}
-	id, err := result.LastInsertId()
-	if err != nil {
-		return nil, fmt.Errorf("unable to get last insert ID: %w", err)
+	return conversation, nil
+}
+
+// CreateConversationWithFreeTitle creates a conversation like
+// CreateConversation, numbering its title if it is taken, see withFreeTitle.
+func (db *DB) CreateConversationWithFreeTitle(title string, folderId int64, tags []string) (*chat.Conversation, error) {
+	var conversation *chat.Conversation
+	err := withFreeTitle(title, func(title string) (err error) {
+		conversation, err = db.CreateConversation(title, folderId, tags)
+		return err
+	})
+	return conversation, err
+}
+
+// The most titles withFreeTitle tries before giving up.
+const maxTitleAttempts = 100
+
+// withFreeTitle calls create with title and, for as long as it fails with
+// ErrDuplicateTitle, with the numbered titles "title (2)", "title (3)" and so
+// on, up to maxTitleAttempts titles in all.
+func withFreeTitle(title string, create func(title string) error) error {
+	for attempt := 1; attempt <= maxTitleAttempts; attempt++ {
+		candidate := title
+		if attempt > 1 {
+			candidate = fmt.Sprintf("%s (%d)", title, attempt)
+		}
+		if err := create(candidate); !errors.Is(err, ErrDuplicateTitle) {
+			return err
+		}
 	}
-	return db.GetConversation(int(id))
+	return fmt.Errorf("unable to find a free title for %q after %d attempts: %w", title, maxTitleAttempts, ErrDuplicateTitle)
 }
 
 func (db *DB) GetConversationByTitle(title string) (*chat.Conversation, error) {
@@ -36,7 +126,7 @@ func (db *DB) GetConversationByTitle(title string) (*chat.Conversation, error) {
 	}
 
 	defer rows.Close()
-	return conversationWithMessagesFromRow(rows)
+	return db.conversationWithTags(db.conversationWithMessagesFromRow(rows))
 }
 
 func (db *DB) GetConversation(id int) (*chat.Conversation, error) {
@@ -46,130 +136,700 @@ func (db *DB) GetConversation(id int) (*chat.Conversation, error) {
 	}
 
 	defer rows.Close()
-	return conversationWithMessagesFromRow(rows)
+	return db.conversationWithTags(db.conversationWithMessagesFromRow(rows))
 }
 
-func (db *DB) ListConversations() ([]*chat.Conversation, error) {
-	rows, err := db.Query(config.LIST_CONVERSATIONS_QUERY)
+// ExportConversations returns every conversation that is not in the trash,
+// archived ones included, with their messages, oldest conversation first.
+func (db *DB) ExportConversations() ([]*chat.Conversation, error) {
+	rows, err := db.Query(config.EXPORT_CONVERSATIONS_QUERY)
+	if err != nil {
+		return nil, fmt.Errorf("unable to export conversations: %w", err)
+	}
+
+	defer rows.Close()
+	return db.conversationsWithTags(db.conversationsWithMessagesFromRows(rows))
+}
+
+// ListConversations lists the conversations that are not in the trash and
+// match the filter, in the given order. Each conversation includes its message
+// count, total tokens, last activity time and a preview of its last message.
+// At most limit conversations are returned, or all of them when limit is 0,
+// after skipping the first offset.
+func (db *DB) ListConversations(filter ConversationFilter, order ConversationOrder, limit, offset int) ([]*chat.Conversation, error) {
+	tags, err := json.Marshal(NormalizeTags(filter.Tags))
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode tag filter: %w", err)
+	}
+	if order.Sort == "" {
+		order.Sort = SortByCreated
+	}
+	if limit == 0 {
+		limit = -1
+	}
+	rows, err := db.Query(
+		config.LIST_CONVERSATIONS_QUERY,
+		filter.IncludeArchived,
+		nullableId(filter.FolderId),
+		string(tags),
+		filter.Title,
+		optionalTime(filter.CreatedAfter),
+		optionalTime(filter.CreatedBefore),
+		string(order.Sort),
+		order.Descending,
+		limit,
+		offset)
 	if err != nil {
 		return nil, fmt.Errorf("unable to list conversations: %w", err)
 	}
 
 	defer rows.Close()
-	conversations := []*chat.Conversation{}
-	for rows.Next() {
-		var id *int64
-		var completionId, title, context *string
-		var createdAt *time.Time
-		if err := rows.Scan(&id, &completionId, &title, &context, &createdAt); err != nil {
-			return nil, fmt.Errorf("unable to build conversation: %w", err)
+	return db.conversationsWithTags(db.conversationSummariesFromRows(rows))
+}
+
+// optionalTime formats t for a query, or returns nil when t is not set.
+func optionalTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return sqlTimestamp(t)
+}
+
+// UpdateConversation stores the completion id, title and context of the
+// conversation. The update only goes through if the conversation is still at
+// conversation.Version, otherwise ErrVersionConflict is returned. A version of
+// 0 updates the conversation whatever its version.
+func (db *DB) UpdateConversation(conversation *chat.Conversation) (*chat.Conversation, error) {
+	context, contextKeyId, err := db.seal(conversationContextColumn, conversation.Id, conversation.Context)
+	if err != nil {
+		return nil, err
+	}
+	var updated *chat.Conversation
+	err = db.WithTx(func(tx *DB) error {
+		before, err := tx.conversationMetadata(conversation.Id)
+		if err != nil {
+			return err
+		}
+		err = tx.execVersioned(
+			config.UPDATE_CONVERSATION_QUERY,
+			conversation.Id,
+			conversation.Version,
+			conversation.CompletionId,
+			conversation.Title,
+			context,
+			contextKeyId)
+		if isUniqueViolation(err, "conversations.title") {
+			return fmt.Errorf("unable to update conversation %d: %w", conversation.Id, ErrDuplicateTitle)
 		}
-		if id == nil || title == nil || createdAt == nil {
-			return nil, fmt.Errorf("missing required fields. id = %v, title = %v, context = %v, createdAt = %v: %w", id, title, context, createdAt, err)
+		if err != nil {
+			return fmt.Errorf("unable to update conversation %d: %w", conversation.Id, err)
 		}
-		conversation := &chat.Conversation{
-			Id:        *id,
-			Title:     *title,
-			CreatedAt: timestamppb.New(*createdAt),
-			Messages:  nil,
+		if updated, err = tx.GetConversation(int(conversation.Id)); err != nil {
+			return err
 		}
-		if context != nil {
-			conversation.Context = *context
+		return tx.audit("conversation.update", auditConversation, conversation.Id, conversationChanges(before, updated))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// UpdateConversationMetadata stores the user editable fields of the
+// conversation: its title, context, archived flag and settings. Like
+// UpdateConversation, it fails with ErrVersionConflict if the conversation is
+// no longer at conversation.Version.
+func (db *DB) UpdateConversationMetadata(conversation *chat.Conversation) (*chat.Conversation, error) {
+	var model *string
+	var temperature *float64
+	if settings := conversation.GetSettings(); settings != nil {
+		if settings.Model != "" {
+			model = &settings.Model
+		}
+		temperature = settings.Temperature
+	}
+	context, contextKeyId, err := db.seal(conversationContextColumn, conversation.Id, conversation.Context)
+	if err != nil {
+		return nil, err
+	}
+	var updated *chat.Conversation
+	err = db.WithTx(func(tx *DB) error {
+		before, err := tx.conversationMetadata(conversation.Id)
+		if err != nil {
+			return err
 		}
-		if completionId != nil {
-			conversation.CompletionId = *completionId
+		err = tx.execVersioned(
+			config.UPDATE_CONVERSATION_METADATA_QUERY,
+			conversation.Id,
+			conversation.Version,
+			conversation.Title,
+			context,
+			contextKeyId,
+			conversation.Archived,
+			model,
+			temperature,
+			nullableId(conversation.FolderId))
+		if isUniqueViolation(err, "conversations.title") {
+			return fmt.Errorf("unable to update conversation %d: %w", conversation.Id, ErrDuplicateTitle)
 		}
-		conversations = append(conversations, conversation)
+		if err != nil {
+			return fmt.Errorf("unable to update conversation %d: %w", conversation.Id, err)
+		}
+		if err := tx.SetConversationTags(conversation.Id, conversation.Tags); err != nil {
+			return err
+		}
+		if updated, err = tx.GetConversation(int(conversation.Id)); err != nil {
+			return err
+		}
+		return tx.audit("conversation.update", auditConversation, conversation.Id, conversationChanges(before, updated))
+	})
+	if err != nil {
+		return nil, err
 	}
+	return updated, nil
+}
 
-	return conversations, nil
+// SetConversationArchived archives or unarchives the conversation with the
+// given id, if it is still at version. A version of 0 skips the check.
+func (db *DB) SetConversationArchived(id int, archived bool, version int64) (*chat.Conversation, error) {
+	action := "conversation.archive"
+	if !archived {
+		action = "conversation.unarchive"
+	}
+	return db.changeConversation(int64(id), action, func(tx *DB) error {
+		if err := tx.execVersioned(config.ARCHIVE_CONVERSATION_QUERY, int64(id), version, archived); err != nil {
+			return fmt.Errorf("unable to archive conversation %d: %w", id, err)
+		}
+		return nil
+	})
 }
 
-func (db *DB) UpdateConversation(conversation *chat.Conversation) (*chat.Conversation, error) {
-	result, err := db.Exec(
-		config.UPDATE_CONVERSATION_QUERY,
-		conversation.CompletionId,
-		conversation.Title,
-		conversation.Context,
-		conversation.Id)
+// TagConversation puts the named tag on the conversation with the given id,
+// if it is still at version. A version of 0 skips the check.
+func (db *DB) TagConversation(id int64, name string, version int64) (*chat.Conversation, error) {
+	return db.changeConversation(id, "conversation.tag", func(tx *DB) error {
+		if err := tx.touchConversation(id, version); err != nil {
+			return err
+		}
+		return tx.AddConversationTag(id, name)
+	})
+}
+
+// UntagConversation takes the named tag off the conversation with the given
+// id, if it is still at version. A version of 0 skips the check.
+func (db *DB) UntagConversation(id int64, name string, version int64) (*chat.Conversation, error) {
+	return db.changeConversation(id, "conversation.untag", func(tx *DB) error {
+		if err := tx.touchConversation(id, version); err != nil {
+			return err
+		}
+		return tx.RemoveConversationTag(id, name)
+	})
+}
+
+// changeConversation runs change in a transaction and records it in the audit
+// log as action, with the differences it made to the conversation with the
+// given id. It returns the conversation as it is after the change.
+func (db *DB) changeConversation(id int64, action string, change func(tx *DB) error) (*chat.Conversation, error) {
+	var updated *chat.Conversation
+	err := db.WithTx(func(tx *DB) error {
+		before, err := tx.conversationMetadata(id)
+		if err != nil {
+			return err
+		}
+		if err := change(tx); err != nil {
+			return err
+		}
+		if updated, err = tx.GetConversation(int(id)); err != nil {
+			return err
+		}
+		return tx.audit(action, auditConversation, id, conversationChanges(before, updated))
+	})
 	if err != nil {
-		return nil, fmt.Errorf("unable to update conversation: %w", err)
+		return nil, err
+	}
+	return updated, nil
+}
+
+// touchConversation moves the conversation with the given id on to its next
+// version without changing anything else, for changes to the conversation
+// that are stored outside of its own row, like its tags. It fails with
+// ErrVersionConflict if the conversation is no longer at version, unless
+// version is 0.
+func (db *DB) touchConversation(id int64, version int64) error {
+	if err := db.execVersioned(config.TOUCH_CONVERSATION_QUERY, id, version); err != nil {
+		return fmt.Errorf("unable to update conversation %d: %w", id, err)
+	}
+	return nil
+}
+
+// execVersioned runs an update of the conversation with the given id that
+// only applies when the conversation is at version. The query takes args
+// first, followed by the id and the version. When nothing is updated because
+// the conversation has moved on to another version, ErrVersionConflict is
+// returned, and ErrNotFound when there is nothing to update.
+func (db *DB) execVersioned(queryName string, id, version int64, args ...any) error {
+	result, err := db.Exec(queryName, append(args, id, version)...)
+	if err != nil {
+		return err
 	}
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return nil, fmt.Errorf("unable to get rows affected: %w", err)
+		return fmt.Errorf("unable to get rows affected: %w", err)
+	}
+	if rowsAffected == 1 {
+		return nil
+	}
+	if version != 0 {
+		current, err := db.conversationVersion(id)
+		if err != nil {
+			return err
+		}
+		if current != 0 && current != version {
+			return ErrVersionConflict
+		}
+	}
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+	return fmt.Errorf("expected 1 row to be affected, got %d", rowsAffected)
+}
+
+// conversationVersion returns the current version of the conversation with
+// the given id, or 0 if there is no such conversation.
+func (db *DB) conversationVersion(id int64) (int64, error) {
+	rows, err := db.Query(config.GET_CONVERSATION_VERSION_QUERY, id)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get conversation version: %w", err)
 	}
-	if rowsAffected != 1 {
-		return nil, fmt.Errorf("expected 1 row to be affected, got %d", rowsAffected)
+	defer rows.Close()
+	var version int64
+	if rows.Next() {
+		if err := rows.Scan(&version); err != nil {
+			return 0, fmt.Errorf("unable to read conversation version: %w", err)
+		}
 	}
-	return db.GetConversation(int(conversation.Id))
+	return version, rows.Err()
+}
+
+// DeleteConversation moves the conversation with the given id to the trash,
+// if it is still at version. A version of 0 skips the check. It can be brought
+// back with RestoreConversation until the trash is purged, and its title can
+// be given to other conversations meanwhile.
+func (db *DB) DeleteConversation(id int, version int64) error {
+	return db.removeConversation(int64(id), "conversation.delete", config.DELETE_CONVERSATION_QUERY, version)
+}
+
+// RestoreConversation brings the conversation with the given id back out of
+// the trash. It fails with ErrDuplicateTitle if its title was given to another
+// conversation while it was in the trash.
+func (db *DB) RestoreConversation(id int) (*chat.Conversation, error) {
+	return db.changeConversation(int64(id), "conversation.restore", func(tx *DB) error {
+		err := tx.execOne(config.RESTORE_CONVERSATION_QUERY, id)
+		if isUniqueViolation(err, "conversations.title") {
+			return fmt.Errorf("unable to restore conversation %d: %w", id, ErrDuplicateTitle)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to restore conversation %d: %w", id, err)
+		}
+		return nil
+	})
+}
+
+// PurgeConversation permanently deletes the conversation with the given id,
+// whether or not it is in the trash, if it is still at version. A version of 0
+// skips the check. Its messages are removed by the foreign key cascade.
+func (db *DB) PurgeConversation(id int, version int64) error {
+	return db.removeConversation(int64(id), "conversation.purge", config.PURGE_CONVERSATION_QUERY, version)
 }
 
-func conversationWithMessagesFromRow(rows *sql.Rows) (*chat.Conversation, error) {
+// removeConversation deletes or purges the conversation with the given id
+// with the named query and records it in the audit log as action.
+func (db *DB) removeConversation(id int64, action, queryName string, version int64) error {
+	return db.WithTx(func(tx *DB) error {
+		before, err := tx.conversationMetadata(id)
+		if err != nil {
+			return err
+		}
+		if err := tx.execVersioned(queryName, id, version); err != nil {
+			return fmt.Errorf("unable to %s conversation %d: %w", strings.TrimPrefix(action, "conversation."), id, err)
+		}
+		after, err := tx.conversationMetadata(id)
+		if err != nil {
+			return err
+		}
+		// Purging a conversation that is already in the trash does not
+		// delete it again.
+		if before.DeletedAt == nil {
+			deleted := after
+			if deleted == nil {
+				deleted = before
+			}
+			if err := tx.emitWebhookEvent(WebhookConversationDeleted, deleted, nil); err != nil {
+				return err
+			}
+		}
+		return tx.audit(action, auditConversation, id, conversationChanges(before, after))
+	})
+}
+
+// ListTrash lists the conversations and messages that are currently in the
+// trash.
+func (db *DB) ListTrash() ([]*chat.Conversation, []*chat.Message, error) {
+	conversationRows, err := db.Query(config.LIST_DELETED_CONVERSATIONS_QUERY)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to list deleted conversations: %w", err)
+	}
+	defer conversationRows.Close()
+	conversations, err := db.conversationsWithTags(db.conversationsFromRows(conversationRows))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	messageRows, err := db.Query(config.LIST_DELETED_MESSAGES_QUERY)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to list deleted messages: %w", err)
+	}
+	defer messageRows.Close()
+	messages, err := db.messagesFromRows(messageRows)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return conversations, messages, nil
+}
+
+// PurgeTrash permanently deletes every conversation and message that was moved
+// to the trash before the given time. It returns the number of conversations
+// and messages removed.
+func (db *DB) PurgeTrash(before time.Time) (conversations, messages int64, err error) {
+	cutoff := sqlTimestamp(before)
+	err = db.WithTx(func(tx *DB) error {
+		result, err := tx.Exec(config.PURGE_TRASH_MESSAGES_QUERY, cutoff)
+		if err != nil {
+			return fmt.Errorf("unable to purge deleted messages: %w", err)
+		}
+		if messages, err = result.RowsAffected(); err != nil {
+			return fmt.Errorf("unable to get rows affected: %w", err)
+		}
+		result, err = tx.Exec(config.PURGE_TRASH_CONVERSATIONS_QUERY, cutoff)
+		if err != nil {
+			return fmt.Errorf("unable to purge deleted conversations: %w", err)
+		}
+		if conversations, err = result.RowsAffected(); err != nil {
+			return fmt.Errorf("unable to get rows affected: %w", err)
+		}
+		if conversations == 0 && messages == 0 {
+			return nil
+		}
+		changes := auditChanges{}
+		changes.set("conversations_purged", nil, conversations)
+		changes.set("messages_purged", nil, messages)
+		return tx.audit("trash.purge", auditTrash, 0, changes)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return conversations, messages, nil
+}
+
+// conversationWithTags fills in the tags of a conversation that was just read.
+func (db *DB) conversationWithTags(conversation *chat.Conversation, err error) (*chat.Conversation, error) {
+	if err != nil {
+		return nil, err
+	}
+	if conversation.Tags, err = db.getConversationTags(conversation.Id); err != nil {
+		return nil, err
+	}
+	return conversation, nil
+}
+
+// conversationsWithTags fills in the tags of conversations that were just read.
+func (db *DB) conversationsWithTags(conversations []*chat.Conversation, err error) ([]*chat.Conversation, error) {
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, len(conversations))
+	for i, conversation := range conversations {
+		ids[i] = conversation.Id
+	}
+	tags, err := db.listConversationTags(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, conversation := range conversations {
+		conversation.Tags = tags[conversation.Id]
+	}
+	return conversations, nil
+}
+
+func (db *DB) conversationsFromRows(rows *sql.Rows) ([]*chat.Conversation, error) {
+	conversations := []*chat.Conversation{}
+	for rows.Next() {
+		conversation, err := db.scanConversation(rows)
+		if err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, conversation)
+	}
+
+	return conversations, rows.Err()
+}
+
+// conversationSummariesFromRows builds conversations from rows that also hold
+// the message count, total tokens and last message of each conversation.
+func (db *DB) conversationSummariesFromRows(rows *sql.Rows) ([]*chat.Conversation, error) {
+	conversations := []*chat.Conversation{}
+	for rows.Next() {
+		var messageCount, totalTokens int64
+		var lastMessageId *int64
+		var lastMessageBody, lastMessageBodyKeyId *string
+		var lastMessageCreatedAt *time.Time
+		conversation, err := db.scanConversation(rows, &messageCount, &totalTokens, &lastMessageId, &lastMessageBody, &lastMessageBodyKeyId, &lastMessageCreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		conversation.MessageCount = messageCount
+		conversation.TotalTokens = totalTokens
+		conversation.LastActivityAt = conversation.CreatedAt
+		if lastMessageCreatedAt != nil {
+			conversation.LastActivityAt = timestamppb.New(*lastMessageCreatedAt)
+		}
+		if lastMessageId != nil && lastMessageBody != nil {
+			body, err := db.open(messageBodyColumn, *lastMessageId, *lastMessageBody, lastMessageBodyKeyId)
+			if err != nil {
+				return nil, fmt.Errorf("last message of conversation %d: %w", conversation.Id, err)
+			}
+			conversation.LastMessagePreview = preview(body)
+		}
+		conversations = append(conversations, conversation)
+	}
+
+	return conversations, rows.Err()
+}
+
+// scanConversation builds a conversation from the current row, scanning any
+// columns after the conversation's own into extra.
+func (db *DB) scanConversation(rows *sql.Rows, extra ...any) (*chat.Conversation, error) {
+	var id, folderId *int64
+	var completionId, title, context, contextKeyId, model *string
+	var temperature *float64
+	var createdAt, deletedAt *time.Time
+	var archived bool
+	var version int64
+	dest := append([]any{&id, &completionId, &title, &context, &createdAt, &archived, &model, &temperature, &folderId, &deletedAt, &contextKeyId, &version}, extra...)
+	if err := rows.Scan(dest...); err != nil {
+		return nil, fmt.Errorf("unable to build conversation: %w", err)
+	}
+	if id == nil || title == nil || createdAt == nil {
+		return nil, fmt.Errorf("missing required fields. id = %v, title = %v, context = %v, createdAt = %v", id, title, context, createdAt)
+	}
+	conversation := &chat.Conversation{
+		Id:        *id,
+		Title:     *title,
+		CreatedAt: timestamppb.New(*createdAt),
+		Archived:  archived,
+		Settings:  conversationSettings(model, temperature),
+		Messages:  nil,
+		Version:   version,
+	}
+	if context != nil {
+		plaintext, err := db.open(conversationContextColumn, *id, *context, contextKeyId)
+		if err != nil {
+			return nil, fmt.Errorf("conversation %d: %w", *id, err)
+		}
+		conversation.Context = plaintext
+	}
+	if completionId != nil {
+		conversation.CompletionId = *completionId
+	}
+	if folderId != nil {
+		conversation.FolderId = *folderId
+	}
+	if deletedAt != nil {
+		conversation.DeletedAt = timestamppb.New(*deletedAt)
+	}
+	return conversation, nil
+}
+
+// preview shortens a message body to a single line of at most
+// previewLength characters.
+func preview(body string) string {
+	runes := []rune(strings.Join(strings.Fields(body), " "))
+	if len(runes) <= previewLength {
+		return string(runes)
+	}
+	return string(runes[:previewLength-1]) + "…"
+}
+
+func (db *DB) conversationWithMessagesFromRow(rows *sql.Rows) (*chat.Conversation, error) {
+	conversations, err := db.conversationsWithMessagesFromRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(conversations) == 0 {
+		return nil, fmt.Errorf("conversation %w", ErrNotFound)
+	}
+	if len(conversations) > 1 {
+		return nil, fmt.Errorf("expected conversation with id [%d], got conversation with id [%d]", conversations[0].Id, conversations[1].Id)
+	}
+	return conversations[0], nil
+}
+
+// conversationsWithMessagesFromRows reads conversations along with their
+// messages from rows that hold one message each, or one row without a message
+// for a conversation that has none. The rows of a conversation must come one
+// after the other.
+func (db *DB) conversationsWithMessagesFromRows(rows *sql.Rows) ([]*chat.Conversation, error) {
+	conversations := []*chat.Conversation{}
 	var conversation *chat.Conversation
-	var conversationId *int64
-	messages := make([]*chat.Message, 0)
 	for rows.Next() {
-		var id int64
-		var completionId, context *string
+		var id, version int64
+		var completionId, context, contextKeyId, model *string
+		var temperature *float64
 		var title string
 		var createdAt time.Time
-		var messageId *int64
-		var messageBody, messageSender *string
-		var messageCreatedAt *time.Time
+		var archived bool
+		var folderId, messageId *int64
+		var messageBody, messageBodyKeyId, messageSender, messageStatus *string
+		var messageReplyTo *int64
+		var messageCreatedAt, messageRedactedAt *time.Time
+		var pinNote *string
+		var pinIncludeInContext *bool
+		var pinCreatedAt *time.Time
+		var messageModel, feedbackThumb, feedbackNote, feedbackCategories *string
+		var feedbackScore *int32
+		var feedbackCreatedAt, feedbackUpdatedAt *time.Time
 		if err := rows.Scan(
 			&id,
 			&completionId,
 			&title,
 			&context,
 			&createdAt,
+			&archived,
+			&model,
+			&temperature,
+			&folderId,
+			&contextKeyId,
+			&version,
 			&messageId,
 			&messageBody,
 			&messageSender,
 			&messageCreatedAt,
+			&messageStatus,
+			&messageReplyTo,
+			&messageRedactedAt,
+			&messageBodyKeyId,
+			&messageModel,
+			&pinNote,
+			&pinIncludeInContext,
+			&pinCreatedAt,
+			&feedbackThumb,
+			&feedbackScore,
+			&feedbackNote,
+			&feedbackCategories,
+			&feedbackCreatedAt,
+			&feedbackUpdatedAt,
 		); err != nil {
 			return nil, fmt.Errorf("unable to build conversation: %w", err)
 		}
-		if conversationId == nil {
-			conversationId = &id
+		if conversation == nil || conversation.Id != id {
 			conversation = &chat.Conversation{
 				Id:        id,
 				Title:     title,
 				CreatedAt: timestamppb.New(createdAt),
+				Archived:  archived,
+				Settings:  conversationSettings(model, temperature),
 				Messages:  nil,
+				Version:   version,
 			}
 			if context != nil {
-				conversation.Context = *context
+				plaintext, err := db.open(conversationContextColumn, id, *context, contextKeyId)
+				if err != nil {
+					return nil, fmt.Errorf("conversation %d: %w", id, err)
+				}
+				conversation.Context = plaintext
 			}
 			if completionId != nil {
 				conversation.CompletionId = *completionId
 			}
+			if folderId != nil {
+				conversation.FolderId = *folderId
+			}
+			conversations = append(conversations, conversation)
 		}
-		if id != *conversationId {
-			return nil, fmt.Errorf("expected conversation with id [%d], got conversation with id [%d]", *conversationId, id)
-		}
-		if messageId == nil || messageBody == nil || messageSender == nil || messageCreatedAt == nil {
+		if messageId == nil || messageBody == nil || messageSender == nil || messageCreatedAt == nil || messageStatus == nil {
 			continue
 		}
 		senderValue, ok := chat.Message_Sender_value[*messageSender]
 		if !ok {
-			return nil, fmt.Errorf("unable to parse sender one conversation message %d", messageId)
+			return nil, fmt.Errorf("unable to parse sender one conversation message %d", *messageId)
+		}
+		statusValue, ok := chat.Message_Status_value[*messageStatus]
+		if !ok {
+			return nil, fmt.Errorf("unable to parse status on conversation message %d", *messageId)
+		}
+		body, err := db.open(messageBodyColumn, *messageId, *messageBody, messageBodyKeyId)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", *messageId, err)
+		}
+		message := &chat.Message{
+			Id:             *messageId,
+			Body:           body,
+			Sender:         chat.Message_Sender(senderValue),
+			CreatedAt:      timestamppb.New(*messageCreatedAt),
+			ConversationId: id,
+			Status:         chat.Message_Status(statusValue),
+		}
+		if messageReplyTo != nil {
+			message.ReplyTo = *messageReplyTo
+		}
+		if messageRedactedAt != nil {
+			message.RedactedAt = timestamppb.New(*messageRedactedAt)
 		}
-		messages = append(messages, &chat.Message{
-			Id:        *messageId,
-			Body:      *messageBody,
-			Sender:    chat.Message_Sender(senderValue),
-			CreatedAt: timestamppb.New(*messageCreatedAt),
-		})
+		if pinCreatedAt != nil {
+			message.Pin = &chat.Pin{
+				MessageId:      message.Id,
+				ConversationId: id,
+				CreatedAt:      timestamppb.New(*pinCreatedAt),
+			}
+			if pinNote != nil {
+				message.Pin.Note = *pinNote
+			}
+			if pinIncludeInContext != nil {
+				message.Pin.IncludeInContext = *pinIncludeInContext
+			}
+		}
+		if feedbackCreatedAt != nil && feedbackUpdatedAt != nil && feedbackCategories != nil {
+			message.Feedback = &chat.Feedback{
+				MessageId:      message.Id,
+				ConversationId: id,
+				Score:          feedbackScore,
+				CreatedAt:      timestamppb.New(*feedbackCreatedAt),
+				UpdatedAt:      timestamppb.New(*feedbackUpdatedAt),
+			}
+			if err := setFeedbackValues(message.Feedback, feedbackThumb, *feedbackCategories); err != nil {
+				return nil, fmt.Errorf("rating of message %d: %w", message.Id, err)
+			}
+			if feedbackNote != nil {
+				message.Feedback.Note = *feedbackNote
+			}
+			if messageModel != nil {
+				message.Feedback.Model = *messageModel
+			}
+		}
+		conversation.Messages = append(conversation.Messages, message)
 	}
 
-	if conversation == nil {
-		return nil, fmt.Errorf("conversation not found")
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read conversations: %w", err)
 	}
+	return conversations, nil
+}
 
-	if len(messages) > 0 {
-		conversation.Messages = messages
+func conversationSettings(model *string, temperature *float64) *chat.ConversationSettings {
+	settings := &chat.ConversationSettings{Temperature: temperature}
+	if model != nil {
+		settings.Model = *model
 	}
-
-	return conversation, nil
+	return settings
 }
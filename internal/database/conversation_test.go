@@ -0,0 +1,232 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTrashedConversationFreesItsTitle(t *testing.T) {
+	db := newTestDB(t, nil)
+	trashed, err := db.CreateConversation("Plans", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteConversation(int(trashed.Id), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	conversations, _, err := db.ListTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conversations) != 1 || conversations[0].Title != "Plans" {
+		t.Fatalf("expected the trash to list %q, got %v", "Plans", conversations)
+	}
+
+	reused, err := db.CreateConversation("Plans", 0, nil)
+	if err != nil {
+		t.Fatalf("expected the title of a trashed conversation to be free, got %v", err)
+	}
+	if _, err := db.RestoreConversation(int(trashed.Id)); !errors.Is(err, ErrDuplicateTitle) {
+		t.Fatalf("expected restoring onto a taken title to fail with ErrDuplicateTitle, got %v", err)
+	}
+
+	if err := db.DeleteConversation(int(reused.Id), 0); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := db.RestoreConversation(int(trashed.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Title != "Plans" {
+		t.Fatalf("expected the restored conversation to get its title back, got %q", restored.Title)
+	}
+}
+
+func TestMissingConversationsAreNotFound(t *testing.T) {
+	db := newTestDB(t, nil)
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{"delete", func() error { return db.DeleteConversation(404, 0) }},
+		{"purge", func() error { return db.PurgeConversation(404, 0) }},
+		{"restore", func() error {
+			_, err := db.RestoreConversation(404)
+			return err
+		}},
+		{"archive", func() error {
+			_, err := db.SetConversationArchived(404, true, 0)
+			return err
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.run(); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expected ErrNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+func TestPurgeTrashKeepsRecentItems(t *testing.T) {
+	db := newTestDB(t, nil)
+	conversation, err := db.CreateConversation("Recent", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteConversation(int(conversation.Id), 0); err != nil {
+		t.Fatal(err)
+	}
+	if purged, _, err := db.PurgeTrash(time.Now().Add(-time.Hour)); err != nil || purged != 0 {
+		t.Fatalf("expected nothing to be purged, got %d, %v", purged, err)
+	}
+	if purged, _, err := db.PurgeTrash(time.Now().Add(time.Minute)); err != nil || purged != 1 {
+		t.Fatalf("expected the conversation to be purged, got %d, %v", purged, err)
+	}
+}
+
+func TestExportConversations(t *testing.T) {
+	db := newTestDB(t, nil)
+	create := func(title string, bodies ...string) int64 {
+		conversation, err := db.CreateConversation(title, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, body := range bodies {
+			if _, err := db.CreateMessage(body, chat.Message_USER, conversation.Id); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return conversation.Id
+	}
+	first := create("First", "one", "two")
+	empty := create("Empty")
+	archived := create("Archived", "three")
+	if _, err := db.SetConversationArchived(int(archived), true, 0); err != nil {
+		t.Fatal(err)
+	}
+	trashed := create("Trashed", "four")
+	if err := db.DeleteConversation(int(trashed), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	exported, err := db.ExportConversations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []int64{}
+	for _, conversation := range exported {
+		ids = append(ids, conversation.Id)
+		want, err := db.GetConversation(int(conversation.Id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(conversation, want) {
+			t.Errorf("expected the export of conversation %d to match GetConversation:\n%v\n%v", conversation.Id, conversation, want)
+		}
+	}
+	if want := []int64{first, empty, archived}; !slices.Equal(ids, want) {
+		t.Fatalf("expected conversations %v, got %v", want, ids)
+	}
+}
+
+func TestListedConversationsHaveTheirTags(t *testing.T) {
+	db := newTestDB(t, nil)
+	tags := map[string][]string{"Work": {"work"}, "Both": {"home", "work"}, "None": nil}
+	for _, title := range []string{"Work", "Both", "None"} {
+		if _, err := db.CreateConversation(title, 0, tags[title]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, page := range []struct{ limit, offset int }{{2, 0}, {2, 2}} {
+		conversations, err := db.ListConversations(ConversationFilter{}, ConversationOrder{}, page.limit, page.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, conversation := range conversations {
+			if !slices.Equal(conversation.Tags, tags[conversation.Title]) {
+				t.Fatalf("expected %q to be tagged %v, got %v", conversation.Title, tags[conversation.Title], conversation.Tags)
+			}
+		}
+	}
+}
+
+func TestStaleVersionsConflict(t *testing.T) {
+	db := newTestDB(t, nil)
+	tests := []struct {
+		name   string
+		change func(conversation *chat.Conversation, version int64) error
+	}{
+		{"update", func(conversation *chat.Conversation, version int64) error {
+			conversation.Version = version
+			conversation.Context = "Be brief."
+			_, err := db.UpdateConversationMetadata(conversation)
+			return err
+		}},
+		{"archive", func(conversation *chat.Conversation, version int64) error {
+			_, err := db.SetConversationArchived(int(conversation.Id), true, version)
+			return err
+		}},
+		{"tag", func(conversation *chat.Conversation, version int64) error {
+			_, err := db.TagConversation(conversation.Id, "work", version)
+			return err
+		}},
+		{"delete", func(conversation *chat.Conversation, version int64) error {
+			return db.DeleteConversation(int(conversation.Id), version)
+		}},
+		{"purge", func(conversation *chat.Conversation, version int64) error {
+			return db.PurgeConversation(int(conversation.Id), version)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stale, err := db.CreateConversation(test.name, 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conversation, err := db.TagConversation(stale.Id, "changed", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := test.change(proto.Clone(conversation).(*chat.Conversation), stale.Version); !errors.Is(err, ErrVersionConflict) {
+				t.Fatalf("expected a change against a stale version to fail with ErrVersionConflict, got %v", err)
+			}
+			unchanged, err := db.GetConversation(int(conversation.Id))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unchanged.Version != conversation.Version {
+				t.Fatalf("expected the conversation to stay at version %d, got %d", conversation.Version, unchanged.Version)
+			}
+			if err := test.change(proto.Clone(conversation).(*chat.Conversation), conversation.Version); err != nil {
+				t.Fatalf("expected a change against the current version to go through, got %v", err)
+			}
+		})
+	}
+}
+
+func TestImportedConversationTitles(t *testing.T) {
+	db := newTestDB(t, nil)
+	if _, err := db.CreateConversation("Notes", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ImportConversation(&chat.Conversation{Title: "Notes"}, false); !errors.Is(err, ErrDuplicateTitle) {
+		t.Fatalf("expected importing onto a taken title to fail with ErrDuplicateTitle, got %v", err)
+	}
+	for _, want := range []string{"Notes (2)", "Notes (3)"} {
+		imported, err := db.ImportConversation(&chat.Conversation{Title: "Notes"}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imported.Title != want {
+			t.Fatalf("expected the conversation to be imported as %q, got %q", want, imported.Title)
+		}
+	}
+}
@@ -3,21 +3,41 @@ package database
 import (
 	"database/sql"
 	"fmt"
+	"time"
 
 	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/encryption"
 )
 
 type DB struct {
-	sql     *sql.DB
+	sql *sql.DB
+	// conn runs the queries. It is the *sql.DB itself, or the *sql.Tx when the
+	// DB was handed out by WithTx.
+	conn    executor
 	queries *queryCache
+	// keys encrypts message bodies and conversation contexts. Nothing is
+	// encrypted when it is nil.
+	keys *encryption.Keyring
+	// actor is who changes are recorded against in the audit log.
+	actor Actor
 }
 
-func CreateDB(sql *sql.DB) *DB {
-	db := &DB{sql: sql, queries: newQueryCache()}
+type executor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// CreateDB initializes and migrates the database. Message bodies and
+// conversation contexts are encrypted with keys, when it is not nil.
+func CreateDB(sql *sql.DB, keys *encryption.Keyring) *DB {
+	db := &DB{sql: sql, conn: sql, queries: newQueryCache(), keys: keys}
 	_, err := db.Exec(config.INIT_QUERY)
 	if err != nil {
 		panic(fmt.Errorf("unable to initialize database: %w", err))
 	}
+	if err := db.migrate(); err != nil {
+		panic(fmt.Errorf("unable to migrate database: %w", err))
+	}
 	return db
 }
 
@@ -26,7 +46,7 @@ func (db *DB) Exec(queryName string, args ...any) (sql.Result, error) {
 	if err != nil {
 		return nil, fmt.Errorf("query %s not found: %w", queryName, err)
 	}
-	return db.sql.Exec(query, args...)
+	return db.conn.Exec(query, args...)
 }
 
 func (db *DB) Query(queryName string, args ...any) (*sql.Rows, error) {
@@ -34,5 +54,103 @@ func (db *DB) Query(queryName string, args ...any) (*sql.Rows, error) {
 	if err != nil {
 		return nil, fmt.Errorf("query %s not found: %w", queryName, err)
 	}
-	return db.sql.Query(query, args...)
+	return db.conn.Query(query, args...)
+}
+
+// WithTx runs fn as a single unit of work. The DB passed to fn runs every query
+// inside one transaction, which is committed if fn returns nil and rolled back
+// otherwise. Calling WithTx on a DB that is already inside a transaction runs
+// fn as part of that transaction.
+func (db *DB) WithTx(fn func(tx *DB) error) (err error) {
+	if _, ok := db.conn.(*sql.Tx); ok {
+		return fn(db)
+	}
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to begin transaction: %w", err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	if err = fn(&DB{sql: db.sql, conn: tx, queries: db.queries, keys: db.keys, actor: db.actor}); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("unable to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// SchemaVersion returns the version of the schema the database is currently
+// migrated to.
+func (db *DB) SchemaVersion() (int, error) {
+	var version int
+	if err := db.sql.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("unable to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// migrate applies every migration in config.MIGRATIONS that has not yet been
+// applied. The schema version is tracked in SQLite's user_version pragma so
+// each migration runs exactly once, inside its own transaction.
+func (db *DB) migrate() error {
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	for i := version; i < len(config.MIGRATIONS); i++ {
+		query, err := db.queries.GetQuery(config.MIGRATIONS[i])
+		if err != nil {
+			return fmt.Errorf("migration %s not found: %w", config.MIGRATIONS[i], err)
+		}
+		tx, err := db.sql.Begin()
+		if err != nil {
+			return fmt.Errorf("unable to begin migration %s: %w", config.MIGRATIONS[i], err)
+		}
+		if _, err := tx.Exec(query); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("unable to apply migration %s: %w", config.MIGRATIONS[i], err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("unable to record migration %s: %w", config.MIGRATIONS[i], err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("unable to commit migration %s: %w", config.MIGRATIONS[i], err)
+		}
+	}
+	return nil
+}
+
+// execOne runs the named query and fails unless exactly one row was affected,
+// with ErrNotFound when no row was.
+func (db *DB) execOne(queryName string, args ...any) error {
+	result, err := db.Exec(queryName, args...)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("unable to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+	if rowsAffected != 1 {
+		return fmt.Errorf("expected 1 row to be affected, got %d", rowsAffected)
+	}
+	return nil
+}
+
+// sqlTimestamp formats t the same way SQLite's CURRENT_TIMESTAMP does so the
+// two can be compared directly in queries.
+func sqlTimestamp(t time.Time) string {
+	return t.UTC().Format(time.DateTime)
 }
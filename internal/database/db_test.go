@@ -0,0 +1,83 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/encryption"
+)
+
+func TestMain(m *testing.M) {
+	// Queries are read from the queries directory at the root of the
+	// repository.
+	if err := os.Chdir("../.."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestDB returns a migrated in-memory database of its own for the test,
+// which encrypts with keys when it is not nil.
+func newTestDB(t *testing.T, keys *encryption.Keyring) *DB {
+	t.Helper()
+	cfg := *config.GetConfig()
+	cfg.DatabaseDSN = fmt.Sprintf("file:/%s.db?vfs=memdb", strings.NewReplacer("/", "_", " ", "_").Replace(t.Name()))
+	sqlDB, err := Open(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	return CreateDB(sqlDB, keys)
+}
+
+// newTestKeyring returns a keyring with a key for each id, the first of which
+// is the active one.
+func newTestKeyring(t *testing.T, ids ...string) *encryption.Keyring {
+	t.Helper()
+	keys := map[string][]byte{}
+	for i, id := range ids {
+		keys[id] = []byte(strings.Repeat(string(rune('a'+i)), 32))
+	}
+	keyring, err := encryption.NewKeyring(ids[0], keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestMigrateKeepsConversationsAndMessages(t *testing.T) {
+	cfg := *config.GetConfig()
+	cfg.DatabaseDSN = "file:/TestMigrateKeepsConversationsAndMessages.db?vfs=memdb"
+	sqlDB, err := Open(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	schema, err := newQueryCache().GetQuery(config.INIT_QUERY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlDB.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlDB.Exec(`INSERT INTO conversations (id, title) VALUES (1, 'Plans');
+		INSERT INTO messages (body, sender, conversation_id) VALUES ('hi', 'USER', 1), ('hello', 'BOT', 1);`); err != nil {
+		t.Fatal(err)
+	}
+
+	db := CreateDB(sqlDB, nil)
+	conversation, err := db.GetConversation(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conversation.Title != "Plans" || len(conversation.Messages) != 2 {
+		t.Fatalf("expected the conversation to keep its title and 2 messages, got %v", conversation)
+	}
+	if _, err := db.CreateConversation("Plans", 0, nil); !errors.Is(err, ErrDuplicateTitle) {
+		t.Fatalf("expected the title to still be unique, got %v", err)
+	}
+}
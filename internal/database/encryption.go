@@ -0,0 +1,163 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/timsexperiments/chat-cli/internal/config"
+)
+
+// The columns that hold encrypted values. The column and the id of the row
+// are bound to every value encrypted for it, so a value cannot be decrypted
+// from any other column or row.
+const (
+	messageBodyColumn         = "messages.body"
+	conversationContextColumn = "conversations.context"
+	webhookSecretColumn       = "webhooks.secret"
+	webhookPayloadColumn      = "webhook_deliveries.payload"
+	idempotentBodyColumn      = "idempotency_keys.body"
+)
+
+// seal encrypts a value for column of the row with the given id with the
+// active key. Values are stored as they are when encryption is not
+// configured, and empty values are never encrypted. It returns the value to
+// store and the id of the key it was encrypted with, or nil if it was not.
+func (db *DB) seal(column string, id int64, value string) (any, *string, error) {
+	if db.keys == nil || value == "" {
+		return value, nil, nil
+	}
+	keyId, envelope, err := db.keys.Encrypt([]byte(value), rowAssociatedData(column, id))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to encrypt %s of row %d: %w", column, id, err)
+	}
+	return envelope, &keyId, nil
+}
+
+// storeSealed seals value for column of the row with the given id and stores
+// it with updateQuery, which takes the value, the id of the key and the id of
+// the row. Rows are inserted without their encrypted values, which are stored
+// with this once the id they are bound to is known.
+func (db *DB) storeSealed(column string, id int64, value, updateQuery string) error {
+	sealed, keyId, err := db.seal(column, id, value)
+	if err != nil {
+		return err
+	}
+	if err := db.execOne(updateQuery, sealed, keyId, id); err != nil {
+		return fmt.Errorf("unable to store %s of row %d: %w", column, id, err)
+	}
+	return nil
+}
+
+// open returns the plaintext of a value read from column of the row with the
+// given id, which was encrypted with the key keyId, or not at all if keyId is
+// nil.
+func (db *DB) open(column string, id int64, value string, keyId *string) (string, error) {
+	if keyId == nil {
+		return value, nil
+	}
+	if db.keys == nil {
+		return "", fmt.Errorf("%s is encrypted with key %q but no encryption keys are configured", column, *keyId)
+	}
+	plaintext, err := db.keys.Decrypt(*keyId, []byte(value), rowAssociatedData(column, id))
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt %s of row %d: %w", column, id, err)
+	}
+	return string(plaintext), nil
+}
+
+// rowAssociatedData returns what the values of column of the row with the
+// given id are bound to.
+func rowAssociatedData(column string, id int64) []byte {
+	return []byte(fmt.Sprintf("%s:%d", column, id))
+}
+
+// KeyRotation counts the values re-encrypted by RotateKeys.
+type KeyRotation struct {
+	Messages        int64
+	Conversations   int64
+	WebhookSecrets  int64
+	WebhookPayloads int64
+}
+
+// RotateKeys re-encrypts every message body, conversation context, webhook
+// secret and webhook payload that is not encrypted with the active key,
+// including values that are not encrypted at all, batchSize rows per
+// transaction. It returns how many values were re-encrypted, including those
+// re-encrypted before an error.
+func (db *DB) RotateKeys(batchSize int) (*KeyRotation, error) {
+	rotation := &KeyRotation{}
+	if db.keys == nil {
+		return rotation, fmt.Errorf("no encryption keys are configured")
+	}
+	columns := []struct {
+		column      string
+		listQuery   string
+		updateQuery string
+		rotated     *int64
+	}{
+		{messageBodyColumn, config.LIST_MESSAGES_TO_ROTATE_QUERY, config.UPDATE_MESSAGE_BODY_QUERY, &rotation.Messages},
+		{conversationContextColumn, config.LIST_CONTEXTS_TO_ROTATE_QUERY, config.UPDATE_CONVERSATION_CONTEXT_QUERY, &rotation.Conversations},
+		{webhookSecretColumn, config.LIST_SECRETS_TO_ROTATE_QUERY, config.ROTATE_WEBHOOK_SECRET_QUERY, &rotation.WebhookSecrets},
+		{webhookPayloadColumn, config.LIST_PAYLOADS_TO_ROTATE_QUERY, config.UPDATE_WEBHOOK_PAYLOAD_QUERY, &rotation.WebhookPayloads},
+	}
+	for _, c := range columns {
+		rotated, err := db.rotateColumn(c.column, c.listQuery, c.updateQuery, batchSize)
+		*c.rotated = rotated
+		if err != nil {
+			return rotation, err
+		}
+	}
+	return rotation, nil
+}
+
+func (db *DB) rotateColumn(column, listQuery, updateQuery string, batchSize int) (int64, error) {
+	var rotated int64
+	for {
+		var batch int
+		err := db.WithTx(func(tx *DB) error {
+			type row struct {
+				id    int64
+				value string
+				keyId *string
+			}
+			rows, err := tx.Query(listQuery, db.keys.ActiveKeyId(), batchSize)
+			if err != nil {
+				return fmt.Errorf("unable to list %s to re-encrypt: %w", column, err)
+			}
+			pending := []row{}
+			for rows.Next() {
+				var r row
+				if err := rows.Scan(&r.id, &r.value, &r.keyId); err != nil {
+					rows.Close()
+					return fmt.Errorf("unable to read %s: %w", column, err)
+				}
+				pending = append(pending, r)
+			}
+			rows.Close()
+
+			for _, r := range pending {
+				plaintext, err := tx.open(column, r.id, r.value, r.keyId)
+				if err != nil {
+					return err
+				}
+				if err := tx.storeSealed(column, r.id, plaintext, updateQuery); err != nil {
+					return err
+				}
+			}
+			batch = len(pending)
+			if batch == 0 {
+				return nil
+			}
+			changes := auditChanges{}
+			changes.set("key_id", nil, db.keys.ActiveKeyId())
+			changes.set(column, nil, batch)
+			return tx.audit("encryption_keys.rotate", auditEncryptionKeys, 0, changes)
+		})
+		if err != nil {
+			return rotated, err
+		}
+		rotated += int64(batch)
+		if batch < batchSize {
+			return rotated, nil
+		}
+	}
+}
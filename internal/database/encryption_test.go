@@ -0,0 +1,212 @@
+package database
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timsexperiments/chat-cli/internal/encryption"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+)
+
+// rotatedKeyring returns a keyring that holds the keys of newTestKeyring(t,
+// "k1") and a new key k2, which is the active one.
+func rotatedKeyring(t *testing.T) *encryption.Keyring {
+	t.Helper()
+	keyring, err := encryption.NewKeyring("k2", map[string][]byte{
+		"k1": []byte(strings.Repeat("a", 32)),
+		"k2": []byte(strings.Repeat("z", 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+// storedBody returns the body of a message and the id of the key it is
+// encrypted with as they are stored.
+func storedBody(t *testing.T, db *DB, id int64) ([]byte, *string) {
+	t.Helper()
+	var body []byte
+	var keyId *string
+	if err := db.sql.QueryRow("SELECT body, body_key_id FROM messages WHERE id = ?", id).Scan(&body, &keyId); err != nil {
+		t.Fatal(err)
+	}
+	return body, keyId
+}
+
+func TestEncryptedValuesAreBoundToTheirRow(t *testing.T) {
+	keys := newTestKeyring(t, "k1")
+	db := newTestDB(t, keys)
+	conversation, err := db.CreateConversation("Secrets", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := func(body string) int64 {
+		message, err := db.CreateMessage(body, chat.Message_USER, conversation.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return message.Id
+	}
+
+	tests := []struct {
+		name string
+		// store replaces the stored body of the message with the given id.
+		store func(id int64)
+		ok    bool
+	}{
+		{"sealed for its row", func(id int64) {}, true},
+		{"copied from another row", func(id int64) {
+			body, keyId := storedBody(t, db, create("someone else's"))
+			if _, err := db.sql.Exec("UPDATE messages SET body = ?, body_key_id = ? WHERE id = ?", body, keyId, id); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"sealed for another column", func(id int64) {
+			keyId, envelope, err := keys.Encrypt([]byte("plans"), rowAssociatedData(conversationContextColumn, id))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.sql.Exec("UPDATE messages SET body = ?, body_key_id = ? WHERE id = ?", envelope, keyId, id); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id := create("plans")
+			if body, _ := storedBody(t, db, id); strings.Contains(string(body), "plans") {
+				t.Fatalf("expected the body to be encrypted, got %q", body)
+			}
+			test.store(id)
+			message, err := db.GetMessage(int(id))
+			if !test.ok {
+				if err == nil {
+					t.Fatalf("expected reading the message to fail, got %q", message.Body)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if message.Body != "plans" {
+				t.Fatalf("expected %q, got %q", "plans", message.Body)
+			}
+		})
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	db := newTestDB(t, newTestKeyring(t, "k1"))
+	imported, err := db.ImportConversation(&chat.Conversation{
+		Title:   "Imported",
+		Context: "be brief",
+		Messages: []*chat.Message{
+			{Body: "question", Sender: chat.Message_USER},
+			{Body: "answer", Sender: chat.Message_BOT},
+		},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateWebhook("http://hooks.test", []string{WebhookMessageCreated}, "shh"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateMessage("queued", chat.Message_USER, imported.Id); err != nil {
+		t.Fatal(err)
+	}
+	plaintext := imported.Messages[0]
+	if _, err := db.sql.Exec("UPDATE messages SET body = ?, body_key_id = NULL WHERE id = ?", plaintext.Body, plaintext.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotating with the key everything is encrypted with only encrypts the
+	// value that is not encrypted at all.
+	rotation, err := db.RotateKeys(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *rotation != (KeyRotation{Messages: 1}) {
+		t.Fatalf("expected 1 message to be encrypted, got %+v", rotation)
+	}
+	if body, keyId := storedBody(t, db, plaintext.Id); keyId == nil || strings.Contains(string(body), plaintext.Body) {
+		t.Fatal("expected the message to be encrypted")
+	}
+
+	rotated := CreateDB(db.sql, rotatedKeyring(t))
+	if rotation, err = rotated.RotateKeys(1); err != nil {
+		t.Fatal(err)
+	}
+	if *rotation != (KeyRotation{Messages: 3, Conversations: 1, WebhookSecrets: 1, WebhookPayloads: 1}) {
+		t.Fatalf("expected 3 messages, 1 conversation, 1 webhook secret and 1 webhook payload to be re-encrypted, got %+v", rotation)
+	}
+	for _, message := range imported.Messages {
+		if _, keyId := storedBody(t, rotated, message.Id); keyId == nil || *keyId != "k2" {
+			t.Fatalf("expected message %d to be encrypted with k2, got %v", message.Id, keyId)
+		}
+	}
+
+	var stale int
+	if err := db.sql.QueryRow(`SELECT (SELECT COUNT(*) FROM webhooks WHERE secret_key_id != 'k2') +
+		(SELECT COUNT(*) FROM webhook_deliveries WHERE payload_key_id != 'k2')`).Scan(&stale); err != nil {
+		t.Fatal(err)
+	}
+	if stale != 0 {
+		t.Fatalf("expected every webhook secret and payload to be encrypted with k2, got %d that are not", stale)
+	}
+	deliveries, err := rotated.ListDueWebhookDeliveries(time.Now().Add(time.Minute), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Secret != "shh" || !strings.Contains(string(deliveries[0].Payload), "queued") {
+		t.Fatalf("expected the queued delivery to read the same after rotation, got %v", deliveries)
+	}
+
+	got, err := db.GetConversation(int(imported.Id))
+	if err == nil {
+		t.Fatalf("expected the conversation not to be readable with k1 alone, got %v", got)
+	}
+	if got, err = rotated.GetConversation(int(imported.Id)); err != nil {
+		t.Fatal(err)
+	}
+	if got.Context != "be brief" || got.Messages[1].Body != "answer" || got.Messages[2].Body != "question" {
+		t.Fatalf("expected the conversation to read the same after rotation, got %v", got)
+	}
+}
+
+func TestWebhookDeliveriesAreEncrypted(t *testing.T) {
+	db := newTestDB(t, newTestKeyring(t, "k1"))
+	for _, url := range []string{"http://one.test", "http://two.test"} {
+		if _, err := db.CreateWebhook(url, []string{WebhookMessageCreated}, "shh"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conversation, err := db.CreateConversation("Hooks", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateMessage("secret plans", chat.Message_USER, conversation.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	var plaintext int
+	if err := db.sql.QueryRow("SELECT COUNT(*) FROM webhook_deliveries WHERE payload_key_id IS NULL OR instr(payload, 'secret plans') > 0").Scan(&plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != 0 {
+		t.Fatalf("expected every payload to be encrypted, got %d that are not", plaintext)
+	}
+	deliveries, err := db.ListDueWebhookDeliveries(time.Now().Add(time.Minute), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 {
+		t.Fatalf("expected a delivery for each webhook, got %d", len(deliveries))
+	}
+	for _, delivery := range deliveries {
+		if delivery.Secret != "shh" || !strings.Contains(string(delivery.Payload), "secret plans") {
+			t.Fatalf("expected delivery %d to be decrypted, got secret %q and payload %s", delivery.Id, delivery.Secret, delivery.Payload)
+		}
+	}
+}
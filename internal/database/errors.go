@@ -0,0 +1,65 @@
+package database
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrNotFound is returned when what was asked for does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned when a change conflicts with what is stored. The more
+// specific conflicts below are each an ErrConflict, so errors.Is reports them
+// as either.
+var ErrConflict = errors.New("conflict")
+
+// ErrDuplicateTitle is returned when a conversation would end up with the same
+// title as another conversation.
+var ErrDuplicateTitle error = &kindError{"a conversation with that title already exists", ErrConflict}
+
+// ErrDuplicateName is returned when a tag or folder would end up with the same
+// name as another tag, or another folder in the same parent folder.
+var ErrDuplicateName error = &kindError{"the name is already taken", ErrConflict}
+
+// ErrVersionConflict is returned when a conversation is changed against a
+// version that is no longer its current version.
+var ErrVersionConflict error = &kindError{"the conversation was changed by someone else", ErrConflict}
+
+// ErrIdempotencyKeyInFlight is returned when an idempotency key is claimed
+// while the request that claimed it first is still being handled.
+var ErrIdempotencyKeyInFlight error = &kindError{"a request with that idempotency key is still being handled", ErrConflict}
+
+// ErrIdempotencyKeyReused is returned when an idempotency key is claimed for
+// a request other than the one it was first claimed for.
+var ErrIdempotencyKeyReused = errors.New("the idempotency key was already used for a different request")
+
+// ErrFolderCycle is returned when a folder would be moved into itself or one
+// of its own sub folders.
+var ErrFolderCycle = errors.New("a folder cannot be moved into itself")
+
+// kindError is a sentinel error that is also one of the broader kinds of
+// error, e.g. ErrConflict.
+type kindError struct {
+	message string
+	kind    error
+}
+
+func (e *kindError) Error() string {
+	return e.message
+}
+
+func (e *kindError) Unwrap() error {
+	return e.kind
+}
+
+// isUniqueViolation reports whether err is a UNIQUE constraint failure on the
+// given table column, e.g. "conversations.title".
+func isUniqueViolation(err error, column string) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) || sqliteErr.ExtendedCode != sqlite3.ErrConstraintUnique {
+		return false
+	}
+	return strings.Contains(sqliteErr.Error(), column)
+}
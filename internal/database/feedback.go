@@ -0,0 +1,266 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/proto/admin"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// FeedbackFilter narrows down the rated replies returned by
+// ListFeedbackExamples. Fields that are not set match every reply.
+type FeedbackFilter struct {
+	Model    string
+	Thumb    chat.Feedback_Thumb
+	Category string
+	// Only include ratings last changed at or after this time, when set.
+	After time.Time
+	// Only include ratings last changed before this time, when set.
+	Before time.Time
+}
+
+// RateMessage stores the rating of a message, replacing any rating it already
+// had, and returns it as stored.
+func (db *DB) RateMessage(messageId int64, rating *chat.RateMessageRequest) (*chat.Feedback, error) {
+	categories, err := json.Marshal(append([]string{}, rating.Categories...))
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode categories of message %d: %w", messageId, err)
+	}
+	var thumb *string
+	if rating.Thumb != chat.Feedback_THUMB_UNSPECIFIED {
+		value := rating.Thumb.String()
+		thumb = &value
+	}
+	var feedback *chat.Feedback
+	err = db.WithTx(func(tx *DB) error {
+		before, err := tx.GetFeedback(messageId)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(config.SET_FEEDBACK_QUERY, messageId, thumb, rating.Score, rating.Note, string(categories)); err != nil {
+			return fmt.Errorf("unable to rate message %d: %w", messageId, err)
+		}
+		if feedback, err = tx.GetFeedback(messageId); err != nil {
+			return err
+		}
+		return tx.audit("message.rate", auditMessage, messageId, feedbackChanges(before, feedback))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return feedback, nil
+}
+
+// UnrateMessage removes the rating from a message. It is not an error to
+// unrate a message that is not rated.
+func (db *DB) UnrateMessage(messageId int64) error {
+	return db.WithTx(func(tx *DB) error {
+		before, err := tx.GetFeedback(messageId)
+		if err != nil || before == nil {
+			return err
+		}
+		if _, err := tx.Exec(config.DELETE_FEEDBACK_QUERY, messageId); err != nil {
+			return fmt.Errorf("unable to unrate message %d: %w", messageId, err)
+		}
+		return tx.audit("message.unrate", auditMessage, messageId, feedbackChanges(before, nil))
+	})
+}
+
+// GetFeedback returns the rating of a message, or nil if it is not rated.
+func (db *DB) GetFeedback(messageId int64) (*chat.Feedback, error) {
+	rows, err := db.Query(config.GET_FEEDBACK_QUERY, messageId)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get rating of message %d: %w", messageId, err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	feedback := &chat.Feedback{}
+	var thumb, model *string
+	var categories string
+	var createdAt, updatedAt time.Time
+	if err := rows.Scan(
+		&feedback.MessageId,
+		&feedback.ConversationId,
+		&thumb,
+		&feedback.Score,
+		&feedback.Note,
+		&categories,
+		&model,
+		&createdAt,
+		&updatedAt,
+	); err != nil {
+		return nil, fmt.Errorf("unable to read rating of message %d: %w", messageId, err)
+	}
+	if err := setFeedbackValues(feedback, thumb, categories); err != nil {
+		return nil, fmt.Errorf("rating of message %d: %w", messageId, err)
+	}
+	if model != nil {
+		feedback.Model = *model
+	}
+	feedback.CreatedAt = timestamppb.New(createdAt)
+	feedback.UpdatedAt = timestamppb.New(updatedAt)
+	return feedback, nil
+}
+
+// FeedbackReport sums up the ratings of replies that are not in the trash for
+// each model that wrote them. Only ratings last changed between after and
+// before are counted, when they are set.
+func (db *DB) FeedbackReport(after, before time.Time) (*admin.FeedbackReport, error) {
+	rows, err := db.Query(config.FEEDBACK_REPORT_QUERY, optionalTime(after), optionalTime(before))
+	if err != nil {
+		return nil, fmt.Errorf("unable to report feedback: %w", err)
+	}
+	defer rows.Close()
+	report := &admin.FeedbackReport{}
+	models := map[string]*admin.ModelFeedback{}
+	for rows.Next() {
+		model := &admin.ModelFeedback{}
+		var averageScore *float64
+		if err := rows.Scan(&model.Model, &model.Rated, &model.ThumbsUp, &model.ThumbsDown, &model.Scored, &averageScore); err != nil {
+			return nil, fmt.Errorf("unable to build feedback report: %w", err)
+		}
+		if averageScore != nil {
+			model.AverageScore = *averageScore
+		}
+		report.Models = append(report.Models, model)
+		models[model.Model] = model
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to report feedback: %w", err)
+	}
+
+	categoryRows, err := db.Query(config.FEEDBACK_REPORT_CATEGORIES_QUERY, optionalTime(after), optionalTime(before))
+	if err != nil {
+		return nil, fmt.Errorf("unable to report feedback categories: %w", err)
+	}
+	defer categoryRows.Close()
+	for categoryRows.Next() {
+		var model string
+		count := &admin.CategoryCount{}
+		if err := categoryRows.Scan(&model, &count.Category, &count.Count); err != nil {
+			return nil, fmt.Errorf("unable to build feedback report: %w", err)
+		}
+		if stats, ok := models[model]; ok {
+			stats.Categories = append(stats.Categories, count)
+		}
+	}
+	return report, categoryRows.Err()
+}
+
+// ListFeedbackExamples returns the rated replies that match the filter along
+// with the user messages they answer, oldest first. Replies in the trash and
+// replies or prompts removed by the retention policy are left out.
+func (db *DB) ListFeedbackExamples(filter FeedbackFilter) ([]*admin.FeedbackExample, error) {
+	thumb := ""
+	if filter.Thumb != chat.Feedback_THUMB_UNSPECIFIED {
+		thumb = filter.Thumb.String()
+	}
+	rows, err := db.Query(
+		config.LIST_FEEDBACK_EXAMPLES_QUERY,
+		filter.Model,
+		thumb,
+		filter.Category,
+		optionalTime(filter.After),
+		optionalTime(filter.Before))
+	if err != nil {
+		return nil, fmt.Errorf("unable to list rated messages: %w", err)
+	}
+	defer rows.Close()
+
+	examples := []*admin.FeedbackExample{}
+	for rows.Next() {
+		example := &admin.FeedbackExample{}
+		feedback := &chat.Feedback{}
+		var promptId int64
+		var prompt, response string
+		var promptKeyId, responseKeyId, thumb *string
+		var categories string
+		var createdAt, updatedAt time.Time
+		if err := rows.Scan(
+			&example.MessageId,
+			&example.ConversationId,
+			&example.Model,
+			&promptId,
+			&prompt,
+			&promptKeyId,
+			&response,
+			&responseKeyId,
+			&thumb,
+			&feedback.Score,
+			&feedback.Note,
+			&categories,
+			&createdAt,
+			&updatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("unable to build rated message: %w", err)
+		}
+		if example.Prompt, err = db.open(messageBodyColumn, promptId, prompt, promptKeyId); err != nil {
+			return nil, fmt.Errorf("prompt of message %d: %w", example.MessageId, err)
+		}
+		if example.Response, err = db.open(messageBodyColumn, example.MessageId, response, responseKeyId); err != nil {
+			return nil, fmt.Errorf("message %d: %w", example.MessageId, err)
+		}
+		if err := setFeedbackValues(feedback, thumb, categories); err != nil {
+			return nil, fmt.Errorf("rating of message %d: %w", example.MessageId, err)
+		}
+		feedback.MessageId = example.MessageId
+		feedback.ConversationId = example.ConversationId
+		feedback.Model = example.Model
+		feedback.CreatedAt = timestamppb.New(createdAt)
+		feedback.UpdatedAt = timestamppb.New(updatedAt)
+		example.Feedback = feedback
+		examples = append(examples, example)
+	}
+	return examples, rows.Err()
+}
+
+// setFeedbackValues sets the thumb and categories of feedback from how they
+// are stored.
+func setFeedbackValues(feedback *chat.Feedback, thumb *string, categories string) error {
+	if thumb != nil {
+		value, ok := chat.Feedback_Thumb_value[*thumb]
+		if !ok {
+			return fmt.Errorf("unable to parse thumb %s", *thumb)
+		}
+		feedback.Thumb = chat.Feedback_Thumb(value)
+	}
+	if err := json.Unmarshal([]byte(categories), &feedback.Categories); err != nil {
+		return fmt.Errorf("unable to parse categories: %w", err)
+	}
+	return nil
+}
+
+// The rating fields recorded in the audit log, in the order they are
+// recorded.
+var feedbackAuditFields = []string{"thumb", "score", "categories"}
+
+// feedbackChanges returns the changes between two ratings of a message, either
+// of which may be nil when the message was not rated before or after. The
+// note is free text about the content of the reply, so it is recorded as
+// changed without its value.
+func feedbackChanges(before, after *chat.Feedback) auditChanges {
+	changes := auditChanges{}
+	changes.fields(feedbackAuditFields, feedbackAuditValues(before), feedbackAuditValues(after))
+	changes.content("note", before.GetNote() != after.GetNote())
+	return changes
+}
+
+func feedbackAuditValues(feedback *chat.Feedback) map[string]any {
+	if feedback == nil {
+		return nil
+	}
+	values := map[string]any{
+		"score":      feedback.Score,
+		"categories": append([]string{}, feedback.Categories...),
+	}
+	if feedback.Thumb != chat.Feedback_THUMB_UNSPECIFIED {
+		values["thumb"] = feedback.Thumb.String()
+	}
+	return values
+}
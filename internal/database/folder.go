@@ -0,0 +1,172 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (db *DB) CreateFolder(name string, parentId int64) (*chat.Folder, error) {
+	var folder *chat.Folder
+	err := db.WithTx(func(tx *DB) error {
+		result, err := tx.Exec(config.CREATE_FOLDER_QUERY, name, nullableId(parentId))
+		if isUniqueViolation(err, "ux__folders__parent_name") {
+			return fmt.Errorf("unable to create folder %q: %w", name, ErrDuplicateName)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to create folder: %w", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("unable to get last insert ID: %w", err)
+		}
+		if folder, err = tx.GetFolder(int(id)); err != nil {
+			return err
+		}
+		return tx.audit("folder.create", auditFolder, id, folderChanges(nil, folder))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return folder, nil
+}
+
+// GetFolder returns the folder with the given id, or nil if there is none.
+func (db *DB) GetFolder(id int) (*chat.Folder, error) {
+	rows, err := db.Query(config.GET_FOLDER_QUERY, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get folder: %w", err)
+	}
+	defer rows.Close()
+	folders, err := foldersFromRows(rows)
+	if err != nil || len(folders) == 0 {
+		return nil, err
+	}
+	return folders[0], nil
+}
+
+func (db *DB) ListFolders() ([]*chat.Folder, error) {
+	rows, err := db.Query(config.LIST_FOLDERS_QUERY)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list folders: %w", err)
+	}
+	defer rows.Close()
+	return foldersFromRows(rows)
+}
+
+// UpdateFolder renames and moves a folder. A folder cannot be moved into
+// itself or any folder inside it.
+func (db *DB) UpdateFolder(folder *chat.Folder) (*chat.Folder, error) {
+	var updated *chat.Folder
+	err := db.WithTx(func(tx *DB) error {
+		before, err := tx.GetFolder(int(folder.Id))
+		if err != nil {
+			return err
+		}
+		if folder.ParentId != 0 {
+			ancestors, err := tx.folderAncestors(folder.ParentId)
+			if err != nil {
+				return err
+			}
+			for _, ancestor := range ancestors {
+				if ancestor == folder.Id {
+					return fmt.Errorf("unable to move folder %d into folder %d: %w", folder.Id, folder.ParentId, ErrFolderCycle)
+				}
+			}
+		}
+		err = tx.execOne(config.UPDATE_FOLDER_QUERY, folder.Name, nullableId(folder.ParentId), folder.Id)
+		if isUniqueViolation(err, "ux__folders__parent_name") {
+			return fmt.Errorf("unable to rename folder %d to %q: %w", folder.Id, folder.Name, ErrDuplicateName)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to update folder %d: %w", folder.Id, err)
+		}
+		if updated, err = tx.GetFolder(int(folder.Id)); err != nil {
+			return err
+		}
+		return tx.audit("folder.update", auditFolder, folder.Id, folderChanges(before, updated))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// DeleteFolder deletes a folder and every folder inside it. Conversations in
+// the deleted folders are kept and no longer filed in a folder.
+func (db *DB) DeleteFolder(id int) error {
+	return db.WithTx(func(tx *DB) error {
+		before, err := tx.GetFolder(id)
+		if err != nil {
+			return err
+		}
+		if err := tx.execOne(config.DELETE_FOLDER_QUERY, id); err != nil {
+			return fmt.Errorf("unable to delete folder %d: %w", id, err)
+		}
+		return tx.audit("folder.delete", auditFolder, int64(id), folderChanges(before, nil))
+	})
+}
+
+// folderChanges returns the changes between two versions of a folder, either
+// of which may be nil when the folder was created or deleted.
+func folderChanges(before, after *chat.Folder) auditChanges {
+	values := func(folder *chat.Folder) map[string]any {
+		if folder == nil {
+			return nil
+		}
+		return map[string]any{"name": folder.Name, "parent_id": nullableId(folder.ParentId)}
+	}
+	changes := auditChanges{}
+	changes.fields([]string{"name", "parent_id"}, values(before), values(after))
+	return changes
+}
+
+// folderAncestors returns the id of the folder followed by the ids of every
+// folder above it.
+func (db *DB) folderAncestors(id int64) ([]int64, error) {
+	rows, err := db.Query(config.GET_FOLDER_ANCESTORS_QUERY, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get ancestors of folder %d: %w", id, err)
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var ancestor int64
+		if err := rows.Scan(&ancestor); err != nil {
+			return nil, fmt.Errorf("unable to read folder: %w", err)
+		}
+		ids = append(ids, ancestor)
+	}
+	return ids, nil
+}
+
+func foldersFromRows(rows *sql.Rows) ([]*chat.Folder, error) {
+	folders := []*chat.Folder{}
+	for rows.Next() {
+		var id int64
+		var name string
+		var parentId *int64
+		var createdAt time.Time
+		if err := rows.Scan(&id, &name, &parentId, &createdAt); err != nil {
+			return nil, fmt.Errorf("unable to build folder: %w", err)
+		}
+		folder := &chat.Folder{Id: id, Name: name, CreatedAt: timestamppb.New(createdAt)}
+		if parentId != nil {
+			folder.ParentId = *parentId
+		}
+		folders = append(folders, folder)
+	}
+	return folders, nil
+}
+
+// nullableId stores an unset id, 0, as NULL.
+func nullableId(id int64) *int64 {
+	if id == 0 {
+		return nil
+	}
+	return &id
+}
@@ -0,0 +1,157 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/timsexperiments/chat-cli/internal/config"
+)
+
+// IdempotentResponse is the response stored for a request sent with an
+// idempotency key, which is sent again when the request is retried.
+type IdempotentResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// ClaimIdempotencyKey claims key for the request with the given fingerprint,
+// for the actor of db. It returns nil if the request should be handled, after
+// which the response is stored with CompleteIdempotencyKey, or the response
+// stored for the key if the request was handled already. Keys claimed before
+// since have expired: they are deleted, for every actor, and can be claimed
+// again.
+//
+// ErrIdempotencyKeyReused is returned if the key was claimed for a request
+// with another fingerprint, and ErrIdempotencyKeyInFlight if the request that
+// claimed it has no response yet.
+func (db *DB) ClaimIdempotencyKey(key, fingerprint string, since time.Time) (*IdempotentResponse, error) {
+	var stored *IdempotentResponse
+	err := db.WithTx(func(tx *DB) error {
+		if _, err := tx.purgeIdempotencyKeys(since); err != nil {
+			return err
+		}
+		result, err := tx.Exec(config.CLAIM_IDEMPOTENCY_KEY_QUERY, tx.actor.Name, key, fingerprint)
+		if err != nil {
+			return fmt.Errorf("unable to claim idempotency key: %w", err)
+		}
+		claimed, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("unable to get rows affected: %w", err)
+		}
+		if claimed == 1 {
+			return nil
+		}
+
+		claim, err := tx.getIdempotencyKey(key)
+		if err != nil {
+			return err
+		}
+		if claim == nil {
+			return fmt.Errorf("idempotency key was neither claimed nor found")
+		}
+		if claim.fingerprint != fingerprint {
+			return ErrIdempotencyKeyReused
+		}
+		if claim.statusCode == nil {
+			return ErrIdempotencyKeyInFlight
+		}
+		body, err := tx.open(idempotentBodyColumn, claim.id, string(claim.body), claim.bodyKeyId)
+		if err != nil {
+			return err
+		}
+		stored = &IdempotentResponse{StatusCode: *claim.statusCode, Header: http.Header{}, Body: []byte(body)}
+		if claim.header != nil {
+			if err := json.Unmarshal([]byte(*claim.header), &stored.Header); err != nil {
+				return fmt.Errorf("unable to parse stored response headers: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// CompleteIdempotencyKey stores the response to the request that claimed key,
+// to be sent again when the request is retried. The body is encrypted like a
+// message body.
+func (db *DB) CompleteIdempotencyKey(key string, response *IdempotentResponse) error {
+	header, err := json.Marshal(response.Header)
+	if err != nil {
+		return fmt.Errorf("unable to encode response headers: %w", err)
+	}
+	return db.WithTx(func(tx *DB) error {
+		claim, err := tx.getIdempotencyKey(key)
+		if err != nil {
+			return err
+		}
+		if claim == nil {
+			return fmt.Errorf("unable to store response for idempotency key: %w", ErrNotFound)
+		}
+		body, bodyKeyId, err := tx.seal(idempotentBodyColumn, claim.id, string(response.Body))
+		if err != nil {
+			return err
+		}
+		if err := tx.execOne(config.COMPLETE_IDEMPOTENCY_KEY_QUERY, response.StatusCode, string(header), body, bodyKeyId, claim.id); err != nil {
+			return fmt.Errorf("unable to store response for idempotency key: %w", err)
+		}
+		return nil
+	})
+}
+
+// idempotencyKey is an idempotency key claimed by an actor, along with the
+// response to the request that claimed it once it has one.
+type idempotencyKey struct {
+	id          int64
+	fingerprint string
+	statusCode  *int
+	header      *string
+	body        []byte
+	bodyKeyId   *string
+}
+
+// getIdempotencyKey returns key as claimed by the actor of db, or nil if it
+// has not claimed it.
+func (db *DB) getIdempotencyKey(key string) (*idempotencyKey, error) {
+	rows, err := db.Query(config.GET_IDEMPOTENCY_KEY_QUERY, db.actor.Name, key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get idempotency key: %w", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("unable to get idempotency key: %w", err)
+		}
+		return nil, nil
+	}
+	claim := &idempotencyKey{}
+	if err := rows.Scan(&claim.id, &claim.fingerprint, &claim.statusCode, &claim.header, &claim.body, &claim.bodyKeyId); err != nil {
+		return nil, fmt.Errorf("unable to read idempotency key: %w", err)
+	}
+	return claim, nil
+}
+
+// ReleaseIdempotencyKey gives up the claim on key without storing a response,
+// so that the request can be retried and handled again, e.g. after it failed
+// with a server error.
+func (db *DB) ReleaseIdempotencyKey(key string) error {
+	if _, err := db.Exec(config.RELEASE_IDEMPOTENCY_KEY_QUERY, db.actor.Name, key); err != nil {
+		return fmt.Errorf("unable to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+// purgeIdempotencyKeys deletes the idempotency keys of every actor claimed
+// before the given time, along with their stored responses, and returns how
+// many were deleted.
+func (db *DB) purgeIdempotencyKeys(before time.Time) (int64, error) {
+	result, err := db.Exec(config.PURGE_IDEMPOTENCY_KEYS_QUERY, sqlTimestamp(before))
+	if err != nil {
+		return 0, fmt.Errorf("unable to purge idempotency keys: %w", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,58 @@
+package database
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClaimIdempotencyKey(t *testing.T) {
+	db := newTestDB(t, newTestKeyring(t, "k1")).As(Actor{Name: "token:a"})
+	since := time.Now().Add(-time.Hour)
+	if stored, err := db.ClaimIdempotencyKey("key", "request", since); err != nil || stored != nil {
+		t.Fatalf("expected the key to be claimed, got %v, %v", stored, err)
+	}
+
+	tests := []struct {
+		name        string
+		db          *DB
+		fingerprint string
+		err         error
+	}{
+		{"while in flight", db, "request", ErrIdempotencyKeyInFlight},
+		{"for another request", db, "other request", ErrIdempotencyKeyReused},
+		{"by another actor", db.As(Actor{Name: "token:b"}), "other request", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.db.ClaimIdempotencyKey("key", test.fingerprint, since); !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+
+	response := &IdempotentResponse{StatusCode: http.StatusCreated, Header: http.Header{"Etag": {`"1"`}}, Body: []byte(`{"body": "secret plans"}`)}
+	if err := db.CompleteIdempotencyKey("key", response); err != nil {
+		t.Fatal(err)
+	}
+	var body []byte
+	var keyId *string
+	if err := db.sql.QueryRow("SELECT body, body_key_id FROM idempotency_keys WHERE actor = ? AND idempotency_key = ?", "token:a", "key").Scan(&body, &keyId); err != nil {
+		t.Fatal(err)
+	}
+	if keyId == nil || string(body) == string(response.Body) {
+		t.Fatalf("expected the stored body to be encrypted, got %q", body)
+	}
+
+	stored, err := db.ClaimIdempotencyKey("key", "request", since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == nil || stored.StatusCode != response.StatusCode || string(stored.Body) != string(response.Body) || stored.Header.Get("ETag") != `"1"` {
+		t.Fatalf("expected the stored response back, got %v", stored)
+	}
+	if stored, err := db.ClaimIdempotencyKey("key", "request", time.Now().Add(time.Second)); err != nil || stored != nil {
+		t.Fatalf("expected an expired key to be claimed again, got %v, %v", stored, err)
+	}
+}
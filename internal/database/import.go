@@ -0,0 +1,104 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ImportConversation stores a conversation read from an import along with its
+// tags, keeping the original creation times of the conversation and its
+// messages. When the title is taken and rename is set, the conversation is
+// stored under the first free title of the form "Title (2)", otherwise
+// ErrDuplicateTitle is returned. The conversation and all of its messages are
+// stored in one transaction.
+func (db *DB) ImportConversation(conversation *chat.Conversation, rename bool) (*chat.Conversation, error) {
+	var imported *chat.Conversation
+	err := db.WithTx(func(tx *DB) error {
+		id, err := tx.insertImportedConversation(conversation, rename)
+		if err != nil {
+			return err
+		}
+		if err := tx.storeSealed(conversationContextColumn, id, conversation.Context, config.UPDATE_CONVERSATION_CONTEXT_QUERY); err != nil {
+			return err
+		}
+		if err := tx.SetConversationTags(id, NormalizeTags(conversation.Tags)); err != nil {
+			return err
+		}
+		for _, message := range conversation.Messages {
+			if message.Sender != chat.Message_USER && message.Sender != chat.Message_BOT {
+				continue
+			}
+			result, err := tx.Exec(
+				config.IMPORT_MESSAGE_QUERY,
+				"",
+				nil,
+				message.Sender.String(),
+				id,
+				optionalTimestamp(message.CreatedAt))
+			if err != nil {
+				return fmt.Errorf("unable to import message: %w", err)
+			}
+			messageId, err := result.LastInsertId()
+			if err != nil {
+				return fmt.Errorf("unable to get last insert ID: %w", err)
+			}
+			if err := tx.storeSealed(messageBodyColumn, messageId, message.Body, config.UPDATE_MESSAGE_BODY_QUERY); err != nil {
+				return err
+			}
+			if message.Pin == nil {
+				continue
+			}
+			if err := tx.PinMessage(messageId, message.Pin.Note, message.Pin.IncludeInContext); err != nil {
+				return err
+			}
+		}
+		if imported, err = tx.GetConversation(int(id)); err != nil {
+			return err
+		}
+		if err := tx.emitWebhookEvent(WebhookConversationCreated, imported, nil); err != nil {
+			return err
+		}
+		return tx.audit("conversation.import", auditConversation, id, conversationChanges(nil, imported))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return imported, nil
+}
+
+// insertImportedConversation stores conversation without its context, which
+// is stored once the id it is bound to is known, and returns its id. Its title
+// is numbered if it is taken and rename is set, see withFreeTitle.
+func (db *DB) insertImportedConversation(conversation *chat.Conversation, rename bool) (int64, error) {
+	var id int64
+	insert := func(title string) error {
+		result, err := db.Exec(config.IMPORT_CONVERSATION_QUERY, title, nil, nil, optionalTimestamp(conversation.CreatedAt))
+		if isUniqueViolation(err, "conversations.title") {
+			return fmt.Errorf("unable to import conversation %q: %w", title, ErrDuplicateTitle)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to import conversation: %w", err)
+		}
+		id, err = result.LastInsertId()
+		return err
+	}
+	var err error
+	if rename {
+		err = withFreeTitle(conversation.Title, insert)
+	} else {
+		err = insert(conversation.Title)
+	}
+	return id, err
+}
+
+// optionalTimestamp formats t for a query, or returns nil so the query can fall
+// back to the current time.
+func optionalTimestamp(t *timestamppb.Timestamp) any {
+	if t == nil {
+		return nil
+	}
+	return sqlTimestamp(t.AsTime())
+}
@@ -1,7 +1,9 @@
 package database
 
 import (
+	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/timsexperiments/chat-cli/internal/config"
@@ -10,55 +12,217 @@ import (
 )
 
 func (db *DB) CreateMessage(body string, sender chat.Message_Sender, conversationId int64) (*chat.Message, error) {
-	result, err := db.Exec(config.CREATE_MESSAGE_QUERY, body, sender.String(), conversationId)
+	return db.createMessage(body, sender, conversationId, chat.Message_COMPLETE, nil, 0, "")
+}
+
+// CreatePendingMessage stores a user message that is waiting on a reply from
+// the bot.
+func (db *DB) CreatePendingMessage(body string, conversationId int64) (*chat.Message, error) {
+	return db.createMessage(body, chat.Message_USER, conversationId, chat.Message_PENDING, nil, 0, "")
+}
+
+// CreateReply stores the bot's reply to the user message with the given id,
+// along with the model that wrote it and the number of tokens it used to
+// produce it.
+func (db *DB) CreateReply(body string, conversationId, replyTo int64, tokens int, model string) (*chat.Message, error) {
+	return db.createMessage(body, chat.Message_BOT, conversationId, chat.Message_COMPLETE, &replyTo, tokens, model)
+}
+
+func (db *DB) createMessage(body string, sender chat.Message_Sender, conversationId int64, status chat.Message_Status, replyTo *int64, tokens int, model string) (*chat.Message, error) {
+	var message *chat.Message
+	err := db.WithTx(func(tx *DB) error {
+		result, err := tx.Exec(config.CREATE_MESSAGE_QUERY, "", nil, sender.String(), conversationId, status.String(), replyTo, tokens, nullableString(model))
+		if err != nil {
+			return fmt.Errorf("unable to create message: %w", err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("unable to get rows affected: %w", err)
+		}
+		if rowsAffected != 1 {
+			return fmt.Errorf("expected 1 row to be affected, got %d", rowsAffected)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("unable to get last insert ID: %w", err)
+		}
+		if err := tx.storeSealed(messageBodyColumn, id, body, config.UPDATE_MESSAGE_BODY_QUERY); err != nil {
+			return err
+		}
+		if message, err = tx.GetMessage(int(id)); err != nil {
+			return err
+		}
+		conversation, err := tx.conversationMetadata(conversationId)
+		if err != nil {
+			return err
+		}
+		eventType := WebhookMessageCreated
+		if replyTo != nil {
+			eventType = WebhookReplyCompleted
+		}
+		if err := tx.emitWebhookEvent(eventType, conversation, message); err != nil {
+			return err
+		}
+		return tx.audit("message.create", auditMessage, id, messageChanges(nil, message))
+	})
 	if err != nil {
-		return nil, fmt.Errorf("unable to create message: %w", err)
+		return nil, err
 	}
-	rowsAffected, err := result.RowsAffected()
+	return message, nil
+}
+
+func (db *DB) GetMessage(id int) (*chat.Message, error) {
+	rows, err := db.Query(config.GET_MESSAGE_QUERY, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get conversation: %w", err)
+	}
+	defer rows.Close()
+
+	messages, err := db.messagesFromRows(rows)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get rows affected: %w", err)
+		return nil, err
+	}
+	if len(messages) > 1 {
+		return nil, fmt.Errorf("expected only one message, got more than one")
+	}
+	if len(messages) == 0 {
+		return nil, nil
 	}
-	if rowsAffected != 1 {
-		return nil, fmt.Errorf("expected 1 row to be affected, got %d", rowsAffected)
+	return messages[0], nil
+}
+
+// SetMessageStatus updates where the message with the given id is in its chat
+// turn. Status changes are part of running a chat turn rather than changes
+// made by anyone, so they are not recorded in the audit log.
+func (db *DB) SetMessageStatus(id int64, status chat.Message_Status) error {
+	if err := db.execOne(config.UPDATE_MESSAGE_STATUS_QUERY, status.String(), id); err != nil {
+		return fmt.Errorf("unable to set status of message %d: %w", id, err)
 	}
-	id, err := result.LastInsertId()
+	return nil
+}
+
+// RecoverOrphanedMessages marks every message still waiting on a reply as
+// failed so that clients can retry it. It is meant to run at startup, when no
+// chat turn can be in flight, and returns the number of messages marked.
+func (db *DB) RecoverOrphanedMessages() (int64, error) {
+	result, err := db.Exec(config.FAIL_PENDING_MESSAGES_QUERY)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get last insert ID: %w", err)
+		return 0, fmt.Errorf("unable to recover orphaned messages: %w", err)
 	}
-	return db.GetMessage(int(id))
+	return result.RowsAffected()
 }
 
-func (db *DB) GetMessage(id int) (*chat.Message, error) {
-	rows, err := db.Query(config.GET_MESSAGE_QUERY, id)
+// DeleteMessage moves a message to the trash. It can be brought back with
+// RestoreMessage until the trash is purged.
+func (db *DB) DeleteMessage(conversationId int64, id int) error {
+	_, err := db.changeMessage(id, "message.delete", config.DELETE_MESSAGE_QUERY, conversationId)
+	return err
+}
+
+// RestoreMessage brings a message back out of the trash.
+func (db *DB) RestoreMessage(conversationId int64, id int) (*chat.Message, error) {
+	return db.changeMessage(id, "message.restore", config.RESTORE_MESSAGE_QUERY, conversationId)
+}
+
+// PurgeMessage permanently deletes a message, whether or not it is in the
+// trash.
+func (db *DB) PurgeMessage(conversationId int64, id int) error {
+	_, err := db.changeMessage(id, "message.purge", config.PURGE_MESSAGE_QUERY, conversationId)
+	return err
+}
+
+// changeMessage runs the named query on the message with the given id in
+// the given conversation, and records it in the audit log as action. It
+// returns the message as it is after the change, or nil if it was purged.
+func (db *DB) changeMessage(id int, action, queryName string, conversationId int64) (*chat.Message, error) {
+	var after *chat.Message
+	err := db.WithTx(func(tx *DB) error {
+		before, err := tx.GetMessage(id)
+		if err != nil {
+			return err
+		}
+		if err := tx.execOne(queryName, id, conversationId); err != nil {
+			return fmt.Errorf("unable to %s message %d: %w", strings.TrimPrefix(action, "message."), id, err)
+		}
+		if after, err = tx.GetMessage(id); err != nil {
+			return err
+		}
+		return tx.audit(action, auditMessage, int64(id), messageChanges(before, after))
+	})
 	if err != nil {
-		return nil, fmt.Errorf("unable to get conversation: %w", err)
+		return nil, err
 	}
-	defer rows.Close()
+	return after, nil
+}
 
-	var message *chat.Message
+// The message fields recorded in the audit log, in the order they are
+// recorded. The body is content and is never recorded.
+var messageAuditFields = []string{"conversation_id", "sender", "reply_to", "deleted"}
+
+// messageChanges returns the changes between two versions of a message,
+// either of which may be nil when the message was created or purged.
+func messageChanges(before, after *chat.Message) auditChanges {
+	changes := auditChanges{}
+	changes.fields(messageAuditFields, messageAuditValues(before), messageAuditValues(after))
+	return changes
+}
+
+func messageAuditValues(message *chat.Message) map[string]any {
+	if message == nil {
+		return nil
+	}
+	return map[string]any{
+		"conversation_id": message.ConversationId,
+		"sender":          message.Sender.String(),
+		"reply_to":        nullableId(message.ReplyTo),
+		"deleted":         message.DeletedAt != nil,
+	}
+}
+
+func (db *DB) messagesFromRows(rows *sql.Rows) ([]*chat.Message, error) {
+	messages := []*chat.Message{}
 	for rows.Next() {
-		if message != nil {
-			return nil, fmt.Errorf("expected only one message, got more than one")
-		}
 		var id, conversationId int64
-		var body, senderStr string
+		var body, senderStr, statusStr string
 		var createdAt time.Time
-		if err := rows.Scan(&id, &body, &senderStr, &createdAt, &conversationId); err != nil {
+		var deletedAt, redactedAt *time.Time
+		var replyTo *int64
+		var bodyKeyId *string
+		if err := rows.Scan(&id, &body, &senderStr, &createdAt, &conversationId, &deletedAt, &statusStr, &replyTo, &redactedAt, &bodyKeyId); err != nil {
 			return nil, fmt.Errorf("unable to build message: %w", err)
 		}
+		body, err := db.open(messageBodyColumn, id, body, bodyKeyId)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", id, err)
+		}
 
 		sender, ok := chat.Message_Sender_value[senderStr]
 		if !ok {
-			return nil, fmt.Errorf("unable to parse sender: %w", err)
+			return nil, fmt.Errorf("unable to parse sender %s", senderStr)
+		}
+		status, ok := chat.Message_Status_value[statusStr]
+		if !ok {
+			return nil, fmt.Errorf("unable to parse status %s", statusStr)
 		}
 
-		message = &chat.Message{
-			Id:        id,
-			Body:      body,
-			Sender:    chat.Message_Sender(sender),
-			CreatedAt: timestamppb.New(createdAt),
+		message := &chat.Message{
+			Id:             id,
+			Body:           body,
+			Sender:         chat.Message_Sender(sender),
+			CreatedAt:      timestamppb.New(createdAt),
+			ConversationId: conversationId,
+			Status:         chat.Message_Status(status),
+		}
+		if replyTo != nil {
+			message.ReplyTo = *replyTo
+		}
+		if deletedAt != nil {
+			message.DeletedAt = timestamppb.New(*deletedAt)
 		}
+		if redactedAt != nil {
+			message.RedactedAt = timestamppb.New(*redactedAt)
+		}
+		messages = append(messages, message)
 	}
-
-	return message, nil
+	return messages, rows.Err()
 }
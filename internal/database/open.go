@@ -0,0 +1,100 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/timsexperiments/chat-cli/internal/config"
+)
+
+// The DSN of the database used for the in-memory mode. The memdb VFS lets every
+// connection in the pool see the same database rather than each getting an
+// empty one of its own, and unlike a shared cache it locks like a file, so
+// writers wait out the busy timeout instead of failing with "table is locked".
+const memoryDSN = "file:/chat.db?vfs=memdb"
+
+// Open opens the SQLite database named by the DSN in cfg with the configured
+// journal mode, busy timeout, foreign key enforcement and connection pool. The
+// directory of a database file is created if it does not exist yet. Open
+// fails if the database cannot be reached or does not take the journal mode.
+func Open(cfg *config.Config) (*sql.DB, error) {
+	dsn := cfg.DatabaseDSN
+	memory := isMemoryDSN(dsn)
+	if memory && dsn == ":memory:" {
+		dsn = memoryDSN
+	}
+	if path := DatabaseFile(dsn); path != "" {
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return nil, fmt.Errorf("unable to create database directory: %w", err)
+		}
+	}
+
+	params := url.Values{}
+	params.Set("_busy_timeout", fmt.Sprint(cfg.DatabaseBusyTimeout.Milliseconds()))
+	params.Set("_foreign_keys", fmt.Sprint(cfg.DatabaseForeignKeys))
+	// Transactions take the write lock when they begin rather than when they
+	// first write, so that a transaction waiting on another writer waits out
+	// the busy timeout instead of failing straight away.
+	params.Set("_txlock", "immediate")
+	if !memory {
+		params.Set("_journal_mode", cfg.DatabaseJournalMode)
+	}
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open("sqlite3", dsn+separator+params.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("unable to open database: %w", err)
+	}
+
+	db.SetMaxOpenConns(cfg.DatabaseMaxOpenConns)
+	db.SetMaxIdleConns(cfg.DatabaseMaxIdleConns)
+	db.SetConnMaxLifetime(cfg.DatabaseConnMaxLifetime)
+	if memory {
+		// An in-memory database is gone once its last connection closes, so
+		// one connection is always kept open.
+		db.SetMaxIdleConns(max(cfg.DatabaseMaxIdleConns, 1))
+		db.SetConnMaxLifetime(0)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to connect to database: %w", err)
+	}
+	if !memory {
+		var journalMode string
+		if err := db.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("unable to read journal mode: %w", err)
+		}
+		if !strings.EqualFold(journalMode, cfg.DatabaseJournalMode) {
+			db.Close()
+			return nil, fmt.Errorf("database is in journal mode %s instead of %s", journalMode, cfg.DatabaseJournalMode)
+		}
+	}
+	return db, nil
+}
+
+// DatabaseFile returns the path of the database file named by dsn, or an empty
+// string if dsn names an in-memory database.
+func DatabaseFile(dsn string) string {
+	if isMemoryDSN(dsn) {
+		return ""
+	}
+	path, _, _ := strings.Cut(strings.TrimPrefix(dsn, "file:"), "?")
+	return path
+}
+
+func isMemoryDSN(dsn string) bool {
+	if dsn == ":memory:" || strings.HasPrefix(dsn, "file::memory:") {
+		return true
+	}
+	_, query, _ := strings.Cut(dsn, "?")
+	params, err := url.ParseQuery(query)
+	return err == nil && (params.Get("mode") == "memory" || params.Get("vfs") == "memdb")
+}
@@ -0,0 +1,179 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// PinMessage pins a message, or updates the note and include_in_context of
+// the pin if the message is already pinned.
+func (db *DB) PinMessage(messageId int64, note string, includeInContext bool) error {
+	return db.WithTx(func(tx *DB) error {
+		before, err := tx.pinAuditValues(messageId)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(config.PIN_MESSAGE_QUERY, messageId, note, includeInContext); err != nil {
+			return fmt.Errorf("unable to pin message %d: %w", messageId, err)
+		}
+		after := map[string]any{"note": note, "include_in_context": includeInContext}
+		changes := auditChanges{}
+		changes.fields(pinAuditFields, before, after)
+		return tx.audit("message.pin", auditMessage, messageId, changes)
+	})
+}
+
+// UnpinMessage removes the pin from a message. It is not an error to unpin a
+// message that is not pinned.
+func (db *DB) UnpinMessage(messageId int64) error {
+	return db.WithTx(func(tx *DB) error {
+		before, err := tx.pinAuditValues(messageId)
+		if err != nil || before == nil {
+			return err
+		}
+		if _, err := tx.Exec(config.UNPIN_MESSAGE_QUERY, messageId); err != nil {
+			return fmt.Errorf("unable to unpin message %d: %w", messageId, err)
+		}
+		changes := auditChanges{}
+		changes.fields(pinAuditFields, before, nil)
+		return tx.audit("message.unpin", auditMessage, messageId, changes)
+	})
+}
+
+// The pin fields recorded in the audit log, in the order they are recorded.
+var pinAuditFields = []string{"note", "include_in_context"}
+
+// pinAuditValues returns the fields of the pin on a message that are recorded
+// in the audit log, or nil if the message is not pinned.
+func (db *DB) pinAuditValues(messageId int64) (map[string]any, error) {
+	rows, err := db.Query(config.GET_PIN_QUERY, messageId)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get pin of message %d: %w", messageId, err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	var note string
+	var includeInContext bool
+	if err := rows.Scan(&note, &includeInContext); err != nil {
+		return nil, fmt.Errorf("unable to read pin of message %d: %w", messageId, err)
+	}
+	return map[string]any{"note": note, "include_in_context": includeInContext}, nil
+}
+
+// GetPin returns the pin on a message, or ErrNotFound if it is not pinned.
+func (db *DB) GetPin(messageId int64) (*chat.Pin, error) {
+	rows, err := db.Query(config.GET_MESSAGE_PIN_QUERY, messageId)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get pin of message %d: %w", messageId, err)
+	}
+	defer rows.Close()
+	pins, err := db.pinsFromRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(pins) == 0 {
+		return nil, fmt.Errorf("pin of message %d %w", messageId, ErrNotFound)
+	}
+	return pins[0], nil
+}
+
+// ListPins returns the pins on messages that are not in the trash, most
+// recently pinned first. A conversationId of 0 lists pins across every
+// conversation.
+func (db *DB) ListPins(conversationId int64) ([]*chat.Pin, error) {
+	rows, err := db.Query(config.LIST_PINS_QUERY, conversationId)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pins: %w", err)
+	}
+	defer rows.Close()
+	return db.pinsFromRows(rows)
+}
+
+// ListContextPins returns the pinned messages of a conversation that should
+// always be sent to the model, oldest first.
+func (db *DB) ListContextPins(conversationId int64) ([]*chat.Message, error) {
+	rows, err := db.Query(config.LIST_CONTEXT_PINS_QUERY, conversationId)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pinned messages of conversation %d: %w", conversationId, err)
+	}
+	defer rows.Close()
+	return db.messagesFromRows(rows)
+}
+
+func (db *DB) pinsFromRows(rows *sql.Rows) ([]*chat.Pin, error) {
+	pins := []*chat.Pin{}
+	for rows.Next() {
+		var note string
+		var includeInContext bool
+		var pinnedAt, createdAt time.Time
+		var id, conversationId int64
+		var body, senderStr, statusStr string
+		var deletedAt, redactedAt *time.Time
+		var replyTo *int64
+		var bodyKeyId *string
+		if err := rows.Scan(
+			&note,
+			&includeInContext,
+			&pinnedAt,
+			&id,
+			&body,
+			&senderStr,
+			&createdAt,
+			&conversationId,
+			&deletedAt,
+			&statusStr,
+			&replyTo,
+			&redactedAt,
+			&bodyKeyId,
+		); err != nil {
+			return nil, fmt.Errorf("unable to build pin: %w", err)
+		}
+		body, err := db.open(messageBodyColumn, id, body, bodyKeyId)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", id, err)
+		}
+
+		sender, ok := chat.Message_Sender_value[senderStr]
+		if !ok {
+			return nil, fmt.Errorf("unable to parse sender %s", senderStr)
+		}
+		status, ok := chat.Message_Status_value[statusStr]
+		if !ok {
+			return nil, fmt.Errorf("unable to parse status %s", statusStr)
+		}
+
+		message := &chat.Message{
+			Id:             id,
+			Body:           body,
+			Sender:         chat.Message_Sender(sender),
+			CreatedAt:      timestamppb.New(createdAt),
+			ConversationId: conversationId,
+			Status:         chat.Message_Status(status),
+		}
+		if replyTo != nil {
+			message.ReplyTo = *replyTo
+		}
+		if deletedAt != nil {
+			message.DeletedAt = timestamppb.New(*deletedAt)
+		}
+		if redactedAt != nil {
+			message.RedactedAt = timestamppb.New(*redactedAt)
+		}
+		pins = append(pins, &chat.Pin{
+			MessageId:        id,
+			ConversationId:   conversationId,
+			Note:             note,
+			IncludeInContext: includeInContext,
+			CreatedAt:        timestamppb.New(pinnedAt),
+			Message:          message,
+		})
+	}
+	return pins, nil
+}
@@ -0,0 +1,38 @@
+package database
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+)
+
+func TestGetPin(t *testing.T) {
+	db := newTestDB(t, nil)
+	conversation, err := db.CreateConversation("Pins", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned, err := db.CreateMessage("pinned", chat.Message_USER, conversation.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpinned, err := db.CreateMessage("unpinned", chat.Message_USER, conversation.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PinMessage(pinned.Id, "note", true); err != nil {
+		t.Fatal(err)
+	}
+
+	pin, err := db.GetPin(pinned.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pin.Note != "note" || !pin.IncludeInContext || pin.Message.GetBody() != "pinned" {
+		t.Fatalf("expected the pin of message %d, got %v", pinned.Id, pin)
+	}
+	if _, err := db.GetPin(unpinned.Id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected a message that is not pinned to fail with ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,323 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/proto/admin"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ApplyRetention purges or redacts up to limit messages that are older than
+// the retention period that applies to them, and records what it removed in
+// the retention audit log. maxAge is the server wide retention period, where
+// zero keeps messages forever unless a policy says otherwise.
+//
+// The context of every conversation that lost messages is cleared as well,
+// since it summarizes them. It returns one audit entry per conversation.
+func (db *DB) ApplyRetention(maxAge time.Duration, action admin.RetentionAction, limit int) ([]*admin.RetentionAuditEntry, error) {
+	var entries []*admin.RetentionAuditEntry
+	err := db.WithTx(func(tx *DB) error {
+		var err error
+		entries, err = tx.expiredMessages(maxAge, action, limit)
+		if err != nil || len(entries) == 0 {
+			return err
+		}
+
+		ids := []int64{}
+		conversationIds := []int64{}
+		for _, entry := range entries {
+			ids = append(ids, entry.MessageIds...)
+			conversationIds = append(conversationIds, entry.ConversationId)
+		}
+		idsJson, err := json.Marshal(ids)
+		if err != nil {
+			return fmt.Errorf("unable to encode expired message ids: %w", err)
+		}
+		conversationIdsJson, err := json.Marshal(conversationIds)
+		if err != nil {
+			return fmt.Errorf("unable to encode conversation ids: %w", err)
+		}
+
+		query := config.PURGE_MESSAGES_QUERY
+		if action == admin.RetentionAction_REDACT {
+			query = config.REDACT_MESSAGES_QUERY
+		}
+		if _, err := tx.Exec(query, string(idsJson)); err != nil {
+			return fmt.Errorf("unable to %s expired messages: %w", action, err)
+		}
+		if _, err := tx.Exec(config.CLEAR_CONVERSATION_CONTEXTS_QUERY, string(conversationIdsJson)); err != nil {
+			return fmt.Errorf("unable to clear conversation contexts: %w", err)
+		}
+
+		for _, entry := range entries {
+			messageIds, err := json.Marshal(entry.MessageIds)
+			if err != nil {
+				return fmt.Errorf("unable to encode message ids: %w", err)
+			}
+			result, err := tx.Exec(
+				config.CREATE_RETENTION_AUDIT_QUERY,
+				action.String(),
+				entry.ConversationId,
+				string(messageIds),
+				len(entry.MessageIds),
+				sqlTimestamp(entry.OldestCreatedAt.AsTime()),
+				sqlTimestamp(entry.NewestCreatedAt.AsTime()))
+			if err != nil {
+				return fmt.Errorf("unable to record retention audit entry: %w", err)
+			}
+			if entry.Id, err = result.LastInsertId(); err != nil {
+				return fmt.Errorf("unable to get last insert ID: %w", err)
+			}
+			changes := auditChanges{}
+			changes.set("message_ids", nil, entry.MessageIds)
+			changes.content("context", true)
+			if err := tx.audit("conversation.retention_"+strings.ToLower(action.String()), auditConversation, entry.ConversationId, changes); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// expiredMessages finds up to limit expired messages, grouped into audit
+// entries by conversation.
+func (db *DB) expiredMessages(maxAge time.Duration, action admin.RetentionAction, limit int) ([]*admin.RetentionAuditEntry, error) {
+	rows, err := db.Query(config.LIST_EXPIRED_MESSAGES_QUERY, int64(maxAge.Seconds()), action.String(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list expired messages: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []*admin.RetentionAuditEntry{}
+	byConversation := map[int64]*admin.RetentionAuditEntry{}
+	for rows.Next() {
+		var id, conversationId int64
+		var createdAt time.Time
+		if err := rows.Scan(&id, &conversationId, &createdAt); err != nil {
+			return nil, fmt.Errorf("unable to read expired message: %w", err)
+		}
+		entry, ok := byConversation[conversationId]
+		if !ok {
+			entry = &admin.RetentionAuditEntry{
+				Action:          action,
+				ConversationId:  conversationId,
+				OldestCreatedAt: timestamppb.New(createdAt),
+				NewestCreatedAt: timestamppb.New(createdAt),
+			}
+			byConversation[conversationId] = entry
+			entries = append(entries, entry)
+		}
+		entry.MessageIds = append(entry.MessageIds, id)
+		if createdAt.Before(entry.OldestCreatedAt.AsTime()) {
+			entry.OldestCreatedAt = timestamppb.New(createdAt)
+		}
+		if createdAt.After(entry.NewestCreatedAt.AsTime()) {
+			entry.NewestCreatedAt = timestamppb.New(createdAt)
+		}
+	}
+	return entries, rows.Err()
+}
+
+// ListRetentionAudit returns the most recent entries of the retention audit
+// log, newest first.
+func (db *DB) ListRetentionAudit(limit int) ([]*admin.RetentionAuditEntry, error) {
+	rows, err := db.Query(config.LIST_RETENTION_AUDIT_QUERY, limit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list retention audit log: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []*admin.RetentionAuditEntry{}
+	for rows.Next() {
+		var id, conversationId int64
+		var action, messageIds string
+		var oldestCreatedAt, newestCreatedAt, createdAt time.Time
+		if err := rows.Scan(&id, &action, &conversationId, &messageIds, &oldestCreatedAt, &newestCreatedAt, &createdAt); err != nil {
+			return nil, fmt.Errorf("unable to build retention audit entry: %w", err)
+		}
+		entry := &admin.RetentionAuditEntry{
+			Id:              id,
+			Action:          admin.RetentionAction(admin.RetentionAction_value[action]),
+			ConversationId:  conversationId,
+			OldestCreatedAt: timestamppb.New(oldestCreatedAt),
+			NewestCreatedAt: timestamppb.New(newestCreatedAt),
+			CreatedAt:       timestamppb.New(createdAt),
+		}
+		if err := json.Unmarshal([]byte(messageIds), &entry.MessageIds); err != nil {
+			return nil, fmt.Errorf("unable to parse message ids of retention audit entry %d: %w", id, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// SetRetentionPolicy creates or replaces the retention policy of a
+// conversation or a tag. Exactly one of conversationId and tagId must be set.
+// A nil maxAge falls back to the next policy in line.
+func (db *DB) SetRetentionPolicy(conversationId, tagId int64, maxAge *time.Duration, legalHold bool) (*admin.RetentionPolicy, error) {
+	var maxAgeSeconds *int64
+	if maxAge != nil {
+		seconds := int64(maxAge.Seconds())
+		maxAgeSeconds = &seconds
+	}
+	var policy *admin.RetentionPolicy
+	err := db.WithTx(func(tx *DB) error {
+		before, err := tx.findRetentionPolicy(conversationId, tagId)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(config.SET_RETENTION_POLICY_QUERY, nullableId(conversationId), nullableId(tagId), maxAgeSeconds, legalHold); err != nil {
+			return fmt.Errorf("unable to set retention policy: %w", err)
+		}
+		if policy, err = tx.findRetentionPolicy(conversationId, tagId); err != nil {
+			return err
+		}
+		if policy == nil {
+			return fmt.Errorf("retention policy was not stored")
+		}
+		return tx.audit("retention_policy.set", auditRetentionPolicy, policy.Id, retentionPolicyChanges(before, policy))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// findRetentionPolicy returns the retention policy of a conversation or a
+// tag, or nil if there is none.
+func (db *DB) findRetentionPolicy(conversationId, tagId int64) (*admin.RetentionPolicy, error) {
+	rows, err := db.Query(config.FIND_RETENTION_POLICY_QUERY, nullableId(conversationId), nullableId(tagId))
+	if err != nil {
+		return nil, fmt.Errorf("unable to get retention policy: %w", err)
+	}
+	defer rows.Close()
+	policies, err := retentionPoliciesFromRows(rows)
+	if err != nil || len(policies) == 0 {
+		return nil, err
+	}
+	return policies[0], nil
+}
+
+// GetRetentionPolicy returns the retention policy with the given id, or nil
+// if there is none.
+func (db *DB) GetRetentionPolicy(id int) (*admin.RetentionPolicy, error) {
+	rows, err := db.Query(config.GET_RETENTION_POLICY_QUERY, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get retention policy: %w", err)
+	}
+	defer rows.Close()
+	policies, err := retentionPoliciesFromRows(rows)
+	if err != nil || len(policies) == 0 {
+		return nil, err
+	}
+	return policies[0], nil
+}
+
+func (db *DB) ListRetentionPolicies() ([]*admin.RetentionPolicy, error) {
+	rows, err := db.Query(config.LIST_RETENTION_POLICIES_QUERY)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list retention policies: %w", err)
+	}
+	defer rows.Close()
+	return retentionPoliciesFromRows(rows)
+}
+
+func (db *DB) DeleteRetentionPolicy(id int) error {
+	return db.WithTx(func(tx *DB) error {
+		before, err := tx.GetRetentionPolicy(id)
+		if err != nil {
+			return err
+		}
+		if err := tx.execOne(config.DELETE_RETENTION_POLICY_QUERY, id); err != nil {
+			return fmt.Errorf("unable to delete retention policy %d: %w", id, err)
+		}
+		return tx.audit("retention_policy.delete", auditRetentionPolicy, int64(id), retentionPolicyChanges(before, nil))
+	})
+}
+
+// retentionPolicyChanges returns the changes between two versions of a
+// retention policy, either of which may be nil when the policy was created or
+// deleted.
+func retentionPolicyChanges(before, after *admin.RetentionPolicy) auditChanges {
+	values := func(policy *admin.RetentionPolicy) map[string]any {
+		if policy == nil {
+			return nil
+		}
+		var maxAgeSeconds *int64
+		if policy.MaxAge != nil {
+			seconds := int64(policy.MaxAge.AsDuration().Seconds())
+			maxAgeSeconds = &seconds
+		}
+		return map[string]any{
+			"conversation_id": nullableId(policy.ConversationId),
+			"tag_id":          nullableId(policy.TagId),
+			"max_age_seconds": maxAgeSeconds,
+			"legal_hold":      policy.LegalHold,
+		}
+	}
+	changes := auditChanges{}
+	changes.fields([]string{"conversation_id", "tag_id", "max_age_seconds", "legal_hold"}, values(before), values(after))
+	return changes
+}
+
+// Vacuum gives the space freed by deleted rows back to the file system. An
+// incremental vacuum is used when the database is set up for it, otherwise
+// the whole database is rebuilt, but only if full is true. It returns whether
+// the database was vacuumed.
+func (db *DB) Vacuum(full bool) (bool, error) {
+	var autoVacuum int
+	if err := db.sql.QueryRow("PRAGMA auto_vacuum").Scan(&autoVacuum); err != nil {
+		return false, fmt.Errorf("unable to read auto_vacuum mode: %w", err)
+	}
+	statement := "VACUUM"
+	// 2 is INCREMENTAL, see https://www.sqlite.org/pragma.html#pragma_auto_vacuum
+	if autoVacuum == 2 {
+		statement = "PRAGMA incremental_vacuum"
+	} else if !full {
+		return false, nil
+	}
+	if _, err := db.sql.Exec(statement); err != nil {
+		return false, fmt.Errorf("unable to vacuum database: %w", err)
+	}
+	return true, nil
+}
+
+func retentionPoliciesFromRows(rows *sql.Rows) ([]*admin.RetentionPolicy, error) {
+	policies := []*admin.RetentionPolicy{}
+	for rows.Next() {
+		var id int64
+		var conversationId, tagId, maxAgeSeconds *int64
+		var legalHold bool
+		var createdAt, updatedAt time.Time
+		if err := rows.Scan(&id, &conversationId, &tagId, &maxAgeSeconds, &legalHold, &createdAt, &updatedAt); err != nil {
+			return nil, fmt.Errorf("unable to build retention policy: %w", err)
+		}
+		policy := &admin.RetentionPolicy{
+			Id:        id,
+			LegalHold: legalHold,
+			CreatedAt: timestamppb.New(createdAt),
+			UpdatedAt: timestamppb.New(updatedAt),
+		}
+		if conversationId != nil {
+			policy.ConversationId = *conversationId
+		}
+		if tagId != nil {
+			policy.TagId = *tagId
+		}
+		if maxAgeSeconds != nil {
+			policy.MaxAge = durationpb.New(time.Duration(*maxAgeSeconds) * time.Second)
+		}
+		policies = append(policies, policy)
+	}
+	return policies, rows.Err()
+}
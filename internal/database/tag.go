@@ -0,0 +1,233 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (db *DB) CreateTag(name string) (*chat.Tag, error) {
+	var tag *chat.Tag
+	err := db.WithTx(func(tx *DB) error {
+		result, err := tx.Exec(config.CREATE_TAG_QUERY, name)
+		if isUniqueViolation(err, "tags.name") {
+			return fmt.Errorf("unable to create tag %q: %w", name, ErrDuplicateName)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to create tag: %w", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("unable to get last insert ID: %w", err)
+		}
+		if tag, err = tx.GetTag(int(id)); err != nil {
+			return err
+		}
+		return tx.audit("tag.create", auditTag, id, tagChanges(nil, tag))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tag, nil
+}
+
+// GetTag returns the tag with the given id, or nil if there is none.
+func (db *DB) GetTag(id int) (*chat.Tag, error) {
+	rows, err := db.Query(config.GET_TAG_QUERY, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get tag: %w", err)
+	}
+	defer rows.Close()
+	tags, err := tagsFromRows(rows)
+	if err != nil || len(tags) == 0 {
+		return nil, err
+	}
+	return tags[0], nil
+}
+
+func (db *DB) ListTags() ([]*chat.Tag, error) {
+	rows, err := db.Query(config.LIST_TAGS_QUERY)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tags: %w", err)
+	}
+	defer rows.Close()
+	return tagsFromRows(rows)
+}
+
+func (db *DB) RenameTag(id int, name string) (*chat.Tag, error) {
+	var tag *chat.Tag
+	err := db.WithTx(func(tx *DB) error {
+		before, err := tx.GetTag(id)
+		if err != nil {
+			return err
+		}
+		err = tx.execOne(config.RENAME_TAG_QUERY, name, id)
+		if isUniqueViolation(err, "tags.name") {
+			return fmt.Errorf("unable to rename tag %d to %q: %w", id, name, ErrDuplicateName)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to rename tag %d: %w", id, err)
+		}
+		if tag, err = tx.GetTag(id); err != nil {
+			return err
+		}
+		return tx.audit("tag.rename", auditTag, int64(id), tagChanges(before, tag))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tag, nil
+}
+
+// DeleteTag deletes the tag with the given id and removes it from every
+// conversation.
+func (db *DB) DeleteTag(id int) error {
+	return db.WithTx(func(tx *DB) error {
+		before, err := tx.GetTag(id)
+		if err != nil {
+			return err
+		}
+		if err := tx.execOne(config.DELETE_TAG_QUERY, id); err != nil {
+			return fmt.Errorf("unable to delete tag %d: %w", id, err)
+		}
+		return tx.audit("tag.delete", auditTag, int64(id), tagChanges(before, nil))
+	})
+}
+
+// tagChanges returns the changes between two versions of a tag, either of
+// which may be nil when the tag was created or deleted.
+func tagChanges(before, after *chat.Tag) auditChanges {
+	values := func(tag *chat.Tag) map[string]any {
+		if tag == nil {
+			return nil
+		}
+		return map[string]any{"name": tag.Name}
+	}
+	changes := auditChanges{}
+	changes.fields([]string{"name"}, values(before), values(after))
+	return changes
+}
+
+// AddConversationTag puts the named tag on a conversation, creating the tag if
+// it does not exist yet. It is not recorded in the audit log on its own, see
+// TagConversation.
+func (db *DB) AddConversationTag(conversationId int64, name string) error {
+	return db.WithTx(func(tx *DB) error {
+		if _, err := tx.Exec(config.ENSURE_TAG_QUERY, name); err != nil {
+			return fmt.Errorf("unable to create tag %q: %w", name, err)
+		}
+		if _, err := tx.Exec(config.ADD_CONVERSATION_TAG_QUERY, conversationId, name); err != nil {
+			return fmt.Errorf("unable to tag conversation %d: %w", conversationId, err)
+		}
+		return nil
+	})
+}
+
+// RemoveConversationTag takes the named tag off a conversation. The tag itself
+// is kept.
+func (db *DB) RemoveConversationTag(conversationId int64, name string) error {
+	if _, err := db.Exec(config.REMOVE_CONVERSATION_TAG_QUERY, conversationId, name); err != nil {
+		return fmt.Errorf("unable to untag conversation %d: %w", conversationId, err)
+	}
+	return nil
+}
+
+// SetConversationTags replaces every tag on a conversation with the named tags,
+// creating any that do not exist yet.
+func (db *DB) SetConversationTags(conversationId int64, names []string) error {
+	return db.WithTx(func(tx *DB) error {
+		if _, err := tx.Exec(config.CLEAR_CONVERSATION_TAGS_QUERY, conversationId); err != nil {
+			return fmt.Errorf("unable to clear tags of conversation %d: %w", conversationId, err)
+		}
+		for _, name := range names {
+			if err := tx.AddConversationTag(conversationId, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *DB) getConversationTags(conversationId int64) ([]string, error) {
+	rows, err := db.Query(config.GET_CONVERSATION_TAGS_QUERY, conversationId)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get tags of conversation %d: %w", conversationId, err)
+	}
+	defer rows.Close()
+	var tags []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("unable to read tag: %w", err)
+		}
+		tags = append(tags, name)
+	}
+	return tags, nil
+}
+
+// listConversationTags returns the tag names of the conversations with the
+// given ids, keyed by conversation id.
+func (db *DB) listConversationTags(conversationIds []int64) (map[int64][]string, error) {
+	ids, err := json.Marshal(conversationIds)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode conversation ids: %w", err)
+	}
+	rows, err := db.Query(config.LIST_CONVERSATION_TAGS_QUERY, string(ids))
+	if err != nil {
+		return nil, fmt.Errorf("unable to list conversation tags: %w", err)
+	}
+	defer rows.Close()
+	tags := map[int64][]string{}
+	for rows.Next() {
+		var conversationId int64
+		var name string
+		if err := rows.Scan(&conversationId, &name); err != nil {
+			return nil, fmt.Errorf("unable to read tag: %w", err)
+		}
+		tags[conversationId] = append(tags[conversationId], name)
+	}
+	return tags, rows.Err()
+}
+
+// NormalizeTags trims tag names and drops empty names and names that repeat,
+// ignoring case, keeping the first spelling.
+func NormalizeTags(names []string) []string {
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		key := strings.ToLower(name)
+		if name == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		tags = append(tags, name)
+	}
+	return tags
+}
+
+func tagsFromRows(rows *sql.Rows) ([]*chat.Tag, error) {
+	tags := []*chat.Tag{}
+	for rows.Next() {
+		var id int64
+		var name string
+		var createdAt time.Time
+		var conversationCount int32
+		if err := rows.Scan(&id, &name, &createdAt, &conversationCount); err != nil {
+			return nil, fmt.Errorf("unable to build tag: %w", err)
+		}
+		tags = append(tags, &chat.Tag{
+			Id:                id,
+			Name:              name,
+			CreatedAt:         timestamppb.New(createdAt),
+			ConversationCount: conversationCount,
+		})
+	}
+	return tags, nil
+}
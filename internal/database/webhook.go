@@ -0,0 +1,543 @@
+package database
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/timsexperiments/chat-cli/internal/codec"
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/proto/admin"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The types of events sent to webhooks.
+const (
+	WebhookConversationCreated = "conversation.created"
+	WebhookMessageCreated      = "message.created"
+	WebhookReplyCompleted      = "reply.completed"
+	WebhookConversationDeleted = "conversation.deleted"
+)
+
+// WebhookEventTypes are the types of events webhooks can subscribe to.
+var WebhookEventTypes = []string{WebhookConversationCreated, WebhookMessageCreated, WebhookReplyCompleted, WebhookConversationDeleted}
+
+// ValidWebhookEventType reports whether webhooks can subscribe to eventType.
+func ValidWebhookEventType(eventType string) bool {
+	return slices.Contains(WebhookEventTypes, eventType)
+}
+
+// PendingWebhookDelivery is an event that is due to be sent to a webhook,
+// along with what is needed to send it.
+type PendingWebhookDelivery struct {
+	Id        int64
+	WebhookId int64
+	EventId   string
+	EventType string
+	// The WebhookEvent to send, as JSON.
+	Payload []byte
+	// The number of failed attempts to send the event since it was queued.
+	Attempts int
+	Url      string
+	Secret   string
+	// Err is why the payload or secret could not be decrypted, in which case
+	// they are empty and the delivery cannot be sent.
+	Err error
+}
+
+// CreateWebhook subscribes url to the given types of events. Deliveries are
+// signed with secret, which is returned on the webhook.
+func (db *DB) CreateWebhook(url string, eventTypes []string, secret string) (*admin.Webhook, error) {
+	var webhook *admin.Webhook
+	err := db.WithTx(func(tx *DB) error {
+		result, err := tx.Exec(config.CREATE_WEBHOOK_QUERY, url, "", nil, strings.Join(eventTypes, ","))
+		if err != nil {
+			return fmt.Errorf("unable to create webhook: %w", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("unable to get last insert ID: %w", err)
+		}
+		if err := tx.storeSealed(webhookSecretColumn, id, secret, config.UPDATE_WEBHOOK_SECRET_QUERY); err != nil {
+			return err
+		}
+		if webhook, err = tx.GetWebhook(int(id)); err != nil {
+			return err
+		}
+		changes := webhookChanges(nil, webhook)
+		changes.content("secret", true)
+		return tx.audit("webhook.create", auditWebhook, id, changes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	webhook.Secret = secret
+	return webhook, nil
+}
+
+// GetWebhook returns the webhook with the given id, without its secret, or nil
+// if there is none.
+func (db *DB) GetWebhook(id int) (*admin.Webhook, error) {
+	rows, err := db.Query(config.GET_WEBHOOK_QUERY, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get webhook: %w", err)
+	}
+	defer rows.Close()
+	webhooks, err := webhooksFromRows(rows)
+	if err != nil || len(webhooks) == 0 {
+		return nil, err
+	}
+	return webhooks[0], nil
+}
+
+// ListWebhooks returns every webhook, without their secrets.
+func (db *DB) ListWebhooks() ([]*admin.Webhook, error) {
+	rows, err := db.Query(config.LIST_WEBHOOKS_QUERY)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list webhooks: %w", err)
+	}
+	defer rows.Close()
+	return webhooksFromRows(rows)
+}
+
+// UpdateWebhook stores the url, event types and active flag of webhook, and
+// replaces its secret with secret unless it is empty. The secret is only
+// returned on the webhook when it was replaced.
+func (db *DB) UpdateWebhook(webhook *admin.Webhook, secret string) (*admin.Webhook, error) {
+	var updated *admin.Webhook
+	err := db.WithTx(func(tx *DB) error {
+		before, err := tx.GetWebhook(int(webhook.Id))
+		if err != nil {
+			return err
+		}
+		if err := tx.execOne(config.UPDATE_WEBHOOK_QUERY, webhook.Url, strings.Join(webhook.EventTypes, ","), webhook.Active, webhook.Id); err != nil {
+			return fmt.Errorf("unable to update webhook %d: %w", webhook.Id, err)
+		}
+		if secret != "" {
+			if err := tx.storeSealed(webhookSecretColumn, webhook.Id, secret, config.UPDATE_WEBHOOK_SECRET_QUERY); err != nil {
+				return err
+			}
+		}
+		if updated, err = tx.GetWebhook(int(webhook.Id)); err != nil {
+			return err
+		}
+		changes := webhookChanges(before, updated)
+		changes.content("secret", secret != "")
+		return tx.audit("webhook.update", auditWebhook, webhook.Id, changes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	updated.Secret = secret
+	return updated, nil
+}
+
+// DeleteWebhook deletes the webhook with the given id along with its
+// deliveries, including the ones that were not sent yet.
+func (db *DB) DeleteWebhook(id int) error {
+	return db.WithTx(func(tx *DB) error {
+		before, err := tx.GetWebhook(id)
+		if err != nil {
+			return err
+		}
+		if err := tx.execOne(config.DELETE_WEBHOOK_QUERY, id); err != nil {
+			return fmt.Errorf("unable to delete webhook %d: %w", id, err)
+		}
+		return tx.audit("webhook.delete", auditWebhook, int64(id), webhookChanges(before, nil))
+	})
+}
+
+// webhookChanges returns the changes between two versions of a webhook,
+// either of which may be nil when the webhook was created or deleted.
+func webhookChanges(before, after *admin.Webhook) auditChanges {
+	values := func(webhook *admin.Webhook) map[string]any {
+		if webhook == nil {
+			return nil
+		}
+		return map[string]any{"url": webhook.Url, "event_types": webhook.EventTypes, "active": webhook.Active}
+	}
+	changes := auditChanges{}
+	changes.fields([]string{"url", "event_types", "active"}, values(before), values(after))
+	return changes
+}
+
+// emitWebhookEvent queues an event for every active webhook that subscribes
+// to its type. It is meant to run in the same transaction as the change the
+// event is about, so that an event is queued if and only if the change is
+// stored. The conversation is sent without its messages.
+func (db *DB) emitWebhookEvent(eventType string, conversation *chat.Conversation, message *chat.Message) error {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("unable to generate id of %s event: %w", eventType, err)
+	}
+	event := &admin.WebhookEvent{
+		Id:        "evt_" + hex.EncodeToString(id),
+		Type:      eventType,
+		CreatedAt: timestamppb.Now(),
+		Message:   message,
+	}
+	if conversation != nil {
+		event.Conversation = proto.Clone(conversation).(*chat.Conversation)
+		event.Conversation.Messages = nil
+	}
+	payload, err := codec.Marshal(codec.JSON, event)
+	if err != nil {
+		return fmt.Errorf("unable to encode %s event: %w", eventType, err)
+	}
+	// The deliveries are queued without their payload, which is bound to the
+	// id of each delivery once it is known.
+	rows, err := db.Query(config.ENQUEUE_WEBHOOK_DELIVERIES_QUERY, event.Id, eventType)
+	if err != nil {
+		return fmt.Errorf("unable to queue %s event: %w", eventType, err)
+	}
+	deliveryIds := []int64{}
+	for rows.Next() {
+		var deliveryId int64
+		if err := rows.Scan(&deliveryId); err != nil {
+			rows.Close()
+			return fmt.Errorf("unable to queue %s event: %w", eventType, err)
+		}
+		deliveryIds = append(deliveryIds, deliveryId)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("unable to queue %s event: %w", eventType, err)
+	}
+	for _, deliveryId := range deliveryIds {
+		if err := db.storeSealed(webhookPayloadColumn, deliveryId, string(payload), config.UPDATE_WEBHOOK_PAYLOAD_QUERY); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListDueWebhookDeliveries returns up to limit pending deliveries to active
+// webhooks that are due to be attempted at now, the longest overdue first. A
+// delivery whose payload or secret cannot be decrypted is returned with Err
+// set rather than failing the others.
+func (db *DB) ListDueWebhookDeliveries(now time.Time, limit int) ([]*PendingWebhookDelivery, error) {
+	rows, err := db.Query(config.LIST_DUE_WEBHOOK_DELIVERIES_QUERY, sqlTimestamp(now), limit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list due webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+	deliveries := []*PendingWebhookDelivery{}
+	for rows.Next() {
+		delivery := &PendingWebhookDelivery{}
+		var payload, secret string
+		var payloadKeyId, secretKeyId *string
+		if err := rows.Scan(
+			&delivery.Id,
+			&delivery.WebhookId,
+			&delivery.EventId,
+			&delivery.EventType,
+			&payload,
+			&payloadKeyId,
+			&delivery.Attempts,
+			&delivery.Url,
+			&secret,
+			&secretKeyId); err != nil {
+			return nil, fmt.Errorf("unable to build webhook delivery: %w", err)
+		}
+		if payload, err = db.open(webhookPayloadColumn, delivery.Id, payload, payloadKeyId); err != nil {
+			delivery.Err = fmt.Errorf("webhook delivery %d: %w", delivery.Id, err)
+		} else if delivery.Secret, err = db.open(webhookSecretColumn, delivery.WebhookId, secret, secretKeyId); err != nil {
+			delivery.Err = fmt.Errorf("webhook %d: %w", delivery.WebhookId, err)
+		} else {
+			delivery.Payload = []byte(payload)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// CompleteWebhookDelivery records a successful attempt to send the delivery
+// with the given id.
+func (db *DB) CompleteWebhookDelivery(id int64, attempt *admin.WebhookAttempt) error {
+	return db.WithTx(func(tx *DB) error {
+		if err := tx.createWebhookAttempt(id, attempt); err != nil {
+			return err
+		}
+		if err := tx.execOne(config.COMPLETE_WEBHOOK_DELIVERY_QUERY, id); err != nil {
+			return fmt.Errorf("unable to complete webhook delivery %d: %w", id, err)
+		}
+		return nil
+	})
+}
+
+// RetryWebhookDelivery records a failed attempt to send the delivery with the
+// given id, which is attempted again at next.
+func (db *DB) RetryWebhookDelivery(id int64, attempt *admin.WebhookAttempt, next time.Time) error {
+	return db.WithTx(func(tx *DB) error {
+		if err := tx.createWebhookAttempt(id, attempt); err != nil {
+			return err
+		}
+		if err := tx.execOne(config.RETRY_WEBHOOK_DELIVERY_QUERY, sqlTimestamp(next), id); err != nil {
+			return fmt.Errorf("unable to reschedule webhook delivery %d: %w", id, err)
+		}
+		return nil
+	})
+}
+
+// FailWebhookDelivery records the last failed attempt to send the delivery
+// with the given id, and moves it to the dead letters.
+func (db *DB) FailWebhookDelivery(id int64, attempt *admin.WebhookAttempt) error {
+	return db.WithTx(func(tx *DB) error {
+		if err := tx.createWebhookAttempt(id, attempt); err != nil {
+			return err
+		}
+		if err := tx.execOne(config.FAIL_WEBHOOK_DELIVERY_QUERY, id); err != nil {
+			return fmt.Errorf("unable to fail webhook delivery %d: %w", id, err)
+		}
+		if _, err := tx.Exec(config.CREATE_WEBHOOK_DEAD_LETTER_QUERY, id, attempt.Error); err != nil {
+			return fmt.Errorf("unable to move webhook delivery %d to the dead letters: %w", id, err)
+		}
+		return nil
+	})
+}
+
+func (db *DB) createWebhookAttempt(deliveryId int64, attempt *admin.WebhookAttempt) error {
+	var statusCode *int32
+	if attempt.StatusCode != 0 {
+		statusCode = &attempt.StatusCode
+	}
+	_, err := db.Exec(
+		config.CREATE_WEBHOOK_ATTEMPT_QUERY,
+		deliveryId,
+		statusCode,
+		nullableString(attempt.Error),
+		attempt.Duration.AsDuration().Milliseconds())
+	if err != nil {
+		return fmt.Errorf("unable to record attempt of webhook delivery %d: %w", deliveryId, err)
+	}
+	return nil
+}
+
+// ListWebhookDeliveries returns the limit most recent deliveries to the
+// webhook with the given id, newest first, with their attempt logs.
+func (db *DB) ListWebhookDeliveries(webhookId int64, limit int) ([]*admin.WebhookDelivery, error) {
+	rows, err := db.Query(config.LIST_WEBHOOK_DELIVERIES_QUERY, webhookId, limit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list deliveries of webhook %d: %w", webhookId, err)
+	}
+	deliveries, err := webhookDeliveriesFromRows(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	for _, delivery := range deliveries {
+		if delivery.AttemptLog, err = db.listWebhookAttempts(delivery.Id); err != nil {
+			return nil, err
+		}
+	}
+	return deliveries, nil
+}
+
+// GetWebhookDelivery returns the delivery with the given id with its attempt
+// log, or nil if there is none.
+func (db *DB) GetWebhookDelivery(id int64) (*admin.WebhookDelivery, error) {
+	rows, err := db.Query(config.GET_WEBHOOK_DELIVERY_QUERY, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get webhook delivery %d: %w", id, err)
+	}
+	deliveries, err := webhookDeliveriesFromRows(rows)
+	rows.Close()
+	if err != nil || len(deliveries) == 0 {
+		return nil, err
+	}
+	if deliveries[0].AttemptLog, err = db.listWebhookAttempts(id); err != nil {
+		return nil, err
+	}
+	return deliveries[0], nil
+}
+
+func (db *DB) listWebhookAttempts(deliveryId int64) ([]*admin.WebhookAttempt, error) {
+	rows, err := db.Query(config.LIST_WEBHOOK_ATTEMPTS_QUERY, deliveryId)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list attempts of webhook delivery %d: %w", deliveryId, err)
+	}
+	defer rows.Close()
+	attempts := []*admin.WebhookAttempt{}
+	for rows.Next() {
+		var statusCode *int32
+		var attemptError *string
+		var durationMs int64
+		var createdAt time.Time
+		if err := rows.Scan(&statusCode, &attemptError, &durationMs, &createdAt); err != nil {
+			return nil, fmt.Errorf("unable to build webhook attempt: %w", err)
+		}
+		attempt := &admin.WebhookAttempt{
+			Attempt:   int32(len(attempts) + 1),
+			Duration:  durationpb.New(time.Duration(durationMs) * time.Millisecond),
+			CreatedAt: timestamppb.New(createdAt),
+		}
+		if statusCode != nil {
+			attempt.StatusCode = *statusCode
+		}
+		if attemptError != nil {
+			attempt.Error = *attemptError
+		}
+		attempts = append(attempts, attempt)
+	}
+	return attempts, rows.Err()
+}
+
+// ListWebhookDeadLetters returns the limit most recent dead letters, newest
+// first.
+func (db *DB) ListWebhookDeadLetters(limit int) ([]*admin.WebhookDeadLetter, error) {
+	rows, err := db.Query(config.LIST_WEBHOOK_DEAD_LETTERS_QUERY, limit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list webhook dead letters: %w", err)
+	}
+	deadLetters, err := webhookDeadLettersFromRows(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return deadLetters, db.withWebhookDeliveries(deadLetters)
+}
+
+// GetWebhookDeadLetter returns the dead letter with the given id, or nil if
+// there is none.
+func (db *DB) GetWebhookDeadLetter(id int) (*admin.WebhookDeadLetter, error) {
+	rows, err := db.Query(config.GET_WEBHOOK_DEAD_LETTER_QUERY, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get webhook dead letter %d: %w", id, err)
+	}
+	deadLetters, err := webhookDeadLettersFromRows(rows)
+	rows.Close()
+	if err != nil || len(deadLetters) == 0 {
+		return nil, err
+	}
+	return deadLetters[0], db.withWebhookDeliveries(deadLetters)
+}
+
+// RedeliverWebhookDeadLetter takes the dead letter with the given id out of
+// the dead letters and queues its delivery to be attempted again right away,
+// with a fresh set of attempts.
+func (db *DB) RedeliverWebhookDeadLetter(id int) (*admin.WebhookDelivery, error) {
+	var delivery *admin.WebhookDelivery
+	err := db.WithTx(func(tx *DB) error {
+		deadLetter, err := tx.GetWebhookDeadLetter(id)
+		if err != nil {
+			return err
+		}
+		if deadLetter == nil {
+			return fmt.Errorf("webhook dead letter %d: %w", id, ErrNotFound)
+		}
+		deliveryId := deadLetter.Delivery.Id
+		if err := tx.execOne(config.REQUEUE_WEBHOOK_DELIVERY_QUERY, deliveryId); err != nil {
+			return fmt.Errorf("unable to queue webhook delivery %d again: %w", deliveryId, err)
+		}
+		if err := tx.execOne(config.DELETE_WEBHOOK_DEAD_LETTER_QUERY, id); err != nil {
+			return fmt.Errorf("unable to delete webhook dead letter %d: %w", id, err)
+		}
+		if delivery, err = tx.GetWebhookDelivery(deliveryId); err != nil {
+			return err
+		}
+		changes := auditChanges{}
+		changes.set("delivery_id", nil, deliveryId)
+		changes.set("event_id", nil, delivery.EventId)
+		return tx.audit("webhook.redeliver", auditWebhook, delivery.WebhookId, changes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// withWebhookDeliveries fills in the delivery of every dead letter.
+func (db *DB) withWebhookDeliveries(deadLetters []*admin.WebhookDeadLetter) error {
+	for _, deadLetter := range deadLetters {
+		delivery, err := db.GetWebhookDelivery(deadLetter.Delivery.Id)
+		if err != nil {
+			return err
+		}
+		if delivery != nil {
+			deadLetter.Delivery = delivery
+		}
+	}
+	return nil
+}
+
+func webhooksFromRows(rows *sql.Rows) ([]*admin.Webhook, error) {
+	webhooks := []*admin.Webhook{}
+	for rows.Next() {
+		var id int64
+		var url, eventTypes string
+		var active bool
+		var createdAt, updatedAt time.Time
+		if err := rows.Scan(&id, &url, &eventTypes, &active, &createdAt, &updatedAt); err != nil {
+			return nil, fmt.Errorf("unable to build webhook: %w", err)
+		}
+		webhooks = append(webhooks, &admin.Webhook{
+			Id:         id,
+			Url:        url,
+			EventTypes: strings.Split(eventTypes, ","),
+			Active:     active,
+			CreatedAt:  timestamppb.New(createdAt),
+			UpdatedAt:  timestamppb.New(updatedAt),
+		})
+	}
+	return webhooks, rows.Err()
+}
+
+func webhookDeliveriesFromRows(rows *sql.Rows) ([]*admin.WebhookDelivery, error) {
+	deliveries := []*admin.WebhookDelivery{}
+	for rows.Next() {
+		delivery := &admin.WebhookDelivery{}
+		var state string
+		var nextAttemptAt, createdAt time.Time
+		var deliveredAt *time.Time
+		if err := rows.Scan(
+			&delivery.Id,
+			&delivery.WebhookId,
+			&delivery.EventId,
+			&delivery.EventType,
+			&state,
+			&delivery.Attempts,
+			&nextAttemptAt,
+			&createdAt,
+			&deliveredAt); err != nil {
+			return nil, fmt.Errorf("unable to build webhook delivery: %w", err)
+		}
+		delivery.State = admin.WebhookDelivery_State(admin.WebhookDelivery_State_value[state])
+		if delivery.State == admin.WebhookDelivery_PENDING {
+			delivery.NextAttemptAt = timestamppb.New(nextAttemptAt)
+		}
+		delivery.CreatedAt = timestamppb.New(createdAt)
+		if deliveredAt != nil {
+			delivery.DeliveredAt = timestamppb.New(*deliveredAt)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// webhookDeadLettersFromRows builds dead letters whose delivery only has its
+// id set.
+func webhookDeadLettersFromRows(rows *sql.Rows) ([]*admin.WebhookDeadLetter, error) {
+	deadLetters := []*admin.WebhookDeadLetter{}
+	for rows.Next() {
+		var id, deliveryId int64
+		var lastError string
+		var createdAt time.Time
+		if err := rows.Scan(&id, &deliveryId, &lastError, &createdAt); err != nil {
+			return nil, fmt.Errorf("unable to build webhook dead letter: %w", err)
+		}
+		deadLetters = append(deadLetters, &admin.WebhookDeadLetter{
+			Id:        id,
+			Delivery:  &admin.WebhookDelivery{Id: deliveryId},
+			LastError: lastError,
+			CreatedAt: timestamppb.New(createdAt),
+		})
+	}
+	return deadLetters, rows.Err()
+}
@@ -0,0 +1,199 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// The version byte at the start of every envelope.
+	envelopeVersion = 1
+	// The size of the keys used, both master keys and data keys. 32 bytes
+	// selects AES-256.
+	keySize = 32
+)
+
+// Keyring holds the master keys used to encrypt data at rest. Every value is
+// encrypted with its own random data key, and the data key is encrypted with
+// the active master key and stored alongside the value. Older master keys
+// are kept so that values encrypted with them can still be read until they
+// are rotated onto the active key.
+type Keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+// NewKeyring creates a keyring from master keys by id. New values are
+// encrypted with the key named by active.
+func NewKeyring(active string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("active key %q is not in the keyring", active)
+	}
+	keyring := &Keyring{active: active, keys: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if id == "" || strings.ContainsAny(id, " \t:") {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		keyring.keys[id] = aead
+	}
+	return keyring, nil
+}
+
+// Load builds the keyring from the configured key or key file. A key is a
+// base64 encoded 32 byte AES key. A key file holds one "<id>:<base64 key>"
+// per line, and the first key in the file is the active key. Blank lines and
+// lines starting with # are ignored. It returns nil when neither is set, in
+// which case nothing is encrypted.
+func Load(key, keyId, keyFile string) (*Keyring, error) {
+	if key != "" && keyFile != "" {
+		return nil, fmt.Errorf("only one of an encryption key and an encryption key file may be set")
+	}
+	if key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode encryption key: %w", err)
+		}
+		return NewKeyring(keyId, map[string][]byte{keyId: decoded})
+	}
+	if keyFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read encryption key file: %w", err)
+	}
+	var active string
+	keys := map[string][]byte{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(text, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected <id>:<base64 key>", keyFile, line)
+		}
+		id = strings.TrimSpace(id)
+		if _, ok := keys[id]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate key id %q", keyFile, line, id)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: unable to decode key: %w", keyFile, line, err)
+		}
+		keys[id] = decoded
+		if active == "" {
+			active = id
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read encryption key file: %w", err)
+	}
+	if active == "" {
+		return nil, fmt.Errorf("encryption key file %s has no keys", keyFile)
+	}
+	return NewKeyring(active, keys)
+}
+
+// ActiveKeyId returns the id of the key new values are encrypted with.
+func (k *Keyring) ActiveKeyId() string {
+	return k.active
+}
+
+// Encrypt encrypts plaintext with a new data key under the active master key.
+// The same associated data must be given to Decrypt. It returns the id of the
+// master key used and the envelope to store.
+func (k *Keyring) Encrypt(plaintext, associatedData []byte) (string, []byte, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", nil, fmt.Errorf("unable to generate data key: %w", err)
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	envelope := []byte{envelopeVersion}
+	envelope, err = seal(k.keys[k.active], envelope, dataKey, associatedData)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to encrypt data key: %w", err)
+	}
+	envelope, err = seal(dataAEAD, envelope, plaintext, associatedData)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to encrypt value: %w", err)
+	}
+	return k.active, envelope, nil
+}
+
+// Decrypt opens an envelope created by Encrypt with the master key keyId.
+func (k *Keyring) Decrypt(keyId string, envelope, associatedData []byte) ([]byte, error) {
+	masterAEAD, ok := k.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %q is not in the keyring", keyId)
+	}
+	if len(envelope) == 0 || envelope[0] != envelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version")
+	}
+	dataKey, rest, err := open(masterAEAD, envelope[1:], keySize, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt data key: %w", err)
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, _, err := open(dataAEAD, rest, len(rest)-dataAEAD.NonceSize()-dataAEAD.Overhead(), associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt value: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("expected a %d byte key, got %d bytes", keySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal appends a random nonce and the sealed plaintext to dst.
+func seal(aead cipher.AEAD, dst, plaintext, associatedData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %w", err)
+	}
+	dst = append(dst, nonce...)
+	return aead.Seal(dst, nonce, plaintext, associatedData), nil
+}
+
+// open reads a nonce and a sealed value of plaintextSize bytes from the start
+// of src, and returns the opened value and what is left of src.
+func open(aead cipher.AEAD, src []byte, plaintextSize int, associatedData []byte) ([]byte, []byte, error) {
+	size := aead.NonceSize() + plaintextSize + aead.Overhead()
+	if plaintextSize < 0 || len(src) < size {
+		return nil, nil, fmt.Errorf("envelope is truncated")
+	}
+	nonce, sealed := src[:aead.NonceSize()], src[aead.NonceSize():size]
+	plaintext, err := aead.Open(nil, nonce, sealed, associatedData)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, src[size:], nil
+}
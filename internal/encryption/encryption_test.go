@@ -0,0 +1,131 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestKeyring(t *testing.T, active string, ids ...string) *Keyring {
+	t.Helper()
+	keys := map[string][]byte{}
+	for i, id := range ids {
+		keys[id] = bytes.Repeat([]byte{byte('a' + i)}, keySize)
+	}
+	keyring, err := NewKeyring(active, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestDecrypt(t *testing.T) {
+	keyring := newTestKeyring(t, "k1", "k1", "k2")
+	keyId, envelope, err := keyring.Encrypt([]byte("secret"), []byte("messages.body:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyId != "k1" || envelope[0] != envelopeVersion {
+		t.Fatalf("expected a version %d envelope under k1, got version %d under %s", envelopeVersion, envelope[0], keyId)
+	}
+	unsupported := append([]byte{envelopeVersion + 1}, envelope[1:]...)
+
+	tests := []struct {
+		name           string
+		keyring        *Keyring
+		keyId          string
+		envelope       []byte
+		associatedData string
+		ok             bool
+	}{
+		{"same row", keyring, "k1", envelope, "messages.body:1", true},
+		{"other row", keyring, "k1", envelope, "messages.body:2", false},
+		{"other column", keyring, "k1", envelope, "conversations.context:1", false},
+		{"other key", keyring, "k2", envelope, "messages.body:1", false},
+		{"unknown key", keyring, "k3", envelope, "messages.body:1", false},
+		{"keyring after rotation", newTestKeyring(t, "k2", "k1", "k2"), "k1", envelope, "messages.body:1", true},
+		{"unsupported version", keyring, "k1", unsupported, "messages.body:1", false},
+		{"truncated", keyring, "k1", envelope[:len(envelope)-1], "messages.body:1", false},
+		{"empty", keyring, "k1", nil, "messages.body:1", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plaintext, err := test.keyring.Decrypt(test.keyId, test.envelope, []byte(test.associatedData))
+			if !test.ok {
+				if err == nil {
+					t.Fatalf("expected decrypting to fail, got %q", plaintext)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(plaintext) != "secret" {
+				t.Fatalf("expected %q, got %q", "secret", plaintext)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	key := func(b byte) string {
+		return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, keySize))
+	}
+	writeFile := func(t *testing.T, content string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "keys")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		keyId   string
+		keyFile string
+		active  string
+		err     string
+	}{
+		{name: "nothing configured"},
+		{name: "key", key: key(1), keyId: "primary", active: "primary"},
+		{name: "key file", keyFile: "# keys\n\nnew: " + key(2) + "\nold:" + key(1) + "\n", active: "new"},
+		{name: "key and key file", key: key(1), keyId: "primary", keyFile: "old:" + key(1), err: "only one"},
+		{name: "short key", key: base64.StdEncoding.EncodeToString([]byte("short")), keyId: "primary", err: "invalid key"},
+		{name: "key that is not base64", key: "!", keyId: "primary", err: "unable to decode"},
+		{name: "line without an id", keyFile: key(1), err: "expected <id>:<base64 key>"},
+		{name: "duplicate id", keyFile: "k:" + key(1) + "\nk:" + key(2), err: "duplicate key id"},
+		{name: "empty key file", keyFile: "# no keys\n", err: "has no keys"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyFile := test.keyFile
+			if keyFile != "" {
+				keyFile = writeFile(t, keyFile)
+			}
+			keyring, err := Load(test.key, test.keyId, keyFile)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.active == "" {
+				if keyring != nil {
+					t.Fatalf("expected no keyring, got one with active key %q", keyring.ActiveKeyId())
+				}
+				return
+			}
+			if keyring.ActiveKeyId() != test.active {
+				t.Fatalf("expected active key %q, got %q", test.active, keyring.ActiveKeyId())
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The version written to ConversationExport.version.
+const Version = 1
+
+const timeLayout = "2006-01-02 15:04:05 MST"
+
+// Format is a format that conversations can be exported to.
+type Format string
+
+const (
+	Markdown Format = "md"
+	JSON     Format = "json"
+	HTML     Format = "html"
+	Text     Format = "txt"
+)
+
+// ParseFormat parses the format query value, defaulting to Markdown.
+func ParseFormat(value string) (Format, error) {
+	switch Format(strings.ToLower(value)) {
+	case "", Markdown:
+		return Markdown, nil
+	case JSON:
+		return JSON, nil
+	case HTML:
+		return HTML, nil
+	case Text:
+		return Text, nil
+	}
+	return "", fmt.Errorf("unsupported export format [%s]. Expected one of md, json, html or txt", value)
+}
+
+// ContentType is the media type of documents in the format.
+func (f Format) ContentType() string {
+	switch f {
+	case JSON:
+		return "application/json"
+	case HTML:
+		return "text/html; charset=utf-8"
+	case Text:
+		return "text/plain; charset=utf-8"
+	}
+	return "text/markdown; charset=utf-8"
+}
+
+// Filename is the name of the exported file for the conversation.
+func (f Format) Filename(conversation *chat.Conversation) string {
+	return fmt.Sprintf("%d-%s.%s", conversation.Id, slug(conversation.Title), f)
+}
+
+// Render writes the conversation to w in the given format.
+func Render(w io.Writer, conversation *chat.Conversation, format Format) error {
+	conversation = chronological(conversation)
+	switch format {
+	case JSON:
+		return renderJSON(w, conversation)
+	case HTML:
+		return renderHTML(w, conversation)
+	case Text:
+		return renderText(w, conversation)
+	}
+	return renderMarkdown(w, conversation)
+}
+
+// Zip writes every conversation to a zip archive on w, one file per
+// conversation.
+func Zip(w io.Writer, conversations []*chat.Conversation, format Format) error {
+	archive := zip.NewWriter(w)
+	for _, conversation := range conversations {
+		header := &zip.FileHeader{Name: format.Filename(conversation), Method: zip.Deflate}
+		if conversation.CreatedAt != nil {
+			header.Modified = conversation.CreatedAt.AsTime()
+		}
+		file, err := archive.CreateHeader(header)
+		if err != nil {
+			return fmt.Errorf("unable to add conversation %d to archive: %w", conversation.Id, err)
+		}
+		if err := Render(file, conversation, format); err != nil {
+			return fmt.Errorf("unable to export conversation %d: %w", conversation.Id, err)
+		}
+	}
+	return archive.Close()
+}
+
+// MarshalJSON encodes conversations as a ConversationExport. protojson
+// deliberately varies its whitespace between runs, so the output is
+// re-indented to keep its formatting stable. The content still differs between
+// exports, if only in exported_at.
+func MarshalJSON(conversations ...*chat.Conversation) ([]byte, error) {
+	export := &chat.ConversationExport{
+		Version:       Version,
+		ExportedAt:    timestamppb.Now(),
+		Conversations: conversations,
+	}
+	raw, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(export)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal export: %w", err)
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, raw, "", "  "); err != nil {
+		return nil, fmt.Errorf("unable to format export: %w", err)
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
+
+func renderJSON(w io.Writer, conversation *chat.Conversation) error {
+	data, err := MarshalJSON(conversation)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func renderMarkdown(w io.Writer, conversation *chat.Conversation) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", conversation.Title)
+	fmt.Fprintf(&b, "_Created %s_\n\n", formatTime(conversation.CreatedAt))
+	if conversation.Context != "" {
+		fmt.Fprintf(&b, "> %s\n\n", strings.ReplaceAll(conversation.Context, "\n", "\n> "))
+	}
+	for _, message := range conversation.Messages {
+		fmt.Fprintf(&b, "---\n\n**%s** · %s\n\n%s\n\n", senderName(message.Sender), formatTime(message.CreatedAt), message.Body)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func renderText(w io.Writer, conversation *chat.Conversation) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\nCreated %s\n", conversation.Title, formatTime(conversation.CreatedAt))
+	if conversation.Context != "" {
+		fmt.Fprintf(&b, "Context: %s\n", conversation.Context)
+	}
+	for _, message := range conversation.Messages {
+		fmt.Fprintf(&b, "\n[%s] %s:\n%s\n", formatTime(message.CreatedAt), senderName(message.Sender), message.Body)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// chronological returns a copy of the conversation with its messages ordered
+// oldest first, the order they are read in.
+func chronological(conversation *chat.Conversation) *chat.Conversation {
+	conversation = proto.Clone(conversation).(*chat.Conversation)
+	sort.SliceStable(conversation.Messages, func(i, j int) bool {
+		a, b := conversation.Messages[i], conversation.Messages[j]
+		if !a.CreatedAt.AsTime().Equal(b.CreatedAt.AsTime()) {
+			return a.CreatedAt.AsTime().Before(b.CreatedAt.AsTime())
+		}
+		return a.Id < b.Id
+	})
+	return conversation
+}
+
+func senderName(sender chat.Message_Sender) string {
+	switch sender {
+	case chat.Message_USER:
+		return "User"
+	case chat.Message_BOT:
+		return "Assistant"
+	}
+	return "Unknown"
+}
+
+func formatTime(t *timestamppb.Timestamp) string {
+	if t == nil {
+		return ""
+	}
+	return t.AsTime().In(time.UTC).Format(timeLayout)
+}
+
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+func slug(title string) string {
+	s := strings.Trim(nonSlugChars.ReplaceAllString(strings.ToLower(title), "-"), "-")
+	if s == "" {
+		return "conversation"
+	}
+	return s
+}
@@ -0,0 +1,101 @@
+package export
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func testConversation() *chat.Conversation {
+	return &chat.Conversation{
+		Id:        7,
+		Title:     "Trip <plans>",
+		CreatedAt: timestamppb.New(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)),
+		// Messages are stored newest first.
+		Messages: []*chat.Message{
+			{Id: 2, Body: "Try the coast.", Sender: chat.Message_BOT},
+			{Id: 1, Body: "Where should we go?", Sender: chat.Message_USER},
+		},
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	tests := []struct {
+		value   string
+		format  Format
+		invalid bool
+	}{
+		{"", Markdown, false},
+		{"md", Markdown, false},
+		{"JSON", JSON, false},
+		{"html", HTML, false},
+		{"txt", Text, false},
+		{"pdf", "", true},
+	}
+	for _, test := range tests {
+		format, err := ParseFormat(test.value)
+		if (err != nil) != test.invalid || format != test.format {
+			t.Errorf("ParseFormat(%q) = %q, %v", test.value, format, err)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		format Format
+		want   []string
+	}{
+		{Markdown, []string{"# Trip <plans>", "Where should we go?", "Try the coast."}},
+		{Text, []string{"Trip <plans>", "Where should we go?", "Try the coast."}},
+		{HTML, []string{"Trip &lt;plans&gt;", "Where should we go?", "Try the coast."}},
+		{JSON, []string{`"title": "Trip <plans>"`, `"body": "Where should we go?"`}},
+	}
+	for _, test := range tests {
+		t.Run(string(test.format), func(t *testing.T) {
+			var out bytes.Buffer
+			if err := Render(&out, testConversation(), test.format); err != nil {
+				t.Fatal(err)
+			}
+			rendered := out.String()
+			for _, want := range test.want {
+				if !strings.Contains(rendered, want) {
+					t.Errorf("expected %q in:\n%s", want, rendered)
+				}
+			}
+			// Messages are rendered oldest first.
+			if strings.Index(rendered, "Where should we go?") > strings.Index(rendered, "Try the coast.") {
+				t.Errorf("expected messages in chronological order:\n%s", rendered)
+			}
+		})
+	}
+}
+
+func TestMarshalJSONFormatting(t *testing.T) {
+	first, err := MarshalJSON(testConversation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := MarshalJSON(testConversation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	strip := func(data []byte) string {
+		lines := []string{}
+		for _, line := range strings.Split(string(data), "\n") {
+			if !strings.Contains(line, `"exported_at"`) {
+				lines = append(lines, line)
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+	if strip(first) != strip(second) {
+		t.Fatalf("expected exports to differ only in exported_at:\n%s\n%s", first, second)
+	}
+	if !strings.HasPrefix(string(first), "{\n  \"version\": 1,") || !strings.HasSuffix(string(first), "}\n") {
+		t.Fatalf("expected a two space indented export, got:\n%s", first)
+	}
+}
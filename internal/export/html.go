@@ -0,0 +1,107 @@
+package export
+
+import (
+	"html/template"
+	"io"
+	"strings"
+
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+)
+
+var htmlTemplate = template.Must(template.New("conversation").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 48rem; margin: 2rem auto; padding: 0 1rem; line-height: 1.5; }
+.meta { color: #666; font-size: 0.875rem; }
+.context { border-left: 4px solid #ccc; padding-left: 1rem; color: #444; }
+.message { border-top: 1px solid #eee; padding: 1rem 0; }
+.sender { font-weight: bold; }
+pre { background: #f6f8fa; padding: 1rem; overflow-x: auto; }
+p { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="meta">Created {{.CreatedAt}}</p>
+{{if .Context}}<blockquote class="context">{{.Context}}</blockquote>
+{{end}}{{range .Messages}}<section class="message">
+<div><span class="sender">{{.Sender}}</span> <span class="meta">{{.CreatedAt}}</span></div>
+{{range .Blocks}}{{if .Code}}<pre><code{{if .Language}} class="language-{{.Language}}"{{end}}>{{.Text}}</code></pre>
+{{else}}<p>{{.Text}}</p>
+{{end}}{{end}}</section>
+{{end}}</body>
+</html>
+`))
+
+type htmlConversation struct {
+	Title     string
+	CreatedAt string
+	Context   string
+	Messages  []htmlMessage
+}
+
+type htmlMessage struct {
+	Sender    string
+	CreatedAt string
+	Blocks    []block
+}
+
+// block is a run of message text, either prose or a fenced code block.
+type block struct {
+	Text     string
+	Code     bool
+	Language string
+}
+
+func renderHTML(w io.Writer, conversation *chat.Conversation) error {
+	page := htmlConversation{
+		Title:     conversation.Title,
+		CreatedAt: formatTime(conversation.CreatedAt),
+		Context:   conversation.Context,
+	}
+	for _, message := range conversation.Messages {
+		page.Messages = append(page.Messages, htmlMessage{
+			Sender:    senderName(message.Sender),
+			CreatedAt: formatTime(message.CreatedAt),
+			Blocks:    splitBlocks(message.Body),
+		})
+	}
+	return htmlTemplate.Execute(w, page)
+}
+
+// splitBlocks splits a message body on markdown code fences so code keeps its
+// formatting in the rendered page. An unterminated fence runs to the end of the
+// body.
+func splitBlocks(body string) []block {
+	var blocks []block
+	var current []string
+	inCode := false
+	language := ""
+	flush := func() {
+		text := strings.Join(current, "\n")
+		if inCode || strings.TrimSpace(text) != "" {
+			if !inCode {
+				text = strings.Trim(text, "\n")
+			}
+			blocks = append(blocks, block{Text: text, Code: inCode, Language: language})
+		}
+		current = nil
+	}
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			flush()
+			if inCode {
+				inCode, language = false, ""
+			} else {
+				inCode, language = true, strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "```"))
+			}
+			continue
+		}
+		current = append(current, line)
+	}
+	flush()
+	return blocks
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/backup"
+	"github.com/timsexperiments/chat-cli/internal/middleware"
+	"github.com/timsexperiments/chat-cli/internal/proto/admin"
+	"github.com/timsexperiments/chat-cli/internal/response"
+	"github.com/timsexperiments/chat-cli/internal/retention"
+	"github.com/timsexperiments/chat-cli/internal/webhooks"
+)
+
+func RegisterAdminHandlers(e *echo.Echo, backups *backup.Service, worker *retention.Worker, webhookWorker *webhooks.Worker) {
+	adminGroup := e.Group("/admin")
+	adminGroup.Use(middleware.AdminChecker)
+	adminGroup.Use(middleware.ProtobufBodyChecker)
+	adminGroup.Use(middleware.ProtobufHeader)
+	adminGroup.POST("/backup", createBackupHandler(backups))
+	adminGroup.GET("/backups", listBackupsHandler(backups))
+	adminGroup.GET("/audit", listAuditEventsHandler)
+	adminGroup.GET("/audit/export", exportAuditEventsHandler)
+	adminGroup.GET("/feedback/report", feedbackReportHandler)
+	adminGroup.GET("/feedback/export", exportFeedbackHandler)
+	retentionGroup := adminGroup.Group("/retention")
+	retentionGroup.POST("/run", runRetentionHandler(worker))
+	retentionGroup.GET("/audit", listRetentionAuditHandler)
+	retentionGroup.GET("/policies", listRetentionPoliciesHandler)
+	retentionGroup.PUT("/policies/conversations/:id", setConversationRetentionPolicyHandler)
+	retentionGroup.PUT("/policies/tags/:id", setTagRetentionPolicyHandler)
+	retentionGroup.DELETE("/policies/:id", deleteRetentionPolicyHandler)
+	webhooksGroup := adminGroup.Group("/webhooks")
+	webhooksGroup.GET("", listWebhooksHandler)
+	webhooksGroup.POST("", createWebhookHandler)
+	webhooksGroup.POST("/run", runWebhooksHandler(webhookWorker))
+	webhooksGroup.GET("/dead-letters", listWebhookDeadLettersHandler)
+	webhooksGroup.POST("/dead-letters/:id/redeliver", redeliverWebhookDeadLetterHandler)
+	webhooksGroup.GET("/:id", getWebhookHandler)
+	webhooksGroup.PATCH("/:id", updateWebhookHandler)
+	webhooksGroup.DELETE("/:id", deleteWebhookHandler)
+	webhooksGroup.GET("/:id/deliveries", listWebhookDeliveriesHandler)
+}
+
+func createBackupHandler(backups *backup.Service) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		created, err := backups.Backup(c.Request().Context())
+		if err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to back up database: %w", err).Error())
+		}
+		return response.Protobuf(c, http.StatusCreated, created)
+	}
+}
+
+func listBackupsHandler(backups *backup.Service) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		list, err := backups.List()
+		if err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to list backups: %w", err).Error())
+		}
+		return response.Protobuf(c, http.StatusOK, &admin.ListBackupsResponse{Backups: list})
+	}
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/proto/admin"
+	"github.com/timsexperiments/chat-cli/internal/response"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// The number of audit events in a page when no page_size is given.
+const defaultAuditPageSize = 100
+
+func listAuditEventsHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	filter, err := auditFilterParams(c)
+	if err != nil {
+		return err
+	}
+	size, offset, err := pageParams(c)
+	if err != nil {
+		return err
+	}
+	if c.QueryParam("page_size") == "" {
+		size = defaultAuditPageSize
+	}
+	limit := 0
+	if size > 0 {
+		// One extra event tells whether there is another page.
+		limit = size + 1
+	}
+	events, err := db.ListAuditEvents(filter, false, limit, offset)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to list audit events: %w", err).Error())
+	}
+	list := &admin.ListAuditEventsResponse{Events: events}
+	if size > 0 && len(events) > size {
+		list.Events = events[:size]
+		list.NextPageToken = nextPageToken(c, offset+size)
+	}
+	return response.Protobuf(c, http.StatusOK, list)
+}
+
+// exportAuditEventsHandler sends every audit event that matches the query as
+// JSON lines, oldest first.
+func exportAuditEventsHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	filter, err := auditFilterParams(c)
+	if err != nil {
+		return err
+	}
+	events, err := db.ListAuditEvents(filter, true, 0, 0)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to list audit events: %w", err).Error())
+	}
+	var out bytes.Buffer
+	for _, event := range events {
+		raw, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(event)
+		if err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to export audit event %d: %w", event.Id, err).Error())
+		}
+		// protojson varies its whitespace, compacting keeps one event per line.
+		if err := json.Compact(&out, raw); err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to export audit event %d: %w", event.Id, err).Error())
+		}
+		out.WriteByte('\n')
+	}
+	filename := fmt.Sprintf("audit-%s.jsonl", time.Now().UTC().Format("20060102-150405"))
+	return attachment(c, filename, "application/x-ndjson", out.Bytes())
+}
+
+// auditFilterParams reads the audit log filters from the query parameters.
+func auditFilterParams(c echo.Context) (database.AuditFilter, error) {
+	filter := database.AuditFilter{
+		Actor:      c.QueryParam("actor"),
+		Action:     c.QueryParam("action"),
+		TargetType: c.QueryParam("target_type"),
+		RequestId:  c.QueryParam("request_id"),
+	}
+	if param := c.QueryParam("target_id"); param != "" {
+		var err error
+		if filter.TargetId, err = strconv.ParseInt(param, 10, 64); err != nil {
+			return filter, invalidField("target_id", fmt.Errorf("invalid target_id [%s]: %w", param, err).Error())
+		}
+	}
+	var err error
+	if filter.After, err = timeParam(c, "after"); err != nil {
+		return filter, err
+	}
+	if filter.Before, err = timeParam(c, "before"); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
@@ -1,41 +1,33 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
 	"github.com/timsexperiments/chat-cli/internal/chatgpt"
+	"github.com/timsexperiments/chat-cli/internal/codec"
 	"github.com/timsexperiments/chat-cli/internal/config"
 	"github.com/timsexperiments/chat-cli/internal/database"
 	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"github.com/timsexperiments/chat-cli/internal/response"
 	"google.golang.org/protobuf/proto"
 )
 
 func handleConversation(c echo.Context) error {
-	token, ok := c.Get(config.OPEN_AI_TOKEN_KEY).(string)
-	if !ok {
-		return echo.NewHTTPError(http.StatusUnauthorized, "missing open api token")
-	}
-	idParam := c.Param("id")
-	conversationId, err := strconv.Atoi(idParam)
+	token, db, conversation, err := chatConversation(c)
 	if err != nil {
-		c.Logger().Error(err)
-		return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("invalid conversation id [%s]: %w", idParam, err).Error())
-	}
-
-	db, ok := c.Get(config.DB_KEY).(*database.DB)
-	if !ok {
-		c.Logger().Error(err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "unable to get database")
+		return err
 	}
-
-	conversation, err := db.GetConversation(conversationId)
-	if (err != nil) || (conversation == nil) {
-		c.Logger().Error(err)
-		return echo.NewHTTPError(http.StatusNotFound, fmt.Errorf("unable to get conversation with id [%d]: %w", conversationId, err).Error())
+	resumeId, resumeToken := c.QueryParam("client_id"), c.QueryParam("resume_token")
+	lastSeq, err := lastSeqParam(c)
+	if err != nil {
+		return err
 	}
 
 	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
@@ -43,102 +35,397 @@ func handleConversation(c echo.Context) error {
 		return err
 	}
 	defer ws.Close()
+	requestId := c.Response().Header().Get(echo.HeaderXRequestID)
+
+	// The client is expected to answer the pings of writeHubEvents, so a
+	// connection that has not been heard from in a while is gone.
+	pongTimeout := config.GetConfig().WebSocketPongTimeout
+	ws.SetReadDeadline(time.Now().Add(pongTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+
+	// Events sent before the client sends anything are sent in the kind of
+	// frame its Accept or Content-Type header asks for.
+	frameType := websocket.BinaryMessage
+	if response.MediaType(c) == codec.JSON {
+		frameType = websocket.TextMessage
+	}
+	client, err := hubs.join(conversation.Id, db.Actor().Name, frameType, resumeId, resumeToken, lastSeq)
+	if err != nil {
+		c.Logger().Error(err)
+		ws.CloseHandler()(websocket.CloseInternalServerErr, "Internal Server Error")
+		return nil
+	}
+	defer hubs.leave(client)
+	go writeHubEvents(c.Logger(), ws, client)
 
-	context := conversation.Context
 	for {
-		_, msg, err := ws.ReadMessage()
+		frameType, msg, err := ws.ReadMessage()
 		if err != nil {
 			c.Logger().Error(err)
 			ws.CloseHandler()(websocket.CloseInternalServerErr, "Internal Server Error")
 			return nil
 		}
 
+		// Events are answered in the kind of frame they were sent in: JSON in
+		// text frames and binary protobuf in binary frames.
+		hubs.received(client, frameType)
 		eventMsg := &chat.MessageEvent{}
-		if err := proto.Unmarshal(msg, eventMsg); err != nil {
+		if err := codec.Unmarshal(frameMediaType(frameType), msg, eventMsg); err != nil {
 			c.Logger().Error(err)
-			errorEvent, err := buildErrorResposne(chat.ErrorEvent_INPUT_VALIDATION_ERROR, "unable to parse message")
-			if err != nil {
-				c.Logger().Error(err)
-				ws.CloseHandler()(websocket.CloseInternalServerErr, "Internal Server Error")
+			errorEvent := buildErrorEvent(chat.ErrorEvent_INPUT_VALIDATION_ERROR, "unable to parse message", 0)
+			setRequestId(errorEvent, requestId)
+			if !hubs.reply(client, errorEvent) {
 				return nil
 			}
-			if err := ws.WriteMessage(websocket.BinaryMessage, errorEvent); err != nil {
-				c.Logger().Error(err)
-			}
+			ws.SetReadDeadline(time.Now().Add(pongTimeout))
 			continue
 		}
 
-		if _, err := db.CreateMessage(eventMsg.Body, chat.Message_USER, conversation.Id); err != nil {
-			c.Logger().Error(err)
+		// Nothing is read while the bot replies, which can take longer than
+		// pongTimeout, so the pongs that arrive meanwhile are only handled
+		// afterwards.
+		ws.SetReadDeadline(time.Time{})
+		var chatEvent *chat.ChatEvent
+		conversation, chatEvent = handleChatEvent(c.Logger(), db, conversation, eventMsg, token, client)
+		setRequestId(chatEvent, requestId)
+		// Replies from the bot were already sent to every client of the
+		// conversation, this one included.
+		if chatEvent.Seq == 0 && !hubs.reply(client, chatEvent) {
+			return nil
 		}
+		ws.SetReadDeadline(time.Now().Add(pongTimeout))
+	}
+}
 
-		var chatEvent *chat.ChatEvent
-		var completionId string
-		chatEvent, context, completionId, err = askChatGpt(eventMsg.Body, token, context)
-		if err != nil {
-			c.Logger().Error(err)
-			errorEvent, err := buildErrorResposne(chat.ErrorEvent_SERVER_ERROR, "unable to ask chatgpt")
-			if err != nil {
-				c.Logger().Error(err)
-				ws.CloseHandler()(websocket.CloseInternalServerErr, "Internal Server Error")
-				return nil
+// writeHubEvents sends the events queued for client, and pings it in between,
+// until its queue is closed, because it left or fell too far behind, and then
+// closes the connection.
+func writeHubEvents(logger echo.Logger, ws *websocket.Conn, client *hubClient) {
+	defer ws.Close()
+	cfg := config.GetConfig()
+	ticker := time.NewTicker(cfg.WebSocketPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case queued, ok := <-client.send:
+			if !ok {
+				return
 			}
-			if err := ws.WriteMessage(websocket.BinaryMessage, errorEvent); err != nil {
-				c.Logger().Error(err)
+			ws.SetWriteDeadline(time.Now().Add(cfg.WebSocketWriteTimeout))
+			if err := writeChatEvent(ws, queued.frameType, queued.event); err != nil {
+				logger.Error(err)
+				return
+			}
+		case <-ticker.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(cfg.WebSocketWriteTimeout)); err != nil {
+				logger.Error(err)
+				return
 			}
-			continue
 		}
+	}
+}
 
-		if _, err := db.CreateMessage(chatEvent.GetMessage().Body, chat.Message_BOT, conversation.Id); err != nil {
-			c.Logger().Error(err)
+// lastSeqParam returns the seq of the last event a resuming client got, or 0
+// if it did not say.
+func lastSeqParam(c echo.Context) (int64, error) {
+	param := c.QueryParam("last_seq")
+	if param == "" {
+		return 0, nil
+	}
+	lastSeq, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || lastSeq < 0 {
+		return 0, invalidField("last_seq", fmt.Sprintf("invalid last_seq [%s]", param))
+	}
+	return lastSeq, nil
+}
+
+// chatConversation returns the OpenAI token, the database and the
+// conversation to chat in for a request to chat over the WebSocket or
+// server-sent events.
+func chatConversation(c echo.Context) (string, *database.DB, *chat.Conversation, error) {
+	token, ok := c.Get(config.OPEN_AI_TOKEN_KEY).(string)
+	if !ok {
+		return "", nil, nil, echo.NewHTTPError(http.StatusUnauthorized, "missing open api token")
+	}
+	idParam := c.Param("id")
+	conversationId, err := strconv.Atoi(idParam)
+	if err != nil {
+		c.Logger().Error(err)
+		return "", nil, nil, invalidField("id", fmt.Errorf("invalid conversation id [%s]: %w", idParam, err).Error())
+	}
+
+	db, ok := c.Get(config.DB_KEY).(*database.DB)
+	if !ok {
+		return "", nil, nil, echo.NewHTTPError(http.StatusInternalServerError, "unable to get database")
+	}
+
+	conversation, err := db.GetConversation(conversationId)
+	if err != nil {
+		return "", nil, nil, databaseError(err, fmt.Sprintf("unable to get conversation with id [%d]", conversationId))
+	}
+	return token, db, conversation, nil
+}
+
+// handleChatEvent handles an event sent to chat in a conversation: a rating is
+// stored, and anything else is a message to reply to. It returns the
+// conversation as it is afterwards and the event to send back. It is shared by
+// the WebSocket, server-sent events and the Chat RPC, and from is the
+// WebSocket or Chat stream that sent the event, if it came from one.
+func handleChatEvent(logger echo.Logger, db *database.DB, conversation *chat.Conversation, event *chat.MessageEvent, token string, from *hubClient) (*chat.Conversation, *chat.ChatEvent) {
+	if event.Feedback != nil {
+		return conversation, rateInChat(logger, db, conversation.Id, event.Feedback)
+	}
+	conversation, _, chatEvent := runChatTurn(logger, db, conversation, event, token, from)
+	return conversation, chatEvent
+}
+
+// The most times a chat turn asks the bot again because the conversation was
+// changed while it was waiting on a reply.
+const maxTurnAttempts = 3
+
+// turnLocks makes chat turns on the same conversation take turns, so that
+// two clients chatting in one conversation each build on the other's context
+// instead of overwriting it.
+var turnLocks = &conversationLocks{locks: map[int64]*conversationLock{}}
+
+type conversationLocks struct {
+	mu    sync.Mutex
+	locks map[int64]*conversationLock
+}
+
+type conversationLock struct {
+	sync.Mutex
+	// The number of turns holding or waiting on the lock.
+	users int
+}
+
+// lock blocks until no other turn holds the conversation with the given id,
+// and returns the function that releases it.
+func (l *conversationLocks) lock(id int64) func() {
+	l.mu.Lock()
+	lock, ok := l.locks[id]
+	if !ok {
+		lock = &conversationLock{}
+		l.locks[id] = lock
+	}
+	lock.users++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mu.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(l.locks, id)
 		}
+		l.mu.Unlock()
+	}
+}
 
-		conversation.Context = context
-		conversation.CompletionId = completionId
-		if _, err = db.UpdateConversation(conversation); err != nil {
-			c.Logger().Error(err)
+// chatTurn is a chat turn that was stored.
+type chatTurn struct {
+	// The user message that was replied to.
+	message *chat.Message
+	// The reply from the bot.
+	reply *chat.Message
+	usage *chat.Usage
+}
+
+// runChatTurn stores the user message from event, asks the bot for a reply and
+// stores that reply. It returns the conversation as it is after the turn, the
+// turn when it was stored, and the event to send back to the user, which is an
+// error event if the turn failed.
+//
+// The user message is committed on its own first, as PENDING, so that it is
+// never lost. The reply, the user message becoming COMPLETE and the new
+// conversation context are then committed together, so a turn is either fully
+// stored or the user message is left FAILED and can be retried by sending its
+// id back as the event's retry_message_id.
+//
+// Turns on the same conversation run one at a time, and each one starts from
+// the latest stored context rather than the one the client last saw. If the
+// conversation is still changed while the bot is replying, e.g. its context
+// is edited, the reply is thrown away and the bot is asked again with the new
+// context, up to maxTurnAttempts times.
+//
+// The user message, once stored and again whenever its status changes, is
+// fanned out to every client of the conversation but from, the client that
+// sent the event, and the reply to every client, from included.
+func runChatTurn(logger echo.Logger, db *database.DB, conversation *chat.Conversation, event *chat.MessageEvent, token string, from *hubClient) (*chat.Conversation, *chatTurn, *chat.ChatEvent) {
+	unlock := turnLocks.lock(conversation.Id)
+	defer unlock()
+
+	userMessage, err := turnMessage(db, conversation, event)
+	if err != nil {
+		logger.Error(err)
+		return conversation, nil, buildErrorEvent(chat.ErrorEvent_INPUT_VALIDATION_ERROR, err.Error(), event.RetryMessageId)
+	}
+	publishUserMessage(userMessage, from)
+
+	for attempt := 1; ; attempt++ {
+		current, err := db.GetConversation(int(conversation.Id))
+		if err != nil {
+			logger.Error(err)
+			failTurn(logger, db, userMessage, from)
+			return conversation, nil, buildErrorEvent(chat.ErrorEvent_SERVER_ERROR, "unable to load conversation", userMessage.Id)
 		}
 
-		outMsg, err := proto.Marshal(chatEvent)
+		pinned, err := db.ListContextPins(current.Id)
 		if err != nil {
-			c.Logger().Error(err)
-			errorEvent, err := buildErrorResposne(chat.ErrorEvent_SERVER_ERROR, "unable to serialize chat event")
+			logger.Error(err)
+			failTurn(logger, db, userMessage, from)
+			return current, nil, buildErrorEvent(chat.ErrorEvent_SERVER_ERROR, "unable to load pinned messages", userMessage.Id)
+		}
+
+		chatEvent, context, completionId, tokens, err := askChatGpt(userMessage, token, current.Context, current.Settings, pinned)
+		if err != nil {
+			logger.Error(err)
+			failTurn(logger, db, userMessage, from)
+			return current, nil, buildErrorEvent(chat.ErrorEvent_SERVER_ERROR, "unable to ask chatgpt", userMessage.Id)
+		}
+
+		var updated *chat.Conversation
+		var reply *chat.Message
+		model := chatgpt.Model(current.Settings)
+		err = db.WithTx(func(tx *database.DB) error {
+			reply, err = tx.CreateReply(chatEvent.GetMessage().Body, current.Id, userMessage.Id, tokens, model)
 			if err != nil {
-				c.Logger().Error(err)
-				ws.CloseHandler()(websocket.CloseInternalServerErr, "Internal Server Error")
-				return nil
+				return err
 			}
-			if err := ws.WriteMessage(websocket.BinaryMessage, errorEvent); err != nil {
-				c.Logger().Error(err)
+			chatEvent.GetMessage().MessageId = reply.Id
+			if err := tx.SetMessageStatus(userMessage.Id, chat.Message_COMPLETE); err != nil {
+				return err
 			}
+			next := proto.Clone(current).(*chat.Conversation)
+			next.Context = context
+			next.CompletionId = completionId
+			updated, err = tx.UpdateConversation(next)
+			return err
+		})
+		if errors.Is(err, database.ErrVersionConflict) && attempt < maxTurnAttempts {
+			logger.Warnf("conversation %d changed during a chat turn, asking again (attempt %d)", current.Id, attempt+1)
 			continue
 		}
+		if err != nil {
+			logger.Error(fmt.Errorf("unable to store chat turn: %w", err))
+			failTurn(logger, db, userMessage, from)
+			return current, nil, buildErrorEvent(chat.ErrorEvent_SERVER_ERROR, "unable to store reply", userMessage.Id)
+		}
+		userMessage.Status = chat.Message_COMPLETE
+		publishUserMessage(userMessage, from)
+		hubs.publish(current.Id, chatEvent, nil)
+		turn := &chatTurn{
+			message: userMessage,
+			reply:   reply,
+			usage:   &chat.Usage{Model: model, TotalTokens: int64(tokens)},
+		}
+		return updated, turn, chatEvent
+	}
+}
 
-		if err := ws.WriteMessage(websocket.BinaryMessage, outMsg); err != nil {
-			c.Logger().Error(err)
+// turnMessage returns the user message a chat turn replies to: a new PENDING
+// message, or the failed message being retried moved back to PENDING.
+func turnMessage(db *database.DB, conversation *chat.Conversation, event *chat.MessageEvent) (*chat.Message, error) {
+	if event.RetryMessageId == 0 {
+		if event.Body == "" {
+			return nil, fmt.Errorf("message body must not be empty")
 		}
+		return db.CreatePendingMessage(event.Body, conversation.Id)
 	}
+
+	message, err := db.GetMessage(int(event.RetryMessageId))
+	if err != nil {
+		return nil, fmt.Errorf("unable to get message %d to retry: %w", event.RetryMessageId, err)
+	}
+	if message == nil || message.ConversationId != conversation.Id || message.DeletedAt != nil {
+		return nil, fmt.Errorf("message %d not found in conversation %d", event.RetryMessageId, conversation.Id)
+	}
+	if message.Sender != chat.Message_USER || message.Status != chat.Message_FAILED {
+		return nil, fmt.Errorf("message %d is not a failed user message", event.RetryMessageId)
+	}
+	if err := db.SetMessageStatus(message.Id, chat.Message_PENDING); err != nil {
+		return nil, err
+	}
+	message.Status = chat.Message_PENDING
+	return message, nil
 }
 
-func buildErrorResposne(errType chat.ErrorEvent_Type, message string) ([]byte, error) {
-	event := &chat.ChatEvent{
+// failTurn leaves the user message of a chat turn FAILED and tells the
+// clients of its conversation but from.
+func failTurn(logger echo.Logger, db *database.DB, message *chat.Message, from *hubClient) {
+	if err := db.SetMessageStatus(message.Id, chat.Message_FAILED); err != nil {
+		logger.Error(err)
+		return
+	}
+	message.Status = chat.Message_FAILED
+	publishUserMessage(message, from)
+}
+
+// writeChatEvent sends event in a frame of frameType, encoded as the media
+// type that kind of frame carries.
+func writeChatEvent(ws *websocket.Conn, frameType int, event *chat.ChatEvent) error {
+	out, err := codec.Marshal(frameMediaType(frameType), event)
+	if err != nil {
+		return err
+	}
+	return ws.WriteMessage(frameType, out)
+}
+
+// frameMediaType returns the media type of the events sent in websocket
+// frames of frameType.
+func frameMediaType(frameType int) string {
+	if frameType == websocket.TextMessage {
+		return codec.JSON
+	}
+	return codec.Protobuf
+}
+
+// buildErrorEvent returns an error event, along with the Error the REST routes
+// would send for it. Server errors for a user message can be retried by
+// sending its id back as a MessageEvent retry_message_id.
+func buildErrorEvent(errType chat.ErrorEvent_Type, message string, messageId int64) *chat.ChatEvent {
+	status := http.StatusInternalServerError
+	if errType == chat.ErrorEvent_INPUT_VALIDATION_ERROR {
+		status = http.StatusBadRequest
+	}
+	apiErr := newAPIError(status, message)
+	apiErr.Retryable = errType == chat.ErrorEvent_SERVER_ERROR && messageId != 0
+	return &chat.ChatEvent{
 		Type: chat.ChatEvent_ERROR,
 		Event: &chat.ChatEvent_Error{
-			Error: &chat.ErrorEvent{Type: errType, Message: message},
+			Error: &chat.ErrorEvent{Type: errType, Message: message, MessageId: messageId, Error: apiErr},
 		},
 	}
-	return proto.Marshal(event)
 }
 
-func askChatGpt(message, token, context string) (*chat.ChatEvent, string, string, error) {
-	messages := []*chat.Message{{Body: message, Sender: chat.Message_USER}}
+// setRequestId sets the identifier of the request that an error event was
+// sent for, as errors sent by the REST routes carry it.
+func setRequestId(event *chat.ChatEvent, requestId string) {
+	if apiErr := event.GetError().GetError(); apiErr != nil {
+		apiErr.RequestId = requestId
+	}
+}
+
+// askChatGpt sends message to the model along with the conversation context
+// and the pinned messages that should always be part of it.
+func askChatGpt(message *chat.Message, token, context string, settings *chat.ConversationSettings, pinned []*chat.Message) (*chat.ChatEvent, string, string, int, error) {
+	messages := make([]*chat.Message, 0, len(pinned)+2)
+	for _, pin := range pinned {
+		if pin.Id != message.Id {
+			messages = append(messages, &chat.Message{Body: pin.Body, Sender: pin.Sender})
+		}
+	}
+	messages = append(messages, &chat.Message{Body: message.Body, Sender: chat.Message_USER})
 	if context != "" {
 		messages = append(messages, &chat.Message{Body: context, Sender: chat.Message_BOT})
 	}
 
-	response, context, completionId, err := chatgpt.SendMessage(message, token, messages)
+	response, context, completionId, tokens, err := chatgpt.SendMessage(message.Body, token, messages, settings)
 	if err != nil {
-		return nil, "", "", fmt.Errorf("unable to ask chatgpt: %w", err)
+		return nil, "", "", 0, fmt.Errorf("unable to ask chatgpt: %w", err)
 	}
 	event := &chat.ChatEvent{
 		Type: chat.ChatEvent_MESSAGE,
@@ -146,5 +433,5 @@ func askChatGpt(message, token, context string) (*chat.ChatEvent, string, string
 			Message: &chat.MessageEvent{Body: response},
 		},
 	}
-	return event, context, completionId, nil
+	return event, context, completionId, tokens, nil
 }
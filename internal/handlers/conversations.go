@@ -1,18 +1,24 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/chatgpt"
+	"github.com/timsexperiments/chat-cli/internal/codec"
 	"github.com/timsexperiments/chat-cli/internal/config"
 	"github.com/timsexperiments/chat-cli/internal/database"
 	"github.com/timsexperiments/chat-cli/internal/middleware"
 	"github.com/timsexperiments/chat-cli/internal/proto/chat"
 	"github.com/timsexperiments/chat-cli/internal/response"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 var (
@@ -23,13 +29,31 @@ func RegisterConversationsHandlers(e *echo.Echo) {
 	conversations := e.Group("/conversations")
 	conversations.Use(middleware.ProtobufBodyChecker)
 	conversations.Use(middleware.ProtobufHeader)
-	conversations.POST("", createConversationHandler)
+	conversations.POST("", createConversationHandler, middleware.Idempotency)
 	conversations.GET("", listConversationsHandler)
+	conversations.GET("/export", exportConversationsHandler, middleware.AuthChecker)
+	conversations.POST("/import", importConversationsHandler, middleware.AuthChecker, middleware.Idempotency)
 	conversationGroup := conversations.Group("/:id")
 	conversationGroup.Use(middleware.AuthChecker)
 	conversationGroup.GET("", conversationHandler)
+	conversationGroup.GET("/export", exportConversationHandler)
+	conversationGroup.GET("/presence", presenceHandler)
+	conversationGroup.POST("/chat", chatStreamHandler)
+	conversationGroup.PATCH("", updateConversationHandler)
+	conversationGroup.DELETE("", deleteConversationHandler)
+	conversationGroup.POST("/restore", restoreConversationHandler)
+	conversationGroup.POST("/archive", archiveConversationHandler(true))
+	conversationGroup.POST("/unarchive", archiveConversationHandler(false))
+	conversationGroup.PUT("/tags/:tag", addConversationTagHandler)
+	conversationGroup.DELETE("/tags/:tag", removeConversationTagHandler)
 	messagesGroup := conversationGroup.Group("/messages")
-	messagesGroup.POST("", createMessage)
+	messagesGroup.POST("", createMessage, middleware.Idempotency)
+	messagesGroup.DELETE("/:messageId", deleteMessageHandler)
+	messagesGroup.POST("/:messageId/restore", restoreMessageHandler)
+	messagesGroup.PUT("/:messageId/pin", pinMessageHandler)
+	messagesGroup.DELETE("/:messageId/pin", unpinMessageHandler)
+	messagesGroup.PUT("/:messageId/feedback", rateMessageHandler)
+	messagesGroup.DELETE("/:messageId/feedback", unrateMessageHandler)
 }
 
 func createConversationHandler(c echo.Context) error {
@@ -39,28 +63,123 @@ func createConversationHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "missing body")
 	}
 	request := &chat.CreateConversationRequest{}
-	if err := proto.Unmarshal([]byte(body), request); err != nil {
+	if err := unmarshalBody(c, body, request); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unable to parse request: %w", err).Error())
 	}
-	conversation, err := db.CreateConversation(request.Title)
+	conversation, err := createConversation(c.Logger(), db, request)
 	if err != nil {
-		c.Logger().Error(err)
-		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to create conversation: %w", err).Error())
+		return err
 	}
+	setETag(c, conversation)
 	return response.Protobuf(c, http.StatusCreated, conversation)
 }
 
+// createConversation creates the conversation asked for by request. It is
+// shared by the REST route and ChatService.
+func createConversation(logger echo.Logger, db *database.DB, request *chat.CreateConversationRequest) (*chat.Conversation, error) {
+	if err := checkFolderExists(db, request.FolderId); err != nil {
+		return nil, err
+	}
+	conversation, err := db.CreateConversation(request.Title, request.FolderId, database.NormalizeTags(request.Tags))
+	if errors.Is(err, database.ErrDuplicateTitle) {
+		return nil, echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	if err != nil {
+		logger.Error(err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to create conversation: %w", err).Error())
+	}
+	return conversation, nil
+}
+
 func listConversationsHandler(c echo.Context) error {
 	db := c.Get(config.DB_KEY).(*database.DB)
-	conversationsList, err := db.ListConversations()
+	conversations, err := listConversations(c.Logger(), db, c.QueryParams())
 	if err != nil {
-		c.Logger().Error(err)
-		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to list conversations: %w", err).Error())
+		return err
 	}
-	conversations := &chat.ListConversationsResponse{Conversations: conversationsList}
 	return response.Protobuf(c, http.StatusOK, conversations)
 }
 
+// listConversations lists the conversations asked for by the query parameters
+// in params. It is shared by the REST route and ChatService.
+func listConversations(logger echo.Logger, db *database.DB, params url.Values) (*chat.ListConversationsResponse, error) {
+	filter := database.ConversationFilter{Tags: params["tag"], Title: params.Get("title")}
+	if archived := params.Get("archived"); archived != "" {
+		var err error
+		if filter.IncludeArchived, err = strconv.ParseBool(archived); err != nil {
+			return nil, invalidField("archived", fmt.Errorf("invalid archived value [%s]: %w", archived, err).Error())
+		}
+	}
+	if folder := params.Get("folder"); folder != "" {
+		var err error
+		if filter.FolderId, err = strconv.ParseInt(folder, 10, 64); err != nil {
+			return nil, invalidField("folder", fmt.Errorf("invalid folder value [%s]: %w", folder, err).Error())
+		}
+	}
+	var err error
+	if filter.CreatedAfter, err = timeValue(params, "created_after"); err != nil {
+		return nil, err
+	}
+	if filter.CreatedBefore, err = timeValue(params, "created_before"); err != nil {
+		return nil, err
+	}
+
+	order := database.ConversationOrder{Sort: database.ConversationSort(params.Get("sort"))}
+	switch order.Sort {
+	case "":
+		order.Sort = database.SortByCreated
+	case database.SortByCreated, database.SortByLastActivity, database.SortByTitle:
+	default:
+		return nil, invalidField("sort", fmt.Sprintf("invalid sort value [%s]. Expected created, last_activity or title", order.Sort))
+	}
+	switch direction := params.Get("order"); direction {
+	case "", "asc":
+	case "desc":
+		order.Descending = true
+	default:
+		return nil, invalidField("order", fmt.Sprintf("invalid order value [%s]. Expected asc or desc", direction))
+	}
+
+	size, offset, err := pageValues(params)
+	if err != nil {
+		return nil, err
+	}
+	limit := 0
+	if size > 0 {
+		// One extra conversation tells whether there is another page.
+		limit = size + 1
+	}
+	conversationsList, err := db.ListConversations(filter, order, limit, offset)
+	if err != nil {
+		logger.Error(err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to list conversations: %w", err).Error())
+	}
+	conversations := &chat.ListConversationsResponse{Conversations: conversationsList}
+	if size > 0 && len(conversationsList) > size {
+		conversations.Conversations = conversationsList[:size]
+		conversations.NextPageToken = pageTokenFor(params, offset+size)
+	}
+	return conversations, nil
+}
+
+// timeParam reads an optional RFC 3339 time from the query parameter name.
+func timeParam(c echo.Context, name string) (time.Time, error) {
+	return timeValue(c.QueryParams(), name)
+}
+
+// timeValue reads an optional RFC 3339 time from the parameter name in params.
+func timeValue(params url.Values, name string) (time.Time, error) {
+	param := params.Get(name)
+	if param == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, param)
+	if err != nil {
+		return time.Time{}, invalidField(name, fmt.Errorf("invalid %s [%s]: %w", name, param, err).Error())
+	}
+	return t, nil
+}
+
 func conversationHandler(c echo.Context) error {
 	if !websocket.IsWebSocketUpgrade(c.Request()) {
 		return getConversationHandler(c)
@@ -78,36 +197,398 @@ func getConversationHandler(c echo.Context) error {
 	if err != nil {
 		conversation, err = db.GetConversationByTitle(strId)
 		if err != nil {
-			c.Logger().Error(err)
-			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to get conversation by title '%s': %w", strId, err).Error())
+			return databaseError(err, fmt.Sprintf("unable to get conversation by title '%s'", strId))
 		}
+		setETag(c, conversation)
 		return response.Protobuf(c, http.StatusOK, conversation)
 	}
 
 	conversation, err = db.GetConversation(id)
 	if err != nil {
-		c.Logger().Error(err)
-		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to get conversation by id '%d': %w", id, err).Error())
+		return databaseError(err, fmt.Sprintf("unable to get conversation by id '%d'", id))
 	}
 
+	setETag(c, conversation)
 	return response.Protobuf(c, http.StatusOK, conversation)
 }
 
+// createMessage adds a user message to a conversation and, unless the reply
+// query parameter is false, runs a chat turn on it like the WebSocket does and
+// responds with the message, the reply from the bot and its usage. With
+// reply=false the message is only stored and returned.
 func createMessage(c echo.Context) error {
+	reply := true
+	if param := c.QueryParam("reply"); param != "" {
+		var err error
+		if reply, err = strconv.ParseBool(param); err != nil {
+			return invalidField("reply", fmt.Errorf("invalid reply value [%s]: %w", param, err).Error())
+		}
+	}
+	body, ok := c.Get(config.BODY_KEY).([]byte)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing body")
+	}
+	request := &chat.CreateMessageRequest{}
+	if err := unmarshalBody(c, body, request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unable to parse request: %w", err).Error())
+	}
+	if reply {
+		return replyToMessage(c, request)
+	}
+
 	db := c.Get(config.DB_KEY).(*database.DB)
-	strId := c.Param("id")
-	id, err := strconv.Atoi(strId)
+	id, err := intParam(c, "id")
 	if err != nil {
-		c.Logger().Error(err)
-		return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("invalid conversation id [%s]: %w", strId, err).Error())
+		return err
+	}
+	if _, err := db.GetConversation(id); err != nil {
+		return databaseError(err, fmt.Sprintf("unable to get conversation with id [%d]", id))
 	}
-	body := c.Get(config.BODY_KEY).([]byte)
-	request := chat.CreateMessageRequest{}
-	proto.Unmarshal(body, &request)
 	message, err := db.CreateMessage(request.Body, chat.Message_USER, int64(id))
 	if err != nil {
 		c.Logger().Error(err)
-		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to create conversation: %w", err).Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to create message: %w", err).Error())
 	}
+	publishUserMessage(message, nil)
 	return response.Protobuf(c, http.StatusCreated, message)
 }
+
+// replyToMessage runs a chat turn on the message asked for by request. A turn
+// that fails after the message is stored leaves it FAILED, and the error names
+// it so that it can be retried over the WebSocket.
+func replyToMessage(c echo.Context, request *chat.CreateMessageRequest) error {
+	token, db, conversation, err := chatConversation(c)
+	if err != nil {
+		return err
+	}
+	_, turn, chatEvent := runChatTurn(c.Logger(), db, conversation, &chat.MessageEvent{Body: request.Body}, token, nil)
+	if turn == nil {
+		failure := chatEvent.GetError()
+		if failure.GetType() == chat.ErrorEvent_INPUT_VALIDATION_ERROR {
+			return echo.NewHTTPError(http.StatusBadRequest, failure.GetMessage())
+		}
+		if failure.GetMessageId() != 0 {
+			// The message is stored, so a retry with the same idempotency
+			// key gets this error back rather than store it again. The
+			// message itself is retried over the WebSocket.
+			middleware.KeepIdempotentResponse(c)
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("%s, message %d was not replied to", failure.GetMessage(), failure.GetMessageId()))
+	}
+	return response.Protobuf(c, http.StatusCreated, &chat.CreateMessageResponse{
+		Message: turn.message,
+		Reply:   turn.reply,
+		Usage:   turn.usage,
+	})
+}
+
+// presenceHandler returns who has the WebSocket of a conversation open.
+func presenceHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+	if _, err := db.GetConversation(id); err != nil {
+		return databaseError(err, fmt.Sprintf("unable to get conversation with id [%d]", id))
+	}
+	return response.Protobuf(c, http.StatusOK, hubs.presence(int64(id)))
+}
+
+func updateConversationHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+	body, ok := c.Get(config.BODY_KEY).([]byte)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing body")
+	}
+	request := &chat.UpdateConversationRequest{}
+	if err := unmarshalBody(c, body, request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unable to parse request: %w", err).Error())
+	}
+	version, err := ifMatchVersion(c, db, id)
+	if err != nil {
+		return err
+	}
+	conversation, err := db.GetConversation(id)
+	if err != nil {
+		return databaseError(err, fmt.Sprintf("unable to get conversation with id [%d]", id))
+	}
+	if version != 0 && version != conversation.Version {
+		return echo.NewHTTPError(http.StatusPreconditionFailed, fmt.Sprintf("conversation %d is at version %d, not %d", id, conversation.Version, version))
+	}
+	if err := applyConversationMask(conversation, request.Conversation, request.UpdateMask); err != nil {
+		return err
+	}
+	if err := checkFolderExists(db, conversation.FolderId); err != nil {
+		return err
+	}
+	conversation, err = db.UpdateConversationMetadata(conversation)
+	if errors.Is(err, database.ErrDuplicateTitle) {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	if conflict := versionConflictError(c, err); conflict != nil {
+		return conflict
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		return databaseError(err, "unable to update conversation")
+	}
+	publishConversation(conversation)
+	setETag(c, conversation)
+	return response.Protobuf(c, http.StatusOK, conversation)
+}
+
+// applyConversationMask copies the fields named in mask from update onto
+// conversation. It returns a 400 error naming the field if one is not valid.
+// The model can only be cleared, to go back to the server default, by
+// replacing all of settings.
+func applyConversationMask(conversation, update *chat.Conversation, mask *fieldmaskpb.FieldMask) error {
+	if len(mask.GetPaths()) == 0 {
+		return invalidField("update_mask", "update_mask must name at least one field")
+	}
+	if update == nil {
+		update = &chat.Conversation{}
+	}
+	if update.Settings == nil {
+		update.Settings = &chat.ConversationSettings{}
+	}
+	if conversation.Settings == nil {
+		conversation.Settings = &chat.ConversationSettings{}
+	}
+	for _, path := range mask.GetPaths() {
+		switch path {
+		case "title":
+			if update.Title == "" {
+				return invalidField("title", "title must not be empty")
+			}
+			conversation.Title = update.Title
+		case "context":
+			conversation.Context = update.Context
+		case "archived":
+			conversation.Archived = update.Archived
+		case "settings":
+			conversation.Settings = update.Settings
+		case "settings.model":
+			if update.Settings.Model == "" {
+				return invalidField("settings.model", "settings.model must not be empty")
+			}
+			conversation.Settings.Model = update.Settings.Model
+		case "settings.temperature":
+			conversation.Settings.Temperature = update.Settings.Temperature
+		case "tags":
+			conversation.Tags = database.NormalizeTags(update.Tags)
+		case "folder_id":
+			conversation.FolderId = update.FolderId
+		default:
+			return invalidField("update_mask", fmt.Sprintf("unsupported update_mask path [%s]", path))
+		}
+	}
+	if temperature := conversation.Settings.Temperature; temperature != nil && (*temperature < chatgpt.MinTemperature || *temperature > chatgpt.MaxTemperature) {
+		return invalidField("settings.temperature", fmt.Sprintf("settings.temperature must be between %g and %g, got %g", chatgpt.MinTemperature, chatgpt.MaxTemperature, *temperature))
+	}
+	return nil
+}
+
+func addConversationTagHandler(c echo.Context) error {
+	return changeConversationTag(c, (*database.DB).TagConversation)
+}
+
+func removeConversationTagHandler(c echo.Context) error {
+	return changeConversationTag(c, (*database.DB).UntagConversation)
+}
+
+func changeConversationTag(c echo.Context, change func(db *database.DB, conversationId int64, name string, version int64) (*chat.Conversation, error)) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+	tag, err := url.PathUnescape(c.Param("tag"))
+	if err != nil {
+		return invalidField("tag", fmt.Errorf("invalid tag [%s]: %w", c.Param("tag"), err).Error())
+	}
+	tags := database.NormalizeTags([]string{tag})
+	if len(tags) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag must not be empty")
+	}
+	if _, err := db.GetConversation(id); err != nil {
+		return databaseError(err, fmt.Sprintf("unable to get conversation with id [%d]", id))
+	}
+	version, err := ifMatchVersion(c, db, id)
+	if err != nil {
+		return err
+	}
+	conversation, err := change(db, int64(id), tags[0], version)
+	if conflict := versionConflictError(c, err); conflict != nil {
+		return conflict
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		return databaseError(err, "unable to change tags")
+	}
+	publishConversation(conversation)
+	setETag(c, conversation)
+	return response.Protobuf(c, http.StatusOK, conversation)
+}
+
+// checkFolderExists fails with a bad request if a folder id is set but there is
+// no such folder.
+func checkFolderExists(db *database.DB, folderId int64) error {
+	if folderId == 0 {
+		return nil
+	}
+	folder, err := db.GetFolder(int(folderId))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to get folder %d: %w", folderId, err).Error())
+	}
+	if folder == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("folder %d does not exist", folderId))
+	}
+	return nil
+}
+
+func deleteConversationHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+	permanent, err := permanentParam(c)
+	if err != nil {
+		return err
+	}
+	version, err := ifMatchVersion(c, db, id)
+	if err != nil {
+		return err
+	}
+	if permanent {
+		err = db.PurgeConversation(id, version)
+	} else {
+		err = db.DeleteConversation(id, version)
+	}
+	if conflict := versionConflictError(c, err); conflict != nil {
+		return conflict
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		return databaseError(err, "unable to delete conversation")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func restoreConversationHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+	conversation, err := db.RestoreConversation(id)
+	if err != nil {
+		c.Logger().Error(err)
+		return databaseError(err, "unable to restore conversation")
+	}
+	return response.Protobuf(c, http.StatusOK, conversation)
+}
+
+func archiveConversationHandler(archived bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := c.Get(config.DB_KEY).(*database.DB)
+		id, err := intParam(c, "id")
+		if err != nil {
+			return err
+		}
+		version, err := ifMatchVersion(c, db, id)
+		if err != nil {
+			return err
+		}
+		conversation, err := db.SetConversationArchived(id, archived, version)
+		if conflict := versionConflictError(c, err); conflict != nil {
+			return conflict
+		}
+		if err != nil {
+			c.Logger().Error(err)
+			return databaseError(err, "unable to archive conversation")
+		}
+		publishConversation(conversation)
+		setETag(c, conversation)
+		return response.Protobuf(c, http.StatusOK, conversation)
+	}
+}
+
+func deleteMessageHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	conversationId, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+	messageId, err := intParam(c, "messageId")
+	if err != nil {
+		return err
+	}
+	permanent, err := permanentParam(c)
+	if err != nil {
+		return err
+	}
+	if permanent {
+		err = db.PurgeMessage(int64(conversationId), messageId)
+	} else {
+		err = db.DeleteMessage(int64(conversationId), messageId)
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		return databaseError(err, "unable to delete message")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func restoreMessageHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	conversationId, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+	messageId, err := intParam(c, "messageId")
+	if err != nil {
+		return err
+	}
+	message, err := db.RestoreMessage(int64(conversationId), messageId)
+	if err != nil {
+		c.Logger().Error(err)
+		return databaseError(err, "unable to restore message")
+	}
+	return response.Protobuf(c, http.StatusOK, message)
+}
+
+// unmarshalBody decodes a request body into message as the media type named
+// by the Content-Type of the request.
+func unmarshalBody(c echo.Context, body []byte, message proto.Message) error {
+	mediaType, _ := codec.MediaType(c.Request().Header.Get(echo.HeaderContentType))
+	return codec.Unmarshal(mediaType, body, message)
+}
+
+// intParam parses the named path parameter as an integer id.
+func intParam(c echo.Context, name string) (int, error) {
+	param := c.Param(name)
+	id, err := strconv.Atoi(param)
+	if err != nil {
+		return 0, invalidField(name, fmt.Errorf("invalid %s [%s]: %w", name, param, err).Error())
+	}
+	return id, nil
+}
+
+// permanentParam reports whether a delete should skip the trash.
+func permanentParam(c echo.Context) (bool, error) {
+	param := c.QueryParam("permanent")
+	if param == "" {
+		return false, nil
+	}
+	permanent, err := strconv.ParseBool(param)
+	if err != nil {
+		return false, invalidField("permanent", fmt.Errorf("invalid permanent value [%s]: %w", param, err).Error())
+	}
+	return permanent, nil
+}
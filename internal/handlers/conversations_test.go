@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUpdateConversationSettings(t *testing.T) {
+	e, db := newTestServer(t)
+	tests := []struct {
+		name string
+		body string
+		code int
+		// field is the field named in the error, if the update is rejected.
+		field string
+	}{
+		{"model", `{"conversation": {"settings": {"model": "gpt-4o"}}, "updateMask": "settings.model"}`, http.StatusOK, ""},
+		{"empty model", `{"conversation": {"settings": {"model": ""}}, "updateMask": "settings.model"}`, http.StatusBadRequest, "settings.model"},
+		{"settings without a model", `{"conversation": {"settings": {}}, "updateMask": "settings"}`, http.StatusOK, ""},
+		{"lowest temperature", `{"conversation": {"settings": {"temperature": 0}}, "updateMask": "settings.temperature"}`, http.StatusOK, ""},
+		{"highest temperature", `{"conversation": {"settings": {"temperature": 2}}, "updateMask": "settings.temperature"}`, http.StatusOK, ""},
+		{"negative temperature", `{"conversation": {"settings": {"temperature": -0.1}}, "updateMask": "settings.temperature"}`, http.StatusBadRequest, "settings.temperature"},
+		{"temperature too high", `{"conversation": {"settings": {"temperature": 2.5}}, "updateMask": "settings.temperature"}`, http.StatusBadRequest, "settings.temperature"},
+		{"temperature too high in settings", `{"conversation": {"settings": {"model": "gpt-4o", "temperature": 3}}, "updateMask": "settings"}`, http.StatusBadRequest, "settings.temperature"},
+		{"empty title", `{"conversation": {"title": ""}, "updateMask": "title"}`, http.StatusBadRequest, "title"},
+		{"unsupported path", `{"conversation": {}, "updateMask": "createdAt"}`, http.StatusBadRequest, "update_mask"},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conversation, err := db.CreateConversation(fmt.Sprintf("Conversation %d", i), 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := serve(e, http.MethodPatch, fmt.Sprintf("/conversations/%d", conversation.Id), test.body)
+			if rec.Code != test.code {
+				t.Fatalf("expected %d, got %d: %s", test.code, rec.Code, rec.Body)
+			}
+			if test.field != "" && !strings.Contains(rec.Body.String(), fmt.Sprintf(`"field":%q`, test.field)) {
+				t.Fatalf("expected the error to name %s, got %s", test.field, rec.Body)
+			}
+		})
+	}
+}
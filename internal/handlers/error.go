@@ -1,23 +1,123 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/labstack/echo/v4"
-	"github.com/timsexperiments/chat-cli/internal/proto/errors"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	errorspb "github.com/timsexperiments/chat-cli/internal/proto/errors"
 	"github.com/timsexperiments/chat-cli/internal/response"
 )
 
+// ErrorHandler sends err as an Error. HTTP errors keep their status and
+// message, errors from the database get the status of their kind, and any
+// other error is sent as an internal error without its message, which is only
+// logged.
 func ErrorHandler(err error, c echo.Context) {
-	code := http.StatusInternalServerError
-	message := "an unknown message occurred"
-	if he, ok := err.(*echo.HTTPError); ok {
-		if messageStr, ok := he.Message.(string); ok {
-			message = messageStr
+	c.Logger().Error(err)
+	if c.Response().Committed {
+		// A stream, e.g. server-sent events, already sent its own response.
+		return
+	}
+	apiErr := apiError(err)
+	apiErr.RequestId = c.Response().Header().Get(echo.HeaderXRequestID)
+	response.Protobuf(c, int(apiErr.Status), apiErr)
+}
+
+// apiError returns err as the Error sent to clients.
+func apiError(err error) *errorspb.Error {
+	var httpErr *echo.HTTPError
+	if !errors.As(err, &httpErr) {
+		status := databaseStatus(err)
+		message := "an unknown error occurred"
+		if status != http.StatusInternalServerError {
+			message = err.Error()
 		}
-		code = he.Code
+		return newAPIError(status, message)
 	}
-	c.Logger().Error(err)
-	responseErr := &errors.Error{Message: message}
-	response.Protobuf(c, code, responseErr)
+	switch message := httpErr.Message.(type) {
+	case *errorspb.Error:
+		apiErr := newAPIError(httpErr.Code, message.Message)
+		apiErr.FieldViolations = message.FieldViolations
+		return apiErr
+	case string:
+		return newAPIError(httpErr.Code, message)
+	default:
+		return newAPIError(httpErr.Code, http.StatusText(httpErr.Code))
+	}
+}
+
+func newAPIError(status int, message string) *errorspb.Error {
+	return &errorspb.Error{
+		Message:   message,
+		Code:      errorCode(status),
+		Status:    int32(status),
+		Retryable: retryableStatus(status),
+	}
+}
+
+// errorCode returns the code of errors sent with an HTTP status.
+func errorCode(status int) errorspb.Error_Code {
+	switch status {
+	case http.StatusUnauthorized:
+		return errorspb.Error_UNAUTHENTICATED
+	case http.StatusForbidden:
+		return errorspb.Error_PERMISSION_DENIED
+	case http.StatusNotFound:
+		return errorspb.Error_NOT_FOUND
+	case http.StatusConflict:
+		return errorspb.Error_CONFLICT
+	case http.StatusPreconditionFailed, http.StatusPreconditionRequired:
+		return errorspb.Error_FAILED_PRECONDITION
+	case http.StatusUnsupportedMediaType:
+		return errorspb.Error_UNSUPPORTED_MEDIA_TYPE
+	case http.StatusTooManyRequests:
+		return errorspb.Error_RATE_LIMITED
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return errorspb.Error_UNAVAILABLE
+	}
+	if status >= 400 && status < 500 {
+		return errorspb.Error_INVALID_ARGUMENT
+	}
+	return errorspb.Error_INTERNAL
+}
+
+// retryableStatus reports whether a request that failed with an HTTP status
+// may succeed when it is sent again later without changes.
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// databaseStatus returns the HTTP status for an error from the database:
+// 404 for database.ErrNotFound, 409 for database.ErrConflict and 500 for
+// anything else.
+func databaseStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrConflict):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// databaseError returns an HTTP error for err from the database, with the
+// status of its kind and message followed by err as its message.
+func databaseError(err error, message string) *echo.HTTPError {
+	return echo.NewHTTPError(databaseStatus(err), fmt.Errorf("%s: %w", message, err).Error()).SetInternal(err)
+}
+
+// invalidField returns a 400 error for a field or parameter of a request that
+// is not valid, naming the field in the error sent to the client.
+func invalidField(field, message string) *echo.HTTPError {
+	return echo.NewHTTPError(http.StatusBadRequest, &errorspb.Error{
+		Message:         message,
+		FieldViolations: []*errorspb.FieldViolation{{Field: field, Description: message}},
+	})
 }
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+)
+
+const (
+	headerETag    = "ETag"
+	headerIfMatch = "If-Match"
+)
+
+// setETag sends the version of the conversation as its ETag, so that clients
+// can send it back in an If-Match header when they change the conversation.
+func setETag(c echo.Context, conversation *chat.Conversation) {
+	c.Response().Header().Set(headerETag, conversationETag(conversation.Version))
+}
+
+func conversationETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// ifMatchVersion returns the version the conversation with the given id must
+// be at for the request to go ahead, going by its If-Match header. It returns
+// 0 when there is no If-Match header or it is "*", in which case any version
+// will do. When the header lists more than one ETag the current version of the
+// conversation is looked up, and the request fails with a precondition failed
+// error if none of them match it.
+func ifMatchVersion(c echo.Context, db *database.DB, id int) (int64, error) {
+	header := strings.TrimSpace(c.Request().Header.Get(headerIfMatch))
+	if header == "" || header == "*" {
+		return 0, nil
+	}
+	versions := []int64{}
+	for _, tag := range strings.Split(header, ",") {
+		// Weak ETags never match in If-Match, and ETags that are not one of
+		// ours cannot match either.
+		unquoted, err := strconv.Unquote(strings.TrimSpace(tag))
+		if err != nil {
+			continue
+		}
+		if version, err := strconv.ParseInt(unquoted, 10, 64); err == nil && version > 0 {
+			versions = append(versions, version)
+		}
+	}
+	if len(versions) == 1 {
+		return versions[0], nil
+	}
+	if len(versions) > 1 {
+		conversation, err := db.GetConversation(id)
+		if err != nil {
+			return 0, databaseError(err, fmt.Sprintf("unable to get conversation with id [%d]", id))
+		}
+		if slices.Contains(versions, conversation.Version) {
+			return conversation.Version, nil
+		}
+	}
+	return 0, echo.NewHTTPError(http.StatusPreconditionFailed, fmt.Sprintf("conversation %d does not match If-Match %s", id, header))
+}
+
+// versionConflictError turns a database.ErrVersionConflict into a precondition
+// failed error when the request asked for a version with If-Match, or a
+// conflict error when the conversation changed while the request was being
+// handled. It returns nil for any other error.
+func versionConflictError(c echo.Context, err error) error {
+	if !errors.Is(err, database.ErrVersionConflict) {
+		return nil
+	}
+	if c.Request().Header.Get(headerIfMatch) != "" {
+		return echo.NewHTTPError(http.StatusPreconditionFailed, err.Error())
+	}
+	return echo.NewHTTPError(http.StatusConflict, err.Error())
+}
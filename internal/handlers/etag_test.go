@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/database"
+)
+
+func TestIfMatch(t *testing.T) {
+	e, db := newTestServer(t)
+	const updateContext = `{"conversation": {"context": "Be brief."}, "updateMask": "context"}`
+	tests := []struct {
+		name   string
+		method string
+		// path is appended to the path of the conversation.
+		path string
+		body string
+		// ifMatch returns the If-Match header to send, given the ETag of the
+		// conversation.
+		ifMatch func(etag string) string
+		code    int
+	}{
+		{"update without If-Match", http.MethodPatch, "", updateContext, func(string) string { return "" }, http.StatusOK},
+		{"update with any version", http.MethodPatch, "", updateContext, func(string) string { return "*" }, http.StatusOK},
+		{"update with the current version", http.MethodPatch, "", updateContext, func(etag string) string { return etag }, http.StatusOK},
+		{"update with one of several versions", http.MethodPatch, "", updateContext, func(etag string) string { return `"99", ` + etag }, http.StatusOK},
+		{"update with a stale version", http.MethodPatch, "", updateContext, func(string) string { return `"99"` }, http.StatusPreconditionFailed},
+		{"update with none of several versions", http.MethodPatch, "", updateContext, func(string) string { return `"98", "99"` }, http.StatusPreconditionFailed},
+		{"update with a weak ETag", http.MethodPatch, "", updateContext, func(etag string) string { return "W/" + etag }, http.StatusPreconditionFailed},
+		{"update with an ETag that is not ours", http.MethodPatch, "", updateContext, func(string) string { return `"abc"` }, http.StatusPreconditionFailed},
+		{"archive with the current version", http.MethodPost, "/archive", "", func(etag string) string { return etag }, http.StatusOK},
+		{"archive with a stale version", http.MethodPost, "/archive", "", func(string) string { return `"99"` }, http.StatusPreconditionFailed},
+		{"tag with the current version", http.MethodPut, "/tags/work", "", func(etag string) string { return etag }, http.StatusOK},
+		{"tag with a stale version", http.MethodPut, "/tags/work", "", func(string) string { return `"99"` }, http.StatusPreconditionFailed},
+		{"delete with the current version", http.MethodDelete, "", "", func(etag string) string { return etag }, http.StatusNoContent},
+		{"delete with a stale version", http.MethodDelete, "", "", func(string) string { return `"99"` }, http.StatusPreconditionFailed},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conversation, err := db.CreateConversation(fmt.Sprintf("Conversation %d", i), 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			target := fmt.Sprintf("/conversations/%d", conversation.Id)
+			etag := serve(e, http.MethodGet, target, "").Header().Get(headerETag)
+			if etag != conversationETag(conversation.Version) {
+				t.Fatalf("expected ETag %s, got %s", conversationETag(conversation.Version), etag)
+			}
+
+			header := []string{}
+			if ifMatch := test.ifMatch(etag); ifMatch != "" {
+				header = append(header, headerIfMatch, ifMatch)
+			}
+			rec := serve(e, test.method, target+test.path, test.body, header...)
+			if rec.Code != test.code {
+				t.Fatalf("expected %d, got %d: %s", test.code, rec.Code, rec.Body)
+			}
+
+			changed, err := db.GetConversation(int(conversation.Id))
+			if test.code == http.StatusNoContent {
+				if !errors.Is(err, database.ErrNotFound) {
+					t.Fatalf("expected the conversation to be deleted, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.code != http.StatusOK {
+				if changed.Version != conversation.Version {
+					t.Fatalf("expected the conversation to stay at version %d, got %d", conversation.Version, changed.Version)
+				}
+				return
+			}
+			if changed.Version != conversation.Version+1 {
+				t.Fatalf("expected the conversation to move to version %d, got %d", conversation.Version+1, changed.Version)
+			}
+			if got := rec.Header().Get(headerETag); got != conversationETag(changed.Version) {
+				t.Fatalf("expected ETag %s, got %s", conversationETag(changed.Version), got)
+			}
+		})
+	}
+}
+
+func TestVersionConflictError(t *testing.T) {
+	conflict := fmt.Errorf("unable to update conversation 1: %w", database.ErrVersionConflict)
+	tests := []struct {
+		name    string
+		ifMatch string
+		err     error
+		code    int
+	}{
+		{"changed while handled", "", conflict, http.StatusConflict},
+		{"stale If-Match", `"1"`, conflict, http.StatusPreconditionFailed},
+		{"other conflict", `"1"`, database.ErrDuplicateTitle, 0},
+		{"no error", "", nil, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPatch, "/conversations/1", nil)
+			if test.ifMatch != "" {
+				req.Header.Set(headerIfMatch, test.ifMatch)
+			}
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			err := versionConflictError(c, test.err)
+			if test.code == 0 {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			var httpErr *echo.HTTPError
+			if !errors.As(err, &httpErr) || httpErr.Code != test.code {
+				t.Fatalf("expected %d, got %v", test.code, err)
+			}
+		})
+	}
+}
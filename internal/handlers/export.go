@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/export"
+)
+
+func exportConversationHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+	format, err := export.ParseFormat(c.QueryParam("format"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	conversation, err := db.GetConversation(id)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Errorf("unable to get conversation with id [%d]: %w", id, err).Error())
+	}
+	var out bytes.Buffer
+	if err := export.Render(&out, conversation, format); err != nil {
+		c.Logger().Error(err)
+		return databaseError(err, "unable to export conversation")
+	}
+	if err := db.AuditExport(conversation.Id); err != nil {
+		c.Logger().Error(err)
+		return databaseError(err, "unable to export conversation")
+	}
+	return attachment(c, format.Filename(conversation), format.ContentType(), out.Bytes())
+}
+
+func exportConversationsHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	format, err := export.ParseFormat(c.QueryParam("format"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	conversations, err := db.ExportConversations()
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to export conversations: %w", err).Error())
+	}
+	ids := make([]int64, 0, len(conversations))
+	for _, conversation := range conversations {
+		ids = append(ids, conversation.Id)
+	}
+	var out bytes.Buffer
+	if err := export.Zip(&out, conversations, format); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to export conversations: %w", err).Error())
+	}
+	if err := db.AuditExport(ids...); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to export conversations: %w", err).Error())
+	}
+	filename := fmt.Sprintf("conversations-%s.zip", time.Now().UTC().Format("20060102-150405"))
+	return attachment(c, filename, "application/zip", out.Bytes())
+}
+
+// attachment sends data as a file download. The content type is set explicitly
+// because the conversations group defaults it to protobuf.
+func attachment(c echo.Context, filename, contentType string, data []byte) error {
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	return c.Blob(http.StatusOK, contentType, data)
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"github.com/timsexperiments/chat-cli/internal/response"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// The longest note that can be left on a rating, in characters.
+const maxFeedbackNoteLength = 4000
+
+func rateMessageHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	message, err := conversationMessage(c, db)
+	if err != nil {
+		return err
+	}
+	request := &chat.RateMessageRequest{}
+	if body, ok := c.Get(config.BODY_KEY).([]byte); ok {
+		if err := unmarshalBody(c, body, request); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unable to parse request: %w", err).Error())
+		}
+	}
+	if err := validateRating(message, request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	feedback, err := db.RateMessage(message.Id, request)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to rate message: %w", err).Error())
+	}
+	return response.Protobuf(c, http.StatusOK, feedback)
+}
+
+func unrateMessageHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	message, err := conversationMessage(c, db)
+	if err != nil {
+		return err
+	}
+	if err := db.UnrateMessage(message.Id); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to unrate message: %w", err).Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// rateInChat stores the rating from a FeedbackEvent sent to chat in a
+// conversation, and returns the event to send back, which is an error event if
+// the rating was not stored.
+func rateInChat(logger echo.Logger, db *database.DB, conversationId int64, event *chat.FeedbackEvent) *chat.ChatEvent {
+	message, err := db.GetMessage(int(event.MessageId))
+	if err != nil {
+		logger.Error(err)
+		return buildErrorEvent(chat.ErrorEvent_SERVER_ERROR, "unable to get message", event.MessageId)
+	}
+	if message == nil || message.ConversationId != conversationId || message.DeletedAt != nil {
+		return buildErrorEvent(chat.ErrorEvent_INPUT_VALIDATION_ERROR, fmt.Sprintf("message %d not found in conversation %d", event.MessageId, conversationId), event.MessageId)
+	}
+	rating := event.Rating
+	if rating == nil {
+		rating = &chat.RateMessageRequest{}
+	}
+	if err := validateRating(message, rating); err != nil {
+		return buildErrorEvent(chat.ErrorEvent_INPUT_VALIDATION_ERROR, err.Error(), message.Id)
+	}
+	feedback, err := db.RateMessage(message.Id, rating)
+	if err != nil {
+		logger.Error(err)
+		return buildErrorEvent(chat.ErrorEvent_SERVER_ERROR, "unable to rate message", message.Id)
+	}
+	return &chat.ChatEvent{
+		Type:  chat.ChatEvent_FEEDBACK,
+		Event: &chat.ChatEvent_Feedback{Feedback: feedback},
+	}
+}
+
+// validateRating checks that message can be given rating, and normalizes the
+// categories of rating so that the same category is always stored the same
+// way: trimmed, lower case and listed once.
+func validateRating(message *chat.Message, rating *chat.RateMessageRequest) error {
+	if message.Sender != chat.Message_BOT {
+		return fmt.Errorf("message %d is not a reply from the bot, only replies can be rated", message.Id)
+	}
+	if _, ok := chat.Feedback_Thumb_name[int32(rating.Thumb)]; !ok {
+		return fmt.Errorf("invalid thumb %d", rating.Thumb)
+	}
+	if rating.Score != nil && (*rating.Score < 1 || *rating.Score > 5) {
+		return fmt.Errorf("score must be from 1 to 5, got %d", *rating.Score)
+	}
+	rating.Note = strings.TrimSpace(rating.Note)
+	if len([]rune(rating.Note)) > maxFeedbackNoteLength {
+		return fmt.Errorf("note must be at most %d characters", maxFeedbackNoteLength)
+	}
+	categories := make([]string, 0, len(rating.Categories))
+	for _, category := range rating.Categories {
+		category = strings.ToLower(strings.TrimSpace(category))
+		if category != "" && !slices.Contains(categories, category) {
+			categories = append(categories, category)
+		}
+	}
+	rating.Categories = categories
+	if rating.Thumb == chat.Feedback_THUMB_UNSPECIFIED && rating.Score == nil && rating.Note == "" && len(rating.Categories) == 0 {
+		return fmt.Errorf("a rating needs at least one of thumb, score, note or categories")
+	}
+	return nil
+}
+
+func feedbackReportHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	after, err := timeParam(c, "after")
+	if err != nil {
+		return err
+	}
+	before, err := timeParam(c, "before")
+	if err != nil {
+		return err
+	}
+	report, err := db.FeedbackReport(after, before)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to report feedback: %w", err).Error())
+	}
+	return response.Protobuf(c, http.StatusOK, report)
+}
+
+// exportFeedbackHandler sends every rated reply that matches the query,
+// along with the user message it answers, as JSON lines for evaluating
+// models.
+func exportFeedbackHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	filter := database.FeedbackFilter{
+		Model:    c.QueryParam("model"),
+		Category: strings.ToLower(strings.TrimSpace(c.QueryParam("category"))),
+	}
+	if param := c.QueryParam("thumb"); param != "" {
+		thumb, ok := chat.Feedback_Thumb_value[strings.ToUpper(param)]
+		if !ok || thumb == int32(chat.Feedback_THUMB_UNSPECIFIED) {
+			return invalidField("thumb", fmt.Sprintf("invalid thumb [%s], expected up or down", param))
+		}
+		filter.Thumb = chat.Feedback_Thumb(thumb)
+	}
+	var err error
+	if filter.After, err = timeParam(c, "after"); err != nil {
+		return err
+	}
+	if filter.Before, err = timeParam(c, "before"); err != nil {
+		return err
+	}
+	examples, err := db.ListFeedbackExamples(filter)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to list rated messages: %w", err).Error())
+	}
+	var out bytes.Buffer
+	for _, example := range examples {
+		raw, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(example)
+		if err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to export rated message %d: %w", example.MessageId, err).Error())
+		}
+		if err := json.Compact(&out, raw); err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to export rated message %d: %w", example.MessageId, err).Error())
+		}
+		out.WriteByte('\n')
+	}
+	filename := fmt.Sprintf("feedback-%s.jsonl", time.Now().UTC().Format("20060102-150405"))
+	return attachment(c, filename, "application/x-ndjson", out.Bytes())
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/middleware"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"github.com/timsexperiments/chat-cli/internal/response"
+)
+
+func RegisterFolderHandlers(e *echo.Echo) {
+	folders := e.Group("/folders")
+	folders.Use(middleware.ProtobufBodyChecker)
+	folders.Use(middleware.ProtobufHeader)
+	folders.GET("", listFoldersHandler)
+	folders.POST("", createFolderHandler, middleware.Idempotency)
+	folders.PATCH("/:id", updateFolderHandler)
+	folders.DELETE("/:id", deleteFolderHandler)
+}
+
+func listFoldersHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	folders, err := db.ListFolders()
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to list folders: %w", err).Error())
+	}
+	return response.Protobuf(c, http.StatusOK, &chat.ListFoldersResponse{Folders: folders})
+}
+
+func createFolderHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	body, ok := c.Get(config.BODY_KEY).([]byte)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing body")
+	}
+	request := &chat.CreateFolderRequest{}
+	if err := unmarshalBody(c, body, request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unable to parse request: %w", err).Error())
+	}
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name must not be empty")
+	}
+	if err := checkFolderExists(db, request.ParentId); err != nil {
+		return err
+	}
+	folder, err := db.CreateFolder(name, request.ParentId)
+	if errors.Is(err, database.ErrDuplicateName) {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to create folder: %w", err).Error())
+	}
+	return response.Protobuf(c, http.StatusCreated, folder)
+}
+
+func updateFolderHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+	body, ok := c.Get(config.BODY_KEY).([]byte)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing body")
+	}
+	request := &chat.UpdateFolderRequest{}
+	if err := unmarshalBody(c, body, request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unable to parse request: %w", err).Error())
+	}
+	folder, err := db.GetFolder(id)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to get folder %d: %w", id, err).Error())
+	}
+	if folder == nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("folder %d does not exist", id))
+	}
+	if len(request.UpdateMask.GetPaths()) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "update_mask must name at least one field")
+	}
+	update := request.Folder
+	if update == nil {
+		update = &chat.Folder{}
+	}
+	for _, path := range request.UpdateMask.GetPaths() {
+		switch path {
+		case "name":
+			folder.Name = strings.TrimSpace(update.Name)
+			if folder.Name == "" {
+				return echo.NewHTTPError(http.StatusBadRequest, "name must not be empty")
+			}
+		case "parent_id":
+			folder.ParentId = update.ParentId
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unsupported update_mask path [%s]", path))
+		}
+	}
+	if err := checkFolderExists(db, folder.ParentId); err != nil {
+		return err
+	}
+	folder, err = db.UpdateFolder(folder)
+	if errors.Is(err, database.ErrDuplicateName) {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	if errors.Is(err, database.ErrFolderCycle) {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to update folder: %w", err).Error())
+	}
+	return response.Protobuf(c, http.StatusOK, folder)
+}
+
+func deleteFolderHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+	folder, err := db.GetFolder(id)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to get folder %d: %w", id, err).Error())
+	}
+	if folder == nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("folder %d does not exist", id))
+	}
+	if err := db.DeleteFolder(id); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to delete folder: %w", err).Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
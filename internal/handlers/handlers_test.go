@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	labstack "github.com/labstack/echo/v4/middleware"
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/middleware"
+)
+
+// The API token sent with test requests.
+const testToken = "test-token"
+
+func TestMain(m *testing.M) {
+	// Queries are read from the queries directory at the root of the
+	// repository.
+	if err := os.Chdir("../.."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestServer returns the API backed by an in-memory database of its own
+// for the test.
+func newTestServer(t *testing.T) (*echo.Echo, *database.DB) {
+	t.Helper()
+	cfg := *config.GetConfig()
+	cfg.DatabaseDSN = fmt.Sprintf("file:/%s.db?vfs=memdb", strings.NewReplacer("/", "_", " ", "_").Replace(t.Name()))
+	sqlDB, err := database.Open(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	db := database.CreateDB(sqlDB, nil)
+
+	e := echo.New()
+	e.HTTPErrorHandler = ErrorHandler
+	e.Use(labstack.RequestID())
+	e.Use(middleware.ContextDB(db))
+	RegisterConversationsHandlers(e)
+	RegisterTrashHandlers(e)
+	RegisterPinHandlers(e)
+	RegisterOpenAIHandlers(e)
+	RegisterChatService(e)
+	return e, db
+}
+
+// serve sends a JSON request with the test token to e and returns the
+// response.
+func serve(e *echo.Echo, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+testToken)
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	if body != "" {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// fakeModel answers the chat completions asked for during the test with
+// handler.
+func fakeModel(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	cfg := config.GetConfig()
+	baseURL := cfg.OpenAiBaseURL
+	cfg.OpenAiBaseURL = server.URL
+	t.Cleanup(func() { cfg.OpenAiBaseURL = baseURL })
+}
+
+// reply answers with a completion with the given id: the reply, then the new
+// context.
+func reply(id string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id": %q, "choices": [{"message": {"role": "assistant", "content": "Hi there\n\nThey said hi."}}], "usage": {"total_tokens": 5}}`, id)
+	}
+}
+
+func TestMissingConversationsAreNotFound(t *testing.T) {
+	e, _ := newTestServer(t)
+	tests := []struct {
+		method string
+		target string
+		body   string
+	}{
+		{http.MethodDelete, "/conversations/404", ""},
+		{http.MethodDelete, "/conversations/404?permanent=true", ""},
+		{http.MethodPost, "/conversations/404/restore", ""},
+		{http.MethodPost, "/conversations/404/archive", ""},
+		{http.MethodPost, "/conversations/404/unarchive", ""},
+		{http.MethodPost, "/conversations/404/messages?reply=false", `{"body": "hello"}`},
+		{http.MethodDelete, "/conversations/404/messages/1", ""},
+		{http.MethodPost, "/conversations/404/messages/1/restore", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.method+" "+test.target, func(t *testing.T) {
+			rec := serve(e, test.method, test.target, test.body)
+			if rec.Code != http.StatusNotFound {
+				t.Fatalf("expected %d, got %d: %s", http.StatusNotFound, rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestBulkRoutesNeedAToken(t *testing.T) {
+	e, _ := newTestServer(t)
+	tests := []struct {
+		method string
+		target string
+		body   string
+	}{
+		{http.MethodGet, "/conversations/export", ""},
+		{http.MethodPost, "/conversations/import", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.method+" "+test.target, func(t *testing.T) {
+			rec := serve(e, test.method, test.target, test.body, echo.HeaderAuthorization, "")
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("expected %d, got %d: %s", http.StatusUnauthorized, rec.Code, rec.Body)
+			}
+		})
+	}
+}
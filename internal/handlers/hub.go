@@ -0,0 +1,370 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// How many events are queued for a client before it is considered too slow to
+// keep up and is disconnected.
+const hubClientBuffer = 64
+
+// hubs fans the events of a conversation out to every client that has its
+// WebSocket, or a Chat stream, open, so that two terminals, or two people, in
+// the same conversation see each other's messages and the bot's replies to
+// them.
+var hubs = &conversationHubs{hubs: map[int64]*conversationHub{}}
+
+type conversationHubs struct {
+	mu   sync.Mutex
+	hubs map[int64]*conversationHub
+}
+
+// conversationHub is the WebSocket clients of a conversation and the events
+// sent to them. It is kept after the last client leaves for as long as one of
+// them may still resume its session.
+type conversationHub struct {
+	// The clients, in the order they joined.
+	clients []*hubClient
+	// The seq of the last event sent.
+	seq int64
+	// The latest events, oldest first, for clients that resume.
+	events []hubRecord
+	// The clients that left and may still resume their sessions, by client
+	// id.
+	left map[string]hubSession
+}
+
+// hubSession is what a client must resume its session with.
+type hubSession struct {
+	// The actor the session belongs to.
+	actor       string
+	resumeToken string
+	// When the client left.
+	leftAt time.Time
+}
+
+// hubRecord is an event sent to the clients of a conversation.
+type hubRecord struct {
+	event  *chat.ChatEvent
+	sentAt time.Time
+	// The id of the client the event was sent to alone, if any.
+	to string
+	// The id of the client the event was not sent to, if any.
+	from string
+}
+
+// hubClient is a WebSocket connection, or a Chat stream, to a conversation.
+// Every event for it, whether it answers its own messages or was fanned out
+// from someone else, is queued on send and written by a single writer, since
+// neither allows concurrent writes.
+type hubClient struct {
+	conversationId int64
+	participant    *chat.Participant
+	// The secret the client resumes its session with, which unlike its
+	// client id is not shown to the other clients.
+	resumeToken string
+	// The kind of frame events are sent in, see frameMediaType. It follows
+	// the kind of frame the client last sent. Guarded by conversationHubs.mu.
+	frameType int
+	send      chan hubEvent
+	// Whether send was closed because the client left or fell behind.
+	// Guarded by conversationHubs.mu.
+	closed bool
+}
+
+type hubEvent struct {
+	frameType int
+	event     *chat.ChatEvent
+}
+
+// join adds a client for actor to the clients of a conversation and tells
+// every client of the conversation, including the new one, who is there now.
+// The new client is sent its session first. If resumeId and resumeToken are
+// those of a session of actor that may still be resumed, the new client takes
+// it over and is sent the events after lastSeq that it missed, replacing the
+// old connection if that is still open. Otherwise it starts a new session.
+func (h *conversationHubs) join(conversationId int64, actor string, frameType int, resumeId, resumeToken string, lastSeq int64) (*hubClient, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	h.pruneLocked(now)
+
+	hub := h.hubs[conversationId]
+	if hub == nil {
+		hub = &conversationHub{left: map[string]hubSession{}}
+		h.hubs[conversationId] = hub
+	}
+	token, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	session := &chat.Session{Seq: hub.seq, ResumeToken: token}
+	var missed []*chat.ChatEvent
+	if resumeId != "" && resumeToken != "" {
+		missed, session.Resumed = hub.missed(resumeId, actor, resumeToken, lastSeq)
+	}
+	if session.Resumed {
+		session.ClientId = resumeId
+		for _, client := range hub.clients {
+			if client.participant.ClientId == resumeId {
+				h.removeLocked(client, now)
+				break
+			}
+		}
+	} else if session.ClientId, err = randomHex(8); err != nil {
+		return nil, err
+	}
+	delete(hub.left, session.ClientId)
+
+	client := &hubClient{
+		conversationId: conversationId,
+		participant: &chat.Participant{
+			ClientId:    session.ClientId,
+			Actor:       actor,
+			ConnectedAt: timestamppb.New(now),
+		},
+		resumeToken: session.ResumeToken,
+		frameType:   frameType,
+		send:        make(chan hubEvent, hubClientBuffer+len(missed)+1),
+	}
+	h.enqueueLocked(client, &chat.ChatEvent{
+		Type:  chat.ChatEvent_SESSION,
+		Event: &chat.ChatEvent_Session{Session: session},
+	})
+	for _, event := range missed {
+		h.enqueueLocked(client, event)
+	}
+	hub.clients = append(hub.clients, client)
+	h.sendLocked(conversationId, h.presenceEventLocked(conversationId), nil, nil)
+	return client, nil
+}
+
+// leave removes a client from its conversation, closes its queue and tells
+// the clients that are left.
+func (h *conversationHubs) leave(client *hubClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	if !h.removeLocked(client, now) {
+		return
+	}
+	h.sendLocked(client.conversationId, h.presenceEventLocked(client.conversationId), nil, nil)
+	h.pruneLocked(now)
+}
+
+// publish sends event to every client of a conversation but from, which is
+// the client the event came from, if any. It never blocks: clients that have
+// fallen too far behind are disconnected instead.
+func (h *conversationHubs) publish(conversationId int64, event *chat.ChatEvent, from *hubClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sendLocked(conversationId, event, nil, from)
+}
+
+// reply sends event to client alone. It reports whether the event was queued.
+func (h *conversationHubs) reply(client *hubClient, event *chat.ChatEvent) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if client.closed {
+		return false
+	}
+	h.sendLocked(client.conversationId, event, client, nil)
+	return !client.closed
+}
+
+// received records the kind of frame client last sent, which the events sent
+// to it from then on are sent in.
+func (h *conversationHubs) received(client *hubClient, frameType int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	client.frameType = frameType
+}
+
+// presence returns who has a conversation open.
+func (h *conversationHubs) presence(conversationId int64) *chat.Presence {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.presenceEventLocked(conversationId).GetPresence()
+}
+
+// sendLocked numbers event, keeps it for clients that resume, and queues it
+// for to alone if it is set, or for every client but from otherwise. Events
+// of conversations that nobody has open, or may resume, are not numbered.
+func (h *conversationHubs) sendLocked(conversationId int64, event *chat.ChatEvent, to, from *hubClient) {
+	hub := h.hubs[conversationId]
+	if hub == nil {
+		return
+	}
+	hub.seq++
+	event.Seq = hub.seq
+	record := hubRecord{event: event, sentAt: time.Now()}
+	if to != nil {
+		record.to = to.participant.ClientId
+	}
+	if from != nil {
+		record.from = from.participant.ClientId
+	}
+	hub.events = append(hub.events, record)
+	if size := config.GetConfig().WebSocketEventBuffer; len(hub.events) > size {
+		hub.events = append(hub.events[:0:0], hub.events[len(hub.events)-size:]...)
+	}
+
+	if to != nil {
+		h.enqueueLocked(to, event)
+		return
+	}
+	// The clients are copied since a client that fell behind is removed while
+	// they are gone through.
+	for _, client := range append([]*hubClient{}, hub.clients...) {
+		if client != from {
+			h.enqueueLocked(client, event)
+		}
+	}
+}
+
+func (h *conversationHubs) enqueueLocked(client *hubClient, event *chat.ChatEvent) {
+	if client.closed {
+		return
+	}
+	select {
+	case client.send <- hubEvent{frameType: client.frameType, event: event}:
+	default:
+		// The writer of the client closes its connection once it has sent
+		// what is queued, which ends its read loop too.
+		h.removeLocked(client, time.Now())
+	}
+}
+
+// removeLocked takes client out of its conversation and closes its queue. It
+// reports whether the client was still there.
+func (h *conversationHubs) removeLocked(client *hubClient, now time.Time) bool {
+	if client.closed {
+		return false
+	}
+	client.closed = true
+	close(client.send)
+	hub := h.hubs[client.conversationId]
+	for i, other := range hub.clients {
+		if other == client {
+			hub.clients = append(hub.clients[:i:i], hub.clients[i+1:]...)
+			break
+		}
+	}
+	hub.left[client.participant.ClientId] = hubSession{
+		actor:       client.participant.Actor,
+		resumeToken: client.resumeToken,
+		leftAt:      now,
+	}
+	return true
+}
+
+// pruneLocked forgets the clients that left too long ago to resume their
+// sessions and the events too old to be sent to them, and then the
+// conversations that nobody has open or may resume.
+func (h *conversationHubs) pruneLocked(now time.Time) {
+	cutoff := now.Add(-config.GetConfig().WebSocketResumeWindow)
+	for conversationId, hub := range h.hubs {
+		for clientId, session := range hub.left {
+			if !session.leftAt.After(cutoff) {
+				delete(hub.left, clientId)
+			}
+		}
+		expired := 0
+		for expired < len(hub.events) && !hub.events[expired].sentAt.After(cutoff) {
+			expired++
+		}
+		hub.events = hub.events[expired:]
+		if len(hub.clients) == 0 && len(hub.left) == 0 {
+			delete(h.hubs, conversationId)
+		}
+	}
+}
+
+func (h *conversationHubs) presenceEventLocked(conversationId int64) *chat.ChatEvent {
+	presence := &chat.Presence{ConversationId: conversationId, Participants: []*chat.Participant{}}
+	if hub := h.hubs[conversationId]; hub != nil {
+		for _, client := range hub.clients {
+			presence.Participants = append(presence.Participants, proto.Clone(client.participant).(*chat.Participant))
+		}
+	}
+	return &chat.ChatEvent{
+		Type:  chat.ChatEvent_PRESENCE,
+		Event: &chat.ChatEvent_Presence{Presence: presence},
+	}
+}
+
+// missed returns the events after lastSeq that were sent to the client with
+// clientId, or that it would have been sent had it been connected. It reports
+// false if the client is unknown, if its session belongs to another actor or
+// was not resumed with its resume token, or if some of those events are no
+// longer kept, in which case the session cannot be resumed.
+func (hub *conversationHub) missed(clientId, actor, resumeToken string, lastSeq int64) ([]*chat.ChatEvent, bool) {
+	owns := func(sessionActor, sessionToken string) bool {
+		return sessionActor == actor && subtle.ConstantTimeCompare([]byte(sessionToken), []byte(resumeToken)) == 1
+	}
+	known := false
+	if session, ok := hub.left[clientId]; ok {
+		known = owns(session.actor, session.resumeToken)
+	}
+	for _, client := range hub.clients {
+		if client.participant.ClientId == clientId {
+			known = owns(client.participant.Actor, client.resumeToken)
+		}
+	}
+	if !known || lastSeq < 0 || lastSeq > hub.seq {
+		return nil, false
+	}
+	if lastSeq < hub.seq && (len(hub.events) == 0 || hub.events[0].event.Seq > lastSeq+1) {
+		return nil, false
+	}
+	missed := []*chat.ChatEvent{}
+	for _, record := range hub.events {
+		if record.event.Seq <= lastSeq || record.from == clientId {
+			continue
+		}
+		if record.to == "" || record.to == clientId {
+			missed = append(missed, record.event)
+		}
+	}
+	return missed, true
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// publishUserMessage tells the clients of a conversation but from about a
+// user message stored in it, or about its status changing. The message is
+// copied, since the event is kept for clients that resume and written by
+// their writers while the caller may go on changing it.
+func publishUserMessage(message *chat.Message, from *hubClient) {
+	hubs.publish(message.ConversationId, &chat.ChatEvent{
+		Type:  chat.ChatEvent_USER_MESSAGE,
+		Event: &chat.ChatEvent_UserMessage{UserMessage: proto.Clone(message).(*chat.Message)},
+	}, from)
+}
+
+// publishConversation tells the clients of a conversation that its metadata
+// changed.
+func publishConversation(conversation *chat.Conversation) {
+	metadata := proto.Clone(conversation).(*chat.Conversation)
+	metadata.Messages = nil
+	hubs.publish(conversation.Id, &chat.ChatEvent{
+		Type:  chat.ChatEvent_CONVERSATION,
+		Event: &chat.ChatEvent_Conversation{Conversation: metadata},
+	}, nil)
+}
@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"connectrpc.com/connect"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/codec"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat/chatconnect"
+)
+
+// joinHub adds a client for actor to the clients of a conversation, and
+// forgets the conversation's hub once the test is done with its clients.
+func joinHub(t *testing.T, conversationId int64, actor string, frameType int, resumeId, resumeToken string, lastSeq int64) *hubClient {
+	t.Helper()
+	client, err := hubs.join(conversationId, actor, frameType, resumeId, resumeToken, lastSeq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		hubs.leave(client)
+		hubs.mu.Lock()
+		defer hubs.mu.Unlock()
+		if hub := hubs.hubs[conversationId]; hub != nil && len(hub.clients) == 0 {
+			delete(hubs.hubs, conversationId)
+		}
+	})
+	return client
+}
+
+// hubEvents writes the events queued for client the way its WebSocket writer
+// does, until its queue is closed, and returns them as they were written. The
+// returned function waits for the queue to be closed.
+func hubEvents(t *testing.T, client *hubClient) func() []*chat.ChatEvent {
+	t.Helper()
+	events := []*chat.ChatEvent{}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for queued := range client.send {
+			out, err := codec.Marshal(frameMediaType(queued.frameType), queued.event)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			event := &chat.ChatEvent{}
+			if err := codec.Unmarshal(frameMediaType(queued.frameType), out, event); err != nil {
+				t.Error(err)
+				continue
+			}
+			events = append(events, event)
+		}
+	}()
+	return func() []*chat.ChatEvent {
+		wg.Wait()
+		return events
+	}
+}
+
+// describeTurnEvents describes the events about a chat turn among events, the
+// type of each and the status of the user messages.
+func describeTurnEvents(events []*chat.ChatEvent) []string {
+	described := []string{}
+	for _, event := range events {
+		switch event.Type {
+		case chat.ChatEvent_USER_MESSAGE:
+			described = append(described, fmt.Sprintf("%s %s", event.Type, event.GetUserMessage().Status))
+		case chat.ChatEvent_MESSAGE:
+			described = append(described, event.Type.String())
+		}
+	}
+	return described
+}
+
+func TestChatTurnEvents(t *testing.T) {
+	_, db := newTestServer(t)
+	tests := []struct {
+		name string
+		// answer is what the model answers with.
+		answer http.HandlerFunc
+		// retry is whether the turn retries a failed message rather than
+		// sending a new one.
+		retry bool
+		// The events about the turn that the client that sent the message
+		// and another client are sent.
+		sender  []string
+		watcher []string
+	}{
+		{"replied", reply("chatcmpl-1"), false, []string{"MESSAGE"}, []string{"USER_MESSAGE PENDING", "USER_MESSAGE COMPLETE", "MESSAGE"}},
+		{"failed", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		}, false, []string{}, []string{"USER_MESSAGE PENDING", "USER_MESSAGE FAILED"}},
+		{"retried", reply("chatcmpl-2"), true, []string{"MESSAGE"}, []string{"USER_MESSAGE PENDING", "USER_MESSAGE COMPLETE", "MESSAGE"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeModel(t, test.answer)
+			conversation, err := db.CreateConversation(test.name, 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			event := &chat.MessageEvent{Body: "hi"}
+			if test.retry {
+				failed, err := db.CreatePendingMessage("hi", conversation.Id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := db.SetMessageStatus(failed.Id, chat.Message_FAILED); err != nil {
+					t.Fatal(err)
+				}
+				event = &chat.MessageEvent{RetryMessageId: failed.Id}
+			}
+
+			sender := joinHub(t, conversation.Id, "alice", websocket.TextMessage, "", "", 0)
+			watcher := joinHub(t, conversation.Id, "bob", websocket.BinaryMessage, "", "", 0)
+			senderEvents, watcherEvents := hubEvents(t, sender), hubEvents(t, watcher)
+			logger := echo.New().Logger
+			logger.SetOutput(io.Discard)
+			runChatTurn(logger, db, conversation, event, testToken, sender)
+			hubs.leave(sender)
+			hubs.leave(watcher)
+
+			if got := describeTurnEvents(senderEvents()); fmt.Sprint(got) != fmt.Sprint(test.sender) {
+				t.Fatalf("expected the sender to be sent %v, got %v", test.sender, got)
+			}
+			if got := describeTurnEvents(watcherEvents()); fmt.Sprint(got) != fmt.Sprint(test.watcher) {
+				t.Fatalf("expected the other client to be sent %v, got %v", test.watcher, got)
+			}
+
+			// The events kept for clients that resume are the ones that were
+			// sent, not the message as it is now.
+			resumed := joinHub(t, conversation.Id, "bob", websocket.TextMessage, watcher.participant.ClientId, watcher.resumeToken, 0)
+			hubs.leave(resumed)
+			events := hubEvents(t, resumed)()
+			if !events[0].GetSession().GetResumed() {
+				t.Fatalf("expected the session to be resumed, got %v", events[0])
+			}
+			if got := describeTurnEvents(events); fmt.Sprint(got) != fmt.Sprint(test.watcher) {
+				t.Fatalf("expected the resumed client to be sent %v, got %v", test.watcher, got)
+			}
+		})
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	tests := []struct {
+		name string
+		// left is whether the client left before it is resumed.
+		left  bool
+		actor string
+		// resumeId and resumeToken return what the session is resumed with,
+		// given the session of the client.
+		resumeId    func(session *chat.Session) string
+		resumeToken func(session *chat.Session) string
+		resumed     bool
+	}{
+		{"after leaving", true, "bob", (*chat.Session).GetClientId, (*chat.Session).GetResumeToken, true},
+		{"while connected", false, "bob", (*chat.Session).GetClientId, (*chat.Session).GetResumeToken, true},
+		{"by another actor after leaving", true, "mallory", (*chat.Session).GetClientId, (*chat.Session).GetResumeToken, false},
+		{"by another actor while connected", false, "mallory", (*chat.Session).GetClientId, (*chat.Session).GetResumeToken, false},
+		{"without a resume token", true, "bob", (*chat.Session).GetClientId, func(*chat.Session) string { return "" }, false},
+		{"with a wrong resume token", false, "bob", (*chat.Session).GetClientId, func(*chat.Session) string { return "0123456789abcdef" }, false},
+		{"with the resume token as the client id", true, "bob", (*chat.Session).GetResumeToken, (*chat.Session).GetResumeToken, false},
+		{"of an unknown client", true, "bob", func(*chat.Session) string { return "unknown" }, (*chat.Session).GetResumeToken, false},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conversationId := int64(1000 + i)
+			owner := joinHub(t, conversationId, "bob", websocket.TextMessage, "", "", 0)
+			session := (<-owner.send).event.GetSession()
+			if session.ClientId == "" || session.ResumeToken == "" || session.ResumeToken == session.ClientId {
+				t.Fatalf("expected a client id and a separate resume token, got %v", session)
+			}
+			for _, participant := range hubs.presence(conversationId).Participants {
+				if participant.ClientId == session.ResumeToken || participant.Actor == session.ResumeToken {
+					t.Fatalf("expected the resume token not to be shown to other clients, got %v", participant)
+				}
+			}
+			lastSeq := (<-owner.send).event.Seq
+			publishConversation(&chat.Conversation{Id: conversationId, Title: "Missed"})
+			if test.left {
+				hubs.leave(owner)
+			}
+
+			client := joinHub(t, conversationId, test.actor, websocket.TextMessage, test.resumeId(session), test.resumeToken(session), lastSeq)
+			resumedSession := (<-client.send).event.GetSession()
+			if resumedSession.Resumed != test.resumed {
+				t.Fatalf("expected resumed to be %t, got %t", test.resumed, resumedSession.Resumed)
+			}
+			if resumedSession.ResumeToken == "" || resumedSession.ResumeToken == session.ResumeToken {
+				t.Fatalf("expected a new resume token, got %q", resumedSession.ResumeToken)
+			}
+			if (resumedSession.ClientId == session.ClientId) != test.resumed {
+				t.Fatalf("expected the client id to be kept only when the session is resumed, got %q for %q", resumedSession.ClientId, session.ClientId)
+			}
+			if missed := (<-client.send).event; test.resumed != (missed.Type == chat.ChatEvent_CONVERSATION) {
+				t.Fatalf("expected the missed events to be sent only when the session is resumed, got %v", missed)
+			}
+			hubs.mu.Lock()
+			replaced := owner.closed
+			hubs.mu.Unlock()
+			if !test.left && replaced != test.resumed {
+				t.Fatalf("expected the old connection to be replaced only when the session is resumed, got %t", replaced)
+			}
+		})
+	}
+}
+
+func TestChatStreamEvents(t *testing.T) {
+	e, db := newTestServer(t)
+	fakeModel(t, reply("chatcmpl-stream"))
+	server := httptest.NewUnstartedServer(e)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	client := chatconnect.NewChatServiceClient(server.Client(), server.URL)
+	conversation, err := db.CreateConversation("Streamed", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher := joinHub(t, conversation.Id, "bob", websocket.BinaryMessage, "", "", 0)
+	watcherEvents := hubEvents(t, watcher)
+
+	stream := client.Chat(context.Background())
+	stream.RequestHeader().Set(echo.HeaderAuthorization, "Bearer "+testToken)
+	if err := stream.Send(&chat.ChatRequest{ConversationId: conversation.Id, Event: &chat.MessageEvent{Body: "hi"}}); err != nil {
+		t.Fatal(err)
+	}
+	streamed := []*chat.ChatEvent{}
+	for len(streamed) == 0 || streamed[len(streamed)-1].Type != chat.ChatEvent_MESSAGE {
+		event, err := stream.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamed = append(streamed, event)
+	}
+	if streamed[0].Type != chat.ChatEvent_SESSION {
+		t.Fatalf("expected the stream to be sent its session first, got %v", streamed[0])
+	}
+
+	// A message stored over the RPC is sent to the stream too.
+	request := connect.NewRequest(&chat.CreateMessageRequest{ConversationId: conversation.Id, Body: "later"})
+	request.Header().Set(echo.HeaderAuthorization, "Bearer "+testToken)
+	if _, err := client.CreateMessage(context.Background(), request); err != nil {
+		t.Fatal(err)
+	}
+	event, err := stream.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.GetUserMessage().GetBody() != "later" {
+		t.Fatalf("expected the stream to be sent the stored message, got %v", event)
+	}
+	if err := stream.CloseRequest(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := stream.Receive(); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.CloseResponse(); err != nil {
+		t.Fatal(err)
+	}
+	hubs.leave(watcher)
+
+	want := []string{"USER_MESSAGE PENDING", "USER_MESSAGE COMPLETE", "MESSAGE", "USER_MESSAGE COMPLETE"}
+	if got := describeTurnEvents(watcherEvents()); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected the other client to be sent %v, got %v", want, got)
+	}
+}
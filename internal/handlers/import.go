@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/importer"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"github.com/timsexperiments/chat-cli/internal/response"
+)
+
+var importFormats = map[chat.ImportConversationsRequest_Format]importer.Format{
+	chat.ImportConversationsRequest_FORMAT_UNSPECIFIED: importer.Detect,
+	chat.ImportConversationsRequest_CHATGPT:            importer.ChatGPT,
+	chat.ImportConversationsRequest_EXPORT_JSON:        importer.JSON,
+	chat.ImportConversationsRequest_MARKDOWN:           importer.Markdown,
+}
+
+func importConversationsHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	body, ok := c.Get(config.BODY_KEY).([]byte)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing body")
+	}
+	request := &chat.ImportConversationsRequest{}
+	if err := unmarshalBody(c, body, request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unable to parse request: %w", err).Error())
+	}
+	format, ok := importFormats[request.Format]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unsupported import format [%s]", request.Format))
+	}
+	conversations, err := importer.Parse(request.Data, format)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unable to read import: %w", err).Error())
+	}
+	rename := request.OnConflict != chat.ImportConversationsRequest_SKIP
+	results := importConversations(db, conversations, rename)
+	for _, result := range results {
+		if result.Status == chat.ImportResult_FAILED {
+			c.Logger().Error(fmt.Errorf("unable to import conversation %q: %s", result.SourceTitle, result.Error))
+		}
+	}
+	return response.Protobuf(c, http.StatusOK, &chat.ImportConversationsResponse{Results: results})
+}
+
+// importConversations stores each conversation and reports what happened to
+// it. A failure to store one conversation does not stop the others.
+func importConversations(db *database.DB, conversations []*chat.Conversation, rename bool) []*chat.ImportResult {
+	results := make([]*chat.ImportResult, 0, len(conversations))
+	for _, conversation := range conversations {
+		result := &chat.ImportResult{SourceTitle: conversation.Title}
+		imported, err := db.ImportConversation(conversation, rename)
+		switch {
+		case errors.Is(err, database.ErrDuplicateTitle) && !rename:
+			result.Status = chat.ImportResult_SKIPPED
+		case err != nil:
+			result.Status = chat.ImportResult_FAILED
+			result.Error = err.Error()
+		default:
+			result.Status = chat.ImportResult_CREATED
+			if imported.Title != conversation.Title {
+				result.Status = chat.ImportResult_RENAMED
+			}
+			result.ConversationId = imported.Id
+			result.Title = imported.Title
+			result.MessageCount = int32(len(imported.Messages))
+		}
+		results = append(results, result)
+	}
+	return results
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/timsexperiments/chat-cli/internal/codec"
+	"github.com/timsexperiments/chat-cli/internal/middleware"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+)
+
+func TestCreateMessageWithoutReply(t *testing.T) {
+	e, db := newTestServer(t)
+	open, err := db.CreateConversation("Open", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trashed, err := db.CreateConversation("Trashed", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteConversation(int(trashed.Id), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		conversationId int64
+		body           string
+		code           int
+	}{
+		{"stored", open.Id, `{"body": "hello"}`, http.StatusCreated},
+		{"trashed conversation", trashed.Id, `{"body": "hello"}`, http.StatusNotFound},
+		{"missing conversation", 404, `{"body": "hello"}`, http.StatusNotFound},
+		{"missing body", open.Id, "", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := serve(e, http.MethodPost, fmt.Sprintf("/conversations/%d/messages?reply=false", test.conversationId), test.body)
+			if rec.Code != test.code {
+				t.Fatalf("expected %d, got %d: %s", test.code, rec.Code, rec.Body)
+			}
+			if test.code != http.StatusCreated {
+				return
+			}
+			message := &chat.Message{}
+			if err := codec.Unmarshal(codec.JSON, rec.Body.Bytes(), message); err != nil {
+				t.Fatal(err)
+			}
+			if message.Body != "hello" || message.Sender != chat.Message_USER || message.ConversationId != test.conversationId {
+				t.Fatalf("expected the user message to be returned, got %v", message)
+			}
+		})
+	}
+}
+
+func TestRetriedFailedReplyIsNotStoredAgain(t *testing.T) {
+	e, db := newTestServer(t)
+	fakeModel(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	})
+	conversation, err := db.CreateConversation("Failing", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := fmt.Sprintf("/conversations/%d/messages", conversation.Id)
+	first := serve(e, http.MethodPost, target, `{"body": "hello"}`, middleware.IdempotencyKeyHeader, "retry-me")
+	if first.Code != http.StatusInternalServerError {
+		t.Fatalf("expected %d, got %d: %s", http.StatusInternalServerError, first.Code, first.Body)
+	}
+	retry := serve(e, http.MethodPost, target, `{"body": "hello"}`, middleware.IdempotencyKeyHeader, "retry-me")
+	if retry.Code != first.Code || retry.Header().Get(middleware.IdempotentReplayedHeader) != "true" {
+		t.Fatalf("expected the failure to be sent again, got %d: %s", retry.Code, retry.Body)
+	}
+
+	stored, err := db.GetConversation(int(conversation.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Messages) != 1 || stored.Messages[0].Status != chat.Message_FAILED {
+		t.Fatalf("expected the message to be stored once and marked failed, got %v", stored.Messages)
+	}
+}
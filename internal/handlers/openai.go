@@ -0,0 +1,378 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/chatgpt"
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/middleware"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+)
+
+// The header that names the conversation an exchange through the OpenAI
+// compatible API is logged in. A conversation is created for the exchange when
+// it is not sent, and its id is sent back in the same header so that the next
+// exchange can be logged in it too.
+const conversationIdHeader = "X-Conversation-Id"
+
+// The tag on conversations created for exchanges through the OpenAI
+// compatible API.
+const openAITag = "openai-api"
+
+// The longest title, in characters, given to a conversation created for an
+// exchange, taken from the start of its prompt.
+const maxOpenAITitleLength = 60
+
+// RegisterOpenAIHandlers serves an OpenAI compatible API under /v1, so that
+// OpenAI clients can be pointed at this server. Requests are forwarded to the
+// configured provider with the bearer token they carry, and every chat
+// completion is logged in a conversation along with the tokens it used.
+func RegisterOpenAIHandlers(e *echo.Echo) {
+	v1 := e.Group("/v1")
+	v1.Use(openAIErrors)
+	v1.Use(middleware.AuthChecker)
+	v1.GET("/models", listModelsHandler)
+	v1.POST("/chat/completions", chatCompletionsHandler)
+}
+
+// openAIErrors sends errors in the shape OpenAI clients expect rather than
+// as an Error.
+func openAIErrors(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		if err == nil || c.Response().Committed {
+			return err
+		}
+		c.Logger().Error(err)
+		apiErr := apiError(err)
+		errorType := "invalid_request_error"
+		if apiErr.Status >= http.StatusInternalServerError {
+			errorType = "server_error"
+		}
+		return c.JSON(int(apiErr.Status), map[string]any{
+			"error": map[string]any{
+				"message": apiErr.Message,
+				"type":    errorType,
+				"code":    strings.ToLower(apiErr.Code.String()),
+			},
+		})
+	}
+}
+
+func listModelsHandler(c echo.Context) error {
+	token := c.Get(config.OPEN_AI_TOKEN_KEY).(string)
+	resp, err := chatgpt.Forward(c.Request().Context(), http.MethodGet, "/models", token, c.Request().Header, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadGateway, fmt.Errorf("unable to list models: %w", err).Error())
+	}
+	defer resp.Body.Close()
+	return c.Stream(resp.StatusCode, resp.Header.Get(echo.HeaderContentType), resp.Body)
+}
+
+// completionRequest is the part of a chat completion request that is read
+// before it is forwarded. The request is forwarded with every other field as
+// it was sent.
+type completionRequest struct {
+	Model    string              `json:"model"`
+	Messages []completionMessage `json:"messages"`
+	Stream   bool                `json:"stream"`
+}
+
+type completionMessage struct {
+	Role string `json:"role"`
+	// Either a string or a list of content parts.
+	Content json.RawMessage `json:"content"`
+}
+
+// completionChunk is the part of a streamed chat completion chunk that is
+// read to log the reply.
+type completionChunk struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Index int `json:"index"`
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *struct {
+		TotalTokens int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+// chatCompletionsHandler forwards a chat completion to the provider and logs
+// the exchange in a conversation: the last message of the request as a user
+// message, and the first choice of the completion as the reply to it. The
+// earlier messages of the request are the client's own context and are not
+// logged again. Requests that do not end in a user message with text, e.g.
+// ones that send back the result of a tool call, are forwarded without being
+// logged.
+func chatCompletionsHandler(c echo.Context) error {
+	token := c.Get(config.OPEN_AI_TOKEN_KEY).(string)
+	db := c.Get(config.DB_KEY).(*database.DB)
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unable to read body: %w", err).Error())
+	}
+	request := completionRequest{}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unable to parse request: %w", err).Error())
+	}
+	body, usageAdded, err := completionBody(body, request)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unable to parse request: %w", err).Error())
+	}
+
+	var message *chat.Message
+	if prompt := lastUserMessage(request.Messages); prompt != "" {
+		conversation, err := openAIConversation(c, db, prompt)
+		if err != nil {
+			return err
+		}
+		c.Response().Header().Set(conversationIdHeader, strconv.FormatInt(conversation.Id, 10))
+		if message, err = db.CreatePendingMessage(prompt, conversation.Id); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to create message: %w", err).Error())
+		}
+		publishUserMessage(message, nil)
+	}
+
+	resp, err := chatgpt.Forward(c.Request().Context(), http.MethodPost, "/chat/completions", token, c.Request().Header, body)
+	if err != nil {
+		failOpenAIMessage(c.Logger(), db, message)
+		return echo.NewHTTPError(http.StatusBadGateway, fmt.Errorf("unable to ask for a completion: %w", err).Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Errors from the provider are already in the shape clients expect.
+		failOpenAIMessage(c.Logger(), db, message)
+		return c.Stream(resp.StatusCode, resp.Header.Get(echo.HeaderContentType), resp.Body)
+	}
+	if request.Stream {
+		return streamCompletion(c, db, message, resp, usageAdded)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		failOpenAIMessage(c.Logger(), db, message)
+		return echo.NewHTTPError(http.StatusBadGateway, fmt.Errorf("unable to read completion: %w", err).Error())
+	}
+	if message != nil {
+		completion := chatgpt.ChatResponse{}
+		if err := json.Unmarshal(data, &completion); err != nil || len(completion.Choices) == 0 {
+			c.Logger().Error(fmt.Errorf("unable to log completion for message %d: %v", message.Id, err))
+			failTurn(c.Logger(), db, message, nil)
+		} else {
+			storeOpenAIReply(c.Logger(), db, message, completion.Choices[0].Message.Content, completion.Usage.TotalTokens, completion.Model)
+		}
+	}
+	return c.Blob(resp.StatusCode, resp.Header.Get(echo.HeaderContentType), data)
+}
+
+// streamCompletion relays a streamed completion to the client as it arrives,
+// and logs the reply to message once the stream is done, if there is one.
+// When usageAdded is set the client did not ask for usage, and the chunk that
+// carries it alone is not relayed.
+func streamCompletion(c echo.Context, db *database.DB, message *chat.Message, resp *http.Response, usageAdded bool) error {
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, resp.Header.Get(echo.HeaderContentType))
+	header.Set(echo.HeaderCacheControl, "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	c.Response().WriteHeader(http.StatusOK)
+
+	var reply strings.Builder
+	var model string
+	tokens, done := 0, false
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	// Whether the event being read is not relayed, in which case neither is
+	// the blank line that ends it.
+	skipped := false
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			if !skipped {
+				if _, err := fmt.Fprintln(c.Response()); err != nil {
+					c.Logger().Error(err)
+					break
+				}
+				c.Response().Flush()
+			}
+			skipped = false
+			continue
+		}
+		if data, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			data = bytes.TrimSpace(data)
+			chunk := completionChunk{}
+			if string(data) == "[DONE]" {
+				done = true
+			} else if err := json.Unmarshal(data, &chunk); err == nil {
+				if chunk.Model != "" {
+					model = chunk.Model
+				}
+				for _, choice := range chunk.Choices {
+					if choice.Index == 0 {
+						reply.WriteString(choice.Delta.Content)
+					}
+				}
+				if chunk.Usage != nil {
+					tokens = chunk.Usage.TotalTokens
+					skipped = usageAdded && len(chunk.Choices) == 0
+				}
+			}
+		}
+		if skipped {
+			continue
+		}
+		if _, err := fmt.Fprintf(c.Response(), "%s\n", line); err != nil {
+			c.Logger().Error(err)
+			break
+		}
+	}
+	c.Response().Flush()
+	if err := scanner.Err(); err != nil {
+		c.Logger().Error(fmt.Errorf("unable to read completion stream: %w", err))
+	}
+	if !done {
+		failOpenAIMessage(c.Logger(), db, message)
+		return nil
+	}
+	if message != nil {
+		storeOpenAIReply(c.Logger(), db, message, reply.String(), tokens, model)
+	}
+	return nil
+}
+
+// storeOpenAIReply stores the reply to message from a completion, along with
+// the model that wrote it and the tokens it used, marks message COMPLETE and
+// tells the clients of its conversation, like a chat turn does.
+func storeOpenAIReply(logger echo.Logger, db *database.DB, message *chat.Message, reply string, tokens int, model string) {
+	var stored *chat.Message
+	err := db.WithTx(func(tx *database.DB) (err error) {
+		if stored, err = tx.CreateReply(reply, message.ConversationId, message.Id, tokens, model); err != nil {
+			return err
+		}
+		return tx.SetMessageStatus(message.Id, chat.Message_COMPLETE)
+	})
+	if err != nil {
+		logger.Error(fmt.Errorf("unable to store reply to message %d: %w", message.Id, err))
+		failTurn(logger, db, message, nil)
+		return
+	}
+	message.Status = chat.Message_COMPLETE
+	publishUserMessage(message, nil)
+	hubs.publish(message.ConversationId, &chat.ChatEvent{
+		Type: chat.ChatEvent_MESSAGE,
+		Event: &chat.ChatEvent_Message{
+			Message: &chat.MessageEvent{Body: reply, MessageId: stored.Id},
+		},
+	}, nil)
+}
+
+// failOpenAIMessage leaves message FAILED, if there is one, see failTurn.
+func failOpenAIMessage(logger echo.Logger, db *database.DB, message *chat.Message) {
+	if message != nil {
+		failTurn(logger, db, message, nil)
+	}
+}
+
+// openAIConversation returns the conversation named by the X-Conversation-Id
+// header, or creates one titled after the prompt when it is not sent.
+func openAIConversation(c echo.Context, db *database.DB, prompt string) (*chat.Conversation, error) {
+	if param := c.Request().Header.Get(conversationIdHeader); param != "" {
+		id, err := strconv.Atoi(param)
+		if err != nil {
+			return nil, invalidField(conversationIdHeader, fmt.Errorf("invalid %s [%s]: %w", conversationIdHeader, param, err).Error())
+		}
+		conversation, err := db.GetConversation(id)
+		if err != nil {
+			return nil, databaseError(err, fmt.Sprintf("unable to get conversation with id [%d]", id))
+		}
+		return conversation, nil
+	}
+
+	title, _, _ := strings.Cut(strings.TrimSpace(prompt), "\n")
+	if runes := []rune(title); len(runes) > maxOpenAITitleLength {
+		title = strings.TrimSpace(string(runes[:maxOpenAITitleLength])) + "…"
+	}
+	conversation, err := db.CreateConversationWithFreeTitle(title, 0, []string{openAITag})
+	if err != nil {
+		return nil, databaseError(err, "unable to create conversation")
+	}
+	return conversation, nil
+}
+
+// lastUserMessage returns the text of the last message of a completion
+// request if it is from the user, or an empty string.
+func lastUserMessage(messages []completionMessage) string {
+	if len(messages) == 0 || messages[len(messages)-1].Role != "user" {
+		return ""
+	}
+	content := messages[len(messages)-1].Content
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return text
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return ""
+	}
+	texts := []string{}
+	for _, part := range parts {
+		if part.Type == "text" && part.Text != "" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// completionBody returns the body of a completion request as it is forwarded:
+// as it was sent, with the default model when it names none, and asking for
+// usage at the end of a stream so that the tokens of streamed replies are
+// logged too. It reports whether usage was asked for on the client's behalf.
+func completionBody(body []byte, request completionRequest) ([]byte, bool, error) {
+	if request.Model != "" && !request.Stream {
+		return body, false, nil
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, false, err
+	}
+	if request.Model == "" {
+		model, err := json.Marshal(chatgpt.Model(nil))
+		if err != nil {
+			return nil, false, err
+		}
+		fields["model"] = model
+	}
+	usageAdded := false
+	if request.Stream {
+		options := map[string]json.RawMessage{}
+		if raw, ok := fields["stream_options"]; ok && string(raw) != "null" {
+			if err := json.Unmarshal(raw, &options); err != nil {
+				return nil, false, fmt.Errorf("invalid stream_options: %w", err)
+			}
+		}
+		if includeUsage, ok := options["include_usage"]; !ok || string(includeUsage) != "true" {
+			options["include_usage"] = json.RawMessage("true")
+			usageAdded = true
+			raw, err := json.Marshal(options)
+			if err != nil {
+				return nil, false, err
+			}
+			fields["stream_options"] = raw
+		}
+	}
+	body, err := json.Marshal(fields)
+	return body, usageAdded, err
+}
@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/timsexperiments/chat-cli/internal/chatgpt"
+	"github.com/timsexperiments/chat-cli/internal/database"
+)
+
+func TestCompletionBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		want       string
+		usageAdded bool
+		err        bool
+	}{
+		{"model named", `{"model": "m", "messages": []}`, `{"model": "m", "messages": []}`, false, false},
+		{"default model", `{"messages": []}`, fmt.Sprintf(`{"messages": [], "model": %q}`, chatgpt.Model(nil)), false, false},
+		{"stream", `{"model": "m", "stream": true}`, `{"model": "m", "stream": true, "stream_options": {"include_usage": true}}`, true, false},
+		{"stream with usage", `{"model": "m", "stream": true, "stream_options": {"include_usage": true}}`, `{"model": "m", "stream": true, "stream_options": {"include_usage": true}}`, false, false},
+		{"stream without usage", `{"model": "m", "stream": true, "stream_options": {"include_usage": false}}`, `{"model": "m", "stream": true, "stream_options": {"include_usage": true}}`, true, false},
+		{"stream with other options", `{"model": "m", "stream": true, "stream_options": {"other": 1}}`, `{"model": "m", "stream": true, "stream_options": {"other": 1, "include_usage": true}}`, true, false},
+		{"stream with null options", `{"model": "m", "stream": true, "stream_options": null}`, `{"model": "m", "stream": true, "stream_options": {"include_usage": true}}`, true, false},
+		{"stream with invalid options", `{"model": "m", "stream": true, "stream_options": 1}`, "", false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := completionRequest{}
+			if err := json.Unmarshal([]byte(test.body), &request); err != nil {
+				t.Fatal(err)
+			}
+			body, usageAdded, err := completionBody([]byte(test.body), request)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", body)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want any
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(test.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) || usageAdded != test.usageAdded {
+				t.Fatalf("expected %s with usageAdded %t, got %s with %t", test.want, test.usageAdded, body, usageAdded)
+			}
+		})
+	}
+}
+
+// The stream sent by the fake model: two chunks of the reply, then the chunk
+// that only carries usage.
+const completionStream = `data: {"model":"m","choices":[{"index":0,"delta":{"content":"Hel"}}],"usage":null}
+
+data: {"model":"m","choices":[{"index":0,"delta":{"content":"lo"}}],"usage":null}
+
+data: {"model":"m","choices":[],"usage":{"total_tokens":7}}
+
+data: [DONE]
+
+`
+
+func TestStreamedCompletionUsage(t *testing.T) {
+	e, db := newTestServer(t)
+	fakeModel(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, completionStream)
+	})
+
+	tests := []struct {
+		name   string
+		body   string
+		stream string
+	}{
+		{
+			"usage asked for",
+			`{"model": "m", "stream": true, "stream_options": {"include_usage": true}, "messages": [{"role": "user", "content": "Say hello"}]}`,
+			completionStream,
+		},
+		{
+			"usage not asked for",
+			`{"model": "m", "stream": true, "messages": [{"role": "user", "content": "Say hi"}]}`,
+			strings.Replace(completionStream, "data: {\"model\":\"m\",\"choices\":[],\"usage\":{\"total_tokens\":7}}\n\n", "", 1),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := serve(e, http.MethodPost, "/v1/chat/completions", test.body)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+			}
+			if rec.Body.String() != test.stream {
+				t.Fatalf("expected the stream\n%s\ngot\n%s", test.stream, rec.Body)
+			}
+
+			var id int
+			fmt.Sscan(rec.Header().Get(conversationIdHeader), &id)
+			conversation, err := db.GetConversation(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(conversation.Messages) != 2 || conversation.Messages[0].Body != "Hello" {
+				t.Fatalf("expected the reply to be logged, got %v", conversation.Messages)
+			}
+			summaries, err := db.ListConversations(database.ConversationFilter{Tags: []string{openAITag}, Title: conversation.Title}, database.ConversationOrder{}, 1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(summaries) != 1 || summaries[0].TotalTokens != 7 {
+				t.Fatalf("expected the usage of the reply to be logged, got %v", summaries)
+			}
+		})
+	}
+}
+
+func TestProxiedExchangeEvents(t *testing.T) {
+	e, db := newTestServer(t)
+	tests := []struct {
+		name   string
+		answer http.HandlerFunc
+		// The events about the exchange that a client of the conversation is
+		// sent.
+		events []string
+	}{
+		{"replied", reply("chatcmpl-proxied"), []string{"USER_MESSAGE PENDING", "USER_MESSAGE COMPLETE", "MESSAGE"}},
+		{"failed", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		}, []string{"USER_MESSAGE PENDING", "USER_MESSAGE FAILED"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeModel(t, test.answer)
+			conversation, err := db.CreateConversation(test.name, 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			watcher := joinHub(t, conversation.Id, "bob", websocket.BinaryMessage, "", "", 0)
+			events := hubEvents(t, watcher)
+			serve(e, http.MethodPost, "/v1/chat/completions", `{"model": "m", "messages": [{"role": "user", "content": "hi"}]}`, conversationIdHeader, fmt.Sprint(conversation.Id))
+			hubs.leave(watcher)
+			if got := describeTurnEvents(events()); fmt.Sprint(got) != fmt.Sprint(test.events) {
+				t.Fatalf("expected the client to be sent %v, got %v", test.events, got)
+			}
+		})
+	}
+}
+
+func TestProxiedConversationTitles(t *testing.T) {
+	e, db := newTestServer(t)
+	fakeModel(t, reply("chatcmpl-titled"))
+	for _, want := range []string{"Name a color", "Name a color (2)", "Name a color (3)"} {
+		rec := serve(e, http.MethodPost, "/v1/chat/completions", `{"model": "m", "messages": [{"role": "user", "content": "Name a color\nany color"}]}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+		}
+		var id int
+		fmt.Sscan(rec.Header().Get(conversationIdHeader), &id)
+		conversation, err := db.GetConversation(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conversation.Title != want {
+			t.Fatalf("expected the conversation to be titled %q, got %q", want, conversation.Title)
+		}
+	}
+}
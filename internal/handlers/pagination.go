@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The most items that can be asked for in one page.
+const maxPageSize = 1000
+
+// pageToken is where the next page of a listing starts. It is handed to
+// clients base64 encoded and is only valid for the query it came from.
+type pageToken struct {
+	Offset int    `json:"offset"`
+	Query  string `json:"query"`
+}
+
+// pageParams reads the page_size and page_token query parameters. A size of 0
+// means every remaining item.
+func pageParams(c echo.Context) (size, offset int, err error) {
+	return pageValues(c.QueryParams())
+}
+
+// pageValues reads the page_size and page_token parameters from params.
+func pageValues(params url.Values) (size, offset int, err error) {
+	if param := params.Get("page_size"); param != "" {
+		size, err = strconv.Atoi(param)
+		if err != nil || size < 0 || size > maxPageSize {
+			return 0, 0, invalidField("page_size", fmt.Sprintf("page_size must be between 0 and %d, got [%s]", maxPageSize, param))
+		}
+	}
+	param := params.Get("page_token")
+	if param == "" {
+		return size, 0, nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(param)
+	if err != nil {
+		return 0, 0, invalidField("page_token", "invalid page_token")
+	}
+	token := pageToken{}
+	if err := json.Unmarshal(decoded, &token); err != nil || token.Offset < 0 {
+		return 0, 0, invalidField("page_token", "invalid page_token")
+	}
+	if token.Query != queryFingerprint(params) {
+		return 0, 0, invalidField("page_token", "page_token does not match the other query parameters")
+	}
+	return size, token.Offset, nil
+}
+
+// nextPageToken returns the token for the page starting at offset.
+func nextPageToken(c echo.Context, offset int) string {
+	return pageTokenFor(c.QueryParams(), offset)
+}
+
+// pageTokenFor returns the token for the page starting at offset of the
+// listing asked for with params.
+func pageTokenFor(params url.Values, offset int) string {
+	encoded, _ := json.Marshal(pageToken{Offset: offset, Query: queryFingerprint(params)})
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// queryFingerprint identifies a listing by its query parameters, leaving out
+// the ones that only move between pages.
+func queryFingerprint(params url.Values) string {
+	query := url.Values{}
+	for key, values := range params {
+		if key != "page_size" && key != "page_token" {
+			query[key] = values
+		}
+	}
+	// Encode sorts by key, so the same parameters always give the same hash.
+	sum := sha256.Sum256([]byte(query.Encode()))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/middleware"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"github.com/timsexperiments/chat-cli/internal/response"
+)
+
+func RegisterPinHandlers(e *echo.Echo) {
+	pins := e.Group("/pins")
+	pins.Use(middleware.ProtobufHeader)
+	pins.GET("", listPinsHandler)
+}
+
+func listPinsHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	var conversationId int64
+	if conversation := c.QueryParam("conversation"); conversation != "" {
+		var err error
+		if conversationId, err = strconv.ParseInt(conversation, 10, 64); err != nil {
+			return invalidField("conversation", fmt.Errorf("invalid conversation value [%s]: %w", conversation, err).Error())
+		}
+	}
+	pins, err := db.ListPins(conversationId)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to list pins: %w", err).Error())
+	}
+	return response.Protobuf(c, http.StatusOK, &chat.ListPinsResponse{Pins: pins})
+}
+
+func pinMessageHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	message, err := conversationMessage(c, db)
+	if err != nil {
+		return err
+	}
+	request := &chat.PinMessageRequest{}
+	if body, ok := c.Get(config.BODY_KEY).([]byte); ok {
+		if err := unmarshalBody(c, body, request); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unable to parse request: %w", err).Error())
+		}
+	}
+	if err := db.PinMessage(message.Id, request.Note, request.IncludeInContext); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to pin message: %w", err).Error())
+	}
+	pin, err := db.GetPin(message.Id)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to get pin: %w", err).Error())
+	}
+	return response.Protobuf(c, http.StatusOK, pin)
+}
+
+func unpinMessageHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	message, err := conversationMessage(c, db)
+	if err != nil {
+		return err
+	}
+	if err := db.UnpinMessage(message.Id); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to unpin message: %w", err).Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// conversationMessage returns the message named by the messageId path
+// parameter, as long as it belongs to the conversation named by the id path
+// parameter and is not in the trash.
+func conversationMessage(c echo.Context, db *database.DB) (*chat.Message, error) {
+	conversationId, err := intParam(c, "id")
+	if err != nil {
+		return nil, err
+	}
+	messageId, err := intParam(c, "messageId")
+	if err != nil {
+		return nil, err
+	}
+	message, err := db.GetMessage(messageId)
+	if err != nil {
+		c.Logger().Error(err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to get message %d: %w", messageId, err).Error())
+	}
+	if message == nil || message.ConversationId != int64(conversationId) || message.DeletedAt != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("message %d not found in conversation %d", messageId, conversationId))
+	}
+	return message, nil
+}
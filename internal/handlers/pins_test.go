@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/timsexperiments/chat-cli/internal/codec"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+)
+
+func TestPinMessage(t *testing.T) {
+	e, db := newTestServer(t)
+	conversation, err := db.CreateConversation("Pins", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := db.CreateMessage("first", chat.Message_USER, conversation.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := db.CreateMessage("second", chat.Message_USER, conversation.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PinMessage(first.Id, "older pin", false); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		messageId int64
+		body      string
+		code      int
+		note      string
+		inContext bool
+	}{
+		{"new pin", second.Id, `{"note": "keep", "includeInContext": true}`, http.StatusOK, "keep", true},
+		{"updated pin", first.Id, `{"note": "changed"}`, http.StatusOK, "changed", false},
+		{"without a body", second.Id, "", http.StatusOK, "", false},
+		{"missing message", 404, "", http.StatusNotFound, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := fmt.Sprintf("/conversations/%d/messages/%d/pin", conversation.Id, test.messageId)
+			rec := serve(e, http.MethodPut, target, test.body)
+			if rec.Code != test.code {
+				t.Fatalf("expected %d, got %d: %s", test.code, rec.Code, rec.Body)
+			}
+			if test.code != http.StatusOK {
+				return
+			}
+			pin := &chat.Pin{}
+			if err := codec.Unmarshal(codec.JSON, rec.Body.Bytes(), pin); err != nil {
+				t.Fatal(err)
+			}
+			if pin.MessageId != test.messageId || pin.Message.GetId() != test.messageId {
+				t.Fatalf("expected the pin of message %d, got %v", test.messageId, pin)
+			}
+			if pin.Note != test.note || pin.IncludeInContext != test.inContext {
+				t.Fatalf("expected note %q and include_in_context %t, got %v", test.note, test.inContext, pin)
+			}
+		})
+	}
+}
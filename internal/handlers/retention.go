@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/proto/admin"
+	"github.com/timsexperiments/chat-cli/internal/response"
+	"github.com/timsexperiments/chat-cli/internal/retention"
+)
+
+// The number of audit entries returned when no limit is given.
+const defaultAuditLimit = 100
+
+func runRetentionHandler(worker *retention.Worker) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		run, err := worker.Run(c.Request().Context())
+		if err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to run retention: %w", err).Error())
+		}
+		return response.Protobuf(c, http.StatusOK, run)
+	}
+}
+
+func listRetentionAuditHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	limit := defaultAuditLimit
+	if param := c.QueryParam("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit < 1 {
+			return invalidField("limit", fmt.Sprintf("invalid limit [%s]", param))
+		}
+	}
+	entries, err := db.ListRetentionAudit(limit)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to list retention audit log: %w", err).Error())
+	}
+	return response.Protobuf(c, http.StatusOK, &admin.ListRetentionAuditResponse{Entries: entries})
+}
+
+func listRetentionPoliciesHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	policies, err := db.ListRetentionPolicies()
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to list retention policies: %w", err).Error())
+	}
+	return response.Protobuf(c, http.StatusOK, &admin.ListRetentionPoliciesResponse{Policies: policies})
+}
+
+func setConversationRetentionPolicyHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+	if _, err := db.GetConversation(id); err != nil {
+		return databaseError(err, fmt.Sprintf("unable to get conversation %d", id))
+	}
+	return setRetentionPolicy(c, db, int64(id), 0)
+}
+
+func setTagRetentionPolicyHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+	if err := checkTagExists(db, id); err != nil {
+		return err
+	}
+	return setRetentionPolicy(c, db, 0, int64(id))
+}
+
+func setRetentionPolicy(c echo.Context, db *database.DB, conversationId, tagId int64) error {
+	request := &admin.SetRetentionPolicyRequest{}
+	if body, ok := c.Get(config.BODY_KEY).([]byte); ok {
+		if err := unmarshalBody(c, body, request); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unable to parse request: %w", err).Error())
+		}
+	}
+	var maxAge *time.Duration
+	if request.MaxAge != nil {
+		if err := request.MaxAge.CheckValid(); err != nil {
+			return invalidField("max_age", fmt.Errorf("invalid max_age: %w", err).Error())
+		}
+		duration := request.MaxAge.AsDuration()
+		if duration < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "max_age must not be negative")
+		}
+		maxAge = &duration
+	}
+	policy, err := db.SetRetentionPolicy(conversationId, tagId, maxAge, request.LegalHold)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to set retention policy: %w", err).Error())
+	}
+	return response.Protobuf(c, http.StatusOK, policy)
+}
+
+func deleteRetentionPolicyHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+	policy, err := db.GetRetentionPolicy(id)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to get retention policy %d: %w", id, err).Error())
+	}
+	if policy == nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("retention policy %d does not exist", id))
+	}
+	if err := db.DeleteRetentionPolicy(id); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to delete retention policy: %w", err).Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
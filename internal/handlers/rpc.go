@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat/chatconnect"
+)
+
+// RegisterChatService serves ChatService over Connect, gRPC and gRPC-Web next
+// to the REST routes. gRPC needs HTTP/2, so the server has to accept HTTP/2
+// without TLS for plain gRPC clients to reach it.
+func RegisterChatService(e *echo.Echo) {
+	path, handler := chatconnect.NewChatServiceHandler(&chatService{})
+	e.Any(path+"*", func(c echo.Context) error {
+		// The echo context carries the database and logger set up for the
+		// request by the middleware, which the service reads back out.
+		ctx := context.WithValue(c.Request().Context(), echoContextKey{}, c)
+		handler.ServeHTTP(c.Response(), c.Request().WithContext(ctx))
+		return nil
+	})
+}
+
+type echoContextKey struct{}
+
+// chatService implements ChatService on top of the same handlers as the REST
+// routes and the WebSocket.
+type chatService struct {
+	chatconnect.UnimplementedChatServiceHandler
+}
+
+func (s *chatService) CreateConversation(ctx context.Context, request *connect.Request[chat.CreateConversationRequest]) (*connect.Response[chat.Conversation], error) {
+	c := rpcContext(ctx)
+	conversation, err := createConversation(c.Logger(), rpcDB(c), request.Msg)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return connect.NewResponse(conversation), nil
+}
+
+func (s *chatService) ListConversations(ctx context.Context, request *connect.Request[chat.ListConversationsRequest]) (*connect.Response[chat.ListConversationsResponse], error) {
+	c := rpcContext(ctx)
+	conversations, err := listConversations(c.Logger(), rpcDB(c), listConversationsParams(request.Msg))
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return connect.NewResponse(conversations), nil
+}
+
+func (s *chatService) GetConversation(ctx context.Context, request *connect.Request[chat.GetConversationRequest]) (*connect.Response[chat.Conversation], error) {
+	if _, err := rpcToken(request.Header()); err != nil {
+		return nil, err
+	}
+	c := rpcContext(ctx)
+	conversation, err := rpcDB(c).GetConversation(int(request.Msg.Id))
+	if err != nil {
+		return nil, rpcError(databaseError(err, fmt.Sprintf("unable to get conversation with id [%d]", request.Msg.Id)))
+	}
+	return connect.NewResponse(conversation), nil
+}
+
+func (s *chatService) CreateMessage(ctx context.Context, request *connect.Request[chat.CreateMessageRequest]) (*connect.Response[chat.Message], error) {
+	if _, err := rpcToken(request.Header()); err != nil {
+		return nil, err
+	}
+	c := rpcContext(ctx)
+	db := rpcDB(c)
+	if request.Msg.Body == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("message body must not be empty"))
+	}
+	if _, err := db.GetConversation(int(request.Msg.ConversationId)); err != nil {
+		return nil, rpcError(databaseError(err, fmt.Sprintf("unable to get conversation with id [%d]", request.Msg.ConversationId)))
+	}
+	message, err := db.CreateMessage(request.Msg.Body, chat.Message_USER, request.Msg.ConversationId)
+	if err != nil {
+		c.Logger().Error(err)
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("unable to create message: %w", err))
+	}
+	publishUserMessage(message, nil)
+	return connect.NewResponse(message), nil
+}
+
+// Chat joins the stream to the clients of its conversation once its first
+// request says which conversation that is, so that, like a WebSocket, it is
+// sent the events of the conversation along with the answers to its own
+// requests. Streams start a new session every time; they cannot resume one.
+func (s *chatService) Chat(ctx context.Context, stream *connect.BidiStream[chat.ChatRequest, chat.ChatEvent]) error {
+	token, err := rpcToken(stream.RequestHeader())
+	if err != nil {
+		return err
+	}
+	c := rpcContext(ctx)
+	db := rpcDB(c)
+	var conversation *chat.Conversation
+	var client *hubClient
+	sent := make(chan struct{})
+	defer func() {
+		if client != nil {
+			hubs.leave(client)
+			<-sent
+		}
+	}()
+	for {
+		request, err := stream.Receive()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if conversation == nil {
+			if conversation, err = db.GetConversation(int(request.ConversationId)); err != nil {
+				return rpcError(databaseError(err, fmt.Sprintf("unable to get conversation with id [%d]", request.ConversationId)))
+			}
+			if client, err = hubs.join(conversation.Id, db.Actor().Name, websocket.BinaryMessage, "", "", 0); err != nil {
+				c.Logger().Error(err)
+				return connect.NewError(connect.CodeInternal, fmt.Errorf("unable to join conversation %d: %w", conversation.Id, err))
+			}
+			go sendHubEvents(c.Logger(), stream, client, sent)
+		} else if request.ConversationId != 0 && request.ConversationId != conversation.Id {
+			return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("stream is chatting in conversation %d, got a request for conversation %d", conversation.Id, request.ConversationId))
+		}
+		event := request.Event
+		if event == nil {
+			event = &chat.MessageEvent{}
+		}
+		var chatEvent *chat.ChatEvent
+		conversation, chatEvent = handleChatEvent(c.Logger(), db, conversation, event, token, client)
+		setRequestId(chatEvent, c.Response().Header().Get(echo.HeaderXRequestID))
+		// Replies from the bot were already sent to every client of the
+		// conversation, this stream included.
+		if chatEvent.Seq == 0 && !hubs.reply(client, chatEvent) {
+			return nil
+		}
+	}
+}
+
+// sendHubEvents sends the events queued for client on stream until its queue
+// is closed, and then closes sent. A stream can only be sent on by one
+// goroutine at a time, so every event for it goes through the queue.
+func sendHubEvents(logger echo.Logger, stream *connect.BidiStream[chat.ChatRequest, chat.ChatEvent], client *hubClient, sent chan<- struct{}) {
+	defer close(sent)
+	for queued := range client.send {
+		if err := stream.Send(queued.event); err != nil {
+			logger.Error(err)
+			hubs.leave(client)
+			return
+		}
+	}
+}
+
+func rpcContext(ctx context.Context) echo.Context {
+	return ctx.Value(echoContextKey{}).(echo.Context)
+}
+
+func rpcDB(c echo.Context) *database.DB {
+	return c.Get(config.DB_KEY).(*database.DB)
+}
+
+// rpcToken returns the OpenAI token sent as a bearer token with a call.
+func rpcToken(header http.Header) (string, error) {
+	token := strings.TrimPrefix(header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return "", connect.NewError(connect.CodeUnauthenticated, fmt.Errorf("missing open api token"))
+	}
+	return token, nil
+}
+
+// listConversationsParams turns request into the query parameters of the
+// REST route, so that both list conversations, and page through them, the
+// same way.
+func listConversationsParams(request *chat.ListConversationsRequest) url.Values {
+	params := url.Values{}
+	for _, tag := range request.Tags {
+		params.Add("tag", tag)
+	}
+	if request.Title != "" {
+		params.Set("title", request.Title)
+	}
+	if request.IncludeArchived {
+		params.Set("archived", "true")
+	}
+	if request.FolderId != 0 {
+		params.Set("folder", strconv.FormatInt(request.FolderId, 10))
+	}
+	if request.CreatedAfter != nil {
+		params.Set("created_after", request.CreatedAfter.AsTime().Format(time.RFC3339))
+	}
+	if request.CreatedBefore != nil {
+		params.Set("created_before", request.CreatedBefore.AsTime().Format(time.RFC3339))
+	}
+	if request.Sort != chat.ListConversationsRequest_SORT_UNSPECIFIED {
+		params.Set("sort", strings.ToLower(request.Sort.String()))
+	}
+	if request.Descending {
+		params.Set("order", "desc")
+	}
+	if request.PageSize != 0 {
+		params.Set("page_size", strconv.Itoa(int(request.PageSize)))
+	}
+	if request.PageToken != "" {
+		params.Set("page_token", request.PageToken)
+	}
+	return params
+}
+
+// rpcError turns an error from the handlers shared with the REST routes into
+// the RPC error with the code closest to its HTTP status. The Error the REST
+// routes would send is attached as a detail.
+func rpcError(err error) error {
+	apiErr := apiError(err)
+	rpcErr := connect.NewError(rpcCode(int(apiErr.Status)), errors.New(apiErr.Message))
+	if detail, err := connect.NewErrorDetail(apiErr); err == nil {
+		rpcErr.AddDetail(detail)
+	}
+	return rpcErr
+}
+
+func rpcCode(status int) connect.Code {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnsupportedMediaType:
+		return connect.CodeInvalidArgument
+	case http.StatusUnauthorized:
+		return connect.CodeUnauthenticated
+	case http.StatusForbidden:
+		return connect.CodePermissionDenied
+	case http.StatusNotFound:
+		return connect.CodeNotFound
+	case http.StatusConflict:
+		return connect.CodeAlreadyExists
+	case http.StatusPreconditionFailed:
+		return connect.CodeFailedPrecondition
+	case http.StatusTooManyRequests:
+		return connect.CodeResourceExhausted
+	case http.StatusServiceUnavailable:
+		return connect.CodeUnavailable
+	}
+	return connect.CodeInternal
+}
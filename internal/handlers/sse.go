@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/codec"
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+)
+
+// How often a comment is sent on a stream of server-sent events while the
+// bot is replying, so that proxies do not close it as idle.
+const sseKeepaliveInterval = 15 * time.Second
+
+// chatStreamHandler chats in a conversation for clients that cannot open the
+// conversation WebSocket, e.g. behind proxies that break the upgrade. It takes
+// a MessageEvent, like the WebSocket does, and answers with a stream of
+// server-sent events carrying the ChatEvents the WebSocket would send back,
+// encoded as JSON. The stream ends once the event is handled.
+func chatStreamHandler(c echo.Context) error {
+	token, db, conversation, err := chatConversation(c)
+	if err != nil {
+		return err
+	}
+	body, ok := c.Get(config.BODY_KEY).([]byte)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing body")
+	}
+	event := &chat.MessageEvent{}
+	if err := unmarshalBody(c, body, event); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unable to parse message: %w", err).Error())
+	}
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, "text/event-stream")
+	header.Set(echo.HeaderCacheControl, "no-cache")
+	// Stops nginx from buffering the stream until it ends.
+	header.Set("X-Accel-Buffering", "no")
+	c.Response().WriteHeader(http.StatusOK)
+	c.Response().Flush()
+
+	// The turn is not tied to the request, so it is stored even if the client
+	// goes away while the bot is replying, as it is over the WebSocket.
+	logger := c.Logger()
+	events := make(chan *chat.ChatEvent, 1)
+	go func() {
+		_, chatEvent := handleChatEvent(logger, db, conversation, event, token, nil)
+		events <- chatEvent
+	}()
+
+	keepalive := time.NewTicker(sseKeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case chatEvent := <-events:
+			setRequestId(chatEvent, c.Response().Header().Get(echo.HeaderXRequestID))
+			if err := writeServerSentEvent(c.Response(), chatEvent); err != nil {
+				logger.Error(err)
+			}
+			return nil
+		case <-keepalive.C:
+			if _, err := c.Response().Write([]byte(": keepalive\n\n")); err != nil {
+				logger.Error(err)
+				return nil
+			}
+			c.Response().Flush()
+		case <-c.Request().Context().Done():
+			return nil
+		}
+	}
+}
+
+// writeServerSentEvent sends event as a server-sent event named after its
+// type, e.g. "message" or "error", with the event as JSON for its data.
+func writeServerSentEvent(w *echo.Response, event *chat.ChatEvent) error {
+	data, err := codec.Marshal(codec.JSON, event)
+	if err != nil {
+		return fmt.Errorf("unable to serialize chat event: %w", err)
+	}
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "event: %s\n", strings.ToLower(event.Type.String()))
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		fmt.Fprintf(&out, "data: %s\n", line)
+	}
+	out.WriteByte('\n')
+	if _, err := w.Write(out.Bytes()); err != nil {
+		return fmt.Errorf("unable to send chat event: %w", err)
+	}
+	w.Flush()
+	return nil
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/middleware"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"github.com/timsexperiments/chat-cli/internal/response"
+)
+
+func RegisterTagHandlers(e *echo.Echo) {
+	tags := e.Group("/tags")
+	tags.Use(middleware.ProtobufBodyChecker)
+	tags.Use(middleware.ProtobufHeader)
+	tags.GET("", listTagsHandler)
+	tags.POST("", createTagHandler, middleware.Idempotency)
+	tags.PATCH("/:id", renameTagHandler)
+	tags.DELETE("/:id", deleteTagHandler)
+}
+
+func listTagsHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	tags, err := db.ListTags()
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to list tags: %w", err).Error())
+	}
+	return response.Protobuf(c, http.StatusOK, &chat.ListTagsResponse{Tags: tags})
+}
+
+func createTagHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	body, ok := c.Get(config.BODY_KEY).([]byte)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing body")
+	}
+	request := &chat.CreateTagRequest{}
+	if err := unmarshalBody(c, body, request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unable to parse request: %w", err).Error())
+	}
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name must not be empty")
+	}
+	tag, err := db.CreateTag(name)
+	if errors.Is(err, database.ErrDuplicateName) {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to create tag: %w", err).Error())
+	}
+	return response.Protobuf(c, http.StatusCreated, tag)
+}
+
+func renameTagHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+	body, ok := c.Get(config.BODY_KEY).([]byte)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing body")
+	}
+	request := &chat.RenameTagRequest{}
+	if err := unmarshalBody(c, body, request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unable to parse request: %w", err).Error())
+	}
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name must not be empty")
+	}
+	if err := checkTagExists(db, id); err != nil {
+		return err
+	}
+	tag, err := db.RenameTag(id, name)
+	if errors.Is(err, database.ErrDuplicateName) {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to rename tag: %w", err).Error())
+	}
+	return response.Protobuf(c, http.StatusOK, tag)
+}
+
+func deleteTagHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+	if err := checkTagExists(db, id); err != nil {
+		return err
+	}
+	if err := db.DeleteTag(id); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to delete tag: %w", err).Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func checkTagExists(db *database.DB, id int) error {
+	tag, err := db.GetTag(id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to get tag %d: %w", id, err).Error())
+	}
+	if tag == nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("tag %d does not exist", id))
+	}
+	return nil
+}
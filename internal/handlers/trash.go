@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/middleware"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"github.com/timsexperiments/chat-cli/internal/response"
+)
+
+func RegisterTrashHandlers(e *echo.Echo) {
+	trash := e.Group("/trash")
+	trash.Use(middleware.ProtobufHeader)
+	trash.GET("", listTrashHandler)
+	trash.DELETE("", emptyTrashHandler)
+}
+
+func listTrashHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	conversations, messages, err := db.ListTrash()
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to list trash: %w", err).Error())
+	}
+	return response.Protobuf(c, http.StatusOK, &chat.ListTrashResponse{Conversations: conversations, Messages: messages})
+}
+
+func emptyTrashHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	if _, _, err := db.PurgeTrash(time.Now()); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to empty trash: %w", err).Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
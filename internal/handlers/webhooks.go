@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/proto/admin"
+	"github.com/timsexperiments/chat-cli/internal/response"
+	"github.com/timsexperiments/chat-cli/internal/webhooks"
+)
+
+// The number of deliveries or dead letters returned when no limit is given.
+const defaultWebhookLogLimit = 50
+
+func runWebhooksHandler(worker *webhooks.Worker) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		run, err := worker.Run(c.Request().Context(), c.Logger())
+		if err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to send webhook deliveries: %w", err).Error())
+		}
+		return response.Protobuf(c, http.StatusOK, run)
+	}
+}
+
+func listWebhooksHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	list, err := db.ListWebhooks()
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to list webhooks: %w", err).Error())
+	}
+	return response.Protobuf(c, http.StatusOK, &admin.ListWebhooksResponse{Webhooks: list})
+}
+
+func createWebhookHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	body, ok := c.Get(config.BODY_KEY).([]byte)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing body")
+	}
+	request := &admin.CreateWebhookRequest{}
+	if err := unmarshalBody(c, body, request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unable to parse request: %w", err).Error())
+	}
+	target, err := webhookURL(request.Url)
+	if err != nil {
+		return err
+	}
+	eventTypes, err := webhookEventTypes(request.EventTypes)
+	if err != nil {
+		return err
+	}
+	secret := request.Secret
+	if secret == "" {
+		if secret, err = webhookSecret(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+	webhook, err := db.CreateWebhook(target, eventTypes, secret)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to create webhook: %w", err).Error())
+	}
+	return response.Protobuf(c, http.StatusCreated, webhook)
+}
+
+func getWebhookHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	webhook, err := webhookParam(c, db)
+	if err != nil {
+		return err
+	}
+	return response.Protobuf(c, http.StatusOK, webhook)
+}
+
+func updateWebhookHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	webhook, err := webhookParam(c, db)
+	if err != nil {
+		return err
+	}
+	body, ok := c.Get(config.BODY_KEY).([]byte)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing body")
+	}
+	request := &admin.UpdateWebhookRequest{}
+	if err := unmarshalBody(c, body, request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("unable to parse request: %w", err).Error())
+	}
+	if len(request.UpdateMask.GetPaths()) == 0 {
+		return invalidField("update_mask", "update_mask must name at least one field")
+	}
+	update := request.Webhook
+	if update == nil {
+		update = &admin.Webhook{}
+	}
+	var secret string
+	for _, path := range request.UpdateMask.GetPaths() {
+		switch path {
+		case "url":
+			if webhook.Url, err = webhookURL(update.Url); err != nil {
+				return err
+			}
+		case "event_types":
+			if webhook.EventTypes, err = webhookEventTypes(update.EventTypes); err != nil {
+				return err
+			}
+		case "active":
+			webhook.Active = update.Active
+		case "secret":
+			if secret = update.Secret; secret == "" {
+				if secret, err = webhookSecret(); err != nil {
+					return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+				}
+			}
+		default:
+			return invalidField("update_mask", fmt.Sprintf("unsupported update_mask path [%s]", path))
+		}
+	}
+	updated, err := db.UpdateWebhook(webhook, secret)
+	if err != nil {
+		c.Logger().Error(err)
+		return databaseError(err, fmt.Sprintf("unable to update webhook %d", webhook.Id))
+	}
+	return response.Protobuf(c, http.StatusOK, updated)
+}
+
+func deleteWebhookHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	webhook, err := webhookParam(c, db)
+	if err != nil {
+		return err
+	}
+	if err := db.DeleteWebhook(int(webhook.Id)); err != nil {
+		c.Logger().Error(err)
+		return databaseError(err, fmt.Sprintf("unable to delete webhook %d", webhook.Id))
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func listWebhookDeliveriesHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	webhook, err := webhookParam(c, db)
+	if err != nil {
+		return err
+	}
+	limit, err := webhookLogLimit(c)
+	if err != nil {
+		return err
+	}
+	deliveries, err := db.ListWebhookDeliveries(webhook.Id, limit)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to list webhook deliveries: %w", err).Error())
+	}
+	return response.Protobuf(c, http.StatusOK, &admin.ListWebhookDeliveriesResponse{Deliveries: deliveries})
+}
+
+func listWebhookDeadLettersHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	limit, err := webhookLogLimit(c)
+	if err != nil {
+		return err
+	}
+	deadLetters, err := db.ListWebhookDeadLetters(limit)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to list webhook dead letters: %w", err).Error())
+	}
+	return response.Protobuf(c, http.StatusOK, &admin.ListWebhookDeadLettersResponse{DeadLetters: deadLetters})
+}
+
+func redeliverWebhookDeadLetterHandler(c echo.Context) error {
+	db := c.Get(config.DB_KEY).(*database.DB)
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+	delivery, err := db.RedeliverWebhookDeadLetter(id)
+	if err != nil {
+		c.Logger().Error(err)
+		return databaseError(err, fmt.Sprintf("unable to redeliver webhook dead letter %d", id))
+	}
+	return response.Protobuf(c, http.StatusOK, delivery)
+}
+
+// webhookParam returns the webhook named by the id path parameter, or a 404
+// if there is none.
+func webhookParam(c echo.Context, db *database.DB) (*admin.Webhook, error) {
+	id, err := intParam(c, "id")
+	if err != nil {
+		return nil, err
+	}
+	webhook, err := db.GetWebhook(id)
+	if err != nil {
+		c.Logger().Error(err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to get webhook %d: %w", id, err).Error())
+	}
+	if webhook == nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("webhook %d does not exist", id))
+	}
+	return webhook, nil
+}
+
+// webhookURL checks that events can be sent to rawURL.
+func webhookURL(rawURL string) (string, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", invalidField("url", fmt.Sprintf("url must be an http or https URL, got [%s]", rawURL))
+	}
+	return rawURL, nil
+}
+
+// webhookEventTypes checks that webhooks can subscribe to every event type,
+// and drops repeated ones.
+func webhookEventTypes(eventTypes []string) ([]string, error) {
+	valid := []string{}
+	for _, eventType := range eventTypes {
+		eventType = strings.TrimSpace(eventType)
+		if !database.ValidWebhookEventType(eventType) {
+			return nil, invalidField("event_types", fmt.Sprintf("unknown event type [%s]. Expected one of %s", eventType, strings.Join(database.WebhookEventTypes, ", ")))
+		}
+		if !slices.Contains(valid, eventType) {
+			valid = append(valid, eventType)
+		}
+	}
+	if len(valid) == 0 {
+		return nil, invalidField("event_types", "event_types must name at least one event type")
+	}
+	return valid, nil
+}
+
+// webhookSecret generates a random secret to sign deliveries with.
+func webhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("unable to generate webhook secret: %w", err)
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+func webhookLogLimit(c echo.Context) (int, error) {
+	param := c.QueryParam("limit")
+	if param == "" {
+		return defaultWebhookLogLimit, nil
+	}
+	limit, err := strconv.Atoi(param)
+	if err != nil || limit < 1 {
+		return 0, invalidField("limit", fmt.Sprintf("invalid limit [%s]", param))
+	}
+	return limit, nil
+}
@@ -0,0 +1,157 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The shape of a conversation in ChatGPT's conversations.json. Messages form a
+// tree in mapping, since editing a prompt branches the conversation, and
+// current_node is the leaf of the branch that was last shown.
+type gptConversation struct {
+	Title       string             `json:"title"`
+	CreateTime  *float64           `json:"create_time"`
+	Mapping     map[string]gptNode `json:"mapping"`
+	CurrentNode string             `json:"current_node"`
+}
+
+type gptNode struct {
+	ID       string      `json:"id"`
+	Message  *gptMessage `json:"message"`
+	Parent   *string     `json:"parent"`
+	Children []string    `json:"children"`
+}
+
+type gptMessage struct {
+	Author struct {
+		Role string `json:"role"`
+	} `json:"author"`
+	Content struct {
+		ContentType string            `json:"content_type"`
+		Parts       []json.RawMessage `json:"parts"`
+	} `json:"content"`
+	CreateTime *float64 `json:"create_time"`
+}
+
+func parseChatGPT(data []byte) ([]*chat.Conversation, error) {
+	var exported []gptConversation
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var single gptConversation
+		if err := json.Unmarshal(trimmed, &single); err != nil {
+			return nil, fmt.Errorf("unable to parse ChatGPT conversation: %w", err)
+		}
+		exported = []gptConversation{single}
+	} else if err := json.Unmarshal(data, &exported); err != nil {
+		return nil, fmt.Errorf("unable to parse ChatGPT conversations: %w", err)
+	}
+
+	conversations := make([]*chat.Conversation, 0, len(exported))
+	for _, gpt := range exported {
+		conversation := &chat.Conversation{Title: strings.TrimSpace(gpt.Title)}
+		if conversation.Title == "" {
+			conversation.Title = untitled
+		}
+		if gpt.CreateTime != nil {
+			conversation.CreatedAt = unixTimestamp(*gpt.CreateTime)
+		}
+		for _, node := range gpt.branch() {
+			message := node.Message.toMessage()
+			if message == nil {
+				continue
+			}
+			if message.CreatedAt == nil {
+				message.CreatedAt = conversation.CreatedAt
+			}
+			conversation.Messages = append(conversation.Messages, message)
+		}
+		conversations = append(conversations, conversation)
+	}
+	return conversations, nil
+}
+
+// branch returns the nodes from the root of the tree to the current node. When
+// the export has no current node the branch follows the last child of every
+// node instead, which is the most recent edit.
+func (c gptConversation) branch() []gptNode {
+	leaf := c.CurrentNode
+	if _, ok := c.Mapping[leaf]; !ok {
+		leaf = ""
+		for id, node := range c.Mapping {
+			if node.Parent == nil || *node.Parent == "" {
+				leaf = id
+				break
+			}
+		}
+		for {
+			node, ok := c.Mapping[leaf]
+			if !ok || len(node.Children) == 0 {
+				break
+			}
+			leaf = node.Children[len(node.Children)-1]
+		}
+	}
+
+	var nodes []gptNode
+	seen := map[string]bool{}
+	for id := leaf; id != "" && !seen[id]; {
+		node, ok := c.Mapping[id]
+		if !ok {
+			break
+		}
+		seen[id] = true
+		nodes = append(nodes, node)
+		if node.Parent == nil {
+			break
+		}
+		id = *node.Parent
+	}
+	for i, j := 0, len(nodes)-1; i < j; i, j = i+1, j-1 {
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
+	return nodes
+}
+
+// toMessage converts a user or assistant message with text content. System and
+// tool messages, and parts that are not text such as images, are dropped.
+func (m *gptMessage) toMessage() *chat.Message {
+	if m == nil {
+		return nil
+	}
+	var sender chat.Message_Sender
+	switch m.Author.Role {
+	case "user":
+		sender = chat.Message_USER
+	case "assistant":
+		sender = chat.Message_BOT
+	default:
+		return nil
+	}
+	var parts []string
+	for _, raw := range m.Content.Parts {
+		var part string
+		if err := json.Unmarshal(raw, &part); err == nil && part != "" {
+			parts = append(parts, part)
+		}
+	}
+	body := strings.Join(parts, "\n")
+	if strings.TrimSpace(body) == "" {
+		return nil
+	}
+	message := &chat.Message{Body: body, Sender: sender}
+	if m.CreateTime != nil {
+		message.CreatedAt = unixTimestamp(*m.CreateTime)
+	}
+	return message
+}
+
+func unixTimestamp(seconds float64) *timestamppb.Timestamp {
+	whole, fraction := math.Modf(seconds)
+	return timestamppb.New(time.Unix(int64(whole), int64(fraction*1e9)))
+}
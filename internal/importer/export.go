@@ -0,0 +1,25 @@
+package importer
+
+import (
+	"fmt"
+
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// parseExport reads a ConversationExport written by the export package.
+func parseExport(data []byte) ([]*chat.Conversation, error) {
+	export := &chat.ConversationExport{}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, export); err != nil {
+		return nil, fmt.Errorf("unable to parse conversation export: %w", err)
+	}
+	if export.Version > 1 {
+		return nil, fmt.Errorf("unsupported conversation export version %d", export.Version)
+	}
+	for _, conversation := range export.Conversations {
+		if conversation.Title == "" {
+			conversation.Title = untitled
+		}
+	}
+	return export.Conversations, nil
+}
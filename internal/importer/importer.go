@@ -0,0 +1,61 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+)
+
+// Format is a file format that conversations can be imported from.
+type Format string
+
+const (
+	Detect   Format = ""
+	ChatGPT  Format = "chatgpt"
+	JSON     Format = "json"
+	Markdown Format = "markdown"
+)
+
+const untitled = "Untitled conversation"
+
+// Parse reads every conversation in data. The returned conversations carry
+// their title, context, creation time and messages, oldest first, but no ids.
+func Parse(data []byte, format Format) ([]*chat.Conversation, error) {
+	if format == Detect {
+		format = DetectFormat(data)
+	}
+	switch format {
+	case ChatGPT:
+		return parseChatGPT(data)
+	case JSON:
+		return parseExport(data)
+	case Markdown:
+		return parseMarkdown(data)
+	}
+	return nil, fmt.Errorf("unsupported import format [%s]", format)
+}
+
+// DetectFormat guesses the format of data from its contents. A JSON array, or
+// an object with a mapping, is a ChatGPT export, any other JSON object is one
+// of our exports and everything else is treated as Markdown.
+func DetectFormat(data []byte) Format {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return Markdown
+	}
+	switch trimmed[0] {
+	case '[':
+		return ChatGPT
+	case '{':
+		var keys map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &keys); err == nil {
+			if _, ok := keys["mapping"]; ok {
+				return ChatGPT
+			}
+		}
+		return JSON
+	}
+	return Markdown
+}
@@ -0,0 +1,342 @@
+package importer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timsexperiments/chat-cli/internal/export"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// message is the part of an imported message that the tests check.
+type message struct {
+	sender chat.Message_Sender
+	body   string
+}
+
+func messagesOf(conversation *chat.Conversation) []message {
+	messages := []message{}
+	for _, m := range conversation.Messages {
+		messages = append(messages, message{m.Sender, m.Body})
+	}
+	return messages
+}
+
+func equalMessages(a, b []message) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want Format
+	}{
+		{"empty", "", Markdown},
+		{"whitespace", " \n\t", Markdown},
+		{"ChatGPT array", `[{"title": "Hi", "mapping": {}}]`, ChatGPT},
+		{"ChatGPT array after whitespace", "\n  []", ChatGPT},
+		{"ChatGPT conversation", `{"title": "Hi", "mapping": {}}`, ChatGPT},
+		{"our export", `{"version": 1, "conversations": []}`, JSON},
+		{"invalid JSON object", `{"mapping": `, JSON},
+		{"Markdown", "# Trip\n\n**User**\n\nHi", Markdown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := DetectFormat([]byte(test.data)); got != test.want {
+				t.Fatalf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+// A ChatGPT conversation where the first prompt was edited, so that the root
+// has two branches. The edited prompt is the current branch.
+const branchedChatGPT = `{
+  "title": "  Colors  ",
+  "create_time": 1714564800.5,
+  "current_node": "edited-reply",
+  "mapping": {
+    "root": {"id": "root", "message": null, "parent": null, "children": ["system"]},
+    "system": {
+      "id": "system",
+      "message": {"author": {"role": "system"}, "content": {"content_type": "text", "parts": ["Be helpful."]}},
+      "parent": "root",
+      "children": ["prompt", "edited"]
+    },
+    "prompt": {
+      "id": "prompt",
+      "message": {"author": {"role": "user"}, "content": {"content_type": "text", "parts": ["Name a color"]}, "create_time": 1714564801},
+      "parent": "system",
+      "children": ["reply"]
+    },
+    "reply": {
+      "id": "reply",
+      "message": {"author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["Blue"]}, "create_time": 1714564802},
+      "parent": "prompt",
+      "children": []
+    },
+    "edited": {
+      "id": "edited",
+      "message": {"author": {"role": "user"}, "content": {"content_type": "text", "parts": ["Name a warm color"]}},
+      "parent": "system",
+      "children": ["edited-reply"]
+    },
+    "edited-reply": {
+      "id": "edited-reply",
+      "message": {"author": {"role": "assistant"}, "content": {"content_type": "multimodal_text", "parts": [{"asset_pointer": "file-1"}, "Red", "", "Orange"]}, "create_time": 1714564803},
+      "parent": "edited",
+      "children": ["tool"]
+    },
+    "tool": {
+      "id": "tool",
+      "message": {"author": {"role": "tool"}, "content": {"content_type": "text", "parts": ["search results"]}},
+      "parent": "edited-reply",
+      "children": []
+    }
+  }
+}`
+
+func TestParseChatGPT(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		title string
+		want  []message
+	}{
+		{
+			name:  "current branch",
+			data:  branchedChatGPT,
+			title: "Colors",
+			want:  []message{{chat.Message_USER, "Name a warm color"}, {chat.Message_BOT, "Red\nOrange"}},
+		},
+		{
+			name:  "latest edit without a current node",
+			data:  strings.Replace(branchedChatGPT, `"current_node": "edited-reply"`, `"current_node": "missing"`, 1),
+			title: "Colors",
+			want:  []message{{chat.Message_USER, "Name a warm color"}, {chat.Message_BOT, "Red\nOrange"}},
+		},
+		{
+			name:  "earlier branch as the current node",
+			data:  strings.Replace(branchedChatGPT, `"current_node": "edited-reply"`, `"current_node": "reply"`, 1),
+			title: "Colors",
+			want:  []message{{chat.Message_USER, "Name a color"}, {chat.Message_BOT, "Blue"}},
+		},
+		{
+			name:  "untitled",
+			data:  `[{"title": "", "mapping": {}}]`,
+			title: untitled,
+			want:  []message{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conversations, err := Parse([]byte(test.data), Detect)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(conversations) != 1 {
+				t.Fatalf("expected 1 conversation, got %d", len(conversations))
+			}
+			conversation := conversations[0]
+			if conversation.Title != test.title {
+				t.Fatalf("expected title %q, got %q", test.title, conversation.Title)
+			}
+			if got := messagesOf(conversation); !equalMessages(got, test.want) {
+				t.Fatalf("expected messages %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestParseChatGPTTimes(t *testing.T) {
+	conversations, err := Parse([]byte(branchedChatGPT), ChatGPT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conversation := conversations[0]
+	if want := time.Unix(1714564800, 5e8); !conversation.CreatedAt.AsTime().Equal(want) {
+		t.Fatalf("expected the conversation to be created at %s, got %s", want, conversation.CreatedAt.AsTime())
+	}
+	// The edited prompt has no time of its own and falls back to the
+	// conversation's.
+	if got := conversation.Messages[0].CreatedAt.AsTime(); !got.Equal(conversation.CreatedAt.AsTime()) {
+		t.Fatalf("expected the edited prompt to be created with the conversation, got %s", got)
+	}
+	if want := time.Unix(1714564803, 0); !conversation.Messages[1].CreatedAt.AsTime().Equal(want) {
+		t.Fatalf("expected the reply to be created at %s, got %s", want, conversation.Messages[1].CreatedAt.AsTime())
+	}
+}
+
+func TestParseExportRoundTrip(t *testing.T) {
+	conversations := []*chat.Conversation{
+		{
+			Id:        7,
+			Title:     "Trip <plans>",
+			Context:   "Be brief.",
+			CreatedAt: timestamppb.New(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)),
+			Messages: []*chat.Message{
+				{Id: 1, Body: "Where should we go?", Sender: chat.Message_USER, CreatedAt: timestamppb.New(time.Date(2024, 5, 1, 12, 1, 0, 0, time.UTC))},
+				{Id: 2, Body: "Try the coast.", Sender: chat.Message_BOT, CreatedAt: timestamppb.New(time.Date(2024, 5, 1, 12, 2, 0, 0, time.UTC))},
+			},
+		},
+		{Id: 8, Title: "Empty", CreatedAt: timestamppb.New(time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC))},
+	}
+	data, err := export.MarshalJSON(conversations...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format := DetectFormat(data); format != JSON {
+		t.Fatalf("expected an export to be detected as %q, got %q", JSON, format)
+	}
+	imported, err := Parse(data, Detect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != len(conversations) {
+		t.Fatalf("expected %d conversations, got %d", len(conversations), len(imported))
+	}
+	for i := range conversations {
+		if !proto.Equal(imported[i], conversations[i]) {
+			t.Fatalf("expected %v, got %v", conversations[i], imported[i])
+		}
+	}
+}
+
+func TestParseExportErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"newer version", `{"version": 2, "conversations": []}`},
+		{"not an export", `{"conversations": "none"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Parse([]byte(test.data), JSON); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestParseMarkdown(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		title   string
+		context string
+		want    []message
+	}{
+		{
+			name:    "our export",
+			data:    "# Trip\n\n_Created 2024-05-01 12:00:00 UTC_\n\n> Be brief.\n> Use lists.\n\n---\n\n**User** · 2024-05-01 12:01:00 UTC\n\nWhere should we go?\n\n---\n\n**Assistant** · 2024-05-01 12:02:00 UTC\n\nTry the coast.\n\n",
+			title:   "Trip",
+			context: "Be brief.\nUse lists.",
+			want:    []message{{chat.Message_USER, "Where should we go?"}, {chat.Message_BOT, "Try the coast."}},
+		},
+		{
+			name:  "headings and Windows line endings",
+			data:  "# Colors\r\n\r\n## You:\r\nName a color\r\n\r\n### ChatGPT\r\nBlue\r\n",
+			title: "Colors",
+			want:  []message{{chat.Message_USER, "Name a color"}, {chat.Message_BOT, "Blue"}},
+		},
+		{
+			name:  "body with its own headings and rules",
+			data:  "**User**\n\nShow me a list\n\n**Bot**\n\n# Not a title\n\n- one\n\n---\n\n- two\n",
+			title: untitled,
+			want:  []message{{chat.Message_USER, "Show me a list"}, {chat.Message_BOT, "# Not a title\n\n- one\n\n---\n\n- two"}},
+		},
+		{
+			name:  "empty messages are dropped",
+			data:  "# Empty\n\n**User**\n\n---\n\n**Assistant**\n\nHello\n",
+			title: "Empty",
+			want:  []message{{chat.Message_BOT, "Hello"}},
+		},
+		{
+			name:  "no messages",
+			data:  "Just some notes.\n",
+			title: untitled,
+			want:  []message{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conversations, err := Parse([]byte(test.data), Markdown)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conversation := conversations[0]
+			if conversation.Title != test.title {
+				t.Fatalf("expected title %q, got %q", test.title, conversation.Title)
+			}
+			if conversation.Context != test.context {
+				t.Fatalf("expected context %q, got %q", test.context, conversation.Context)
+			}
+			if got := messagesOf(conversation); !equalMessages(got, test.want) {
+				t.Fatalf("expected messages %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestParseMarkdownTimes(t *testing.T) {
+	data := "# Trip\n\n_Created 2024-05-01 12:00:00 UTC_\n\n**User** · 2024-05-01T12:01:00Z\n\nHi\n\n**Assistant** · yesterday\n\nHello\n"
+	conversations, err := Parse([]byte(data), Markdown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conversation := conversations[0]
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if !conversation.CreatedAt.AsTime().Equal(created) {
+		t.Fatalf("expected the conversation to be created at %s, got %s", created, conversation.CreatedAt.AsTime())
+	}
+	if want := created.Add(time.Minute); !conversation.Messages[0].CreatedAt.AsTime().Equal(want) {
+		t.Fatalf("expected the prompt to be created at %s, got %s", want, conversation.Messages[0].CreatedAt.AsTime())
+	}
+	// A time that cannot be parsed falls back to the conversation's.
+	if got := conversation.Messages[1].CreatedAt.AsTime(); !got.Equal(created) {
+		t.Fatalf("expected the reply to be created at %s, got %s", created, got)
+	}
+}
+
+func TestParseMarkdownRoundTrip(t *testing.T) {
+	conversation := &chat.Conversation{
+		Title:     "Trip",
+		Context:   "Be brief.",
+		CreatedAt: timestamppb.New(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)),
+		Messages: []*chat.Message{
+			{Body: "Where should we go?", Sender: chat.Message_USER, CreatedAt: timestamppb.New(time.Date(2024, 5, 1, 12, 1, 0, 0, time.UTC))},
+			{Body: "Try the coast.\n\nOr the mountains.", Sender: chat.Message_BOT, CreatedAt: timestamppb.New(time.Date(2024, 5, 1, 12, 2, 0, 0, time.UTC))},
+		},
+	}
+	var out bytes.Buffer
+	if err := export.Render(&out, conversation, export.Markdown); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := Parse(out.Bytes(), Detect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(imported[0], conversation) {
+		t.Fatalf("expected %v, got %v", conversation, imported[0])
+	}
+}
+
+func TestParseUnsupportedFormat(t *testing.T) {
+	if _, err := Parse([]byte("{}"), Format("csv")); err == nil {
+		t.Fatal("expected an error")
+	}
+}
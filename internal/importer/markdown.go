@@ -0,0 +1,102 @@
+package importer
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	// A message header in our own Markdown export, "**User** · <time>", or a
+	// heading naming the speaker, "## Assistant".
+	boldSenderPattern    = regexp.MustCompile(`^\*\*(User|You|Assistant|ChatGPT|Bot)\*\*(?:\s*·\s*(.+))?$`)
+	headingSenderPattern = regexp.MustCompile(`^#{2,3}\s+(User|You|Assistant|ChatGPT|Bot)\s*:?$`)
+	createdPattern       = regexp.MustCompile(`^_Created (.+)_$`)
+)
+
+var markdownTimeLayouts = []string{"2006-01-02 15:04:05 MST", time.RFC3339, "2006-01-02 15:04:05"}
+
+// parseMarkdown reads a single conversation transcript. The first level one
+// heading is the title, a block quote before the first message is the context
+// and every message starts at a line naming its sender.
+func parseMarkdown(data []byte) ([]*chat.Conversation, error) {
+	conversation := &chat.Conversation{}
+	var context []string
+	var message *chat.Message
+	var body []string
+
+	flush := func() {
+		if message == nil {
+			return
+		}
+		text := strings.TrimSpace(strings.Join(body, "\n"))
+		text = strings.TrimSpace(strings.TrimSuffix(text, "---"))
+		if text != "" {
+			message.Body = text
+			conversation.Messages = append(conversation.Messages, message)
+		}
+		message, body = nil, nil
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if sender, at, ok := senderLine(trimmed); ok {
+			flush()
+			message = &chat.Message{Sender: sender, CreatedAt: at}
+			continue
+		}
+		if message != nil {
+			body = append(body, line)
+			continue
+		}
+		switch {
+		case conversation.Title == "" && strings.HasPrefix(trimmed, "# "):
+			conversation.Title = strings.TrimSpace(strings.TrimPrefix(trimmed, "# "))
+		case createdPattern.MatchString(trimmed):
+			conversation.CreatedAt = parseMarkdownTime(createdPattern.FindStringSubmatch(trimmed)[1])
+		case strings.HasPrefix(trimmed, ">"):
+			context = append(context, strings.TrimSpace(strings.TrimPrefix(trimmed, ">")))
+		}
+	}
+	flush()
+
+	if conversation.Title == "" {
+		conversation.Title = untitled
+	}
+	conversation.Context = strings.Join(context, "\n")
+	for _, message := range conversation.Messages {
+		if message.CreatedAt == nil {
+			message.CreatedAt = conversation.CreatedAt
+		}
+	}
+	return []*chat.Conversation{conversation}, nil
+}
+
+func senderLine(line string) (chat.Message_Sender, *timestamppb.Timestamp, bool) {
+	var name, at string
+	if match := boldSenderPattern.FindStringSubmatch(line); match != nil {
+		name, at = match[1], match[2]
+	} else if match := headingSenderPattern.FindStringSubmatch(line); match != nil {
+		name = match[1]
+	} else {
+		return chat.Message_SENDER_UNSPECIFIED, nil, false
+	}
+	sender := chat.Message_BOT
+	if name == "User" || name == "You" {
+		sender = chat.Message_USER
+	}
+	return sender, parseMarkdownTime(at), true
+}
+
+func parseMarkdownTime(value string) *timestamppb.Timestamp {
+	value = strings.TrimSpace(value)
+	for _, layout := range markdownTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return timestamppb.New(t)
+		}
+	}
+	return nil
+}
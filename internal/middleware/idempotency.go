@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/database"
+)
+
+// The header clients send an idempotency key in.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// The header set on responses that are sent again for a retried request.
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// The longest idempotency key that is accepted.
+const maxIdempotencyKeyLength = 255
+
+// The context key set by KeepIdempotentResponse.
+const keepIdempotentResponseKey = "KEEP_IDEMPOTENT_RESPONSE"
+
+// The response headers stored along with the response to a request sent with
+// an idempotency key, and sent again with it.
+var idempotentHeaders = []string{echo.HeaderContentType, echo.HeaderLocation, "ETag"}
+
+// Idempotency makes it safe to retry requests sent with an Idempotency-Key
+// header. The first request with a key is handled and its response stored for
+// the configured window. Retries with the same key get that response back
+// without being handled again, marked with an Idempotent-Replayed header.
+//
+// Sending a key again with a different request fails with 422, and retrying
+// while the first request is still being handled fails with 409. Responses
+// with server errors are not stored, so the request can be retried after
+// them, unless the handler calls KeepIdempotentResponse. Requests without the
+// header are handled as usual.
+func Idempotency(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			return next(c)
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s must be at most %d characters", IdempotencyKeyHeader, maxIdempotencyKeyLength))
+		}
+
+		db := c.Get(config.DB_KEY).(*database.DB)
+		since := time.Now().Add(-config.GetConfig().IdempotencyWindow)
+		stored, err := db.ClaimIdempotencyKey(key, requestFingerprint(c), since)
+		switch {
+		case errors.Is(err, database.ErrIdempotencyKeyReused):
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		case errors.Is(err, database.ErrIdempotencyKeyInFlight):
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		case err != nil:
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("unable to check idempotency key: %w", err).Error())
+		}
+		if stored != nil {
+			header := c.Response().Header()
+			for name, values := range stored.Header {
+				header[name] = values
+			}
+			header.Set(IdempotentReplayedHeader, "true")
+			return c.Blob(stored.StatusCode, stored.Header.Get(echo.HeaderContentType), stored.Body)
+		}
+
+		recorder := &bodyRecorder{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = recorder
+		if err := next(c); err != nil {
+			// The error is sent here rather than once the request is done, so
+			// that it is recorded and stored like any other response.
+			c.Error(err)
+		}
+		c.Response().Writer = recorder.ResponseWriter
+
+		status := c.Response().Status
+		keep, _ := c.Get(keepIdempotentResponseKey).(bool)
+		if !c.Response().Committed || (status >= http.StatusInternalServerError && !keep) {
+			if err := db.ReleaseIdempotencyKey(key); err != nil {
+				c.Logger().Error(err)
+			}
+			return nil
+		}
+		response := &database.IdempotentResponse{StatusCode: status, Header: http.Header{}, Body: recorder.body.Bytes()}
+		for _, name := range idempotentHeaders {
+			if value := c.Response().Header().Get(name); value != "" {
+				response.Header.Set(name, value)
+			}
+		}
+		if err := db.CompleteIdempotencyKey(key, response); err != nil {
+			// The request was handled, so the key is released to let a retry
+			// go through rather than fail as still being handled.
+			c.Logger().Error(err)
+			if err := db.ReleaseIdempotencyKey(key); err != nil {
+				c.Logger().Error(err)
+			}
+		}
+		return nil
+	}
+}
+
+// KeepIdempotentResponse stores the response to the request for its
+// idempotency key even if it is a server error. It is for requests that fail
+// after storing a change, which a retry must not make again.
+func KeepIdempotentResponse(c echo.Context) {
+	c.Set(keepIdempotentResponseKey, true)
+}
+
+// requestFingerprint identifies a request by its method, URL, content type and
+// body, so that a key sent again with a different request can be told apart
+// from a retry.
+func requestFingerprint(c echo.Context) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n%s\n", c.Request().Method, c.Request().URL.RequestURI(), c.Request().Header.Get(echo.HeaderContentType))
+	if body, ok := c.Get(config.BODY_KEY).([]byte); ok {
+		hash.Write(body)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// bodyRecorder keeps a copy of the response body as it is written.
+type bodyRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *bodyRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
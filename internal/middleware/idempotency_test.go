@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/database"
+)
+
+func TestMain(m *testing.M) {
+	// Queries are read from the queries directory at the root of the
+	// repository.
+	if err := os.Chdir("../.."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestIdempotency(t *testing.T) {
+	cfg := *config.GetConfig()
+	cfg.DatabaseDSN = fmt.Sprintf("file:/%s.db?vfs=memdb", t.Name())
+	sqlDB, err := database.Open(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	db := database.CreateDB(sqlDB, nil)
+
+	tests := []struct {
+		name string
+		// handle handles the request the n-th time it is handled.
+		handle func(c echo.Context, n int) error
+		// retry is the body the request is sent again with.
+		retry string
+		// The status of the retry and how many times the request is handled.
+		code    int
+		handled int
+		replay  bool
+	}{
+		{"created", func(c echo.Context, n int) error {
+			return c.String(http.StatusCreated, fmt.Sprintf("created %d", n))
+		}, "first", http.StatusCreated, 1, true},
+		{"client error", func(c echo.Context, n int) error {
+			return echo.NewHTTPError(http.StatusBadRequest, "bad request")
+		}, "first", http.StatusBadRequest, 1, true},
+		{"server error", func(c echo.Context, n int) error {
+			if n == 1 {
+				return echo.NewHTTPError(http.StatusInternalServerError, "try again")
+			}
+			return c.String(http.StatusCreated, fmt.Sprintf("created %d", n))
+		}, "first", http.StatusCreated, 2, false},
+		{"server error after storing a change", func(c echo.Context, n int) error {
+			KeepIdempotentResponse(c)
+			return echo.NewHTTPError(http.StatusInternalServerError, "stored but not replied to")
+		}, "first", http.StatusInternalServerError, 1, true},
+		{"key reused for another request", func(c echo.Context, n int) error {
+			return c.String(http.StatusCreated, fmt.Sprintf("created %d", n))
+		}, "second", http.StatusUnprocessableEntity, 1, false},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handled := 0
+			e := echo.New()
+			e.Use(ProtobufBodyChecker, ContextDB(db))
+			e.POST("/things", func(c echo.Context) error {
+				handled++
+				return test.handle(c, handled)
+			}, Idempotency)
+			send := func(body string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodPost, "/things", strings.NewReader(body))
+				req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+				req.Header.Set(IdempotencyKeyHeader, fmt.Sprintf("key-%d", i))
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, req)
+				return rec
+			}
+
+			first := send("first")
+			retry := send(test.retry)
+			if retry.Code != test.code {
+				t.Fatalf("expected %d, got %d: %s", test.code, retry.Code, retry.Body)
+			}
+			if handled != test.handled {
+				t.Fatalf("expected the request to be handled %d times, got %d", test.handled, handled)
+			}
+			replayed := retry.Header().Get(IdempotentReplayedHeader) == "true"
+			if replayed != test.replay {
+				t.Fatalf("expected replayed to be %t, got %t", test.replay, replayed)
+			}
+			if replayed && (retry.Body.String() != first.Body.String() || retry.Header().Get(echo.HeaderContentType) != first.Header().Get(echo.HeaderContentType)) {
+				t.Fatalf("expected the first response to be sent again, got %q after %q", retry.Body, first.Body)
+			}
+		})
+	}
+}
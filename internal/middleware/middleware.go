@@ -1,18 +1,26 @@
 package middleware
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/codec"
 	"github.com/timsexperiments/chat-cli/internal/config"
 	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/response"
 )
 
+// ProtobufHeader sets the content type of responses to the media type they
+// are encoded as, so that responses without a body carry it too.
 func ProtobufHeader(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		c.Response().Header().Set("Content-Type", "application/protobuf")
+		c.Response().Header().Set(echo.HeaderContentType, response.MediaType(c))
 		return next(c)
 	}
 }
@@ -35,6 +43,25 @@ func AuthChecker(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// AdminChecker only lets requests through that carry the configured admin
+// token. Every request is rejected when no admin token is configured.
+func AdminChecker(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		adminToken := config.GetConfig().AdminToken
+		if adminToken == "" {
+			return echo.NewHTTPError(http.StatusForbidden, "the admin API is disabled")
+		}
+		authHeader := c.Request().Header.Get("Authorization")
+		token := strings.TrimPrefix(authHeader, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid admin token")
+		}
+		return next(c)
+	}
+}
+
+// ProtobufBodyChecker reads the request body for handlers to decode, as long
+// as it is binary protobuf or JSON.
 func ProtobufBodyChecker(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		body, err := io.ReadAll(c.Request().Body)
@@ -44,20 +71,44 @@ func ProtobufBodyChecker(next echo.HandlerFunc) echo.HandlerFunc {
 		if len(body) == 0 {
 			return next(c)
 		}
-		contentType := c.Request().Header.Get("Content-Type")
-		if contentType != "application/protobuf" {
-			return echo.NewHTTPError(http.StatusUnsupportedMediaType, fmt.Errorf("invalid content type. Expected application/protobuf: %s", contentType).Error())
+		contentType := c.Request().Header.Get(echo.HeaderContentType)
+		if _, ok := codec.MediaType(contentType); !ok {
+			return echo.NewHTTPError(http.StatusUnsupportedMediaType, fmt.Errorf("invalid content type. Expected %s or %s: %s", codec.Protobuf, codec.JSON, contentType).Error())
 		}
 		c.Set(config.BODY_KEY, body)
 		return next(c)
 	}
 }
 
+// ContextDB hands the database to handlers, set up to record the changes
+// they make in the audit log against the caller of the request.
 func ContextDB(db *database.DB) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			c.Set(config.DB_KEY, db)
+			c.Set(config.DB_KEY, db.As(database.Actor{
+				Name:      actor(c),
+				RequestId: c.Response().Header().Get(echo.HeaderXRequestID),
+				ClientIp:  c.RealIP(),
+			}))
 			return next(c)
 		}
 	}
 }
+
+// actor names who sent the request for the audit log: "admin" for the admin
+// token, or "token:" and a fingerprint of any other token, so that requests
+// made with the same token can be told apart without storing it.
+func actor(c echo.Context) string {
+	token := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = c.QueryParams().Get("api_secret")
+	}
+	if token == "" {
+		return "anonymous"
+	}
+	if adminToken := config.GetConfig().AdminToken; adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+		return "admin"
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:6])
+}
@@ -4,13 +4,31 @@ import (
 	"net/http"
 
 	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/codec"
 	"google.golang.org/protobuf/proto"
 )
 
+// Protobuf sends message encoded as the media type the client asked for,
+// which is binary protobuf unless it asked for JSON.
 func Protobuf(c echo.Context, code int, message proto.Message) error {
-	serialized, err := proto.Marshal(message)
+	mediaType := MediaType(c)
+	serialized, err := codec.Marshal(mediaType, message)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
-	return c.Blob(code, "application/protobuf", serialized)
+	// The content type is set explicitly because Blob keeps one that is
+	// already set, e.g. by middleware.ProtobufHeader before negotiating.
+	c.Response().Header().Set(echo.HeaderContentType, mediaType)
+	return c.Blob(code, mediaType, serialized)
+}
+
+// MediaType returns the media type responses to the request are encoded as,
+// going by its Accept header. Requests that do not name a supported type in
+// Accept are answered in the media type of their body, or protobuf.
+func MediaType(c echo.Context) string {
+	fallback := codec.Protobuf
+	if mediaType, ok := codec.MediaType(c.Request().Header.Get(echo.HeaderContentType)); ok {
+		fallback = mediaType
+	}
+	return codec.Negotiate(c.Request().Header.Get(echo.HeaderAccept), fallback)
 }
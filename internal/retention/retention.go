@@ -0,0 +1,118 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/proto/admin"
+)
+
+// Worker removes messages that are older than their retention period and
+// empties expired items out of the trash.
+type Worker struct {
+	db             *database.DB
+	maxAge         time.Duration
+	action         admin.RetentionAction
+	batchSize      int
+	trashRetention time.Duration
+	// fullVacuum is whether the database is rebuilt after removing rows when
+	// it is not set up for incremental vacuums.
+	fullVacuum bool
+	// mutex keeps scheduled and on demand runs from running at once.
+	mutex sync.Mutex
+}
+
+func NewWorker(db *database.DB, maxAge time.Duration, action admin.RetentionAction, batchSize int, trashRetention time.Duration, fullVacuum bool) *Worker {
+	return &Worker{
+		db:             db,
+		maxAge:         maxAge,
+		action:         action,
+		batchSize:      batchSize,
+		trashRetention: trashRetention,
+		fullVacuum:     fullVacuum,
+	}
+}
+
+// ParseAction parses the RETENTION_ACTION setting.
+func ParseAction(action string) (admin.RetentionAction, error) {
+	switch action {
+	case "purge":
+		return admin.RetentionAction_PURGE, nil
+	case "redact":
+		return admin.RetentionAction_REDACT, nil
+	}
+	return admin.RetentionAction_RETENTION_ACTION_UNSPECIFIED, fmt.Errorf("unknown retention action [%s]", action)
+}
+
+// Run removes expired messages in batches until none are left or ctx is done,
+// purges the trash and vacuums the database if anything was deleted and the
+// worker is allowed to. Every batch is its own transaction, so a run that is
+// cut short keeps the batches it finished.
+func (w *Worker) Run(ctx context.Context) (*admin.RetentionRun, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	run := &admin.RetentionRun{}
+	for ctx.Err() == nil {
+		entries, err := w.db.ApplyRetention(w.maxAge, w.action, w.batchSize)
+		if err != nil {
+			return run, fmt.Errorf("unable to apply retention: %w", err)
+		}
+		removed := 0
+		for _, entry := range entries {
+			removed += len(entry.MessageIds)
+		}
+		if w.action == admin.RetentionAction_REDACT {
+			run.MessagesRedacted += int64(removed)
+		} else {
+			run.MessagesPurged += int64(removed)
+		}
+		if removed < w.batchSize {
+			break
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return run, err
+	}
+
+	conversations, messages, err := w.db.PurgeTrash(time.Now().Add(-w.trashRetention))
+	if err != nil {
+		return run, fmt.Errorf("unable to purge trash: %w", err)
+	}
+	run.TrashConversationsPurged = conversations
+	run.TrashMessagesPurged = messages
+
+	if run.MessagesPurged+run.MessagesRedacted+run.TrashConversationsPurged+run.TrashMessagesPurged > 0 {
+		vacuumed, err := w.db.Vacuum(w.fullVacuum)
+		if err != nil {
+			return run, err
+		}
+		run.Vacuumed = vacuumed
+	}
+	return run, nil
+}
+
+// Schedule runs the worker every interval until ctx is done.
+func (w *Worker) Schedule(ctx context.Context, interval time.Duration, logger echo.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			run, err := w.Run(ctx)
+			if err != nil {
+				logger.Error(fmt.Errorf("scheduled retention run failed: %w", err))
+				continue
+			}
+			logger.Infof(
+				"retention run purged %d and redacted %d messages, emptied %d conversations and %d messages from the trash",
+				run.MessagesPurged, run.MessagesRedacted, run.TrashConversationsPurged, run.TrashMessagesPurged)
+		}
+	}
+}
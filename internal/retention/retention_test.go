@@ -0,0 +1,158 @@
+package retention
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/encryption"
+	"github.com/timsexperiments/chat-cli/internal/proto/admin"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+)
+
+func TestMain(m *testing.M) {
+	// Queries are read from the queries directory at the root of the
+	// repository.
+	if err := os.Chdir("../.."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestDB returns a migrated, encrypted in-memory database of its own for
+// the test, along with the connection it is opened on.
+func newTestDB(t *testing.T) (*database.DB, *sql.DB) {
+	t.Helper()
+	cfg := *config.GetConfig()
+	cfg.DatabaseDSN = fmt.Sprintf("file:/%s.db?vfs=memdb", strings.NewReplacer("/", "_", " ", "_").Replace(t.Name()))
+	sqlDB, err := database.Open(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	keys, err := encryption.NewKeyring("k1", map[string][]byte{"k1": []byte(strings.Repeat("a", 32))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return database.CreateDB(sqlDB, keys), sqlDB
+}
+
+// policy is a retention policy to set in a test.
+type policy struct {
+	maxAge    *time.Duration
+	legalHold bool
+}
+
+func age(d time.Duration) *time.Duration {
+	return &d
+}
+
+func TestRunAppliesTheRetentionPolicyThatWins(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxAge       time.Duration
+		tag          *policy
+		conversation *policy
+		pending      bool
+		purged       bool
+	}{
+		{name: "past the global period", maxAge: time.Hour, purged: true},
+		{name: "no global period", purged: false},
+		{name: "tag policy beats the global period", maxAge: 24 * time.Hour, tag: &policy{maxAge: age(time.Hour)}, purged: true},
+		{name: "tag policy keeps messages longer", maxAge: time.Hour, tag: &policy{maxAge: age(24 * time.Hour)}, purged: false},
+		{name: "tag policy without a max age", maxAge: time.Hour, tag: &policy{}, purged: true},
+		{name: "conversation policy beats the tag policy", tag: &policy{maxAge: age(24 * time.Hour)}, conversation: &policy{maxAge: age(time.Hour)}, purged: true},
+		{name: "conversation policy keeps messages longer", tag: &policy{maxAge: age(time.Hour)}, conversation: &policy{maxAge: age(24 * time.Hour)}, purged: false},
+		{name: "conversation policy keeps messages forever", maxAge: time.Hour, conversation: &policy{maxAge: age(0)}, purged: false},
+		{name: "legal hold on the conversation", maxAge: time.Hour, conversation: &policy{legalHold: true}, purged: false},
+		{name: "legal hold on a tag", conversation: &policy{maxAge: age(time.Hour)}, tag: &policy{legalHold: true}, purged: false},
+		{name: "pending message", maxAge: time.Hour, pending: true, purged: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, sqlDB := newTestDB(t)
+			tag, err := db.CreateTag("work")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conversation, err := db.CreateConversation("Retention", 0, []string{tag.Name})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.tag != nil {
+				if _, err := db.SetRetentionPolicy(0, tag.Id, test.tag.maxAge, test.tag.legalHold); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.conversation != nil {
+				if _, err := db.SetRetentionPolicy(conversation.Id, 0, test.conversation.maxAge, test.conversation.legalHold); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var message *chat.Message
+			if test.pending {
+				message, err = db.CreatePendingMessage("Hello", conversation.Id)
+			} else {
+				message, err = db.CreateMessage("Hello", chat.Message_USER, conversation.Id)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := sqlDB.Exec("UPDATE messages SET created_at = datetime('now', '-2 hours') WHERE id = ?", message.Id); err != nil {
+				t.Fatal(err)
+			}
+
+			run, err := NewWorker(db, test.maxAge, admin.RetentionAction_PURGE, 10, 24*time.Hour, false).Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var count int
+			if err := sqlDB.QueryRow("SELECT COUNT(*) FROM messages WHERE id = ?", message.Id).Scan(&count); err != nil {
+				t.Fatal(err)
+			}
+			if purged := count == 0; purged != test.purged {
+				t.Fatalf("expected purged to be %t, got %t", test.purged, purged)
+			}
+			if want := map[bool]int64{true: 1}[test.purged]; run.MessagesPurged != want {
+				t.Fatalf("expected the run to purge %d messages, got %d", want, run.MessagesPurged)
+			}
+		})
+	}
+}
+
+func TestRunOnlyRebuildsTheDatabaseWhenAllowed(t *testing.T) {
+	for _, fullVacuum := range []bool{false, true} {
+		t.Run(fmt.Sprintf("full vacuum %t", fullVacuum), func(t *testing.T) {
+			db, sqlDB := newTestDB(t)
+			conversation, err := db.CreateConversation("Retention", 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			message, err := db.CreateMessage("Hello", chat.Message_USER, conversation.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := sqlDB.Exec("UPDATE messages SET created_at = datetime('now', '-2 hours') WHERE id = ?", message.Id); err != nil {
+				t.Fatal(err)
+			}
+
+			// The in-memory database is not set up for incremental vacuums.
+			run, err := NewWorker(db, time.Hour, admin.RetentionAction_PURGE, 10, 24*time.Hour, fullVacuum).Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if run.MessagesPurged != 1 {
+				t.Fatalf("expected the run to purge 1 message, got %d", run.MessagesPurged)
+			}
+			if run.Vacuumed != fullVacuum {
+				t.Fatalf("expected vacuumed to be %t, got %t", fullVacuum, run.Vacuumed)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+// Package webhooks sends queued conversation events to the webhooks that
+// subscribe to them.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/proto/admin"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// The headers sent with every delivery.
+const (
+	// The type of the event, e.g. "message.created".
+	EventHeader = "X-Webhook-Event"
+	// The id of the event, which stays the same across retries.
+	EventIdHeader = "X-Webhook-Event-Id"
+	// The signature of the delivery, see Sign.
+	SignatureHeader = "X-Webhook-Signature"
+)
+
+// How many deliveries are loaded at once.
+const batchSize = 50
+
+// How long to wait before the first retry of a delivery. Every retry after it
+// waits twice as long as the one before, up to maxBackoff.
+const (
+	initialBackoff = 30 * time.Second
+	maxBackoff     = time.Hour
+)
+
+// How much of the response body of a failed attempt is kept in its error.
+const maxErrorBody = 512
+
+// Worker sends the deliveries that are due, retrying failed ones with
+// exponential backoff until they run out of attempts, after which they are
+// moved to the dead letters.
+type Worker struct {
+	db          *database.DB
+	client      *http.Client
+	maxAttempts int
+	// mutex keeps scheduled and on demand runs from sending the same
+	// deliveries at once.
+	mutex sync.Mutex
+}
+
+func NewWorker(db *database.DB, timeout time.Duration, maxAttempts int) *Worker {
+	return &Worker{
+		db:          db,
+		client:      &http.Client{Timeout: timeout},
+		maxAttempts: maxAttempts,
+	}
+}
+
+// Run sends every delivery that is due until none are left or ctx is done.
+// Deliveries that cannot be decrypted are moved to the dead letters and
+// logged to logger.
+func (w *Worker) Run(ctx context.Context, logger echo.Logger) (*admin.WebhookRun, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	run := &admin.WebhookRun{}
+	for ctx.Err() == nil {
+		deliveries, err := w.db.ListDueWebhookDeliveries(time.Now(), batchSize)
+		if err != nil {
+			return run, err
+		}
+		for _, delivery := range deliveries {
+			if ctx.Err() != nil {
+				break
+			}
+			if delivery.Err != nil {
+				logger.Error(fmt.Errorf("unable to send webhook delivery %d: %w", delivery.Id, delivery.Err))
+				run.DeadLettered++
+				if err := w.db.FailWebhookDelivery(delivery.Id, &admin.WebhookAttempt{Error: delivery.Err.Error()}); err != nil {
+					return run, err
+				}
+				continue
+			}
+			if err := w.deliver(ctx, delivery, run); err != nil {
+				return run, err
+			}
+		}
+		if len(deliveries) < batchSize {
+			break
+		}
+	}
+	return run, nil
+}
+
+// deliver attempts to send a delivery, records the outcome and counts it in
+// run.
+func (w *Worker) deliver(ctx context.Context, delivery *database.PendingWebhookDelivery, run *admin.WebhookRun) error {
+	start := time.Now()
+	statusCode, attemptErr := w.send(ctx, delivery, start)
+	attempt := &admin.WebhookAttempt{
+		StatusCode: int32(statusCode),
+		Duration:   durationpb.New(time.Since(start)),
+	}
+	if attemptErr == nil {
+		run.Delivered++
+		return w.db.CompleteWebhookDelivery(delivery.Id, attempt)
+	}
+	if ctx.Err() != nil {
+		// The server is shutting down, which is not the webhook's fault. The
+		// delivery is attempted again on the next run.
+		return ctx.Err()
+	}
+	attempt.Error = attemptErr.Error()
+	attempts := delivery.Attempts + 1
+	if attempts >= w.maxAttempts {
+		run.DeadLettered++
+		return w.db.FailWebhookDelivery(delivery.Id, attempt)
+	}
+	run.Retried++
+	return w.db.RetryWebhookDelivery(delivery.Id, attempt, time.Now().Add(backoff(attempts)))
+}
+
+// send posts the event of a delivery to its webhook. It returns the status the
+// webhook answered with, if it answered, and an error unless the status was
+// 2xx.
+func (w *Worker) send(ctx context.Context, delivery *database.PendingWebhookDelivery, now time.Time) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("unable to create request: %w", err)
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("User-Agent", "chat-cli-webhooks")
+	req.Header.Set(EventHeader, delivery.EventType)
+	req.Header.Set(EventIdHeader, delivery.EventId)
+	req.Header.Set(SignatureHeader, Sign(delivery.Secret, now, delivery.Payload))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	body = bytes.TrimSpace(body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if len(body) == 0 {
+			return resp.StatusCode, fmt.Errorf("the webhook answered with %s", resp.Status)
+		}
+		return resp.StatusCode, fmt.Errorf("the webhook answered with %s: %s", resp.Status, body)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign returns the signature sent with a delivery of body signed with secret
+// at timestamp, in the form "t=<unix seconds>,v1=<hex>". The hex part is the
+// HMAC-SHA256, keyed with secret, of the unix seconds, a dot, and the body.
+// Receivers compute it the same way to check that a delivery came from this
+// server, and can reject old timestamps to guard against replays.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	seconds := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(seconds))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%s,v1=%s", seconds, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// backoff returns how long to wait before attempting a delivery again after
+// it failed the given number of times.
+func backoff(attempts int) time.Duration {
+	delay := initialBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
+
+// Schedule runs the worker every interval until ctx is done.
+func (w *Worker) Schedule(ctx context.Context, interval time.Duration, logger echo.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			run, err := w.Run(ctx, logger)
+			if err != nil && ctx.Err() == nil {
+				logger.Error(fmt.Errorf("scheduled webhook run failed: %w", err))
+			}
+			if run.Delivered+run.Retried+run.DeadLettered > 0 {
+				logger.Infof(
+					"webhook run delivered %d events, will retry %d and moved %d to the dead letters",
+					run.Delivered, run.Retried, run.DeadLettered)
+			}
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/timsexperiments/chat-cli/internal/config"
+	"github.com/timsexperiments/chat-cli/internal/database"
+	"github.com/timsexperiments/chat-cli/internal/encryption"
+	"github.com/timsexperiments/chat-cli/internal/proto/admin"
+	"github.com/timsexperiments/chat-cli/internal/proto/chat"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMain(m *testing.M) {
+	// Queries are read from the queries directory at the root of the
+	// repository.
+	if err := os.Chdir("../.."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestDB returns a migrated, encrypted in-memory database of its own for
+// the test, along with the connection it is opened on.
+func newTestDB(t *testing.T) (*database.DB, *sql.DB) {
+	t.Helper()
+	cfg := *config.GetConfig()
+	cfg.DatabaseDSN = fmt.Sprintf("file:/%s.db?vfs=memdb", strings.NewReplacer("/", "_", " ", "_").Replace(t.Name()))
+	sqlDB, err := database.Open(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	keys, err := encryption.NewKeyring("k1", map[string][]byte{"k1": []byte(strings.Repeat("a", 32))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return database.CreateDB(sqlDB, keys), sqlDB
+}
+
+// newReceiver returns a webhook receiver that checks that every delivery is
+// signed with secret, and answers the n-th delivery with statuses[n], or 200
+// once they run out. It counts the deliveries it received in received.
+func newReceiver(t *testing.T, secret string, statuses []int, received *atomic.Int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(received.Add(1)) - 1
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if r.Header.Get(EventHeader) != database.WebhookMessageCreated || r.Header.Get(EventIdHeader) == "" {
+			t.Errorf("expected a %s event with an id, got %q with id %q", database.WebhookMessageCreated, r.Header.Get(EventHeader), r.Header.Get(EventIdHeader))
+		}
+		signature := r.Header.Get(SignatureHeader)
+		seconds, _, _ := strings.Cut(strings.TrimPrefix(signature, "t="), ",")
+		unix, err := strconv.ParseInt(seconds, 10, 64)
+		if err != nil {
+			t.Errorf("expected the signature to start with a timestamp, got %q", signature)
+		}
+		if signed := time.Unix(unix, 0); time.Since(signed) > time.Minute {
+			t.Errorf("expected the signature to be recent, got one from %s", signed)
+		}
+		if want := Sign(secret, time.Unix(unix, 0), body); signature != want {
+			t.Errorf("expected signature %q, got %q", want, signature)
+		}
+		if n < len(statuses) {
+			w.WriteHeader(statuses[n])
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{50, time.Hour},
+	}
+	for _, test := range tests {
+		t.Run(strconv.Itoa(test.attempts), func(t *testing.T) {
+			if delay := backoff(test.attempts); delay != test.delay {
+				t.Fatalf("expected %s, got %s", test.delay, delay)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name string
+		// statuses are what the webhook answers each attempt with.
+		statuses    []int
+		maxAttempts int
+		// runs are the outcomes of running the worker after each attempt is
+		// due.
+		runs  []*admin.WebhookRun
+		state admin.WebhookDelivery_State
+	}{
+		{"delivered", []int{http.StatusNoContent}, 3, []*admin.WebhookRun{
+			{Delivered: 1},
+		}, admin.WebhookDelivery_DELIVERED},
+		{"retried until delivered", []int{http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusOK}, 3, []*admin.WebhookRun{
+			{Retried: 1},
+			{Retried: 1},
+			{Delivered: 1},
+		}, admin.WebhookDelivery_DELIVERED},
+		{"out of attempts", []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusGone}, 3, []*admin.WebhookRun{
+			{Retried: 1},
+			{Retried: 1},
+			{DeadLettered: 1},
+		}, admin.WebhookDelivery_FAILED},
+		{"single attempt", []int{http.StatusNotFound}, 1, []*admin.WebhookRun{
+			{DeadLettered: 1},
+		}, admin.WebhookDelivery_FAILED},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, sqlDB := newTestDB(t)
+			received := &atomic.Int32{}
+			receiver := newReceiver(t, "shh", test.statuses, received)
+			webhook, err := db.CreateWebhook(receiver.URL, []string{database.WebhookMessageCreated}, "shh")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conversation, err := db.CreateConversation("Hooks", 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.CreateMessage("hello", chat.Message_USER, conversation.Id); err != nil {
+				t.Fatal(err)
+			}
+			worker := NewWorker(db, 5*time.Second, test.maxAttempts)
+
+			var delivery *admin.WebhookDelivery
+			for i, want := range test.runs {
+				run, err := worker.Run(context.Background(), echo.New().Logger)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !proto.Equal(run, want) {
+					t.Fatalf("expected run %d to be %v, got %v", i+1, want, run)
+				}
+				deliveries, err := db.ListWebhookDeliveries(webhook.Id, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				delivery = deliveries[0]
+				if want.Retried == 0 {
+					continue
+				}
+				next := delivery.NextAttemptAt.AsTime()
+				if expected := time.Now().Add(backoff(i + 1)); next.Before(expected.Add(-5*time.Second)) || next.After(expected.Add(time.Second)) {
+					t.Fatalf("expected attempt %d to be retried around %s, got %s", i+2, expected, next)
+				}
+				// Make the retry due now rather than waiting for it.
+				if _, err := sqlDB.Exec("UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id = ?", time.Now().UTC().Add(-time.Second).Format(time.DateTime), delivery.Id); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := int(received.Load()); got != len(test.runs) {
+				t.Fatalf("expected the webhook to receive %d deliveries, got %d", len(test.runs), got)
+			}
+			if delivery.State != test.state || len(delivery.AttemptLog) != len(test.runs) {
+				t.Fatalf("expected the delivery to be %s after %d attempts, got %s after %d", test.state, len(test.runs), delivery.State, len(delivery.AttemptLog))
+			}
+			deadLetters, err := db.ListWebhookDeadLetters(10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dead := test.state == admin.WebhookDelivery_FAILED; dead != (len(deadLetters) == 1) {
+				t.Fatalf("expected dead letters only when the delivery failed, got %d", len(deadLetters))
+			}
+		})
+	}
+}
+
+func TestRunDeadLettersUndecryptableDeliveries(t *testing.T) {
+	db, sqlDB := newTestDB(t)
+	received := &atomic.Int32{}
+	receiver := newReceiver(t, "shh", nil, received)
+	readable, err := db.CreateWebhook(receiver.URL, []string{database.WebhookMessageCreated}, "shh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreadable, err := db.CreateWebhook(receiver.URL, []string{database.WebhookMessageCreated}, "shh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlDB.Exec("UPDATE webhooks SET secret_key_id = 'lost' WHERE id = ?", unreadable.Id); err != nil {
+		t.Fatal(err)
+	}
+	conversation, err := db.CreateConversation("Hooks", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateMessage("hello", chat.Message_USER, conversation.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := echo.New().Logger
+	logs := &bytes.Buffer{}
+	logger.SetOutput(logs)
+	run, err := NewWorker(db, 5*time.Second, 3).Run(context.Background(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(run, &admin.WebhookRun{Delivered: 1, DeadLettered: 1}) {
+		t.Fatalf("expected one delivery to be delivered and one to be dead-lettered, got %v", run)
+	}
+	if received.Load() != 1 {
+		t.Fatalf("expected the webhook to receive 1 delivery, got %d", received.Load())
+	}
+	if !strings.Contains(logs.String(), fmt.Sprintf("webhook %d", unreadable.Id)) {
+		t.Fatalf("expected the undecryptable delivery to be logged, got %q", logs)
+	}
+	for webhookId, state := range map[int64]admin.WebhookDelivery_State{
+		readable.Id:   admin.WebhookDelivery_DELIVERED,
+		unreadable.Id: admin.WebhookDelivery_FAILED,
+	} {
+		deliveries, err := db.ListWebhookDeliveries(webhookId, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deliveries[0].State != state {
+			t.Fatalf("expected the delivery to webhook %d to be %s, got %s", webhookId, state, deliveries[0].State)
+		}
+	}
+}
@@ -25,9 +25,10 @@ func Build() error {
 	return sh.RunV("go", "build", "-o", "bin/api/main", "cmd/api/main.go")
 }
 
-// Generates the Golang and C# protofiles for the project.
+// Generates the Golang and C# protofiles for the project, along with the
+// Connect handlers for the Golang services. Needs protoc-gen-connect-go.
 func GenProto() error {
-	return sh.RunV("protoc", "--proto_path=proto", "--csharp_out=cli/build/gen", "--csharp_opt=file_extension=.g.cs", "--go_out=internal/proto", "--go_opt=paths=source_relative", "chat/chat.proto", "errors/error.proto")
+	return sh.RunV("protoc", "--proto_path=proto", "--csharp_out=cli/build/gen", "--csharp_opt=file_extension=.g.cs", "--go_out=internal/proto", "--go_opt=paths=source_relative", "--connect-go_out=internal/proto", "--connect-go_opt=paths=source_relative", "admin/admin.proto", "chat/chat.proto", "errors/error.proto")
 }
 
 // Cleans up build artifacts and generated code.
@@ -0,0 +1 @@
+INSERT OR IGNORE INTO conversation_tags (conversation_id, tag_id) SELECT ?, id FROM tags WHERE name = ?;
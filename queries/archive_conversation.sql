@@ -0,0 +1,3 @@
+UPDATE conversations
+SET archived = ?1, version = version + 1
+WHERE id = ?2 AND deleted_at IS NULL AND (?3 = 0 OR version = ?3);
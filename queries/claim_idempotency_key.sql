@@ -0,0 +1,2 @@
+INSERT INTO idempotency_keys (actor, idempotency_key, fingerprint) VALUES (?, ?, ?)
+ON CONFLICT (actor, idempotency_key) DO NOTHING;
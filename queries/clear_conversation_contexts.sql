@@ -0,0 +1,3 @@
+UPDATE conversations
+SET context = NULL, context_key_id = NULL, version = version + 1
+WHERE id IN (SELECT value FROM json_each(?));
@@ -0,0 +1 @@
+DELETE FROM conversation_tags WHERE conversation_id = ?;
@@ -0,0 +1 @@
+UPDATE idempotency_keys SET status_code = ?, headers = ?, body = ?, body_key_id = ? WHERE id = ?;
@@ -0,0 +1,3 @@
+UPDATE webhook_deliveries
+SET state = 'DELIVERED', attempts = attempts + 1, delivered_at = CURRENT_TIMESTAMP
+WHERE id = ? AND state = 'PENDING';
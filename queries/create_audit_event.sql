@@ -0,0 +1,2 @@
+INSERT INTO audit_events (actor, action, target_type, target_id, request_id, client_ip, changes)
+VALUES (?, ?, ?, ?, ?, ?, ?);
@@ -1 +1 @@
-INSERT INTO conversations (title) VALUES (?);
+INSERT INTO conversations (title, folder_id) VALUES (?, ?);
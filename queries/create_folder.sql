@@ -0,0 +1 @@
+INSERT INTO folders (name, parent_id) VALUES (?, ?);
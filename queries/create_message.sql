@@ -1 +1 @@
-INSERT INTO messages (body, sender, conversation_id) VALUES (?, ?, ?);
+INSERT INTO messages (body, body_key_id, sender, conversation_id, status, reply_to, tokens, model) VALUES (?, ?, ?, ?, ?, ?, ?, ?);
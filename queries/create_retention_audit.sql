@@ -0,0 +1,2 @@
+INSERT INTO retention_audit (action, conversation_id, message_ids, message_count, oldest_created_at, newest_created_at)
+VALUES (?, ?, ?, ?, ?, ?);
@@ -0,0 +1 @@
+INSERT INTO webhooks (url, secret, secret_key_id, event_types) VALUES (?, ?, ?, ?);
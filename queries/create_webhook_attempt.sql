@@ -0,0 +1 @@
+INSERT INTO webhook_attempts (delivery_id, status_code, error, duration_ms) VALUES (?, ?, ?, ?);
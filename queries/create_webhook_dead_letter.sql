@@ -0,0 +1 @@
+INSERT INTO webhook_dead_letters (delivery_id, last_error) VALUES (?, ?);
@@ -0,0 +1 @@
+UPDATE conversations SET deleted_at = CURRENT_TIMESTAMP WHERE id = ?1 AND deleted_at IS NULL AND (?2 = 0 OR version = ?2);
@@ -0,0 +1 @@
+DELETE FROM message_feedback WHERE message_id = ?;
@@ -0,0 +1 @@
+DELETE FROM folders WHERE id = ?;
@@ -0,0 +1 @@
+UPDATE messages SET deleted_at = CURRENT_TIMESTAMP WHERE id = ? AND conversation_id = ? AND deleted_at IS NULL;
@@ -0,0 +1 @@
+DELETE FROM retention_policies WHERE id = ?;
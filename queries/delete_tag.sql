@@ -0,0 +1 @@
+DELETE FROM tags WHERE id = ?;
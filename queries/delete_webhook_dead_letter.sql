@@ -0,0 +1 @@
+DELETE FROM webhook_dead_letters WHERE id = ?;
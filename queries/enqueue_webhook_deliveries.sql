@@ -0,0 +1,5 @@
+INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload, payload_key_id)
+SELECT id, ?1, ?2, '', NULL
+FROM webhooks
+WHERE active AND ',' || event_types || ',' LIKE '%,' || ?2 || ',%'
+RETURNING id;
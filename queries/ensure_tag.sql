@@ -0,0 +1 @@
+INSERT INTO tags (name) VALUES (?) ON CONFLICT (name) DO NOTHING;
@@ -0,0 +1 @@
+UPDATE messages SET status = 'FAILED' WHERE status = 'PENDING';
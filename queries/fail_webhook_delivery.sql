@@ -0,0 +1,3 @@
+UPDATE webhook_deliveries
+SET state = 'FAILED', attempts = attempts + 1
+WHERE id = ? AND state = 'PENDING';
@@ -0,0 +1,14 @@
+SELECT
+    COALESCE(m.model, '') AS model,
+    COUNT(*) AS rated,
+    COALESCE(SUM(f.thumb = 'UP'), 0) AS thumbs_up,
+    COALESCE(SUM(f.thumb = 'DOWN'), 0) AS thumbs_down,
+    COUNT(f.score) AS scored,
+    AVG(f.score) AS average_score
+FROM message_feedback f
+    JOIN messages m ON m.id = f.message_id
+WHERE m.deleted_at IS NULL
+    AND (?1 IS NULL OR f.updated_at >= ?1)
+    AND (?2 IS NULL OR f.updated_at < ?2)
+GROUP BY 1
+ORDER BY 1;
@@ -0,0 +1,12 @@
+SELECT
+    COALESCE(m.model, '') AS model,
+    c.value AS category,
+    COUNT(*) AS count
+FROM message_feedback f
+    JOIN messages m ON m.id = f.message_id,
+    json_each(f.categories) c
+WHERE m.deleted_at IS NULL
+    AND (?1 IS NULL OR f.updated_at >= ?1)
+    AND (?2 IS NULL OR f.updated_at < ?2)
+GROUP BY 1, 2
+ORDER BY 1, 3 DESC, 2;
@@ -4,11 +4,33 @@ SELECT
     c.title,
     c.context,
     c.created_at,
+    c.archived,
+    c.model,
+    c.temperature,
+    c.folder_id,
+    c.context_key_id,
+    c.version,
     m.id AS message_id,
     m.body,
     m.sender,
-    m.created_at AS message_created_at
+    m.created_at AS message_created_at,
+    m.status AS message_status,
+    m.reply_to AS message_reply_to,
+    m.redacted_at AS message_redacted_at,
+    m.body_key_id AS message_body_key_id,
+    m.model AS message_model,
+    p.note AS pin_note,
+    p.include_in_context AS pin_include_in_context,
+    p.created_at AS pin_created_at,
+    f.thumb AS feedback_thumb,
+    f.score AS feedback_score,
+    f.note AS feedback_note,
+    f.categories AS feedback_categories,
+    f.created_at AS feedback_created_at,
+    f.updated_at AS feedback_updated_at
 FROM conversations c 
-    LEFT JOIN messages m ON c.id = m.conversation_id
-WHERE c.id = ?
-ORDER BY m.created_at DESC;
+    LEFT JOIN messages m ON c.id = m.conversation_id AND m.deleted_at IS NULL
+    LEFT JOIN pins p ON m.id = p.message_id
+    LEFT JOIN message_feedback f ON m.id = f.message_id
+WHERE c.id = ? AND c.deleted_at IS NULL
+ORDER BY m.created_at DESC, m.id DESC;
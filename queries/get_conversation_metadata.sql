@@ -0,0 +1,15 @@
+SELECT
+    id,
+    completion_id,
+    title,
+    context,
+    created_at,
+    archived,
+    model,
+    temperature,
+    folder_id,
+    deleted_at,
+    context_key_id,
+    version
+FROM conversations
+WHERE id = ?;
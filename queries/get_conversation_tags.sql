@@ -0,0 +1,6 @@
+SELECT
+    t.name
+FROM conversation_tags ct
+    JOIN tags t ON t.id = ct.tag_id
+WHERE ct.conversation_id = ?
+ORDER BY t.name COLLATE NOCASE ASC;
@@ -0,0 +1 @@
+SELECT version FROM conversations WHERE id = ?;
@@ -0,0 +1,13 @@
+SELECT
+    f.message_id,
+    m.conversation_id,
+    f.thumb,
+    f.score,
+    f.note,
+    f.categories,
+    m.model,
+    f.created_at,
+    f.updated_at
+FROM message_feedback f
+    JOIN messages m ON m.id = f.message_id
+WHERE f.message_id = ?;
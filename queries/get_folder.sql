@@ -0,0 +1,7 @@
+SELECT
+    id,
+    name,
+    parent_id,
+    created_at
+FROM folders
+WHERE id = ?;
@@ -0,0 +1,6 @@
+WITH RECURSIVE ancestors (id, parent_id) AS (
+    SELECT id, parent_id FROM folders WHERE id = ?
+    UNION ALL
+    SELECT f.id, f.parent_id FROM folders f JOIN ancestors a ON f.id = a.parent_id
+)
+SELECT id FROM ancestors;
@@ -0,0 +1 @@
+SELECT id, fingerprint, status_code, headers, body, body_key_id FROM idempotency_keys WHERE actor = ? AND idempotency_key = ?;
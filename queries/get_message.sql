@@ -3,6 +3,11 @@ SELECT
     body,
     sender,
     created_at,
-    conversation_id
+    conversation_id,
+    deleted_at,
+    status,
+    reply_to,
+    redacted_at,
+    body_key_id
 FROM messages
 WHERE id = ?;
@@ -0,0 +1,17 @@
+SELECT
+    p.note,
+    p.include_in_context,
+    p.created_at,
+    m.id,
+    m.body,
+    m.sender,
+    m.created_at,
+    m.conversation_id,
+    m.deleted_at,
+    m.status,
+    m.reply_to,
+    m.redacted_at,
+    m.body_key_id
+FROM pins p
+    JOIN messages m ON m.id = p.message_id
+WHERE p.message_id = ?;
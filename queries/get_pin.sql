@@ -0,0 +1 @@
+SELECT note, include_in_context FROM pins WHERE message_id = ?;
@@ -0,0 +1,10 @@
+SELECT
+    id,
+    conversation_id,
+    tag_id,
+    max_age_seconds,
+    legal_hold,
+    created_at,
+    updated_at
+FROM retention_policies
+WHERE id = ?;
@@ -0,0 +1,7 @@
+SELECT
+    id,
+    delivery_id,
+    last_error,
+    created_at
+FROM webhook_dead_letters
+WHERE id = ?;
@@ -0,0 +1,12 @@
+SELECT
+    id,
+    webhook_id,
+    event_id,
+    event_type,
+    state,
+    attempts,
+    next_attempt_at,
+    created_at,
+    delivered_at
+FROM webhook_deliveries
+WHERE id = ?;
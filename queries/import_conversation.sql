@@ -0,0 +1 @@
+INSERT INTO conversations (title, context, context_key_id, created_at) VALUES (?, ?, ?, COALESCE(?, CURRENT_TIMESTAMP));
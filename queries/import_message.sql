@@ -0,0 +1 @@
+INSERT INTO messages (body, body_key_id, sender, conversation_id, created_at) VALUES (?, ?, ?, ?, COALESCE(?, CURRENT_TIMESTAMP));
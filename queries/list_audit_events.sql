@@ -0,0 +1,22 @@
+SELECT
+    id,
+    actor,
+    action,
+    target_type,
+    target_id,
+    request_id,
+    client_ip,
+    changes,
+    created_at
+FROM audit_events
+WHERE (?1 = '' OR actor = ?1)
+    AND (?2 = '' OR action = ?2)
+    AND (?3 = '' OR target_type = ?3)
+    AND (?4 = 0 OR target_id = ?4)
+    AND (?5 = '' OR request_id = ?5)
+    AND (?6 IS NULL OR created_at >= ?6)
+    AND (?7 IS NULL OR created_at < ?7)
+ORDER BY
+    CASE WHEN ?8 THEN id END ASC,
+    id DESC
+LIMIT ?9 OFFSET ?10;
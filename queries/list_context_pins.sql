@@ -0,0 +1,18 @@
+SELECT
+    m.id,
+    m.body,
+    m.sender,
+    m.created_at,
+    m.conversation_id,
+    m.deleted_at,
+    m.status,
+    m.reply_to,
+    m.redacted_at,
+    m.body_key_id
+FROM pins p
+    JOIN messages m ON m.id = p.message_id
+WHERE m.conversation_id = ?
+    AND m.deleted_at IS NULL
+    AND m.redacted_at IS NULL
+    AND p.include_in_context
+ORDER BY m.created_at ASC, m.id ASC;
@@ -0,0 +1,8 @@
+SELECT
+    id,
+    context,
+    context_key_id
+FROM conversations
+WHERE context_key_id IS NOT ? AND context IS NOT NULL AND context != ''
+ORDER BY id ASC
+LIMIT ?;
@@ -0,0 +1,7 @@
+SELECT
+    ct.conversation_id,
+    t.name
+FROM conversation_tags ct
+    JOIN tags t ON t.id = ct.tag_id
+WHERE ct.conversation_id IN (SELECT value FROM json_each(?))
+ORDER BY t.name COLLATE NOCASE ASC;
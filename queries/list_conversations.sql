@@ -1,8 +1,58 @@
 SELECT
-    id,
-    completion_id,
-    title,
-    context,
-    created_at
-FROM conversations
-ORDER BY created_at ASC;
+    c.id,
+    c.completion_id,
+    c.title,
+    c.context,
+    c.created_at,
+    c.archived,
+    c.model,
+    c.temperature,
+    c.folder_id,
+    c.deleted_at,
+    c.context_key_id,
+    c.version,
+    (
+        SELECT COUNT(*)
+        FROM messages m
+        WHERE m.conversation_id = c.id AND m.deleted_at IS NULL
+    ) AS message_count,
+    (
+        SELECT COALESCE(SUM(m.tokens), 0)
+        FROM messages m
+        WHERE m.conversation_id = c.id AND m.deleted_at IS NULL
+    ) AS total_tokens,
+    lm.id AS last_message_id,
+    lm.body AS last_message_body,
+    lm.body_key_id AS last_message_body_key_id,
+    lm.created_at AS last_message_created_at
+FROM conversations c
+    LEFT JOIN messages lm ON lm.id = (
+        SELECT m.id
+        FROM messages m
+        WHERE m.conversation_id = c.id AND m.deleted_at IS NULL
+        ORDER BY m.created_at DESC, m.id DESC
+        LIMIT 1
+    )
+WHERE c.deleted_at IS NULL
+    AND (?1 OR NOT c.archived)
+    AND (?2 IS NULL OR c.folder_id = ?2)
+    AND json_array_length(?3) = (
+        SELECT COUNT(*)
+        FROM conversation_tags ct
+            JOIN tags t ON t.id = ct.tag_id
+        WHERE ct.conversation_id = c.id
+            AND t.name IN (SELECT value FROM json_each(?3))
+    )
+    AND (?4 = '' OR instr(lower(c.title), lower(?4)) > 0)
+    AND (?5 IS NULL OR c.created_at >= ?5)
+    AND (?6 IS NULL OR c.created_at < ?6)
+ORDER BY
+    CASE WHEN ?7 = 'title' AND NOT ?8 THEN c.title END COLLATE NOCASE ASC,
+    CASE WHEN ?7 = 'title' AND ?8 THEN c.title END COLLATE NOCASE DESC,
+    CASE WHEN ?7 = 'last_activity' AND NOT ?8 THEN COALESCE(lm.created_at, c.created_at) END ASC,
+    CASE WHEN ?7 = 'last_activity' AND ?8 THEN COALESCE(lm.created_at, c.created_at) END DESC,
+    CASE WHEN NOT ?8 THEN c.created_at END ASC,
+    CASE WHEN ?8 THEN c.created_at END DESC,
+    CASE WHEN NOT ?8 THEN c.id END ASC,
+    CASE WHEN ?8 THEN c.id END DESC
+LIMIT ?9 OFFSET ?10;
@@ -0,0 +1,16 @@
+SELECT
+    id,
+    completion_id,
+    title,
+    context,
+    created_at,
+    archived,
+    model,
+    temperature,
+    folder_id,
+    deleted_at,
+    context_key_id,
+    version
+FROM conversations
+WHERE deleted_at IS NOT NULL
+ORDER BY deleted_at DESC;
@@ -0,0 +1,15 @@
+SELECT
+    m.id,
+    m.body,
+    m.sender,
+    m.created_at,
+    m.conversation_id,
+    m.deleted_at,
+    m.status,
+    m.reply_to,
+    m.redacted_at,
+    m.body_key_id
+FROM messages m
+    JOIN conversations c ON c.id = m.conversation_id
+WHERE m.deleted_at IS NOT NULL AND c.deleted_at IS NULL
+ORDER BY m.deleted_at DESC;
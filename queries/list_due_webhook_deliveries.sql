@@ -0,0 +1,16 @@
+SELECT
+    d.id,
+    d.webhook_id,
+    d.event_id,
+    d.event_type,
+    d.payload,
+    d.payload_key_id,
+    d.attempts,
+    w.url,
+    w.secret,
+    w.secret_key_id
+FROM webhook_deliveries d
+JOIN webhooks w ON w.id = d.webhook_id
+WHERE d.state = 'PENDING' AND d.next_attempt_at <= ? AND w.active
+ORDER BY d.next_attempt_at, d.id
+LIMIT ?;
@@ -0,0 +1,40 @@
+-- Finds messages older than the retention period that applies to their
+-- conversation. A conversation policy wins over tag policies, and tag policies
+-- win over the global period in ?1. Between tags the longest period wins, and a
+-- period of 0 keeps messages forever. A legal hold on the conversation or any
+-- of its tags exempts it entirely.
+WITH conversation_retention AS (
+    SELECT
+        c.id AS conversation_id,
+        COALESCE(cp.legal_hold, 0) OR EXISTS (
+            SELECT 1
+            FROM conversation_tags ct
+                JOIN retention_policies tp ON tp.tag_id = ct.tag_id
+            WHERE ct.conversation_id = c.id AND tp.legal_hold
+        ) AS legal_hold,
+        COALESCE(
+            cp.max_age_seconds,
+            (
+                SELECT CASE WHEN MIN(tp.max_age_seconds) = 0 THEN 0 ELSE MAX(tp.max_age_seconds) END
+                FROM conversation_tags ct
+                    JOIN retention_policies tp ON tp.tag_id = ct.tag_id
+                WHERE ct.conversation_id = c.id AND tp.max_age_seconds IS NOT NULL
+            ),
+            ?1
+        ) AS max_age_seconds
+    FROM conversations c
+        LEFT JOIN retention_policies cp ON cp.conversation_id = c.id
+)
+SELECT
+    m.id,
+    m.conversation_id,
+    m.created_at
+FROM messages m
+    JOIN conversation_retention r ON r.conversation_id = m.conversation_id
+WHERE NOT r.legal_hold
+    AND r.max_age_seconds > 0
+    AND m.created_at <= datetime('now', '-' || r.max_age_seconds || ' seconds')
+    AND m.status != 'PENDING'
+    AND (?2 = 'PURGE' OR m.redacted_at IS NULL)
+ORDER BY m.id ASC
+LIMIT ?3;
@@ -0,0 +1,27 @@
+SELECT
+    f.message_id,
+    m.conversation_id,
+    COALESCE(m.model, '') AS model,
+    p.id AS prompt_id,
+    p.body AS prompt,
+    p.body_key_id AS prompt_key_id,
+    m.body AS response,
+    m.body_key_id AS response_key_id,
+    f.thumb,
+    f.score,
+    f.note,
+    f.categories,
+    f.created_at,
+    f.updated_at
+FROM message_feedback f
+    JOIN messages m ON m.id = f.message_id
+    JOIN messages p ON p.id = m.reply_to
+WHERE m.deleted_at IS NULL
+    AND m.redacted_at IS NULL
+    AND p.redacted_at IS NULL
+    AND (?1 = '' OR m.model = ?1)
+    AND (?2 = '' OR f.thumb = ?2)
+    AND (?3 = '' OR EXISTS (SELECT 1 FROM json_each(f.categories) WHERE value = ?3))
+    AND (?4 IS NULL OR f.updated_at >= ?4)
+    AND (?5 IS NULL OR f.updated_at < ?5)
+ORDER BY f.message_id;
@@ -0,0 +1,7 @@
+SELECT
+    id,
+    name,
+    parent_id,
+    created_at
+FROM folders
+ORDER BY COALESCE(parent_id, 0) ASC, name COLLATE NOCASE ASC;
@@ -0,0 +1,8 @@
+SELECT
+    id,
+    body,
+    body_key_id
+FROM messages
+WHERE body_key_id IS NOT ? AND body != ''
+ORDER BY id ASC
+LIMIT ?;
@@ -0,0 +1,8 @@
+SELECT
+    id,
+    payload,
+    payload_key_id
+FROM webhook_deliveries
+WHERE payload_key_id IS NOT ? AND payload != ''
+ORDER BY id ASC
+LIMIT ?;
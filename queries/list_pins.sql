@@ -0,0 +1,21 @@
+SELECT
+    p.note,
+    p.include_in_context,
+    p.created_at,
+    m.id,
+    m.body,
+    m.sender,
+    m.created_at,
+    m.conversation_id,
+    m.deleted_at,
+    m.status,
+    m.reply_to,
+    m.redacted_at,
+    m.body_key_id
+FROM pins p
+    JOIN messages m ON m.id = p.message_id
+    JOIN conversations c ON c.id = m.conversation_id
+WHERE m.deleted_at IS NULL
+    AND c.deleted_at IS NULL
+    AND (?1 = 0 OR m.conversation_id = ?1)
+ORDER BY p.created_at DESC, p.message_id DESC;
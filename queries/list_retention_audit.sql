@@ -0,0 +1,11 @@
+SELECT
+    id,
+    action,
+    conversation_id,
+    message_ids,
+    oldest_created_at,
+    newest_created_at,
+    created_at
+FROM retention_audit
+ORDER BY created_at DESC, id DESC
+LIMIT ?;
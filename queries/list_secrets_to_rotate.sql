@@ -0,0 +1,8 @@
+SELECT
+    id,
+    secret,
+    secret_key_id
+FROM webhooks
+WHERE secret_key_id IS NOT ? AND secret != ''
+ORDER BY id ASC
+LIMIT ?;
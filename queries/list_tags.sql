@@ -0,0 +1,9 @@
+SELECT
+    t.id,
+    t.name,
+    t.created_at,
+    COUNT(ct.conversation_id) AS conversation_count
+FROM tags t
+    LEFT JOIN conversation_tags ct ON t.id = ct.tag_id
+GROUP BY t.id
+ORDER BY t.name COLLATE NOCASE ASC;
@@ -0,0 +1,8 @@
+SELECT
+    status_code,
+    error,
+    duration_ms,
+    created_at
+FROM webhook_attempts
+WHERE delivery_id = ?
+ORDER BY id;
@@ -0,0 +1,8 @@
+SELECT
+    id,
+    delivery_id,
+    last_error,
+    created_at
+FROM webhook_dead_letters
+ORDER BY id DESC
+LIMIT ?;
@@ -0,0 +1,9 @@
+SELECT
+    id,
+    url,
+    event_types,
+    active,
+    created_at,
+    updated_at
+FROM webhooks
+ORDER BY id;
@@ -0,0 +1,44 @@
+-- A conversation in the trash keeps its title, but gives it up so that another
+-- conversation can take it, which moves the title's unique constraint off the
+-- column and onto an index of the conversations that are not in the trash.
+-- SQLite cannot drop a column constraint, so the table is rebuilt. Foreign
+-- keys cannot be turned off inside the migration's transaction, and renaming
+-- the old table makes the foreign key of messages follow it, so messages are
+-- rebuilt along with it rather than deleted with it when it is dropped.
+ALTER TABLE conversations RENAME TO conversations_001;
+
+CREATE TABLE conversations (
+  id INTEGER PRIMARY KEY ASC,
+  completion_id TEXT UNIQUE,
+  title TEXT NOT NULL,
+  context TEXT,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  archived BOOLEAN NOT NULL DEFAULT FALSE,
+  deleted_at TIMESTAMP
+);
+
+INSERT INTO conversations (id, completion_id, title, context, created_at)
+SELECT id, completion_id, title, context, created_at
+FROM conversations_001;
+
+CREATE TABLE messages_001 (
+  id INTEGER PRIMARY KEY ASC,
+  body TEXT NOT NULL,
+  sender VARCHAR(4) NOT NULL CHECK (sender IN ('USER', 'BOT')),
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  conversation_id INT NOT NULL,
+  deleted_at TIMESTAMP,
+  CONSTRAINT fk__messages__convesations__id FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE
+);
+
+INSERT INTO messages_001 (id, body, sender, created_at, conversation_id)
+SELECT id, body, sender, created_at, conversation_id
+FROM messages;
+
+DROP TABLE messages;
+DROP TABLE conversations_001;
+ALTER TABLE messages_001 RENAME TO messages;
+
+CREATE UNIQUE INDEX IF NOT EXISTS ux__conversations__title ON conversations(title) WHERE deleted_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx__messages__conversation_id ON messages(conversation_id);
@@ -0,0 +1,2 @@
+ALTER TABLE conversations ADD COLUMN model TEXT;
+ALTER TABLE conversations ADD COLUMN temperature REAL;
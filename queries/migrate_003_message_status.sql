@@ -0,0 +1,4 @@
+ALTER TABLE messages ADD COLUMN status VARCHAR(8) NOT NULL DEFAULT 'COMPLETE' CHECK (status IN ('PENDING', 'COMPLETE', 'FAILED'));
+ALTER TABLE messages ADD COLUMN reply_to INT REFERENCES messages(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx__messages__status ON messages(status);
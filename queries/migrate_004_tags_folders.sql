@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS tags (
+  id INTEGER PRIMARY KEY ASC,
+  name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS conversation_tags (
+  conversation_id INT NOT NULL,
+  tag_id INT NOT NULL,
+  PRIMARY KEY (conversation_id, tag_id),
+  CONSTRAINT fk__conversation_tags__conversations__id FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+  CONSTRAINT fk__conversation_tags__tags__id FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx__conversation_tags__tag_id ON conversation_tags(tag_id);
+
+CREATE TABLE IF NOT EXISTS folders (
+  id INTEGER PRIMARY KEY ASC,
+  name TEXT NOT NULL,
+  parent_id INT,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT fk__folders__folders__id FOREIGN KEY (parent_id) REFERENCES folders(id) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS ux__folders__parent_name ON folders(COALESCE(parent_id, 0), name COLLATE NOCASE);
+
+ALTER TABLE conversations ADD COLUMN folder_id INT REFERENCES folders(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx__conversations__folder_id ON conversations(folder_id);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS pins (
+  message_id INTEGER PRIMARY KEY,
+  note TEXT NOT NULL DEFAULT '',
+  include_in_context BOOLEAN NOT NULL DEFAULT 0,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT fk__pins__messages__id FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx__pins__created_at ON pins(created_at);
@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS retention_policies (
+  id INTEGER PRIMARY KEY ASC,
+  conversation_id INT UNIQUE,
+  tag_id INT UNIQUE,
+  max_age_seconds INT CHECK (max_age_seconds IS NULL OR max_age_seconds >= 0),
+  legal_hold BOOLEAN NOT NULL DEFAULT 0,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT ck__retention_policies__scope CHECK ((conversation_id IS NULL) != (tag_id IS NULL)),
+  CONSTRAINT fk__retention_policies__conversations__id FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+  CONSTRAINT fk__retention_policies__tags__id FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS retention_audit (
+  id INTEGER PRIMARY KEY ASC,
+  action VARCHAR(8) NOT NULL CHECK (action IN ('PURGE', 'REDACT')),
+  -- Not a foreign key, the audit log outlives the conversations it describes.
+  conversation_id INT NOT NULL,
+  message_ids TEXT NOT NULL,
+  message_count INT NOT NULL,
+  oldest_created_at TIMESTAMP NOT NULL,
+  newest_created_at TIMESTAMP NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx__retention_audit__created_at ON retention_audit(created_at);
+
+ALTER TABLE messages ADD COLUMN redacted_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx__messages__created_at ON messages(created_at);
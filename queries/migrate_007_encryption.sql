@@ -0,0 +1,5 @@
+ALTER TABLE messages ADD COLUMN body_key_id TEXT;
+ALTER TABLE conversations ADD COLUMN context_key_id TEXT;
+
+CREATE INDEX IF NOT EXISTS idx__messages__body_key_id ON messages(body_key_id);
+CREATE INDEX IF NOT EXISTS idx__conversations__context_key_id ON conversations(context_key_id);
@@ -0,0 +1,3 @@
+ALTER TABLE messages ADD COLUMN tokens INT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx__messages__conversation_id__created_at ON messages(conversation_id, created_at);
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS audit_events (
+  id INTEGER PRIMARY KEY ASC,
+  actor TEXT NOT NULL,
+  action TEXT NOT NULL,
+  target_type TEXT NOT NULL,
+  -- Not a foreign key, the audit log outlives what it describes.
+  target_id INT,
+  request_id TEXT,
+  client_ip TEXT,
+  changes TEXT,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx__audit_events__target ON audit_events(target_type, target_id);
+CREATE INDEX IF NOT EXISTS idx__audit_events__created_at ON audit_events(created_at);
+
+-- The audit log is append only.
+CREATE TRIGGER IF NOT EXISTS tr__audit_events__no_update BEFORE UPDATE ON audit_events
+BEGIN
+  SELECT RAISE(ABORT, 'audit events cannot be changed');
+END;
+
+CREATE TRIGGER IF NOT EXISTS tr__audit_events__no_delete BEFORE DELETE ON audit_events
+BEGIN
+  SELECT RAISE(ABORT, 'audit events cannot be deleted');
+END;
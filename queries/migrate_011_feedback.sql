@@ -0,0 +1,14 @@
+ALTER TABLE messages ADD COLUMN model TEXT;
+
+CREATE TABLE IF NOT EXISTS message_feedback (
+  message_id INT PRIMARY KEY,
+  thumb VARCHAR(4) CHECK (thumb IS NULL OR thumb IN ('UP', 'DOWN')),
+  score INT CHECK (score IS NULL OR score BETWEEN 1 AND 5),
+  note TEXT NOT NULL DEFAULT '',
+  categories TEXT NOT NULL DEFAULT '[]',
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT fk__message_feedback__messages__id FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx__message_feedback__updated_at ON message_feedback(updated_at);
@@ -0,0 +1,16 @@
+-- Stored responses are encrypted like message bodies, which binds them to the
+-- id of their row. Rows get an id that, unlike the rowid, is kept by VACUUM.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  id INTEGER PRIMARY KEY ASC,
+  actor TEXT NOT NULL,
+  idempotency_key TEXT NOT NULL,
+  fingerprint TEXT NOT NULL,
+  status_code INT,
+  headers TEXT,
+  body BLOB,
+  body_key_id TEXT,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (actor, idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx__idempotency_keys__created_at ON idempotency_keys(created_at);
@@ -0,0 +1,50 @@
+CREATE TABLE IF NOT EXISTS webhooks (
+  id INTEGER PRIMARY KEY ASC,
+  url TEXT NOT NULL,
+  secret TEXT NOT NULL,
+  secret_key_id TEXT,
+  -- Comma separated, e.g. "conversation.created,message.created".
+  event_types TEXT NOT NULL,
+  active BOOLEAN NOT NULL DEFAULT 1,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id INTEGER PRIMARY KEY ASC,
+  webhook_id INT NOT NULL,
+  event_id TEXT NOT NULL,
+  event_type TEXT NOT NULL,
+  payload TEXT NOT NULL,
+  payload_key_id TEXT,
+  state VARCHAR(9) NOT NULL DEFAULT 'PENDING' CHECK (state IN ('PENDING', 'DELIVERED', 'FAILED')),
+  -- Attempts since the delivery was last queued.
+  attempts INT NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  delivered_at TIMESTAMP,
+  CONSTRAINT fk__webhook_deliveries__webhooks__id FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx__webhook_deliveries__state_next_attempt_at ON webhook_deliveries(state, next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx__webhook_deliveries__webhook_id ON webhook_deliveries(webhook_id);
+
+CREATE TABLE IF NOT EXISTS webhook_attempts (
+  id INTEGER PRIMARY KEY ASC,
+  delivery_id INT NOT NULL,
+  status_code INT,
+  error TEXT,
+  duration_ms INT NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT fk__webhook_attempts__webhook_deliveries__id FOREIGN KEY (delivery_id) REFERENCES webhook_deliveries(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx__webhook_attempts__delivery_id ON webhook_attempts(delivery_id);
+
+CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+  id INTEGER PRIMARY KEY ASC,
+  delivery_id INT NOT NULL UNIQUE,
+  last_error TEXT NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT fk__webhook_dead_letters__webhook_deliveries__id FOREIGN KEY (delivery_id) REFERENCES webhook_deliveries(id) ON DELETE CASCADE
+);
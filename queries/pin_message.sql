@@ -0,0 +1,5 @@
+INSERT INTO pins (message_id, note, include_in_context)
+VALUES (?, ?, ?)
+ON CONFLICT (message_id) DO UPDATE SET
+    note = excluded.note,
+    include_in_context = excluded.include_in_context;
@@ -0,0 +1 @@
+DELETE FROM conversations WHERE id = ?1 AND (?2 = 0 OR version = ?2);
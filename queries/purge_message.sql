@@ -0,0 +1 @@
+DELETE FROM messages WHERE id = ? AND conversation_id = ?;
@@ -0,0 +1 @@
+DELETE FROM messages WHERE id IN (SELECT value FROM json_each(?));
@@ -0,0 +1 @@
+DELETE FROM conversations WHERE deleted_at IS NOT NULL AND deleted_at <= ?;
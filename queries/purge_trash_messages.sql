@@ -0,0 +1 @@
+DELETE FROM messages WHERE deleted_at IS NOT NULL AND deleted_at <= ?;
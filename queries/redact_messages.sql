@@ -0,0 +1,3 @@
+UPDATE messages
+SET body = '', body_key_id = NULL, redacted_at = CURRENT_TIMESTAMP
+WHERE id IN (SELECT value FROM json_each(?));
@@ -0,0 +1 @@
+DELETE FROM idempotency_keys WHERE actor = ? AND idempotency_key = ?;
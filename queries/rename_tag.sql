@@ -0,0 +1 @@
+UPDATE tags SET name = ? WHERE id = ?;
@@ -0,0 +1,3 @@
+UPDATE webhook_deliveries
+SET state = 'PENDING', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP
+WHERE id = ? AND state = 'FAILED';
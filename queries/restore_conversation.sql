@@ -0,0 +1 @@
+UPDATE conversations SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL;
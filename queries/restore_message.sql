@@ -0,0 +1 @@
+UPDATE messages SET deleted_at = NULL WHERE id = ? AND conversation_id = ? AND deleted_at IS NOT NULL;
@@ -0,0 +1,3 @@
+UPDATE webhook_deliveries
+SET attempts = attempts + 1, next_attempt_at = ?
+WHERE id = ? AND state = 'PENDING';
@@ -0,0 +1 @@
+UPDATE webhooks SET secret = ?, secret_key_id = ? WHERE id = ?;
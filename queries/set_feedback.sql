@@ -0,0 +1,8 @@
+INSERT INTO message_feedback (message_id, thumb, score, note, categories)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (message_id) DO UPDATE SET
+    thumb = excluded.thumb,
+    score = excluded.score,
+    note = excluded.note,
+    categories = excluded.categories,
+    updated_at = CURRENT_TIMESTAMP;
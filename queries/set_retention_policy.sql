@@ -0,0 +1,6 @@
+INSERT INTO retention_policies (conversation_id, tag_id, max_age_seconds, legal_hold)
+VALUES (?1, ?2, ?3, ?4)
+ON CONFLICT DO UPDATE SET
+    max_age_seconds = excluded.max_age_seconds,
+    legal_hold = excluded.legal_hold,
+    updated_at = CURRENT_TIMESTAMP;
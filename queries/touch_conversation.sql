@@ -0,0 +1,3 @@
+UPDATE conversations
+SET version = version + 1
+WHERE id = ?1 AND deleted_at IS NULL AND (?2 = 0 OR version = ?2);
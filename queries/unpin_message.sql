@@ -0,0 +1 @@
+DELETE FROM pins WHERE message_id = ?;
@@ -1 +1,3 @@
-UPDATE conversations SET completion_id = ?, title = ?, context = ? WHERE id = ?;
+UPDATE conversations
+SET completion_id = ?1, title = ?2, context = ?3, context_key_id = ?4, version = version + 1
+WHERE id = ?5 AND deleted_at IS NULL AND (?6 = 0 OR version = ?6);
@@ -0,0 +1 @@
+UPDATE conversations SET context = ?, context_key_id = ? WHERE id = ?;
@@ -0,0 +1,3 @@
+UPDATE conversations
+SET title = ?1, context = ?2, context_key_id = ?3, archived = ?4, model = ?5, temperature = ?6, folder_id = ?7, version = version + 1
+WHERE id = ?8 AND deleted_at IS NULL AND (?9 = 0 OR version = ?9);
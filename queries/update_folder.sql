@@ -0,0 +1 @@
+UPDATE folders SET name = ?, parent_id = ? WHERE id = ?;
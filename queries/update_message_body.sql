@@ -0,0 +1 @@
+UPDATE messages SET body = ?, body_key_id = ? WHERE id = ?;
@@ -0,0 +1 @@
+UPDATE messages SET status = ? WHERE id = ?;
@@ -0,0 +1,3 @@
+UPDATE webhooks
+SET url = ?, event_types = ?, active = ?, updated_at = CURRENT_TIMESTAMP
+WHERE id = ?;
@@ -0,0 +1 @@
+UPDATE webhook_deliveries SET payload = ?, payload_key_id = ? WHERE id = ?;
@@ -0,0 +1,3 @@
+UPDATE webhooks
+SET secret = ?, secret_key_id = ?, updated_at = CURRENT_TIMESTAMP
+WHERE id = ?;